@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// monthlyTransferCap limits the bytes each authenticated user may download
+// and upload per calendar month (0 disables the cap)
+var monthlyTransferCap int64
+
+// UserUsage is the transfer accounting of one user
+type UserUsage struct {
+	User       string `json:"user"`
+	Month      string `json:"month"`
+	Downloaded int64  `json:"downloaded"`
+	Uploaded   int64  `json:"uploaded"`
+	Downloads  int64  `json:"downloads"`
+	Uploads    int64  `json:"uploads"`
+	// Lifetime totals, not reset at the start of a month
+	TotalDownloaded int64 `json:"totalDownloaded"`
+	TotalUploaded   int64 `json:"totalUploaded"`
+	// Bytes stored in the user's home directory, with -quota
+	Stored int64 `json:"stored,omitempty"`
+}
+
+// Transferred returns the bytes counted against the monthly cap
+func (u UserUsage) Transferred() int64 {
+	return u.Downloaded + u.Uploaded
+}
+
+// UsageReport is served by the transfer accounting dashboard and API
+type UsageReport struct {
+	Page
+	Month string      `json:"month"`
+	Cap   int64       `json:"cap"`
+	Quota int64       `json:"quota"`
+	Users []UserUsage `json:"users"`
+}
+
+// usageTracker accounts transferred bytes per authenticated user
+type usageTracker struct {
+	mu       sync.Mutex
+	accounts map[string]*UserUsage
+}
+
+var usage = &usageTracker{accounts: make(map[string]*UserUsage)}
+
+// currentMonth names the accounting period, e.g. "2026-10"
+func currentMonth() string {
+	return time.Now().Format("2006-01")
+}
+
+// account returns the usage of user for the current month, starting a new
+// month when the previous one is over. The caller must hold u.mu.
+func (u *usageTracker) account(user string) *UserUsage {
+	month := currentMonth()
+	account, ok := u.accounts[user]
+	if !ok {
+		account = &UserUsage{User: user, Month: month}
+		u.accounts[user] = account
+	}
+	if account.Month != month {
+		account.Month = month
+		account.Downloaded, account.Uploaded = 0, 0
+		account.Downloads, account.Uploads = 0, 0
+	}
+	return account
+}
+
+// startTransfer counts a download or upload by user
+func (u *usageTracker) startTransfer(user, kind string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	account := u.account(user)
+	switch kind {
+	case "download":
+		account.Downloads++
+	case "upload":
+		account.Uploads++
+	}
+}
+
+// add counts n bytes of a download or upload by user
+func (u *usageTracker) add(user, kind string, n int64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	account := u.account(user)
+	switch kind {
+	case "download":
+		account.Downloaded += n
+		account.TotalDownloaded += n
+	case "upload":
+		account.Uploaded += n
+		account.TotalUploaded += n
+	}
+}
+
+// overCap reports whether user has used up the monthly transfer cap
+func (u *usageTracker) overCap(user string) bool {
+	if monthlyTransferCap <= 0 || user == "" {
+		return false
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.account(user).Transferred() >= monthlyTransferCap
+}
+
+// report returns the usage of all users, heaviest first
+func (u *usageTracker) report() UsageReport {
+	report := UsageReport{Month: currentMonth(), Cap: monthlyTransferCap, Quota: userQuota, Users: []UserUsage{}}
+	u.mu.Lock()
+	if userQuota > 0 {
+		// Every user has storage to report, even without transfers
+		for _, user := range knownUsers() {
+			u.account(user)
+		}
+	}
+	for user := range u.accounts {
+		report.Users = append(report.Users, *u.account(user))
+	}
+	u.mu.Unlock()
+
+	if userQuota > 0 {
+		for i := range report.Users {
+			report.Users[i].Stored = quotas.stored(report.Users[i].User)
+		}
+	}
+
+	sort.Slice(report.Users, func(i, j int) bool {
+		if report.Users[i].Transferred() != report.Users[j].Transferred() {
+			return report.Users[i].Transferred() > report.Users[j].Transferred()
+		}
+		return report.Users[i].User < report.Users[j].User
+	})
+	return report
+}
+
+// persisted returns the accounts to save across restarts
+func (u *usageTracker) persisted() []UserUsage {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	accounts := make([]UserUsage, 0, len(u.accounts))
+	for _, account := range u.accounts {
+		accounts = append(accounts, *account)
+	}
+	return accounts
+}
+
+// restore loads accounts saved by a previous run; account() starts a new
+// month for those saved in an earlier one
+func (u *usageTracker) restore(accounts []UserUsage) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for _, account := range accounts {
+		account := account
+		account.Stored = 0
+		u.accounts[account.User] = &account
+	}
+}
+
+// writeCapExceeded reports that a user's monthly transfer cap is used up
+func writeCapExceeded(w http.ResponseWriter, r *http.Request, user string) {
+	auditLogf("cap-exceeded client=%s user=%q path=%q", clientHost(r), user, r.URL.Path)
+	http.Error(w, "Monthly transfer cap exceeded", http.StatusTooManyRequests)
+}
+
+// parseSize parses a byte count with an optional binary unit suffix,
+// e.g. "512", "100M", "10GB" or "1.5TiB"
+func parseSize(s string) (int64, error) {
+	value := strings.ToUpper(strings.TrimSpace(s))
+	value = strings.TrimSuffix(strings.TrimSuffix(value, "B"), "I")
+	multiplier := int64(1)
+	if value != "" {
+		if i := strings.IndexByte("KMGTPE", value[len(value)-1]); i >= 0 {
+			multiplier = int64(1) << (10 * (i + 1))
+			value = value[:len(value)-1]
+		}
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(n * float64(multiplier)), nil
+}
+
+// adminUsageHandler serves per-user transfer accounting as JSON
+func adminUsageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(usage.report()); err != nil {
+		log.Printf("JSON encoding error: %v", err)
+	}
+}
+
+// adminUsagePageHandler renders the per-user transfer accounting dashboard
+func adminUsagePageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	report := usage.report()
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := renderTemplate(w, r, "usage.html", &report); err != nil {
+		log.Printf("Template error: %v", err)
+		http.Error(w, "Error rendering page", http.StatusInternalServerError)
+	}
+}
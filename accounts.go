@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/term"
+)
+
+// accountsBucket is the bucket of the user database holding the accounts,
+// keyed by user name
+var accountsBucket = []byte("users")
+
+// userRole is what an account may do on the server
+type userRole int
+
+const (
+	// roleReader may list and download, but not change anything
+	roleReader userRole = iota
+	// roleWriter may upload and manage files as well
+	roleWriter
+	// roleAdmin may also use the admin pages and API from anywhere
+	roleAdmin
+)
+
+var userRoleNames = []string{"reader", "writer", "admin"}
+
+// parseUserRole parses a role name
+func parseUserRole(s string) (userRole, error) {
+	for i, name := range userRoleNames {
+		if s == name {
+			return userRole(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown role %q (expected reader, writer or admin)", s)
+}
+
+func (role userRole) String() string {
+	return userRoleNames[role]
+}
+
+// account is a user of the user database (-users-db)
+type account struct {
+	// Password is the bcrypt hash of the password
+	Password string    `json:"password"`
+	Role     string    `json:"role"`
+	Created  time.Time `json:"created"`
+}
+
+// accountStore holds the accounts of the user database in memory. The
+// database is read again when it changes, so accounts added with
+// "files user" apply to a running server.
+type accountStore struct {
+	file     string
+	mu       sync.RWMutex
+	accounts map[string]account
+	modTime  time.Time
+	checked  time.Time
+}
+
+// accounts is the user database, nil without -users-db
+var accounts *accountStore
+
+// openUserDB opens a user database. A running server only opens it
+// read-only and briefly, so "files user" can change it meanwhile.
+func openUserDB(file string, readOnly bool) (*bolt.DB, error) {
+	db, err := bolt.Open(file, 0600, &bolt.Options{Timeout: 5 * time.Second, ReadOnly: readOnly})
+	if err != nil {
+		return nil, err
+	}
+	if !readOnly {
+		err = db.Update(func(tx *bolt.Tx) error {
+			_, err := tx.CreateBucketIfNotExists(accountsBucket)
+			return err
+		})
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return db, nil
+}
+
+// readAccounts reads every account of a user database
+func readAccounts(db *bolt.DB) (map[string]account, error) {
+	loaded := make(map[string]account)
+	err := db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(accountsBucket)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(name, value []byte) error {
+			var acct account
+			if err := json.Unmarshal(value, &acct); err != nil {
+				return fmt.Errorf("account %q: %v", name, err)
+			}
+			loaded[string(name)] = acct
+			return nil
+		})
+	})
+	return loaded, err
+}
+
+// loadAccountStore opens the user database of a server, creating it if
+// it doesn't exist yet
+func loadAccountStore(file string) (*accountStore, error) {
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		db, err := openUserDB(file, false)
+		if err != nil {
+			return nil, err
+		}
+		db.Close()
+	}
+	store := &accountStore{file: file}
+	if err := store.load(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// load reads the accounts from the database
+func (s *accountStore) load() error {
+	info, err := os.Stat(s.file)
+	if err != nil {
+		return err
+	}
+	db, err := openUserDB(s.file, true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	loaded, err := readAccounts(db)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.accounts, s.modTime = loaded, info.ModTime()
+	s.mu.Unlock()
+	return nil
+}
+
+// refresh reads the database again if it changed; it looks at most once
+// a second
+func (s *accountStore) refresh() {
+	s.mu.Lock()
+	if time.Since(s.checked) < time.Second {
+		s.mu.Unlock()
+		return
+	}
+	s.checked = time.Now()
+	modTime := s.modTime
+	s.mu.Unlock()
+
+	info, err := os.Stat(s.file)
+	if err != nil || info.ModTime().Equal(modTime) {
+		return
+	}
+	if err := s.load(); err != nil {
+		log.Printf("Failed to reload user database: %v", err)
+	}
+}
+
+// get returns the account of a user
+func (s *accountStore) get(name string) (account, bool) {
+	s.refresh()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	acct, ok := s.accounts[name]
+	return acct, ok
+}
+
+// names returns the names of all accounts
+func (s *accountStore) names() []string {
+	s.refresh()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	names := make([]string, 0, len(s.accounts))
+	for name := range s.accounts {
+		names = append(names, name)
+	}
+	return names
+}
+
+// knownUsers returns the names of the users of the users file and the user
+// database, whose home directories and transfers are tracked
+func knownUsers() []string {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	names := make([]string, 0, len(users))
+	for name := range users {
+		names = append(names, name)
+	}
+	if accounts != nil {
+		for _, name := range accounts.names() {
+			if _, ok := users[name]; !ok {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// roleOf returns the role of a user. Users of the users file, API tokens
+// and OpenID Connect logins without an account are writers.
+func roleOf(user string) userRole {
+	if accounts == nil || user == "" {
+		return roleWriter
+	}
+	acct, ok := accounts.get(user)
+	if !ok {
+		return roleWriter
+	}
+	role, err := parseUserRole(acct.Role)
+	if err != nil {
+		// A role this version doesn't know grants nothing beyond reading
+		return roleReader
+	}
+	return role
+}
+
+// runUser manages the accounts of a user database ("files user")
+func runUser(args []string) {
+	usage := func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s user <command> -db <file> [options] [name]\n\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, "Commands:")
+		fmt.Fprintln(os.Stderr, "  list                  List the accounts and their roles")
+		fmt.Fprintln(os.Stderr, "  add [-role r] name    Add an account; the password is read from the terminal or stdin")
+		fmt.Fprintln(os.Stderr, "  passwd name           Change the password of an account")
+		fmt.Fprintln(os.Stderr, "  role name role        Change the role of an account: reader, writer or admin")
+		fmt.Fprintln(os.Stderr, "  remove name           Remove an account")
+	}
+	if len(args) == 0 {
+		usage()
+		os.Exit(2)
+	}
+	command := args[0]
+	flags := flag.NewFlagSet("user "+command, flag.ExitOnError)
+	dbFlag := flags.String("db", "", "User database (required)")
+	roleFlag := flags.String("role", "writer", "Role of a new account: reader, writer or admin")
+	flags.Parse(args[1:])
+	if *dbFlag == "" {
+		log.Fatal("user: -db is required")
+	}
+
+	wantArgs := map[string]int{"list": 0, "add": 1, "passwd": 1, "role": 2, "remove": 1}
+	n, ok := wantArgs[command]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+	if flags.NArg() != n {
+		log.Fatalf("user %s: expected %d arguments", command, n)
+	}
+	name := flags.Arg(0)
+	if n > 0 {
+		if err := addCredential(map[string]string{}, name+":x"); err != nil {
+			log.Fatal("user: ", err)
+		}
+	}
+
+	db, err := openUserDB(*dbFlag, command == "list")
+	if err != nil {
+		log.Fatal("user: ", err)
+	}
+	defer db.Close()
+
+	switch command {
+	case "list":
+		loaded, err := readAccounts(db)
+		if err != nil {
+			log.Fatal("user: ", err)
+		}
+		names := make([]string, 0, len(loaded))
+		for name := range loaded {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Printf("%-20s %-7s %s\n", name, loaded[name].Role, loaded[name].Created.Format(time.RFC3339))
+		}
+	case "add":
+		role, err := parseUserRole(*roleFlag)
+		if err != nil {
+			log.Fatal("user: ", err)
+		}
+		err = updateAccount(db, name, func(acct *account, exists bool) error {
+			if exists {
+				return errors.New("account already exists")
+			}
+			acct.Role, acct.Created = role.String(), time.Now().UTC()
+			return setPassword(acct)
+		})
+		if err != nil {
+			log.Fatal("user: ", err)
+		}
+		fmt.Printf("Added %s (%s)\n", name, role)
+	case "passwd":
+		err := updateAccount(db, name, func(acct *account, exists bool) error {
+			if !exists {
+				return errors.New("no such account")
+			}
+			return setPassword(acct)
+		})
+		if err != nil {
+			log.Fatal("user: ", err)
+		}
+		fmt.Printf("Changed the password of %s\n", name)
+	case "role":
+		role, err := parseUserRole(flags.Arg(1))
+		if err != nil {
+			log.Fatal("user: ", err)
+		}
+		err = updateAccount(db, name, func(acct *account, exists bool) error {
+			if !exists {
+				return errors.New("no such account")
+			}
+			acct.Role = role.String()
+			return nil
+		})
+		if err != nil {
+			log.Fatal("user: ", err)
+		}
+		fmt.Printf("%s is now %s\n", name, role)
+	case "remove":
+		err := db.Update(func(tx *bolt.Tx) error {
+			bucket := tx.Bucket(accountsBucket)
+			if bucket.Get([]byte(name)) == nil {
+				return errors.New("no such account")
+			}
+			return bucket.Delete([]byte(name))
+		})
+		if err != nil {
+			log.Fatal("user: ", err)
+		}
+		fmt.Printf("Removed %s\n", name)
+	}
+}
+
+// updateAccount changes or creates an account in one transaction
+func updateAccount(db *bolt.DB, name string, change func(acct *account, exists bool) error) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(accountsBucket)
+		var acct account
+		value := bucket.Get([]byte(name))
+		if value != nil {
+			if err := json.Unmarshal(value, &acct); err != nil {
+				return err
+			}
+		}
+		if err := change(&acct, value != nil); err != nil {
+			return err
+		}
+		value, err := json.Marshal(acct)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(name), value)
+	})
+}
+
+// setPassword asks for a new password and stores its bcrypt hash. On a
+// terminal the password is typed twice without echo; otherwise the first
+// line of stdin is the password, for scripts.
+func setPassword(acct *account) error {
+	var password string
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		fmt.Fprint(os.Stderr, "Password: ")
+		first, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return err
+		}
+		fmt.Fprint(os.Stderr, "Repeat password: ")
+		second, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return err
+		}
+		if string(first) != string(second) {
+			return errors.New("passwords don't match")
+		}
+		password = string(first)
+	} else {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return errors.New("no password on stdin")
+		}
+		password = strings.TrimRight(line, "\r\n")
+	}
+	if password == "" {
+		return errors.New("empty password")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	acct.Password = string(hash)
+	return nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// aclPermission is what a rule of -acl lets its users do with a path
+type aclPermission int
+
+const (
+	// aclDeny hides a path as if it didn't exist
+	aclDeny aclPermission = iota
+	// aclRead allows listing and downloading
+	aclRead
+	// aclWrite allows uploads, moves, copies and new folders as well
+	aclWrite
+)
+
+var aclPermissionNames = []string{"deny", "read", "write"}
+
+// aclRule grants a permission on a path and everything below it to a user,
+// a group ("@name"), every signed-in user ("@users") or everyone ("*")
+type aclRule struct {
+	pattern    []string
+	who        string
+	permission aclPermission
+}
+
+var (
+	// aclRules are the rules of -acl, in the order given
+	aclRules []aclRule
+	// aclGroups maps group names to their members
+	aclGroups = make(map[string]map[string]bool)
+)
+
+// parseACL adds the rules and groups of an access control file. Each line
+// is either a group, "@name = user, user", or a rule, "path who
+// permission": path may use path.Match wildcards like -auth-only, who is a
+// user name, @group, @users or *, and permission is deny, read or write.
+func parseACL(input string) error {
+	var rules []aclRule
+	for _, line := range strings.Split(input, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if name, members, ok := strings.Cut(line, "="); ok && strings.HasPrefix(line, "@") {
+			name = strings.TrimSpace(strings.TrimPrefix(name, "@"))
+			if name == "" || name == "users" || strings.ContainsAny(name, " \t") {
+				return fmt.Errorf("acl group %q: invalid name", name)
+			}
+			if aclGroups[name] == nil {
+				aclGroups[name] = make(map[string]bool)
+			}
+			for _, member := range parseList(members) {
+				aclGroups[name][member] = true
+			}
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return fmt.Errorf("acl rule %q: expected path, user or @group, and permission", line)
+		}
+		permission := -1
+		for i, name := range aclPermissionNames {
+			if strings.EqualFold(fields[2], name) {
+				permission = i
+			}
+		}
+		if permission < 0 {
+			return fmt.Errorf("acl rule %q: unknown permission %q (expected deny, read or write)", line, fields[2])
+		}
+		pattern := splitAuthPath(fields[0])
+		for _, component := range pattern {
+			if _, err := path.Match(component, ""); err != nil {
+				return fmt.Errorf("acl rule %q: %v", line, err)
+			}
+		}
+		rules = append(rules, aclRule{pattern: pattern, who: fields[1], permission: aclPermission(permission)})
+	}
+
+	// Groups may be defined after the rules using them
+	for _, rule := range rules {
+		if group, ok := strings.CutPrefix(rule.who, "@"); ok && group != "users" && aclGroups[group] == nil {
+			return fmt.Errorf("acl: unknown group @%s", group)
+		}
+	}
+	aclRules = append(aclRules, rules...)
+	return nil
+}
+
+// aclNamesUsers reports whether any rule is for particular users rather
+// than everyone
+func aclNamesUsers() bool {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	for _, rule := range aclRules {
+		if rule.who != "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// appliesTo reports whether a rule is for a user ("" for anonymous)
+func (rule aclRule) appliesTo(user string) bool {
+	switch {
+	case rule.who == "*":
+		return true
+	case user == "":
+		return false
+	case rule.who == "@users":
+		return true
+	case strings.HasPrefix(rule.who, "@"):
+		return aclGroups[rule.who[1:]][user]
+	}
+	return rule.who == user
+}
+
+// aclPermissionFor returns what a user may do with a path relative to
+// workingDir. The rule for the longest path applies, and of several for
+// the same path the first one for the user; without one, anything goes.
+func aclPermissionFor(user, requestedPath string) aclPermission {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	if len(aclRules) == 0 {
+		return aclWrite
+	}
+	components := splitAuthPath(requestedPath)
+	matched, permission := -1, aclWrite
+	for _, rule := range aclRules {
+		if len(rule.pattern) <= matched || !rule.appliesTo(user) || !matchPathPattern(rule.pattern, components) {
+			continue
+		}
+		matched, permission = len(rule.pattern), rule.permission
+	}
+	return permission
+}
+
+// canRead reports whether a user ("" for anonymous) may see a path: list
+// it, download it and find it in listings
+func canRead(user, requestedPath string) bool {
+	return (user != "" || !isAuthOnly(requestedPath)) && homeAllows(user, requestedPath) && aclPermissionFor(user, requestedPath) >= aclRead
+}
+
+// canWrite reports whether a user may create, replace, move or copy onto
+// a path; readers of the user database may not write anywhere, upload
+// policies and the names recorded for uploads are only changed on the
+// server's disk, and mounts (-mount) stay where they are
+func canWrite(user, requestedPath string) bool {
+	if name := path.Base(requestedPath); strings.EqualFold(name, uploadPolicyFile) || strings.EqualFold(name, uploadNamesFile) {
+		return false
+	}
+	if isMountPoint(requestedPath) || (virtualRoot && mountOf(requestedPath) == "") {
+		return false
+	}
+	if _, ok := served.(writableStorage); !ok {
+		return false
+	}
+	return (user != "" || !isAuthOnly(requestedPath)) && homeAllows(user, requestedPath) && aclPermissionFor(user, requestedPath) >= aclWrite && roleOf(user) >= roleWriter
+}
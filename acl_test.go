@@ -0,0 +1,77 @@
+package main
+
+import "testing"
+
+// useACL replaces the rules of -acl with those of input for the rest of a
+// test
+func useACL(t *testing.T, input string) {
+	t.Helper()
+	oldRules, oldGroups := aclRules, aclGroups
+	aclRules, aclGroups = nil, make(map[string]map[string]bool)
+	t.Cleanup(func() { aclRules, aclGroups = oldRules, oldGroups })
+	if err := parseACL(input); err != nil {
+		t.Fatal(err)
+	}
+}
+
+const testACL = `
+@staff = alice, bob
+/ * read
+/public * write
+/staff @staff write
+/staff * deny
+/staff/archive @staff read
+/private/carol carol write
+/private/* @users deny
+`
+
+func TestParseACLErrors(t *testing.T) {
+	tests := []string{
+		"/docs alice",
+		"/docs alice execute",
+		"/docs @nobody read",
+		"/docs[ alice read",
+		"@ = alice",
+		"@users = alice",
+	}
+	for _, input := range tests {
+		oldRules, oldGroups := aclRules, aclGroups
+		aclRules, aclGroups = nil, make(map[string]map[string]bool)
+		if err := parseACL(input); err == nil {
+			t.Errorf("parseACL(%q) succeeded, want an error", input)
+		}
+		aclRules, aclGroups = oldRules, oldGroups
+	}
+}
+
+func TestACLPermissions(t *testing.T) {
+	useWorkingDir(t)
+	useACL(t, testACL)
+
+	tests := []struct {
+		user, path  string
+		read, write bool
+	}{
+		{"", "", true, false},
+		{"", "readme.txt", true, false},
+		{"", "public/upload.txt", true, true},
+		{"", "staff", false, false},
+		{"dave", "staff/plan.txt", false, false},
+		{"alice", "staff/plan.txt", true, true},
+		{"bob", "staff/archive/2023.txt", true, false},
+		{"", "private/carol/notes.txt", true, false},
+		{"dave", "private/carol/notes.txt", false, false},
+		{"carol", "private/carol/notes.txt", true, true},
+		{"carol", "private/dave", false, false},
+		// Upload policies are only changed on the server's disk
+		{"", "public/" + uploadPolicyFile, true, false},
+	}
+	for _, tt := range tests {
+		if got := canRead(tt.user, tt.path); got != tt.read {
+			t.Errorf("canRead(%q, %q) = %v, want %v", tt.user, tt.path, got, tt.read)
+		}
+		if got := canWrite(tt.user, tt.path); got != tt.write {
+			t.Errorf("canWrite(%q, %q) = %v, want %v", tt.user, tt.path, got, tt.write)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// apiErrorBodyLimit is the most of an error message that is turned into a
+// JSON error; longer bodies are passed on as they are
+const apiErrorBodyLimit = 64 << 10
+
+// APIError is the body of an error response to API clients:
+// {"error": {...}}
+type APIError struct {
+	Error APIErrorDetail `json:"error"`
+}
+
+// APIErrorDetail describes what went wrong
+type APIErrorDetail struct {
+	// Code is the HTTP status as a word, e.g. "not_found"
+	Code    string `json:"code"`
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+	// RequestID is also sent as X-Request-ID and logged with the request
+	RequestID string `json:"requestId"`
+	// Details repeats headers the client may act on, e.g. uploadOffset
+	Details map[string]string `json:"details,omitempty"`
+}
+
+// apiErrorDetailHeaders are the response headers copied into Details
+var apiErrorDetailHeaders = map[string]string{
+	"Retry-After":      "retryAfter",
+	"Upload-Offset":    "uploadOffset",
+	"Allow":            "allow",
+	"Content-Range":    "contentRange",
+	"X-Queue-Position": "queuePosition",
+}
+
+// requestIDKey is the context key of a request's ID
+type requestIDKey struct{}
+
+// requestID returns the ID of a request: the client's X-Request-ID, if it
+// is well-formed, or one made up by the server
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// errorCode turns an HTTP status into the code of an APIError
+func errorCode(status int) string {
+	text := http.StatusText(status)
+	if text == "" {
+		return "status_" + strconv.Itoa(status)
+	}
+	return strings.NewReplacer(" ", "_", "-", "_", "'", "").Replace(strings.ToLower(text))
+}
+
+// wantsJSONErrors reports whether errors are sent to a request as
+// APIErrors: for the /api/ endpoints, and for clients accepting JSON
+func wantsJSONErrors(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, "/api/") || strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// apiErrorMiddleware gives every request an ID (X-Request-ID) and turns
+// the plain-text errors of http.Error into APIErrors for API clients, so
+// handlers report errors the same way whoever asks
+func apiErrorMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := clientID(r, "X-Request-ID", "")
+		if id == "" {
+			id = hex.EncodeToString(randomBytes(8))
+		}
+		w.Header().Set("X-Request-ID", id)
+		r = r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+		if !wantsJSONErrors(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ew := &apiErrorWriter{ResponseWriter: w, id: id}
+		next.ServeHTTP(ew, r)
+		ew.finish()
+	})
+}
+
+// apiErrorWriter holds back a plain-text error response to send it as an
+// APIError once the handler is done
+type apiErrorWriter struct {
+	http.ResponseWriter
+	id      string
+	status  int
+	wrote   bool
+	message bytes.Buffer
+}
+
+func (w *apiErrorWriter) WriteHeader(code int) {
+	if w.wrote || w.status != 0 {
+		return
+	}
+	if code >= 400 && strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+		w.status = code
+		return
+	}
+	if code >= 200 {
+		w.wrote = true
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *apiErrorWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.wrote = true
+		return w.ResponseWriter.Write(b)
+	}
+	if w.message.Len()+len(b) <= apiErrorBodyLimit {
+		return w.message.Write(b)
+	}
+	// Not a short error message after all
+	status := w.status
+	w.status = 0
+	w.ResponseWriter.WriteHeader(status)
+	w.wrote = true
+	if _, err := w.ResponseWriter.Write(w.message.Bytes()); err != nil {
+		return 0, err
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush lets streaming handlers flush through the writer
+func (w *apiErrorWriter) Flush() {
+	if w.status != 0 {
+		return
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		w.wrote = true
+		flusher.Flush()
+	}
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (w *apiErrorWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// finish sends the error held back, if any
+func (w *apiErrorWriter) finish() {
+	if w.status == 0 {
+		return
+	}
+	detail := APIErrorDetail{
+		Code:      errorCode(w.status),
+		Status:    w.status,
+		Message:   strings.TrimSpace(w.message.String()),
+		RequestID: w.id,
+	}
+	if detail.Message == "" {
+		detail.Message = http.StatusText(w.status)
+	}
+	header := w.Header()
+	for name, key := range apiErrorDetailHeaders {
+		if value := header.Get(name); value != "" {
+			if detail.Details == nil {
+				detail.Details = make(map[string]string)
+			}
+			detail.Details[key] = value
+		}
+	}
+	body, _ := json.Marshal(APIError{Error: detail})
+	header.Set("Content-Type", "application/json")
+	header.Set("Content-Length", strconv.Itoa(len(body)+1))
+	w.ResponseWriter.WriteHeader(w.status)
+	w.ResponseWriter.Write(append(body, '\n'))
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// archiveFile is a file or directory to be added to an archive
+type archiveFile struct {
+	// Name is the slash-separated path inside the archive
+	Name     string
+	FullPath string
+	Info     fs.FileInfo
+}
+
+// collectArchiveFiles walks a directory and returns the files and
+// directories to archive under prefix, leaving out what the request may
+// not see. Symbolic links and other special files are skipped.
+func collectArchiveFiles(r *http.Request, fullPath, requestedPath, prefix string) ([]archiveFile, int64, error) {
+	var files []archiveFile
+	var total int64
+	user := authenticatedUser(r)
+
+	err := walkServed(fullPath, requestedPath, func(p, rel string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Skip unreadable directories instead of failing the archive
+			if d != nil && d.IsDir() && rel != "." {
+				return fs.SkipDir
+			}
+			return err
+		}
+		if rel != "." && !canRead(user, path.Join(filepath.ToSlash(requestedPath), rel)) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if !d.IsDir() && !d.Type().IsRegular() {
+			return nil
+		}
+		if len(files) >= archiveMaxEntries {
+			return errArchiveTooLarge
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		name := path.Join(prefix, rel)
+		if d.IsDir() {
+			name += "/"
+		} else {
+			total += info.Size()
+		}
+		files = append(files, archiveFile{Name: name, FullPath: p, Info: info})
+		return nil
+	})
+	return files, total, err
+}
+
+// storedCategories are file categories whose data is already compressed
+var storedCategories = map[string]bool{"image": true, "audio": true, "video": true, "archive": true}
+
+// writeZip streams files as a zip archive, reading them through transfer
+func writeZip(w io.Writer, files []archiveFile, transfer *transfer) error {
+	zw := zip.NewWriter(w)
+	for _, file := range files {
+		header, err := zip.FileInfoHeader(file.Info)
+		if err != nil {
+			return err
+		}
+		header.Name = file.Name
+		if file.Info.IsDir() {
+			if _, err := zw.CreateHeader(header); err != nil {
+				return err
+			}
+			continue
+		}
+
+		header.Method = zip.Deflate
+		if storedCategories[fileCategory(file.Name)] {
+			header.Method = zip.Store
+		}
+		entry, err := zw.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		if err := copyFileTo(entry, file.FullPath, transfer); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// writeTarGz streams files as a gzip-compressed tar archive, reading them
+// through transfer. Unlike zip, tar keeps Unix permissions and ownership.
+func writeTarGz(w io.Writer, files []archiveFile, transfer *transfer) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	for _, file := range files {
+		header, err := tar.FileInfoHeader(file.Info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = file.Name
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if file.Info.IsDir() {
+			continue
+		}
+		if err := copyFileTo(tw, file.FullPath, transfer); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// copyFileTo copies a file's contents to w, counting them toward transfer
+func copyFileTo(w io.Writer, fullPath string, transfer *transfer) error {
+	f, err := os.Open(fullPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, transfer.reader(f))
+	return err
+}
+
+// archiveFormat returns the archive format a request asks for with
+// ?format= (or the format form field): zip by default, or tar.gz
+func archiveFormat(r *http.Request) (string, bool) {
+	switch format := r.FormValue("format"); format {
+	case "", "zip":
+		return "zip", true
+	case "tar.gz":
+		return format, true
+	}
+	return "", false
+}
+
+// sendArchive streams files as an archive named name.<format>, accounting
+// it as a download of requestedPath. With -artifact-cache, an archive of
+// the same files is sent from the cache, and a new one is kept there.
+func sendArchive(w http.ResponseWriter, r *http.Request, format, name, requestedPath string, files []archiveFile, total int64) {
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.%s"`, name, format))
+	if format == "tar.gz" {
+		w.Header().Set("Content-Type", "application/gzip")
+	} else {
+		w.Header().Set("Content-Type", "application/zip")
+	}
+	var key string
+	var cached *os.File
+	if artifacts != nil {
+		key = artifactKey(format, files)
+		if f, size, ok := artifacts.open(key); ok {
+			defer f.Close()
+			w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+			transfer := stats.startTransfer("download", requestedPath, clientHost(r), authenticatedUser(r), size)
+			defer stats.endTransfer(transfer)
+			io.Copy(w, transfer.reader(f))
+			return
+		}
+		cached = artifacts.create(total)
+	}
+
+	transfer := stats.startTransfer("download", requestedPath, clientHost(r), authenticatedUser(r), total)
+	defer stats.endTransfer(transfer)
+	var dst io.Writer = w
+	if cached != nil {
+		dst = io.MultiWriter(w, cached)
+	}
+	out := bufio.NewWriterSize(dst, archiveBufferSize)
+	var err error
+	if format == "tar.gz" {
+		err = writeTarGz(out, files, transfer)
+	} else {
+		err = writeZip(out, files, transfer)
+	}
+	if err == nil {
+		err = out.Flush()
+	}
+	if cached != nil {
+		artifacts.store(cached, key, err != nil)
+	}
+	if err != nil {
+		// The headers are sent, so abort the connection to make sure the
+		// client doesn't take the truncated archive for a complete one
+		log.Printf("Archive error for %s: %v", requestedPath, err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// archiveName returns the name of the archive of a directory: its own
+// name, or "files" for workingDir
+func archiveName(requestedPath string) string {
+	if requestedPath == "" {
+		return "files"
+	}
+	return path.Base(requestedPath)
+}
+
+// zipHandler streams a directory as a zip archive (/zip/<path>), or as a
+// tar.gz archive with ?format=tar.gz. The archive is built while it is
+// sent, by one of the archive workers; only -artifact-cache keeps a copy.
+func zipHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	format, ok := archiveFormat(r)
+	if !ok {
+		http.Error(w, "Unknown archive format", http.StatusBadRequest)
+		return
+	}
+
+	requestedPath := strings.Trim(pathParam(r, "path"), "/")
+
+	// Security check: ensure the path is within workingDir
+	fullPath, err := resolvePath(requestedPath)
+	if err != nil {
+		writePathError(w, err)
+		return
+	}
+
+	// Paths the user may not see look nonexistent
+	user := authenticatedUser(r)
+	info, err := os.Stat(fullPath)
+	if err != nil || !canRead(user, requestedPath) {
+		if err == nil || os.IsNotExist(err) {
+			http.Error(w, "Path not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Error accessing path", http.StatusInternalServerError)
+		return
+	}
+	if !info.IsDir() {
+		http.Error(w, "Not a directory", http.StatusBadRequest)
+		return
+	}
+	if usage.overCap(user) {
+		writeCapExceeded(w, r, user)
+		return
+	}
+
+	release := startArchive(w, r, requestedPath)
+	if release == nil {
+		return
+	}
+	defer release()
+
+	// The archive is named after the directory; its entries sit in a
+	// top-level folder of the same name
+	name := archiveName(requestedPath)
+	files, total, err := collectArchiveFiles(r, fullPath, requestedPath, name)
+	if err != nil {
+		writeArchiveError(w, err)
+		return
+	}
+	sendArchive(w, r, format, name, requestedPath, files, total)
+}
+
+// writeArchiveError responds to a request whose files couldn't be collected
+func writeArchiveError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errArchiveTooLarge) {
+		http.Error(w, "Too many files for one archive", http.StatusRequestEntityTooLarge)
+		return
+	}
+	http.Error(w, "Error reading directory", http.StatusInternalServerError)
+}
+
+// commonDir returns the deepest directory containing all of the paths
+func commonDir(paths []string) string {
+	dir := path.Dir(paths[0])
+	for _, p := range paths[1:] {
+		for dir != "." && !strings.HasPrefix(p, dir+"/") {
+			dir = path.Dir(dir)
+		}
+	}
+	if dir == "." {
+		return ""
+	}
+	return dir
+}
+
+// archiveSelectionHandler streams a selection of files and directories as
+// one archive. It takes the form fields path (repeated, relative to
+// workingDir) and format. Entries are named relative to the deepest
+// directory containing the whole selection.
+func archiveSelectionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form", http.StatusBadRequest)
+		return
+	}
+	format, ok := archiveFormat(r)
+	if !ok {
+		http.Error(w, "Unknown archive format", http.StatusBadRequest)
+		return
+	}
+	user := authenticatedUser(r)
+	if usage.overCap(user) {
+		writeCapExceeded(w, r, user)
+		return
+	}
+
+	var paths []string
+	for _, p := range r.PostForm["path"] {
+		if p = strings.Trim(path.Clean("/"+filepath.ToSlash(p)), "/"); p != "" {
+			paths = append(paths, p)
+		}
+	}
+	if len(paths) == 0 {
+		http.Error(w, "Nothing selected", http.StatusBadRequest)
+		return
+	}
+	// Entries inside a selected directory come with it anyway
+	sort.Strings(paths)
+	selected := paths[:1]
+	for _, p := range paths[1:] {
+		if last := selected[len(selected)-1]; p != last && !strings.HasPrefix(p, last+"/") {
+			selected = append(selected, p)
+		}
+	}
+
+	release := startArchive(w, r, "")
+	if release == nil {
+		return
+	}
+	defer release()
+
+	base := commonDir(selected)
+	var files []archiveFile
+	var total int64
+	for _, requestedPath := range selected {
+		// Security check: ensure the path is within workingDir
+		fullPath, err := resolvePath(requestedPath)
+		if err != nil {
+			writePathError(w, err)
+			return
+		}
+
+		// Paths the user may not see look nonexistent
+		info, err := os.Stat(fullPath)
+		if err != nil || !canRead(user, requestedPath) {
+			if err == nil || os.IsNotExist(err) {
+				http.Error(w, "Path not found: "+requestedPath, http.StatusNotFound)
+				return
+			}
+			http.Error(w, "Error accessing path", http.StatusInternalServerError)
+			return
+		}
+
+		name := strings.TrimPrefix(strings.TrimPrefix(requestedPath, base), "/")
+		if !info.IsDir() {
+			files = append(files, archiveFile{Name: name, FullPath: fullPath, Info: info})
+			total += info.Size()
+			continue
+		}
+		dirFiles, size, err := collectArchiveFiles(r, fullPath, requestedPath, name)
+		if err == nil && len(files)+len(dirFiles) > archiveMaxEntries {
+			err = errArchiveTooLarge
+		}
+		if err != nil {
+			writeArchiveError(w, err)
+			return
+		}
+		files = append(files, dirFiles...)
+		total += size
+	}
+
+	sendArchive(w, r, format, archiveName(base), base, files, total)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// archiveBufferSize is the output buffer of each archive being built.
+// Together with the compressor's fixed state and one open file at a time,
+// it bounds what an archive job holds, whatever the size of the tree.
+const archiveBufferSize = 256 * 1024
+
+// archiveMaxEntries caps the files and directories in one archive, since
+// the list of entries is held in memory while the archive is built
+const archiveMaxEntries = 200000
+
+var (
+	errArchiveQueueFull = errors.New("archive queue is full")
+	errArchiveTooLarge  = errors.New("too many entries for one archive")
+)
+
+// archiveJob is an archive request holding or waiting for a worker
+type archiveJob struct {
+	id     string
+	path   string
+	queued time.Time
+	ready  chan struct{}
+}
+
+// archiveQueue limits how many archives are built at once (-archive-workers)
+// and lines up further requests in arrival order, up to -archive-queue
+// of them
+type archiveQueue struct {
+	mu         sync.Mutex
+	workers    int
+	maxWaiting int
+	running    []*archiveJob
+	waiting    []*archiveJob
+}
+
+var archives = &archiveQueue{workers: 4, maxWaiting: 32}
+
+// ArchiveQueueStatus is the response of /api/archive/queue
+type ArchiveQueueStatus struct {
+	Workers int `json:"workers"`
+	Running int `json:"running"`
+	Waiting int `json:"waiting"`
+	// State and Position describe the archive asked about with ?id=:
+	// "running", or "waiting" at a position counted from 1
+	State    string `json:"state,omitempty"`
+	Position int    `json:"position,omitempty"`
+}
+
+// acquire waits until a worker is free for an archive request and returns
+// the function that frees it again. It fails with errArchiveQueueFull
+// when too many requests are waiting, or with the context's error when the
+// client gives up first.
+func (q *archiveQueue) acquire(r *http.Request, id, requestedPath string) (func(), error) {
+	job := &archiveJob{id: id, path: requestedPath, queued: time.Now(), ready: make(chan struct{})}
+	q.mu.Lock()
+	if len(q.running) < q.workers && len(q.waiting) == 0 {
+		q.running = append(q.running, job)
+		q.mu.Unlock()
+		return func() { q.release(job) }, nil
+	}
+	if len(q.waiting) >= q.maxWaiting {
+		q.mu.Unlock()
+		return nil, errArchiveQueueFull
+	}
+	q.waiting = append(q.waiting, job)
+	q.mu.Unlock()
+
+	select {
+	case <-job.ready:
+		log.Printf("Archive of /%s waited %v for a worker", requestedPath, time.Since(job.queued).Round(time.Millisecond))
+		return func() { q.release(job) }, nil
+	case <-r.Context().Done():
+		q.mu.Lock()
+		for i, waiting := range q.waiting {
+			if waiting == job {
+				q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+				q.mu.Unlock()
+				return nil, r.Context().Err()
+			}
+		}
+		q.mu.Unlock()
+		// The worker was handed over just as the client left
+		q.release(job)
+		return nil, r.Context().Err()
+	}
+}
+
+// release frees the worker of a job and hands it to the first one waiting
+func (q *archiveQueue) release(job *archiveJob) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, running := range q.running {
+		if running == job {
+			q.running = append(q.running[:i], q.running[i+1:]...)
+			break
+		}
+	}
+	for len(q.running) < q.workers && len(q.waiting) > 0 {
+		next := q.waiting[0]
+		q.waiting = q.waiting[1:]
+		q.running = append(q.running, next)
+		close(next.ready)
+	}
+}
+
+// status reports the queue, and where the archive with a client-chosen ID
+// stands; ok is false if no such archive is running or waiting
+func (q *archiveQueue) status(id string) (ArchiveQueueStatus, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	status := ArchiveQueueStatus{Workers: q.workers, Running: len(q.running), Waiting: len(q.waiting)}
+	if id == "" {
+		return status, true
+	}
+	for _, job := range q.running {
+		if job.id == id {
+			status.State = "running"
+			return status, true
+		}
+	}
+	for i, job := range q.waiting {
+		if job.id == id {
+			status.State = "waiting"
+			status.Position = i + 1
+			return status, true
+		}
+	}
+	return status, false
+}
+
+// startArchive waits for an archive worker. The client may name its request
+// with X-Archive-ID or ?archive_id= to follow its place in the queue. If no
+// worker can be had, it responds and returns nil.
+func startArchive(w http.ResponseWriter, r *http.Request, requestedPath string) func() {
+	release, err := archives.acquire(r, clientID(r, "X-Archive-ID", "archive_id"), requestedPath)
+	if err == errArchiveQueueFull {
+		w.Header().Set("Retry-After", "10")
+		http.Error(w, "Too many archives in progress, try again later", http.StatusServiceUnavailable)
+		return nil
+	}
+	if err != nil {
+		// The client is gone; there is no one to respond to
+		return nil
+	}
+	return release
+}
+
+// archiveQueueHandler reports how busy the archive workers are
+// (/api/archive/queue), and with ?id= the state and queue position of the
+// archive requested under that ID
+func archiveQueueHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	status, ok := archives.status(r.URL.Query().Get("id"))
+	if !ok {
+		http.Error(w, "No archive with that ID is running or waiting", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		log.Printf("JSON encoding error: %v", err)
+	}
+}
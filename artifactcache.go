@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// artifactCache keeps generated archives on disk (-artifact-cache) so
+// asking again for the same files doesn't compress them again. Archives
+// are keyed by their content: the format and the name, size and
+// modification time of every entry, which also keeps archives built for
+// users with different access apart. The least recently used archives are
+// removed once the cache grows past its size.
+type artifactCache struct {
+	dir     string
+	maxSize int64
+
+	mu      sync.Mutex
+	size    int64
+	entries map[string]*artifactEntry
+}
+
+// artifactEntry is a cached archive
+type artifactEntry struct {
+	size int64
+	used time.Time
+}
+
+// artifacts is nil unless -artifact-cache is set
+var artifacts *artifactCache
+
+// openArtifactCache opens the cache in dir, creating it if needed. Archives
+// left by an earlier run are kept; unfinished ones are removed.
+func openArtifactCache(dir string, maxSize int64) (*artifactCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	c := &artifactCache{dir: dir, maxSize: maxSize, entries: make(map[string]*artifactEntry)}
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, ".tmp-") {
+			os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		c.entries[name] = &artifactEntry{size: info.Size(), used: info.ModTime()}
+		c.size += info.Size()
+	}
+	c.mu.Lock()
+	c.evict()
+	c.mu.Unlock()
+	return c, nil
+}
+
+// artifactKey names the archive of files in a format
+func artifactKey(format string, files []archiveFile) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n", format)
+	for _, file := range files {
+		fmt.Fprintf(h, "%s\x00%d\x00%d\x00%o\n", file.Name, file.Info.Size(), file.Info.ModTime().UnixNano(), file.Info.Mode())
+	}
+	return hex.EncodeToString(h.Sum(nil)[:16]) + "." + format
+}
+
+// open returns a cached archive and its size, and marks it as used
+func (c *artifactCache) open(key string) (*os.File, int64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, 0, false
+	}
+	f, err := os.Open(filepath.Join(c.dir, key))
+	if err != nil {
+		// Removed behind the server's back
+		c.size -= entry.size
+		delete(c.entries, key)
+		return nil, 0, false
+	}
+	// The modification time records the last use across restarts
+	entry.used = time.Now()
+	os.Chtimes(filepath.Join(c.dir, key), entry.used, entry.used)
+	return f, entry.size, true
+}
+
+// create returns a temporary file for an archive about to be built, or nil
+// if an archive of about size bytes would not fit
+func (c *artifactCache) create(size int64) *os.File {
+	if size > c.maxSize {
+		return nil
+	}
+	f, err := os.CreateTemp(c.dir, ".tmp-*")
+	if err != nil {
+		log.Printf("Artifact cache error: %v", err)
+		return nil
+	}
+	return f
+}
+
+// store adds a completely built archive to the cache, or drops it if
+// building it failed
+func (c *artifactCache) store(f *os.File, key string, failed bool) {
+	info, err := f.Stat()
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && !failed && info.Size() <= c.maxSize {
+		err = os.Rename(f.Name(), filepath.Join(c.dir, key))
+		if err == nil {
+			c.mu.Lock()
+			if old, ok := c.entries[key]; ok {
+				c.size -= old.size
+			}
+			c.entries[key] = &artifactEntry{size: info.Size(), used: time.Now()}
+			c.size += info.Size()
+			c.evict()
+			c.mu.Unlock()
+			return
+		}
+	}
+	if err != nil {
+		log.Printf("Artifact cache error: %v", err)
+	}
+	os.Remove(f.Name())
+}
+
+// evict removes the least recently used archives until the cache fits its
+// size. The caller must hold c.mu.
+func (c *artifactCache) evict() {
+	if c.size <= c.maxSize {
+		return
+	}
+	keys := make([]string, 0, len(c.entries))
+	for key := range c.entries {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return c.entries[keys[i]].used.Before(c.entries[keys[j]].used) })
+	for _, key := range keys {
+		if c.size <= c.maxSize {
+			break
+		}
+		// Open files keep their data until they are closed
+		if err := os.Remove(filepath.Join(c.dir, key)); err != nil && !os.IsNotExist(err) {
+			log.Printf("Artifact cache error: %v", err)
+			continue
+		}
+		c.size -= c.entries[key].size
+		delete(c.entries, key)
+	}
+}
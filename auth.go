@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/text/unicode/norm"
+)
+
+// authRealm is the HTTP Basic authentication realm
+const authRealm = "Files"
+
+var (
+	// users maps user names to passwords loaded from the -auth file
+	users map[string]string
+	// tokens maps names to the API tokens of -token and -token-file; a
+	// token authenticates as the user it is named after
+	tokens map[string]string
+	// authOnlyPatterns are the paths only visible to authenticated users,
+	// split into lowercased components
+	authOnlyPatterns [][]string
+	// uploadOnly turns the server into a drop box (-upload-only): anonymous
+	// visitors may upload files but not list or download any
+	uploadOnly bool
+)
+
+// authEnabled reports whether user accounts, API tokens or an OpenID
+// Connect provider are configured
+func authEnabled() bool {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	return users != nil || accounts != nil || tokens != nil || oidc != nil
+}
+
+// loadUsers reads a users file: one "name:password" per line, where the
+// password is either plain text or "sha256:" followed by its hex digest.
+// Blank lines and lines starting with # are ignored.
+func loadUsers(file string) (map[string]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	loaded := make(map[string]string)
+	lineScanner := bufio.NewScanner(f)
+	for n := 1; lineScanner.Scan(); n++ {
+		line := strings.TrimSpace(lineScanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := addCredential(loaded, line); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", file, n, err)
+		}
+	}
+	if err := lineScanner.Err(); err != nil {
+		return nil, err
+	}
+	return loaded, nil
+}
+
+// parseTokens reads comma-separated name:token pairs (-token) into a map
+func parseTokens(input string) (map[string]string, error) {
+	loaded := make(map[string]string)
+	for _, pair := range strings.Split(input, ",") {
+		if err := addCredential(loaded, strings.TrimSpace(pair)); err != nil {
+			return nil, fmt.Errorf("-token: %v", err)
+		}
+	}
+	return loaded, nil
+}
+
+// addCredential adds one "name:secret" entry to a users or tokens map
+func addCredential(credentials map[string]string, entry string) error {
+	name, secret, ok := strings.Cut(entry, ":")
+	if !ok || name == "" || secret == "" {
+		return errors.New("expected name:password")
+	}
+	// Names double as home directory names
+	if name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("invalid user name %q", name)
+	}
+	credentials[name] = secret
+	return nil
+}
+
+// checkPassword compares a password against its stored form in constant
+// time: plain text, "sha256:<hex>" or a bcrypt hash ("$2b$...")
+func checkPassword(stored, given string) bool {
+	if strings.HasPrefix(stored, "$2") {
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(given)) == nil
+	}
+	if digest, ok := strings.CutPrefix(stored, "sha256:"); ok {
+		sum := sha256.Sum256([]byte(given))
+		given = hex.EncodeToString(sum[:])
+		stored = strings.ToLower(digest)
+	}
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(given)) == 1
+}
+
+// authenticatedUser returns the user whose valid credentials the request
+// carries, or "" for anonymous requests. Browsers carry a session cookie
+// once logged in; scripts send a name and password or an API token as
+// "Authorization: Bearer <token>".
+func authenticatedUser(r *http.Request) string {
+	if !authEnabled() {
+		return ""
+	}
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return tokenUser(strings.TrimSpace(token))
+	}
+	if sessionsEnabled() {
+		if user := sessionUser(r); user != "" {
+			return user
+		}
+	}
+	name, password, ok := r.BasicAuth()
+	if !ok {
+		return ""
+	}
+	return passwordUser(name, password)
+}
+
+// passwordUser returns name if password is the user's password, or ""
+func passwordUser(name, password string) string {
+	if stored, ok := storedPassword(name); !ok || !checkPassword(stored, password) {
+		return ""
+	}
+	// A password alone isn't enough for users with a second factor
+	if totp.isEnrolled(name) {
+		return ""
+	}
+	return name
+}
+
+// loginUser checks the name and password a client of another protocol
+// (FTP, SFTP) logs in with, and returns the user or "". Those protocols
+// have no room for a second factor, so an API token of the user's name
+// works as the password too.
+func loginUser(name, password string) string {
+	if user := passwordUser(name, password); user != "" {
+		return user
+	}
+	if name != "" && tokenUser(password) == name {
+		return name
+	}
+	return ""
+}
+
+// storedPassword returns the stored form of a user's password; the users
+// file comes before the user database
+func storedPassword(name string) (string, bool) {
+	settingsMu.RLock()
+	stored, ok := users[name]
+	settingsMu.RUnlock()
+	if ok {
+		return stored, true
+	}
+	if accounts != nil {
+		if acct, ok := accounts.get(name); ok {
+			return acct.Password, true
+		}
+	}
+	return "", false
+}
+
+// tokenUser returns the name of an API token, or "" if it is not valid.
+// Every token is compared, so the time taken reveals nothing about which
+// one matched.
+func tokenUser(token string) string {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	user := ""
+	for name, stored := range tokens {
+		if checkPassword(stored, token) && user == "" {
+			user = name
+		}
+	}
+	return user
+}
+
+// parseAuthOnlyPatterns adds comma- or newline-separated path patterns to
+// authOnlyPatterns. Each pattern is a path relative to workingDir whose
+// components may use path.Match wildcards; it matches the path itself and
+// everything below it.
+func parseAuthOnlyPatterns(input string) error {
+	for _, pattern := range strings.FieldsFunc(input, func(r rune) bool { return r == ',' || r == '\n' }) {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" || strings.HasPrefix(pattern, "#") {
+			continue
+		}
+		components := splitAuthPath(pattern)
+		if len(components) == 0 {
+			return fmt.Errorf("auth-only pattern %q matches the whole tree", pattern)
+		}
+		for _, component := range components {
+			if _, err := path.Match(component, ""); err != nil {
+				return fmt.Errorf("invalid auth-only pattern %q: %v", pattern, err)
+			}
+		}
+		authOnlyPatterns = append(authOnlyPatterns, components)
+	}
+	return nil
+}
+
+// splitAuthPath cleans a relative path and splits it into components for
+// pattern matching. Components are compared in lowercase NFC so that
+// case-insensitive filesystems and other Unicode forms cannot be used to
+// get around a pattern.
+func splitAuthPath(p string) []string {
+	p = path.Clean("/" + filepath.ToSlash(p))
+	p = strings.ToLower(norm.NFC.String(strings.TrimPrefix(p, "/")))
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
+
+// isAuthOnly reports whether a path relative to workingDir is hidden from
+// anonymous users
+func isAuthOnly(requestedPath string) bool {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	if len(authOnlyPatterns) == 0 {
+		return false
+	}
+	components := splitAuthPath(requestedPath)
+	for _, pattern := range authOnlyPatterns {
+		if matchPathPattern(pattern, components) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPathPattern reports whether a split pattern matches a split path or
+// one of its parents
+func matchPathPattern(pattern, components []string) bool {
+	if len(components) < len(pattern) {
+		return false
+	}
+	for i, component := range pattern {
+		if ok, _ := path.Match(component, components[i]); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// canSee reports whether the request may list or access a path relative
+// to workingDir
+func canSee(r *http.Request, requestedPath string) bool {
+	return canRead(authenticatedUser(r), requestedPath)
+}
+
+// canBrowse reports whether the request may list and download files at
+// all; in a drop box only authenticated users may
+func canBrowse(r *http.Request) bool {
+	return !uploadOnly || authenticatedUser(r) != ""
+}
+
+// dropBoxMiddleware hides a route from visitors of a drop box as if it
+// didn't exist. The root sends them to the upload form instead.
+func dropBoxMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if canBrowse(r) {
+			next(w, r)
+			return
+		}
+		if r.URL.Path == "/" {
+			http.Redirect(w, r, "/upload", http.StatusFound)
+			return
+		}
+		http.NotFound(w, r)
+	}
+}
+
+// loginHandler shows the login form, or sends the browser to the OpenID
+// Connect provider, then returns to the page named by the next parameter.
+// Without either, it asks the browser for credentials.
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	next := localRedirect(r.URL.Query().Get("next"))
+	user := authenticatedUser(r)
+	if user == "" {
+		if name, _, ok := r.BasicAuth(); ok {
+			auditLogf("login-failed client=%s user=%q", clientHost(r), name)
+		}
+	}
+	switch {
+	case user != "":
+		auditLogf("login client=%s user=%q", clientHost(r), user)
+		http.Redirect(w, r, next, http.StatusFound)
+	case oidc != nil && (!passwordLogin() || r.URL.Query().Get("sso") != ""):
+		oidc.login(w, r, next)
+	case passwordLogin():
+		renderLogin(w, r, LoginPage{Next: next, SSO: oidc != nil}, http.StatusOK)
+	default:
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", authRealm))
+		http.Error(w, "Authentication required", http.StatusUnauthorized)
+	}
+}
+
+// localRedirect returns a page to return to after logging in, or "/" if it
+// is not a local path: only local redirects are followed
+func localRedirect(next string) string {
+	if u, err := url.Parse(next); err != nil || next == "" || u.Host != "" || u.Scheme != "" || !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
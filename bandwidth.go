@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// bandwidthChunk is the most a throttled read asks for at once, which
+// keeps the bytes sent between two waits small
+const bandwidthChunk = 64 << 10
+
+// weekdayNames are the day names of schedule rules, in time.Weekday order
+var weekdayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// bandwidthRule caps the rate of downloads at certain times: from start to
+// end (minutes since midnight, wrapping past midnight if end < start) on
+// the days set in days
+type bandwidthRule struct {
+	days       [7]bool
+	start, end int
+	// rate is in bytes per second; 0 is unlimited
+	rate int64
+}
+
+// matches reports whether a rule applies at a point in time
+func (rule bandwidthRule) matches(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	if rule.start <= rule.end {
+		return rule.days[day] && minute >= rule.start && minute < rule.end
+	}
+	// A window past midnight belongs to the day it starts on
+	if minute >= rule.start {
+		return rule.days[day]
+	}
+	return minute < rule.end && rule.days[(day+6)%7]
+}
+
+// bandwidthLimiter shares a rate among all downloads. Every read books the
+// time its bytes take at the current rate and waits until the booked time
+// catches up with the clock. Each download books its own bytes against
+// perTransfer as well.
+type bandwidthLimiter struct {
+	mu    sync.Mutex
+	rules []bandwidthRule
+	next  time.Time
+	// max caps the rate of the schedule at all times (-max-bandwidth), and
+	// perTransfer the rate of every single download (-max-per-conn); 0 is
+	// unlimited
+	max, perTransfer int64
+}
+
+var bandwidth = &bandwidthLimiter{}
+
+// parseBandwidthRules adds comma- or newline-separated schedule rules to
+// the download limiter. A rule is "[days] HH:MM-HH:MM=rate", where days is
+// a day ("sat") or range ("mon-fri") and rate a size per second ("5M") or
+// 0 for unlimited. The first rule matching the local time applies; without
+// one, downloads are unlimited.
+func parseBandwidthRules(input string) error {
+	for _, rule := range strings.FieldsFunc(input, func(r rune) bool { return r == ',' || r == '\n' }) {
+		rule = strings.TrimSpace(rule)
+		if rule == "" || strings.HasPrefix(rule, "#") {
+			continue
+		}
+		parsed, err := parseBandwidthRule(rule)
+		if err != nil {
+			return err
+		}
+		bandwidth.rules = append(bandwidth.rules, parsed)
+	}
+	return nil
+}
+
+// parseBandwidthRule parses one schedule rule
+func parseBandwidthRule(rule string) (bandwidthRule, error) {
+	var parsed bandwidthRule
+	window, rate, ok := strings.Cut(rule, "=")
+	if !ok {
+		return parsed, fmt.Errorf("bandwidth rule %q: expected [days] HH:MM-HH:MM=rate", rule)
+	}
+	fields := strings.Fields(window)
+	switch len(fields) {
+	case 1:
+		for i := range parsed.days {
+			parsed.days[i] = true
+		}
+	case 2:
+		first, last, _ := strings.Cut(strings.ToLower(fields[0]), "-")
+		if last == "" {
+			last = first
+		}
+		from, to := weekdayIndex(first), weekdayIndex(last)
+		if from < 0 || to < 0 {
+			return parsed, fmt.Errorf("bandwidth rule %q: unknown day in %q", rule, fields[0])
+		}
+		for day := from; ; day = (day + 1) % 7 {
+			parsed.days[day] = true
+			if day == to {
+				break
+			}
+		}
+	default:
+		return parsed, fmt.Errorf("bandwidth rule %q: expected [days] HH:MM-HH:MM=rate", rule)
+	}
+
+	start, end, _ := strings.Cut(fields[len(fields)-1], "-")
+	var err error
+	if parsed.start, err = parseClock(start); err != nil {
+		return parsed, fmt.Errorf("bandwidth rule %q: %v", rule, err)
+	}
+	if parsed.end, err = parseClock(end); err != nil {
+		return parsed, fmt.Errorf("bandwidth rule %q: %v", rule, err)
+	}
+	if parsed.start == parsed.end {
+		return parsed, fmt.Errorf("bandwidth rule %q: empty time window", rule)
+	}
+	if parsed.rate, err = parseSize(rate); err != nil {
+		return parsed, fmt.Errorf("bandwidth rule %q: %v", rule, err)
+	}
+	return parsed, nil
+}
+
+// weekdayIndex returns the time.Weekday of a day name, or -1
+func weekdayIndex(name string) int {
+	for i, day := range weekdayNames {
+		if day == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// parseClock parses a time of day, HH:MM up to 24:00, into minutes since
+// midnight
+func parseClock(s string) (int, error) {
+	var hour, minute int
+	if _, err := fmt.Sscanf(s, "%d:%d", &hour, &minute); err != nil || hour < 0 || minute < 0 || minute > 59 || hour*60+minute > 24*60 {
+		return 0, fmt.Errorf("invalid time %q (expected HH:MM)", s)
+	}
+	return hour*60 + minute, nil
+}
+
+// rate returns the download rate in effect at a point in time, 0 for
+// unlimited
+func (b *bandwidthLimiter) rate(t time.Time) int64 {
+	var rate int64
+	for _, rule := range b.rules {
+		if rule.matches(t) {
+			rate = rule.rate
+			break
+		}
+	}
+	if b.max > 0 && (rate == 0 || rate > b.max) {
+		rate = b.max
+	}
+	return rate
+}
+
+// limited reports whether downloads are throttled at all
+func (b *bandwidthLimiter) limited() bool {
+	return len(b.rules) > 0 || b.max > 0 || b.perTransfer > 0
+}
+
+// describeRate formats a rate of a schedule rule for people
+func describeRate(rate int64) string {
+	if rate == 0 {
+		return "unlimited"
+	}
+	return formatRate(float64(rate))
+}
+
+// limit returns how many bytes the next read may ask for
+func (b *bandwidthLimiter) limit(n int) int {
+	if !b.limited() || n <= bandwidthChunk {
+		return n
+	}
+	return bandwidthChunk
+}
+
+// wait books n bytes sent by a download, whose own booked time is in own,
+// and sleeps as long as the current rate and the per-download rate ask for.
+// own may be nil without a per-download rate.
+func (b *bandwidthLimiter) wait(n int, own *time.Time) {
+	if !b.limited() || n <= 0 {
+		return
+	}
+	now := time.Now()
+	until := now
+	if rate := b.rate(now); rate > 0 {
+		b.mu.Lock()
+		b.next = bookBytes(b.next, now, n, rate)
+		until = b.next
+		b.mu.Unlock()
+	}
+	if b.perTransfer > 0 {
+		*own = bookBytes(*own, now, n, b.perTransfer)
+		if own.After(until) {
+			until = *own
+		}
+	}
+	time.Sleep(until.Sub(now))
+}
+
+// bookBytes returns the booked time next after adding the time n bytes take
+// at rate
+func bookBytes(next, now time.Time, n int, rate int64) time.Time {
+	// Idle time isn't saved up for a later burst
+	if next.Before(now) {
+		next = now
+	}
+	return next.Add(time.Duration(float64(n) / float64(rate) * float64(time.Second)))
+}
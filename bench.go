@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// benchResult is the outcome of one request of "files bench"
+type benchResult struct {
+	bytes int64
+	// firstByte is the time to the response headers, latency the time to
+	// the end of the body
+	firstByte, latency time.Duration
+	err                error
+}
+
+// runBench drives concurrent ranged downloads or uploads against a server
+// and reports throughput and latency percentiles ("files bench")
+func runBench(args []string) {
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	concurrencyFlag := flags.Int("c", 8, "Number of requests in flight")
+	durationFlag := flags.Duration("d", 10*time.Second, "How long to run")
+	requestsFlag := flags.Int("n", 0, "Stop after this many requests instead (default: run for -d)")
+	rangeFlag := flags.String("range", "1M", "Bytes per ranged download at a random offset; 0 downloads the whole file")
+	uploadFlag := flags.String("upload", "", "Upload bodies of this size instead, e.g. 8M; the URL is an /upload/ directory")
+	userFlag := flags.String("u", "", "name:password to log in with")
+	tokenFlag := flags.String("token", "", "API token to send as 'Authorization: Bearer <token>'")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s bench [options] <URL>\n\n", os.Args[0])
+		fmt.Fprintf(flags.Output(), "Downloads ranges of a file (e.g. http://127.0.0.1:8080/download/big.iso), or with -upload\nputs files into a directory (e.g. http://127.0.0.1:8080/upload/bench), and reports\nthroughput and latency.\n\nOptions:\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 || *concurrencyFlag < 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	target := flags.Arg(0)
+
+	rangeSize, err := parseSize(*rangeFlag)
+	if err != nil {
+		log.Fatal("bench: ", err)
+	}
+	var uploadSize int64
+	if *uploadFlag != "" {
+		if uploadSize, err = parseSize(*uploadFlag); err != nil {
+			log.Fatal("bench: ", err)
+		}
+	}
+
+	authorize := func(req *http.Request) {
+		if name, password, ok := strings.Cut(*userFlag, ":"); ok {
+			req.SetBasicAuth(name, password)
+		}
+		if *tokenFlag != "" {
+			req.Header.Set("Authorization", "Bearer "+*tokenFlag)
+		}
+	}
+	client := &http.Client{
+		Transport: &http.Transport{MaxIdleConnsPerHost: *concurrencyFlag, DisableCompression: true},
+	}
+
+	// Downloads need the size of the file to pick ranges from
+	var fileSize int64
+	if uploadSize == 0 {
+		req, err := http.NewRequest(http.MethodHead, target, nil)
+		if err != nil {
+			log.Fatal("bench: ", err)
+		}
+		authorize(req)
+		resp, err := client.Do(req)
+		if err != nil {
+			log.Fatal("bench: ", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			log.Fatalf("bench: %s: %s", target, resp.Status)
+		}
+		fileSize = resp.ContentLength
+		if rangeSize > 0 && (fileSize <= 0 || resp.Header.Get("Accept-Ranges") != "bytes") {
+			log.Fatalf("bench: %s does not support ranges; use -range 0", target)
+		}
+		if rangeSize > fileSize {
+			rangeSize = fileSize
+		}
+	}
+
+	// Every worker uploads the same random body to a file of its own
+	var body []byte
+	if uploadSize > 0 {
+		body = make([]byte, uploadSize)
+		rand.New(rand.NewSource(time.Now().UnixNano())).Read(body)
+	}
+
+	request := func(worker int, rng *rand.Rand) benchResult {
+		var req *http.Request
+		var err error
+		if uploadSize > 0 {
+			fileURL := strings.TrimSuffix(target, "/") + "/bench-" + strconv.Itoa(worker) + ".bin"
+			req, err = http.NewRequest(http.MethodPut, fileURL, bytes.NewReader(body))
+		} else {
+			req, err = http.NewRequest(http.MethodGet, target, nil)
+			if err == nil && rangeSize > 0 {
+				start := rng.Int63n(fileSize - rangeSize + 1)
+				req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, start+rangeSize-1))
+			}
+		}
+		if err != nil {
+			return benchResult{err: err}
+		}
+		authorize(req)
+
+		started := time.Now()
+		resp, err := client.Do(req)
+		if err != nil {
+			return benchResult{err: err}
+		}
+		result := benchResult{firstByte: time.Since(started)}
+		n, err := io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		result.latency = time.Since(started)
+		result.err = err
+		if uploadSize > 0 {
+			result.bytes = uploadSize
+		} else {
+			result.bytes = n
+		}
+		if err == nil && resp.StatusCode >= 400 {
+			result.err = errors.New(resp.Status)
+		}
+		return result
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	stop := make(chan struct{})
+	var stopOnce sync.Once
+	finish := func() { stopOnce.Do(func() { close(stop) }) }
+	var deadline <-chan time.Time
+	if *requestsFlag == 0 {
+		deadline = time.After(*durationFlag)
+	}
+	go func() {
+		select {
+		case <-interrupt:
+		case <-deadline:
+		}
+		finish()
+	}()
+
+	var (
+		mu       sync.Mutex
+		results  []benchResult
+		issued   atomic.Int64
+		received atomic.Int64
+		wg       sync.WaitGroup
+	)
+	started := time.Now()
+	for i := 0; i < *concurrencyFlag; i++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(time.Now().UnixNano() + int64(worker)))
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if *requestsFlag > 0 && issued.Add(1) > int64(*requestsFlag) {
+					finish()
+					return
+				}
+				result := request(worker, rng)
+				if result.err == nil {
+					received.Add(result.bytes)
+				}
+				mu.Lock()
+				results = append(results, result)
+				mu.Unlock()
+			}
+		}(i)
+	}
+
+	// Show how it goes while it runs
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		case <-ticker.C:
+			elapsed := time.Since(started)
+			mu.Lock()
+			count := len(results)
+			mu.Unlock()
+			fmt.Fprintf(os.Stderr, "\r%5.0fs %8d requests %12s/s", elapsed.Seconds(), count, formatSize(int64(float64(received.Load())/elapsed.Seconds())))
+		}
+	}
+	fmt.Fprintln(os.Stderr)
+	printBenchReport(results, time.Since(started))
+}
+
+// printBenchReport summarizes the results of a benchmark
+func printBenchReport(results []benchResult, elapsed time.Duration) {
+	var total int64
+	var latencies, firstBytes []time.Duration
+	failures := make(map[string]int)
+	for _, result := range results {
+		if result.err != nil {
+			failures[result.err.Error()]++
+			continue
+		}
+		total += result.bytes
+		latencies = append(latencies, result.latency)
+		firstBytes = append(firstBytes, result.firstByte)
+	}
+
+	seconds := elapsed.Seconds()
+	fmt.Printf("Requests:    %d in %s (%.1f/s), %d failed\n", len(results), elapsed.Round(time.Millisecond), float64(len(results))/seconds, len(results)-len(latencies))
+	fmt.Printf("Transferred: %s (%s/s)\n", formatSize(total), formatSize(int64(float64(total)/seconds)))
+	if len(latencies) > 0 {
+		fmt.Printf("%-12s %10s %10s %10s %10s %10s\n", "", "p50", "p90", "p99", "max", "mean")
+		for _, row := range []struct {
+			name   string
+			values []time.Duration
+		}{{"Latency:", latencies}, {"First byte:", firstBytes}} {
+			sort.Slice(row.values, func(i, j int) bool { return row.values[i] < row.values[j] })
+			var sum time.Duration
+			for _, value := range row.values {
+				sum += value
+			}
+			fmt.Printf("%-12s %10s %10s %10s %10s %10s\n", row.name,
+				benchPercentile(row.values, 50), benchPercentile(row.values, 90), benchPercentile(row.values, 99),
+				row.values[len(row.values)-1].Round(time.Microsecond), (sum / time.Duration(len(row.values))).Round(time.Microsecond))
+		}
+	}
+
+	messages := make([]string, 0, len(failures))
+	for message := range failures {
+		messages = append(messages, message)
+	}
+	sort.Strings(messages)
+	for _, message := range messages {
+		fmt.Printf("Failed:      %dx %s\n", failures[message], message)
+	}
+	if len(latencies) == 0 {
+		os.Exit(1)
+	}
+}
+
+// benchPercentile returns the p-th percentile of sorted durations
+func benchPercentile(sorted []time.Duration, p int) time.Duration {
+	i := (len(sorted)*p+99)/100 - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i].Round(time.Microsecond)
+}
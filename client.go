@@ -0,0 +1,613 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// transferSaveEvery is how much of a download is written between updates
+// of the transfer journal
+const transferSaveEvery = 8 << 20
+
+// transferRetries is how often a transfer is retried after a network
+// error before the command gives up; running it again resumes it anyway
+const transferRetries = 5
+
+// transferEntry is an unfinished "files get" or "files put" in the local
+// transfer journal. Offset bytes were transferred and hash to PrefixSHA256,
+// which is checked on both ends before a transfer resumes.
+type transferEntry struct {
+	Kind  string `json:"kind"`
+	URL   string `json:"url"`
+	Local string `json:"local"`
+	// Size and ETag describe the remote file of a download; Size and
+	// ModTime the local file of an upload
+	Size     int64     `json:"size"`
+	ETag     string    `json:"etag,omitempty"`
+	ModTime  time.Time `json:"modTime"`
+	UploadID string    `json:"uploadId,omitempty"`
+
+	Offset       int64     `json:"offset"`
+	PrefixSHA256 string    `json:"prefixSha256"`
+	Updated      time.Time `json:"updated"`
+}
+
+// transferJournal is the file unfinished transfers are kept in
+type transferJournal struct {
+	path string
+}
+
+// defaultTransferJournal returns where the journal is kept unless -journal
+// says otherwise
+func defaultTransferJournal() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "files", "transfers.json")
+}
+
+// load reads all entries; a missing journal has none
+func (j transferJournal) load() (map[string]transferEntry, error) {
+	entries := make(map[string]transferEntry)
+	data, err := os.ReadFile(j.path)
+	if os.IsNotExist(err) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("%s: %v", j.path, err)
+	}
+	return entries, nil
+}
+
+// get returns the entry of a transfer, if there is one
+func (j transferJournal) get(key string) (transferEntry, bool) {
+	entries, err := j.load()
+	if err != nil {
+		log.Printf("Ignoring the transfer journal: %v", err)
+		return transferEntry{}, false
+	}
+	entry, ok := entries[key]
+	return entry, ok
+}
+
+// put stores the entry of a transfer, or drops it when entry is nil.
+// The journal is read again first, so commands running side by side keep
+// each other's entries.
+func (j transferJournal) put(key string, entry *transferEntry) error {
+	entries, err := j.load()
+	if err != nil {
+		entries = make(map[string]transferEntry)
+	}
+	if entry == nil {
+		if _, ok := entries[key]; !ok {
+			return nil
+		}
+		delete(entries, key)
+	} else {
+		entry.Updated = time.Now().UTC()
+		entries[key] = *entry
+	}
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(j.path), 0700); err != nil {
+		return err
+	}
+	tmp := j.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, j.path)
+}
+
+// transferClient holds what "files get" and "files put" share
+type transferClient struct {
+	base      *url.URL
+	remote    string
+	client    *http.Client
+	authorize func(*http.Request)
+	journal   transferJournal
+}
+
+// newTransferClient parses the common flags and the URL of the remote
+// file: the server's address followed by the file's path
+func newTransferClient(flags *flag.FlagSet, rawURL string, userFlag, tokenFlag, journalFlag *string) *transferClient {
+	base, err := url.Parse(rawURL)
+	if err != nil || (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" {
+		log.Fatalf("%s: invalid URL %q", flags.Name(), rawURL)
+	}
+	remote := strings.Trim(base.Path, "/")
+	prefix := ""
+	// Download and upload links work as well, also below a -prefix
+	for _, route := range []string{"download/", "upload/"} {
+		if before, after, found := strings.Cut("/"+remote, "/"+route); found {
+			prefix, remote = before, after
+			break
+		}
+	}
+	base.Path, base.RawPath, base.RawQuery, base.Fragment = prefix, "", "", ""
+	return &transferClient{
+		base:    base,
+		remote:  remote,
+		client:  &http.Client{},
+		journal: transferJournal{path: *journalFlag},
+		authorize: func(req *http.Request) {
+			if name, password, ok := strings.Cut(*userFlag, ":"); ok {
+				req.SetBasicAuth(name, password)
+			}
+			if *tokenFlag != "" {
+				req.Header.Set("Authorization", "Bearer "+*tokenFlag)
+			}
+		},
+	}
+}
+
+// url returns the URL of the remote file below a route of the server
+func (c *transferClient) url(route string) string {
+	u := *c.base
+	u.Path += route + "/" + c.remote
+	return u.String()
+}
+
+// do sends a request for the remote file
+func (c *transferClient) do(ctx context.Context, method, route string, body io.Reader, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.url(route), body)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	c.authorize(req)
+	return c.client.Do(req)
+}
+
+// resumeInfo asks the server about the remote file and the SHA-256 of its
+// first prefix bytes
+func (c *transferClient) resumeInfo(ctx context.Context, prefix int64) (ResumeInfo, error) {
+	var info ResumeInfo
+	u := c.url("/api/resume") + "?prefix=" + strconv.FormatInt(prefix, 10)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return info, err
+	}
+	c.authorize(req)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return info, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return info, responseError(resp)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&info)
+	return info, err
+}
+
+// statusError is a response that ended a transfer
+type statusError struct {
+	status  int
+	message string
+}
+
+func (e *statusError) Error() string {
+	if e.message == "" {
+		return http.StatusText(e.status)
+	}
+	return fmt.Sprintf("%s: %s", http.StatusText(e.status), e.message)
+}
+
+// responseError turns an unexpected response into an error
+func responseError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	var apiError APIError
+	if json.Unmarshal(body, &apiError) == nil && apiError.Error.Message != "" {
+		return &statusError{resp.StatusCode, apiError.Error.Message}
+	}
+	return &statusError{resp.StatusCode, strings.TrimSpace(string(body))}
+}
+
+// retryable reports whether a transfer may be tried again after err:
+// network errors, but not answers of the server or an interrupt
+func retryable(ctx context.Context, err error) bool {
+	var status *statusError
+	return ctx.Err() == nil && !errors.As(err, &status)
+}
+
+// hashPrefix returns a SHA-256 of the first n bytes of a file, to be
+// continued with what follows them
+func hashPrefix(name string, n int64) (hash.Hash, error) {
+	h := sha256.New()
+	if n == 0 {
+		return h, nil
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := io.CopyN(h, f, n); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// transferUsage sets the help of "files get" and "files put"
+func transferUsage(flags *flag.FlagSet, arguments, description string) {
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s %s [options] %s\n\n%s\n\nOptions:\n", os.Args[0], flags.Name(), arguments, description)
+		flags.PrintDefaults()
+	}
+}
+
+// interruptible returns a context canceled by Ctrl+C, so a transfer can
+// save where it stopped
+func interruptible() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+}
+
+// runGet downloads a file ("files get"), resuming an interrupted download
+// of the same URL to the same place
+func runGet(args []string) {
+	flags := flag.NewFlagSet("get", flag.ExitOnError)
+	userFlag := flags.String("u", "", "name:password to log in with")
+	tokenFlag := flags.String("token", "", "API token to send as 'Authorization: Bearer <token>'")
+	journalFlag := flags.String("journal", defaultTransferJournal(), "File unfinished transfers are recorded in")
+	restartFlag := flags.Bool("restart", false, "Start over instead of resuming")
+	transferUsage(flags, "<URL> [local path]", "Downloads a file (e.g. http://nas:8080/videos/a.mkv) into the current\ndirectory or the given path. An interrupted download is resumed by\nrunning the same command again.")
+	flags.Parse(args)
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	c := newTransferClient(flags, flags.Arg(0), userFlag, tokenFlag, journalFlag)
+	if c.remote == "" {
+		log.Fatal("get: the URL names no file")
+	}
+	local := path.Base(c.remote)
+	if flags.NArg() == 2 {
+		local = flags.Arg(1)
+		if info, err := os.Stat(local); err == nil && info.IsDir() {
+			local = filepath.Join(local, path.Base(c.remote))
+		}
+	}
+	local, err := filepath.Abs(local)
+	if err != nil {
+		log.Fatal("get: ", err)
+	}
+	key := "get " + c.url("") + " " + local
+	if *restartFlag {
+		c.journal.put(key, nil)
+	}
+
+	ctx, stop := interruptible()
+	defer stop()
+	start := time.Now()
+	var received, resumed int64
+	for attempt := 0; ; attempt++ {
+		var n int64
+		n, resumed, err = c.get(ctx, key, local)
+		received += n
+		if err == nil || attempt == transferRetries || !retryable(ctx, err) {
+			break
+		}
+		log.Printf("get: %v; retrying", err)
+		time.Sleep(time.Duration(attempt+1) * time.Second)
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			err = errors.New("interrupted")
+		}
+		log.Fatalf("get: %v%s", err, resumeHint(c.journal, key))
+	}
+	log.Printf("Downloaded %s to %s: %s in %s%s", c.remote, local, formatSize(received), time.Since(start).Round(time.Millisecond), resumedNote(resumed))
+}
+
+// get runs one attempt of a download. It returns the bytes received and
+// where the download resumed.
+func (c *transferClient) get(ctx context.Context, key, local string) (int64, int64, error) {
+	part := local + ".part"
+	var offset int64
+	h := sha256.New()
+	if entry, ok := c.journal.get(key); ok {
+		// The partial file must still hold what the journal recorded, and
+		// the server's file must still begin with it
+		if partial, err := hashPrefix(part, entry.Offset); err == nil && hex.EncodeToString(partial.Sum(nil)) == entry.PrefixSHA256 {
+			info, err := c.resumeInfo(ctx, entry.Offset)
+			var status *statusError
+			switch {
+			case err == nil && info.PrefixSHA256 == entry.PrefixSHA256:
+				offset, h = entry.Offset, partial
+			case err != nil && !(errors.As(err, &status) && status.status == http.StatusRequestedRangeNotSatisfiable):
+				return 0, 0, err
+			default:
+				log.Printf("%s changed on the server; starting over", c.remote)
+			}
+		} else {
+			log.Printf("%s no longer matches the transfer journal; starting over", part)
+		}
+	}
+	resumed := offset
+
+	header := http.Header{}
+	if offset > 0 {
+		// Open-ended, since the server refuses ranges past the end
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := c.do(ctx, http.MethodGet, "/download", nil, header)
+	if err != nil {
+		return 0, resumed, err
+	}
+	defer resp.Body.Close()
+	entry := transferEntry{Kind: "get", URL: c.url(""), Local: local, ETag: resp.Header.Get("ETag")}
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		offset, resumed, h = 0, 0, sha256.New()
+		entry.Size = resp.ContentLength
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		_, _, total, err := parseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil {
+			return 0, resumed, err
+		}
+		entry.Size = total
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		// The whole file had arrived already
+		if resp.Header.Get("Content-Range") != fmt.Sprintf("bytes */%d", offset) {
+			return 0, resumed, responseError(resp)
+		}
+		entry.Size = offset
+		resp.Body = io.NopCloser(strings.NewReader(""))
+	default:
+		return 0, resumed, responseError(resp)
+	}
+	if offset > 0 {
+		log.Printf("Resuming %s at %s of %s", c.remote, formatSize(offset), formatSize(entry.Size))
+	}
+
+	f, err := os.OpenFile(part, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return 0, resumed, err
+	}
+	if err := f.Truncate(offset); err != nil {
+		f.Close()
+		return 0, resumed, err
+	}
+	save := func() {
+		entry.Offset, entry.PrefixSHA256 = offset, hex.EncodeToString(h.Sum(nil))
+		if err := c.journal.put(key, &entry); err != nil {
+			log.Printf("Error saving the transfer journal: %v", err)
+		}
+	}
+	save()
+	var received int64
+	buf := make([]byte, 256<<10)
+	for err == nil {
+		var n int
+		n, err = io.ReadFull(resp.Body, buf)
+		if n > 0 {
+			if _, werr := f.WriteAt(buf[:n], offset); werr != nil {
+				err = werr
+				break
+			}
+			h.Write(buf[:n])
+			offset += int64(n)
+			received += int64(n)
+			if received%transferSaveEvery < int64(n) {
+				save()
+			}
+		}
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+		if entry.Size >= 0 && offset != entry.Size {
+			err = io.ErrUnexpectedEOF
+		}
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		save()
+		return received, resumed, err
+	}
+	if err := os.Rename(part, local); err != nil {
+		return received, resumed, err
+	}
+	return received, resumed, c.journal.put(key, nil)
+}
+
+// runPut uploads a file ("files put") in chunks, resuming an interrupted
+// upload of the same file to the same URL
+func runPut(args []string) {
+	flags := flag.NewFlagSet("put", flag.ExitOnError)
+	userFlag := flags.String("u", "", "name:password to log in with")
+	tokenFlag := flags.String("token", "", "API token to send as 'Authorization: Bearer <token>'")
+	journalFlag := flags.String("journal", defaultTransferJournal(), "File unfinished transfers are recorded in")
+	restartFlag := flags.Bool("restart", false, "Start over instead of resuming")
+	chunkFlag := flags.String("chunk", "8M", "Size of the chunks the file is sent in")
+	transferUsage(flags, "<local file> <URL>", "Uploads a file to a path on a server (e.g. http://nas:8080/videos/a.mkv),\nor into a folder with a URL ending in /. An interrupted upload is resumed\nby running the same command again.")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	chunkSize, err := parseSize(*chunkFlag)
+	if err != nil || chunkSize <= 0 {
+		log.Fatalf("put: invalid -chunk %q", *chunkFlag)
+	}
+	local, err := filepath.Abs(flags.Arg(0))
+	if err != nil {
+		log.Fatal("put: ", err)
+	}
+	c := newTransferClient(flags, flags.Arg(1), userFlag, tokenFlag, journalFlag)
+	if c.remote == "" || strings.HasSuffix(flags.Arg(1), "/") {
+		c.remote = path.Join(c.remote, filepath.Base(local))
+	}
+	key := "put " + local + " " + c.url("")
+	if *restartFlag {
+		c.journal.put(key, nil)
+	}
+
+	ctx, stop := interruptible()
+	defer stop()
+	start := time.Now()
+	var sent, resumed int64
+	for attempt := 0; ; attempt++ {
+		var n int64
+		n, resumed, err = c.put(ctx, key, local, chunkSize)
+		sent += n
+		if err == nil || attempt == transferRetries || !retryable(ctx, err) {
+			break
+		}
+		log.Printf("put: %v; retrying", err)
+		time.Sleep(time.Duration(attempt+1) * time.Second)
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			err = errors.New("interrupted")
+		}
+		log.Fatalf("put: %v%s", err, resumeHint(c.journal, key))
+	}
+	log.Printf("Uploaded %s to %s: %s in %s%s", local, c.remote, formatSize(sent), time.Since(start).Round(time.Millisecond), resumedNote(resumed))
+}
+
+// put runs one attempt of an upload. It returns the bytes sent and where
+// the upload resumed.
+func (c *transferClient) put(ctx context.Context, key, local string, chunkSize int64) (int64, int64, error) {
+	f, err := os.Open(local)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	if info.IsDir() {
+		return 0, 0, &statusError{http.StatusBadRequest, local + " is a folder"}
+	}
+	size := info.Size()
+	if size == 0 {
+		// Nothing to resume
+		resp, err := c.do(ctx, http.MethodPut, "/upload", http.NoBody, nil)
+		if err != nil {
+			return 0, 0, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+			return 0, 0, responseError(resp)
+		}
+		return 0, 0, c.journal.put(key, nil)
+	}
+
+	// An upload is resumed if the file still begins with what was sent;
+	// the server keeps the partial file under the upload ID
+	entry, ok := c.journal.get(key)
+	var offset int64
+	h := sha256.New()
+	if ok && entry.Size == size && entry.ModTime.Equal(info.ModTime()) {
+		if sent, err := hashPrefix(local, entry.Offset); err == nil && hex.EncodeToString(sent.Sum(nil)) == entry.PrefixSHA256 {
+			offset, h = entry.Offset, sent
+		}
+	}
+	if offset == 0 || entry.UploadID == "" {
+		id := make([]byte, 16)
+		if _, err := rand.Read(id); err != nil {
+			return 0, 0, err
+		}
+		entry = transferEntry{Kind: "put", URL: c.url(""), Local: local, Size: size, ModTime: info.ModTime(), UploadID: hex.EncodeToString(id)}
+		offset = 0
+	} else {
+		log.Printf("Resuming %s at %s of %s", c.remote, formatSize(offset), formatSize(size))
+	}
+	resumed := offset
+
+	var sent int64
+	buf := make([]byte, min(chunkSize, size))
+	for {
+		end := min(offset+int64(len(buf)), size)
+		chunk := buf[:end-offset]
+		if _, err := f.ReadAt(chunk, offset); err != nil {
+			return sent, resumed, err
+		}
+		header := http.Header{}
+		header.Set("X-Upload-ID", entry.UploadID)
+		header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, end-1, size))
+		resp, err := c.do(ctx, http.MethodPut, "/upload", bytes.NewReader(chunk), header)
+		if err != nil {
+			return sent, resumed, err
+		}
+		switch resp.StatusCode {
+		case http.StatusOK, http.StatusCreated:
+			resp.Body.Close()
+			return sent + int64(len(chunk)), resumed, c.journal.put(key, nil)
+		case http.StatusAccepted:
+			resp.Body.Close()
+			h.Write(chunk)
+			offset = end
+			sent += int64(len(chunk))
+		case http.StatusConflict:
+			// The server has a different part of the file, e.g. some of
+			// a chunk sent before the connection dropped
+			err := responseError(resp)
+			resp.Body.Close()
+			next, parseErr := strconv.ParseInt(resp.Header.Get("Upload-Offset"), 10, 64)
+			if parseErr != nil || next < 0 || next > size || next == offset {
+				return sent, resumed, err
+			}
+			if h, err = hashPrefix(local, next); err != nil {
+				return sent, resumed, err
+			}
+			offset = next
+		default:
+			err := responseError(resp)
+			resp.Body.Close()
+			return sent, resumed, err
+		}
+		entry.Offset, entry.PrefixSHA256 = offset, hex.EncodeToString(h.Sum(nil))
+		if err := c.journal.put(key, &entry); err != nil {
+			log.Printf("Error saving the transfer journal: %v", err)
+		}
+	}
+}
+
+// resumeHint tells how to go on with a transfer left in the journal
+func resumeHint(journal transferJournal, key string) string {
+	if _, ok := journal.get(key); !ok {
+		return ""
+	}
+	return " (run the same command again to resume)"
+}
+
+// resumedNote tells where a transfer was resumed, if it was
+func resumedNote(offset int64) string {
+	if offset == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" (resumed at %s)", formatSize(offset))
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"compress/gzip"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+var (
+	// compressMinSize is the smallest response body worth compressing
+	compressMinSize int64 = 1024
+	// compressExcludeTypes are media types that are sent uncompressed;
+	// "type/*" entries match a whole top-level type
+	compressExcludeTypes = parseList("image/*,video/*,audio/*,font/woff,font/woff2,application/octet-stream,application/pdf,application/zip,application/gzip,application/x-gzip,application/x-bzip2,application/x-xz,application/x-7z-compressed,application/vnd.rar,application/zstd")
+	// compressExcludePaths are URL paths (path.Match patterns) whose
+	// responses, including everything below them, are sent uncompressed
+	compressExcludePaths []string
+)
+
+// parseList splits a comma-separated flag value, dropping empty entries
+func parseList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// acceptsGzip reports whether the client accepts gzip-encoded responses
+func acceptsGzip(r *http.Request) bool {
+	for _, coding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(coding, ";")
+		if strings.TrimSpace(name) != "gzip" {
+			continue
+		}
+		q := strings.ReplaceAll(params, " ", "")
+		return q != "q=0" && q != "q=0.0" && q != "q=0.00" && q != "q=0.000"
+	}
+	return false
+}
+
+// compressibleType reports whether a Content-Type is worth compressing
+func compressibleType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, excluded := range compressExcludeTypes {
+		if prefix, ok := strings.CutSuffix(excluded, "/*"); ok {
+			if strings.HasPrefix(mediaType, prefix+"/") {
+				return false
+			}
+		} else if mediaType == excluded {
+			return false
+		}
+	}
+	return true
+}
+
+// compressExcludedPath reports whether a URL path is opted out of compression
+func compressExcludedPath(urlPath string) bool {
+	for _, pattern := range compressExcludePaths {
+		pattern = "/" + strings.Trim(pattern, "/")
+		if ok, _ := path.Match(pattern, urlPath); ok || urlPath == pattern || strings.HasPrefix(urlPath, pattern+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// compressMiddleware gzips responses for clients that accept it. Range
+// responses, HEAD requests, excluded types and paths, and bodies smaller
+// than compressMinSize are passed through unchanged.
+func compressMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead || r.Header.Get("Range") != "" || compressExcludedPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressWriter{ResponseWriter: w, acceptsGzip: acceptsGzip(r)}
+		defer cw.Close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// compressWriter holds back the start of a response until it knows
+// whether the body reaches compressMinSize, then either compresses it or
+// sends it as is
+type compressWriter struct {
+	http.ResponseWriter
+	acceptsGzip bool
+	status      int
+	buf         []byte
+	decided     bool
+	gz          *gzip.Writer
+}
+
+func (cw *compressWriter) WriteHeader(code int) {
+	if cw.status != 0 {
+		return
+	}
+	cw.status = code
+	// Informational, bodiless and partial responses are never compressed
+	if code < 200 || code == http.StatusNoContent || code == http.StatusNotModified || code == http.StatusPartialContent {
+		cw.decide(false)
+	}
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if cw.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.decided {
+		if cw.gz != nil {
+			return cw.gz.Write(b)
+		}
+		return cw.ResponseWriter.Write(b)
+	}
+
+	cw.buf = append(cw.buf, b...)
+	if int64(len(cw.buf)) >= compressMinSize {
+		if err := cw.decide(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// decide sends the headers and buffered data, compressing the rest of the
+// response if large is set and the response qualifies
+func (cw *compressWriter) decide(large bool) error {
+	if cw.decided {
+		return nil
+	}
+	cw.decided = true
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+
+	header := cw.Header()
+	compress := false
+	if large && cw.status == http.StatusOK && header.Get("Content-Encoding") == "" && header.Get("Content-Range") == "" {
+		contentType := header.Get("Content-Type")
+		if contentType == "" {
+			contentType = http.DetectContentType(cw.buf)
+			header.Set("Content-Type", contentType)
+		}
+		if compressibleType(contentType) {
+			header.Add("Vary", "Accept-Encoding")
+			compress = cw.acceptsGzip
+		}
+	}
+
+	if compress {
+		// Ranges would refer to the uncompressed body, so resuming is
+		// only offered for identity responses
+		header.Del("Content-Length")
+		header.Del("Accept-Ranges")
+		header.Set("Content-Encoding", "gzip")
+		cw.ResponseWriter.WriteHeader(cw.status)
+		cw.gz = gzip.NewWriter(cw.ResponseWriter)
+		_, err := cw.gz.Write(cw.buf)
+		cw.buf = nil
+		return err
+	}
+
+	cw.ResponseWriter.WriteHeader(cw.status)
+	_, err := cw.ResponseWriter.Write(cw.buf)
+	cw.buf = nil
+	return err
+}
+
+// Close sends what is still buffered and finishes the gzip stream
+func (cw *compressWriter) Close() error {
+	if !cw.decided {
+		if cw.status == 0 && len(cw.buf) == 0 {
+			// The handler wrote nothing; let net/http send its default response
+			return nil
+		}
+		return cw.decide(false)
+	}
+	if cw.gz != nil {
+		return cw.gz.Close()
+	}
+	return nil
+}
+
+// Flush sends buffered data now, which commits to the current decision
+func (cw *compressWriter) Flush() {
+	if !cw.decided {
+		cw.decide(int64(len(cw.buf)) >= compressMinSize)
+	}
+	if cw.gz != nil {
+		cw.gz.Flush()
+	}
+	if flusher, ok := cw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
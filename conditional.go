@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fileETag returns the entity tag of a file, derived from its modification
+// time and size
+func fileETag(info os.FileInfo) string {
+	return `"` + strconv.FormatInt(info.ModTime().UnixNano(), 36) + "-" + strconv.FormatInt(info.Size(), 36) + `"`
+}
+
+// setValidators sets the ETag and Last-Modified headers of a file
+func setValidators(w http.ResponseWriter, info os.FileInfo) {
+	w.Header().Set("ETag", fileETag(info))
+	w.Header().Set("Last-Modified", info.ModTime().UTC().Format(http.TimeFormat))
+}
+
+// listingETag returns a weak entity tag for a window of a listing, derived
+// from the names, modification times and sizes of its entries. vary holds
+// whatever else the response depends on, such as the user it is for. Tags
+// change with every start, as the templates and options may have.
+func listingETag(page ListPage, vary ...string) string {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%d\x00%d\x00%d\x00%s\x00", stats.started.UnixNano(), page.Total, page.Offset, page.Next)
+	for _, v := range vary {
+		fmt.Fprintf(h, "%s\x00", v)
+	}
+	for _, f := range page.Files {
+		fmt.Fprintf(h, "%s\x00%d\x00%d\x00%t\x00%t\x00%d\x00", f.Name, f.ModTime.UnixNano(), f.Size, f.IsDir, f.HasChecksum, f.Links)
+		if f.DirSize != nil {
+			fmt.Fprintf(h, "%d\x00%d\x00%d\x00", f.DirSize.Items, f.DirSize.Files, f.DirSize.Size)
+		}
+	}
+	return `W/"` + strconv.FormatUint(h.Sum64(), 36) + `"`
+}
+
+// listingNotModified sets the ETag of a listing and answers 304 Not
+// Modified if the request's If-None-Match has it already. Browsers are
+// asked to check every time, since listings change without notice.
+func listingNotModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	if header := r.Header.Get("If-None-Match"); header != "" && etagListMatches(header, strings.TrimPrefix(etag, "W/"), true) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+// etagListMatches reports whether an If-Match or If-None-Match header lists
+// etag; weak tags match when weak is set
+func etagListMatches(header, etag string, weak bool) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if weak {
+			tag = strings.TrimPrefix(tag, "W/")
+		}
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// writePreconditionsHold evaluates If-Match, If-Unmodified-Since and
+// If-None-Match for a write to fullPath, in the order of RFC 9110. A client
+// creates a file only if it is missing with "If-None-Match: *", and
+// replaces only the version it has seen with "If-Match: <etag>".
+func writePreconditionsHold(r *http.Request, fullPath string) bool {
+	info, err := os.Stat(fullPath)
+	exists := err == nil
+
+	if header := r.Header.Get("If-Match"); header != "" {
+		// If-Match needs a strong comparison
+		if !exists || !etagListMatches(header, fileETag(info), false) {
+			return false
+		}
+	} else if header := r.Header.Get("If-Unmodified-Since"); header != "" && exists {
+		// Dates have a resolution of one second
+		if since, err := http.ParseTime(header); err == nil && info.ModTime().Truncate(time.Second).After(since) {
+			return false
+		}
+	}
+
+	if header := r.Header.Get("If-None-Match"); header != "" && exists && etagListMatches(header, fileETag(info), true) {
+		return false
+	}
+	return true
+}
+
+// writeLocks serialize writes to the same file, so that its preconditions
+// still hold when it is written. Paths share a fixed set of locks.
+var writeLocks [64]sync.Mutex
+
+// lockWrite locks the write lock of a path and returns its unlock function
+func lockWrite(fullPath string) func() {
+	h := fnv.New32a()
+	h.Write([]byte(fullPath))
+	lock := &writeLocks[h.Sum32()%uint32(len(writeLocks))]
+	lock.Lock()
+	return lock.Unlock
+}
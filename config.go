@@ -0,0 +1,127 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// configFile is the configuration file of -config, read again on reload;
+// commandLineOptions are the options given on the command line, which
+// override it
+var (
+	configFile         string
+	commandLineOptions = make(map[string]bool)
+)
+
+// loadConfig sets the options of a YAML configuration file (-config) that
+// weren't given on the command line, so flags override the file. Keys are
+// the names of the flags; keys that aren't flags group others into
+// sections, which carry no meaning of their own.
+func loadConfig(path string) error {
+	flag.Visit(func(f *flag.Flag) { commandLineOptions[f.Name] = true })
+	configFile = path
+	return readConfig(path, func(name, value string) error {
+		if commandLineOptions[name] {
+			return nil
+		}
+		return flag.Set(name, value)
+	})
+}
+
+// readConfig passes the options of a configuration file to set, by name
+// and in the flag's syntax
+func readConfig(path string, set func(name, value string) error) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var config map[string]interface{}
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return err
+	}
+	return applyConfig(config, set, "")
+}
+
+// applyConfig sets the options of a section of a configuration file; where
+// is the path of the section, for error messages
+func applyConfig(section map[string]interface{}, set func(name, value string) error, where string) error {
+	names := make([]string, 0, len(section))
+	for name := range section {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := section[name]
+		if flag.Lookup(name) == nil || name == "config" {
+			sub, ok := value.(map[string]interface{})
+			if !ok || name == "config" {
+				return fmt.Errorf("%s%s: unknown option", where, name)
+			}
+			if err := applyConfig(sub, set, where+name+"."); err != nil {
+				return err
+			}
+			continue
+		}
+		if value == nil {
+			continue
+		}
+		s, err := configValue(value)
+		if err != nil {
+			return fmt.Errorf("%s%s: %v", where, name, err)
+		}
+		if err := set(name, s); err != nil {
+			return fmt.Errorf("%s%s: %v", where, name, err)
+		}
+	}
+	return nil
+}
+
+// configValue turns the value of an option in a configuration file into
+// the flag's syntax: lists are joined with commas, and mappings become
+// "key:value" pairs joined with semicolons, as -i takes them
+func configValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case []interface{}:
+		items := make([]string, len(v))
+		for i, item := range v {
+			switch item.(type) {
+			case []interface{}, map[string]interface{}, map[interface{}]interface{}:
+				return "", fmt.Errorf("a list may only hold plain values")
+			}
+			s, err := configValue(item)
+			if err != nil {
+				return "", err
+			}
+			items[i] = s
+		}
+		return strings.Join(items, ","), nil
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		pairs := make([]string, len(keys))
+		for i, key := range keys {
+			s, err := configValue(v[key])
+			if err != nil {
+				return "", err
+			}
+			pairs[i] = key + ":" + s
+		}
+		return strings.Join(pairs, ";"), nil
+	case nil:
+		return "", nil
+	}
+	if _, ok := value.(map[interface{}]interface{}); ok {
+		return "", fmt.Errorf("keys must be text")
+	}
+	return fmt.Sprint(value), nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// contentLinkLifetime is how long a signed link to the content origin works
+const contentLinkLifetime = 5 * time.Minute
+
+var (
+	// contentHost is the host name (and port) of the separate origin that
+	// serves inline user content (-content-host); "" serves it from the
+	// main origin
+	contentHost string
+	// contentKey signs links to the content origin; it is new with every
+	// process, so links don't outlive the server
+	contentKey = make([]byte, 32)
+)
+
+// contentAccessKey marks requests to the content origin that carry a valid
+// signed link, and holds the user who was granted the link
+type contentAccessKey struct{}
+
+func init() {
+	if _, err := rand.Read(contentKey); err != nil {
+		panic(err)
+	}
+}
+
+// contentSignature signs a link to a file on the content origin
+func contentSignature(requestedPath, user string, expires int64) string {
+	mac := hmac.New(sha256.New, contentKey)
+	mac.Write([]byte(requestedPath + "\x00" + user + "\x00" + strconv.FormatInt(expires, 10)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// contentURL returns a signed link to view a file on the content origin.
+// The link stands in for the user's credentials, which the browser doesn't
+// send to another origin.
+func contentURL(r *http.Request, requestedPath, user string) string {
+	expires := time.Now().Add(contentLinkLifetime).Unix()
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(expires, 10))
+	query.Set("sig", contentSignature(requestedPath, user, expires))
+	if user != "" {
+		query.Set("user", user)
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	u := url.URL{Scheme: scheme, Host: contentHost, Path: urlPrefix + "/download/" + requestedPath, RawQuery: query.Encode()}
+	return u.String()
+}
+
+// contentUser returns the user a request to the content origin was granted
+// access for; ok is false when the request has no valid signed link
+func contentUser(r *http.Request) (user string, ok bool) {
+	user, ok = r.Context().Value(contentAccessKey{}).(string)
+	return user, ok
+}
+
+// isContentOrigin reports whether a request was sent to the content origin
+func isContentOrigin(r *http.Request) bool {
+	return contentHost != "" && strings.EqualFold(r.Host, contentHost)
+}
+
+// contentHandler serves a file on the content origin (/download/<path>),
+// if the request carries a valid, unexpired signed link to it
+func contentHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	requestedPath := pathParam(r, "path")
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	want := contentSignature(requestedPath, query.Get("user"), expires)
+	if err != nil || time.Now().Unix() > expires || !hmac.Equal([]byte(query.Get("sig")), []byte(want)) {
+		http.Error(w, "Link expired or invalid; open the file again", http.StatusForbidden)
+		return
+	}
+	ctx := context.WithValue(r.Context(), contentAccessKey{}, query.Get("user"))
+	downloadHandler(w, r.WithContext(ctx))
+}
+
+// contentMiddleware sends requests to the content origin to its own
+// router, which serves nothing but signed downloads
+func contentMiddleware(main, content http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isContentOrigin(r) {
+			content.ServeHTTP(w, r)
+			return
+		}
+		main.ServeHTTP(w, r)
+	})
+}
+
+// sandboxInline restricts a response shown in the browser: the sandbox
+// gives it a unique origin without scripts, so an uploaded page or image
+// can't reach this server with the viewer's credentials. Chrome refuses
+// to render PDFs in a sandbox; its viewer doesn't run document scripts
+// with the page's origin anyway.
+func sandboxInline(w http.ResponseWriter, contentType string) {
+	if contentType == "application/pdf" {
+		return
+	}
+	w.Header().Set("Content-Security-Policy", "sandbox")
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// crawlWindow is how far back a client's requests are counted
+	crawlWindow = time.Minute
+	// crawlDelayStep is the delay added for every request over the limit
+	crawlDelayStep = 250 * time.Millisecond
+	// crawlMaxDelay caps the delay of a single request
+	crawlMaxDelay = 10 * time.Second
+	// crawlBlockTime is how long a client that kept going is refused
+	crawlBlockTime = 10 * time.Minute
+)
+
+// crawlLimit is the number of listings and downloads an anonymous client
+// may request per minute before it is slowed down (-crawl-limit); 0
+// disables the throttle
+var crawlLimit int
+
+// crawlClient is what the throttle remembers about one client address
+type crawlClient struct {
+	hits     []time.Time
+	lastPath string
+	blocked  time.Time
+}
+
+// crawlTracker throttles clients that list and download the tree faster
+// than a person browsing would
+type crawlTracker struct {
+	mu      sync.Mutex
+	clients map[string]*crawlClient
+}
+
+var crawls = &crawlTracker{clients: make(map[string]*crawlClient)}
+
+// check records a request and returns how long to delay it, or blocked if
+// the client is refused for now. Repeated requests for the same path, such
+// as the range requests of a video player, count once.
+func (c *crawlTracker) check(client, requestedPath string, now time.Time) (delay time.Duration, blocked time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	state, ok := c.clients[client]
+	if !ok {
+		state = &crawlClient{}
+		c.clients[client] = state
+	}
+	if now.Before(state.blocked) {
+		return 0, state.blocked
+	}
+	if requestedPath == state.lastPath {
+		return 0, time.Time{}
+	}
+	state.lastPath = requestedPath
+
+	recent := state.hits[:0]
+	for _, hit := range state.hits {
+		if now.Sub(hit) < crawlWindow {
+			recent = append(recent, hit)
+		}
+	}
+	state.hits = append(recent, now)
+
+	over := len(state.hits) - crawlLimit
+	switch {
+	case over <= 0:
+		return 0, time.Time{}
+	case over > 2*crawlLimit:
+		// Slowing down didn't help; refuse the client for a while
+		state.blocked = now.Add(crawlBlockTime)
+		state.hits = nil
+		auditLogf("crawl-blocked client=%s until=%s", client, state.blocked.Format(time.RFC3339))
+		return 0, state.blocked
+	}
+	return min(time.Duration(over)*crawlDelayStep, crawlMaxDelay), time.Time{}
+}
+
+// prune forgets clients that have been quiet for a window and are not
+// blocked
+func (c *crawlTracker) prune(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for client, state := range c.clients {
+		quiet := len(state.hits) == 0 || now.Sub(state.hits[len(state.hits)-1]) >= crawlWindow
+		if quiet && !now.Before(state.blocked) {
+			delete(c.clients, client)
+		}
+	}
+}
+
+// startCrawlPruning forgets idle clients once per window
+func startCrawlPruning() {
+	ticker := time.NewTicker(crawlWindow)
+	go func() {
+		for now := range ticker.C {
+			crawls.prune(now)
+		}
+	}()
+}
+
+// crawlMiddleware slows down anonymous clients that request listings and
+// downloads faster than -crawl-limit per minute, a little more with every
+// request, and refuses those that keep going with 429 Too Many Requests.
+// Authenticated users are never throttled.
+func crawlMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if crawlLimit == 0 || authenticatedUser(r) != "" {
+			next(w, r)
+			return
+		}
+		delay, blocked := crawls.check(clientHost(r), r.URL.Path, time.Now())
+		if !blocked.IsZero() {
+			w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(blocked).Seconds())+1))
+			http.Error(w, "Too many requests; slow down", http.StatusTooManyRequests)
+			return
+		}
+		if delay > 0 {
+			timer := time.NewTimer(delay)
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+			case <-r.Context().Done():
+				return
+			}
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/webdav"
+)
+
+// davLocks holds the locks WebDAV clients such as Finder and Office take
+// while they edit a file. They are advisory and kept in memory only.
+var davLocks = webdav.NewMemLS()
+
+// davHandler serves the files over WebDAV below /dav/ (-webdav), so Finder,
+// Windows Explorer, rclone and other clients can mount them as a network
+// drive. It works on the same storage, with the same access rules, quotas,
+// upload policies and bookkeeping as the HTML interface.
+func davHandler(w http.ResponseWriter, r *http.Request) {
+	// WebDAV clients only send credentials once asked for them, so with
+	// users they are asked at once rather than shown the public files only
+	user := authenticatedUser(r)
+	if authEnabled() && user == "" {
+		if name, _, ok := r.BasicAuth(); ok {
+			auditLogf("login-failed client=%s user=%q", clientHost(r), name)
+		}
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", authRealm))
+		http.Error(w, "Authentication required", http.StatusUnauthorized)
+		return
+	}
+
+	fsys := &userFS{user: user, client: clientHost(r)}
+	requestedPath := strings.Trim(pathParam(r, "path"), "/")
+	switch r.Method {
+	case http.MethodGet, http.MethodPost:
+		if usage.overCap(user) {
+			writeCapExceeded(w, r, user)
+			return
+		}
+		// Files are sent as they are, so like uploaded pages shown in the
+		// browser they run sandboxed
+		sandboxInline(w, "")
+		info, err := fsys.Stat(r.Context(), requestedPath)
+		if err != nil || info.IsDir() {
+			break
+		}
+		transferLimitMiddleware(func(w http.ResponseWriter, r *http.Request) {
+			fsys.transfer = stats.startTransfer("download", requestedPath, fsys.client, user, info.Size())
+			defer stats.endTransfer(fsys.transfer)
+			serveDav(w, r, fsys)
+		})(w, r)
+		return
+	case http.MethodPut:
+		if !davPutAllowed(w, r, fsys, requestedPath) {
+			return
+		}
+		transferLimitMiddleware(func(w http.ResponseWriter, r *http.Request) {
+			size := davExpectedLength(r)
+			fsys.transfer = stats.startTransfer("upload", requestedPath, fsys.client, user, size)
+			defer stats.endTransfer(fsys.transfer)
+			defer progress.track(uploadID(r), fsys.transfer, 0, size)()
+			stopWatching := watchUpload(w, fsys.transfer)
+			defer stopWatching()
+			fsys.body = &uploadBody{Reader: fsys.transfer.reader(r.Body)}
+			r.Body = io.NopCloser(fsys.body)
+			serveDav(w, r, fsys)
+		})(w, r)
+		return
+	}
+	serveDav(w, r, fsys)
+}
+
+// serveDav runs a WebDAV request on a user's view of the files. The paths
+// in its responses name the files as clients reach them, below urlPrefix.
+func serveDav(w http.ResponseWriter, r *http.Request, fsys *userFS) {
+	u := *r.URL
+	u.Path = urlPrefix + u.Path
+	u.RawPath = ""
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.URL = &u
+	handler := &webdav.Handler{
+		Prefix:     urlPrefix + "/dav",
+		FileSystem: fsys,
+		LockSystem: davLocks,
+		Logger: func(r *http.Request, err error) {
+			if err != nil && !errors.Is(err, fs.ErrNotExist) && !errors.Is(err, fs.ErrExist) && !errors.Is(err, fs.ErrPermission) {
+				log.Printf("WebDAV %s %s: %v", r.Method, r.URL.Path, err)
+			}
+		},
+	}
+	handler.ServeHTTP(w, r2)
+}
+
+// davExpectedLength returns the size of a PUT request's body, or -1. Finder
+// streams files without a Content-Length, but tells their size in
+// X-Expected-Entity-Length.
+func davExpectedLength(r *http.Request) int64 {
+	if r.ContentLength >= 0 {
+		return r.ContentLength
+	}
+	if n, err := strconv.ParseInt(r.Header.Get("X-Expected-Entity-Length"), 10, 64); err == nil && n >= 0 {
+		return n
+	}
+	return -1
+}
+
+// davPutAllowed checks a PUT request as putHandler does before the body
+// is read, so clients learn why a file is refused, and responds if it is
+func davPutAllowed(w http.ResponseWriter, r *http.Request, fsys *userFS, requestedPath string) bool {
+	if usage.overCap(fsys.user) {
+		writeCapExceeded(w, r, fsys.user)
+		return false
+	}
+	if path.Base("/"+requestedPath) == "/" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	// Visitors of a drop box only add files
+	if err := fsys.checkUpload(requestedPath, davExpectedLength(r), canBrowse(r)); err != nil {
+		http.Error(w, err.message, err.status)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dirSizeCacheLimit caps the number of directories whose sizes are kept;
+// past it the cache starts over
+const dirSizeCacheLimit = 100000
+
+// DirSize is the content of a directory shown as badges in listings
+type DirSize struct {
+	// Items counts the directory's own entries
+	Items int `json:"items"`
+	// Files and Size cover everything below it
+	Files int64 `json:"files"`
+	Size  int64 `json:"size"`
+}
+
+// dirSizeEntry is a cached DirSize and when it was measured
+type dirSizeEntry struct {
+	size     DirSize
+	measured time.Time
+}
+
+// dirSizeCache measures directories in the background as listings show
+// them. A measurement stays valid until something below the directory
+// changes through the server, or for treeScanInterval at most, to catch
+// changes made on the server's disk.
+type dirSizeCache struct {
+	mu      sync.Mutex
+	entries map[string]dirSizeEntry
+	pending map[string]bool
+	queue   chan string
+	// generation counts invalidations, so a walk that saw the disk before
+	// a change doesn't cache what it saw
+	generation int
+}
+
+var dirSizes = &dirSizeCache{
+	entries: make(map[string]dirSizeEntry),
+	pending: make(map[string]bool),
+}
+
+// lookup returns the cached size of a directory (relative to workingDir),
+// or nil while it is being measured
+func (c *dirSizeCache) lookup(requestedPath string) *DirSize {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[requestedPath]
+	if ok && time.Since(entry.measured) < treeScanInterval {
+		return &entry.size
+	}
+	if !c.pending[requestedPath] {
+		if c.queue == nil {
+			c.queue = make(chan string, 1024)
+			go c.run()
+		}
+		select {
+		case c.queue <- requestedPath:
+			c.pending[requestedPath] = true
+		default:
+			// Asked for again by the next listing
+		}
+	}
+	return nil
+}
+
+// invalidate forgets the sizes of a changed path, the directories above
+// it and, for a directory, those below it
+func (c *dirSizeCache) invalidate(requestedPath string) {
+	requestedPath = strings.Trim(path.Clean("/"+requestedPath), "/")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	if len(c.entries) == 0 {
+		return
+	}
+	for p := requestedPath; ; p = path.Dir(p) {
+		if p == "." {
+			p = ""
+		}
+		delete(c.entries, p)
+		if p == "" {
+			break
+		}
+	}
+	prefix := requestedPath + "/"
+	for p := range c.entries {
+		if strings.HasPrefix(p, prefix) {
+			delete(c.entries, p)
+		}
+	}
+}
+
+// run measures the queued directories one at a time, so listings never
+// start more than one walk over the disk
+func (c *dirSizeCache) run() {
+	for requestedPath := range c.queue {
+		c.mu.Lock()
+		entry, ok := c.entries[requestedPath]
+		fresh := ok && time.Since(entry.measured) < treeScanInterval
+		generation := c.generation
+		c.mu.Unlock()
+		if !fresh {
+			c.measure(localPath(requestedPath), requestedPath, generation)
+		}
+		c.mu.Lock()
+		delete(c.pending, requestedPath)
+		c.mu.Unlock()
+	}
+}
+
+// measure adds up a directory and caches the result for it and every
+// directory below it, which makes opening those instant. Files hard-linked
+// within a directory count once toward its size; the links seen are
+// returned for the directory above.
+func (c *dirSizeCache) measure(fullPath, requestedPath string, generation int) (DirSize, hardLinks) {
+	var size DirSize
+	links := hardLinks{}
+	entries, err := os.ReadDir(fsPath(fullPath))
+	if err != nil {
+		return size, links
+	}
+	size.Items = len(entries)
+	for _, entry := range entries {
+		// Symbolic links are counted, but not followed
+		if entry.IsDir() {
+			sub, subLinks := c.measure(filepath.Join(fullPath, entry.Name()), path.Join(requestedPath, entry.Name()), generation)
+			size.Files += sub.Files
+			size.Size += sub.Size
+			// Data linked from a sibling as well was counted twice
+			for id, linkedSize := range subLinks {
+				if _, ok := links[id]; ok {
+					size.Size -= linkedSize
+				} else {
+					links[id] = linkedSize
+				}
+			}
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		size.Files++
+		if !links.seen(info) {
+			size.Size += info.Size()
+		}
+	}
+
+	c.mu.Lock()
+	if c.generation == generation {
+		if len(c.entries) >= dirSizeCacheLimit {
+			c.entries = make(map[string]dirSizeEntry)
+		}
+		c.entries[requestedPath] = dirSizeEntry{size: size, measured: time.Now()}
+	}
+	c.mu.Unlock()
+	return size, links
+}
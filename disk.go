@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+)
+
+// DiskUsage describes the filesystem holding workingDir
+type DiskUsage struct {
+	Total      int64 `json:"total"`
+	Free       int64 `json:"free"`
+	Available  int64 `json:"available"`
+	Inodes     int64 `json:"inodes"`
+	InodesFree int64 `json:"inodesFree"`
+}
+
+// Used returns the bytes in use on the filesystem
+func (d DiskUsage) Used() int64 {
+	return d.Total - d.Free
+}
+
+// fileID identifies the data of a file on disk, which hard links share
+type fileID struct {
+	dev, ino uint64
+}
+
+// hardLinks holds the files with several hard links that a walk has seen
+// and their sizes, so the data of backups made of hard links is counted
+// once, like du does
+type hardLinks map[fileID]int64
+
+// seen reports whether a file is one more link to data already counted,
+// and remembers it otherwise
+func (h hardLinks) seen(info os.FileInfo) bool {
+	id, links := fileLinks(info)
+	if links < 2 {
+		return false
+	}
+	if _, ok := h[id]; ok {
+		return true
+	}
+	h[id] = info.Size()
+	return false
+}
+
+// DiskReport is served by the disk usage dashboard and API
+type DiskReport struct {
+	Page
+	Path      string     `json:"path"`
+	Disk      *DiskUsage `json:"disk,omitempty"`
+	DiskError string     `json:"diskError,omitempty"`
+	Scan      *TreeScan  `json:"scan"`
+	Scanning  bool       `json:"scanning"`
+}
+
+// diskReport gathers filesystem statistics and the cached tree scan
+func diskReport() DiskReport {
+	report := DiskReport{Path: workingDir}
+	if usage, err := statDisk(workingDir); err != nil {
+		report.DiskError = err.Error()
+	} else {
+		report.Disk = &usage
+	}
+	report.Scan, report.Scanning = scanner.get()
+	return report
+}
+
+// adminDiskHandler serves the disk usage report as JSON
+func adminDiskHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(diskReport()); err != nil {
+		log.Printf("JSON encoding error: %v", err)
+	}
+}
+
+// adminDiskPageHandler renders the disk usage dashboard; POST starts a rescan
+func adminDiskPageHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		auditLogf("rescan client=%s", clientHost(r))
+		scanner.refresh()
+		http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+		return
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	report := diskReport()
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := renderTemplate(w, r, "disk.html", &report); err != nil {
+		log.Printf("Template error: %v", err)
+		http.Error(w, "Error rendering page", http.StatusInternalServerError)
+	}
+}
+
+// TypeReport is served by the file-type statistics view and API
+type TypeReport struct {
+	Page
+	Path     string    `json:"path"`
+	Scan     *TreeScan `json:"scan"`
+	Scanning bool      `json:"scanning"`
+}
+
+// adminTypesHandler serves the file-type breakdown as JSON
+func adminTypesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	report := TypeReport{Path: workingDir}
+	report.Scan, report.Scanning = scanner.get()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		log.Printf("JSON encoding error: %v", err)
+	}
+}
+
+// adminTypesPageHandler renders the file-type statistics; POST starts a rescan
+func adminTypesPageHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		auditLogf("rescan client=%s", clientHost(r))
+		scanner.refresh()
+		http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+		return
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	report := TypeReport{Path: workingDir}
+	report.Scan, report.Scanning = scanner.get()
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := renderTemplate(w, r, "types.html", &report); err != nil {
+		log.Printf("Template error: %v", err)
+		http.Error(w, "Error rendering page", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !linux && !darwin && !freebsd && !windows
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// statDisk is not implemented on this platform
+func statDisk(path string) (DiskUsage, error) {
+	return DiskUsage{}, errors.New("disk statistics are not supported on this platform")
+}
+
+// fileLinks treats every file as having a single link on this platform
+func fileLinks(info os.FileInfo) (fileID, uint64) {
+	return fileID{}, 1
+}
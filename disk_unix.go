@@ -0,0 +1,35 @@
+//go:build linux || darwin || freebsd
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// statDisk reports capacity and inode usage of the filesystem holding path
+func statDisk(path string) (DiskUsage, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return DiskUsage{}, err
+	}
+
+	blockSize := uint64(st.Bsize)
+	return DiskUsage{
+		Total:      int64(uint64(st.Blocks) * blockSize),
+		Free:       int64(uint64(st.Bfree) * blockSize),
+		Available:  int64(uint64(st.Bavail) * blockSize),
+		Inodes:     int64(st.Files),
+		InodesFree: int64(st.Ffree),
+	}, nil
+}
+
+// fileLinks returns the identity of a file's data on disk and the number
+// of hard links to it
+func fileLinks(info os.FileInfo) (fileID, uint64) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileID{}, 1
+	}
+	return fileID{dev: uint64(st.Dev), ino: uint64(st.Ino)}, uint64(st.Nlink)
+}
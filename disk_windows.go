@@ -0,0 +1,43 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var procGetDiskFreeSpaceEx = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+// statDisk reports capacity of the volume holding path; NTFS has no
+// fixed inode table, so inode counts are left at zero
+func statDisk(path string) (DiskUsage, error) {
+	p, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return DiskUsage{}, err
+	}
+
+	var available, total, free uint64
+	ok, _, err := procGetDiskFreeSpaceEx.Call(
+		uintptr(unsafe.Pointer(p)),
+		uintptr(unsafe.Pointer(&available)),
+		uintptr(unsafe.Pointer(&total)),
+		uintptr(unsafe.Pointer(&free)),
+	)
+	if ok == 0 {
+		return DiskUsage{}, err
+	}
+
+	return DiskUsage{
+		Total:     int64(total),
+		Free:      int64(free),
+		Available: int64(available),
+	}, nil
+}
+
+// fileLinks treats every file as having a single link: the link count of
+// an NTFS file needs a handle to it, which listings don't open
+func fileLinks(info os.FileInfo) (fileID, uint64) {
+	return fileID{}, 1
+}
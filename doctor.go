@@ -0,0 +1,443 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// doctorLowSpace is the free space below which "files doctor" warns
+const doctorLowSpace = 1 << 30
+
+// doctorReport prints the results of "files doctor" as they come and
+// counts the problems
+type doctorReport struct {
+	failures, warnings int
+}
+
+// ok reports a check that passed
+func (d *doctorReport) ok(check, format string, args ...interface{}) {
+	fmt.Printf("OK    %-14s %s\n", check, fmt.Sprintf(format, args...))
+}
+
+// warn reports something the server runs with, but likely shouldn't
+func (d *doctorReport) warn(check, format string, args ...interface{}) {
+	d.warnings++
+	fmt.Printf("WARN  %-14s %s\n", check, fmt.Sprintf(format, args...))
+}
+
+// fail reports something the server won't start or work with
+func (d *doctorReport) fail(check, format string, args ...interface{}) {
+	d.failures++
+	fmt.Printf("FAIL  %-14s %s\n", check, fmt.Sprintf(format, args...))
+}
+
+// runDoctor checks the configuration given by the server's flags and the
+// machine it is to run on ("files doctor"), and exits with status 1 if the
+// server would not start or work. Each problem comes with what to do about
+// it; all of them are reported, not just the first.
+func runDoctor() {
+	option := func(name string) string {
+		return flag.Lookup(name).Value.String()
+	}
+	d := &doctorReport{}
+
+	if os.Geteuid() == 0 {
+		d.warn("user", "running as root; run the server as an unprivileged user that owns only what it serves")
+	}
+
+	// The served directory, where uploads are written as temporary files
+	// next to their destination
+	dir := option("dir")
+	if dir == "" {
+		dir, _ = os.Getwd()
+	}
+	dir, _ = filepath.Abs(dir)
+	if info, err := os.Stat(dir); err != nil {
+		d.fail("directory", "%v; create it or fix -dir", err)
+	} else if !info.IsDir() {
+		d.fail("directory", "%s is not a directory; fix -dir", dir)
+	} else {
+		if _, err := os.ReadDir(dir); err != nil {
+			d.fail("directory", "%v; the server's user must be able to read it", err)
+		} else if err := checkWritable(dir); err != nil {
+			d.warn("directory", "%s is not writable (%v): uploads, moves and new folders will fail", dir, err)
+		} else {
+			d.ok("directory", "%s is readable and writable", dir)
+		}
+		if info.Mode().Perm()&0002 != 0 {
+			d.warn("directory", "%s is writable by every local user; remove the write permission for others (chmod o-w)", dir)
+		}
+		checkUploadPolicies(d, dir)
+		if disk, err := statDisk(dir); err == nil && disk.Total > 0 {
+			if disk.Available < doctorLowSpace || disk.Available < disk.Total/20 {
+				d.warn("disk", "only %s of %s available; uploads may run out of space", formatSize(disk.Available), formatSize(disk.Total))
+			} else {
+				d.ok("disk", "%s of %s available", formatSize(disk.Available), formatSize(disk.Total))
+			}
+		}
+	}
+
+	if dataDir := option("data-dir"); dataDir != "" {
+		if _, err := os.Stat(dataDir); os.IsNotExist(err) {
+			// The server creates it
+			if err := checkWritable(filepath.Dir(dataDir)); err != nil {
+				d.fail("data-dir", "%s can't be created (%v); create it or fix -data-dir", dataDir, err)
+			} else {
+				d.ok("data-dir", "%s will be created", dataDir)
+			}
+		} else if err := checkWritable(dataDir); err != nil {
+			d.fail("data-dir", "%s is not writable (%v); statistics, sessions and checksums are saved there", dataDir, err)
+		} else {
+			d.ok("data-dir", "%s is writable", dataDir)
+		}
+	} else {
+		if option("checksums") == "true" {
+			d.fail("data-dir", "-checksums requires -data-dir")
+		}
+		if option("artifact-cache") != "" {
+			d.fail("data-dir", "-artifact-cache requires -data-dir")
+		}
+	}
+	if dirs := option("tier"); dirs != "" {
+		coldDir, after := option("tier-path"), option("tier-after")
+		if option("data-dir") == "" || coldDir == "" {
+			d.fail("tier", "-tier requires -data-dir and -tier-path")
+		} else if _, err := parseLifetime(after); err != nil {
+			d.fail("tier", "%q is not an age such as 30d; fix -tier-after", after)
+		} else if err := checkWritable(coldDir); err != nil && !os.IsNotExist(err) {
+			d.fail("tier", "%s is not writable (%v); fix -tier-path", coldDir, err)
+		} else {
+			d.ok("tier", "moving files of %s unused for %s to %s", dirs, after, coldDir)
+		}
+	}
+	if interval := option("scrub"); interval != "" {
+		if option("checksums") != "true" {
+			d.fail("scrub", "-scrub requires -checksums")
+		} else if _, err := parseLifetime(interval); err != nil {
+			d.fail("scrub", "%q is not an interval such as 7d or 12h; fix -scrub", interval)
+		} else if option("admin") != "true" && option("scrub-webhook") == "" {
+			d.warn("scrub", "mismatches are only reported in the audit log; add -admin or -scrub-webhook")
+		} else {
+			d.ok("scrub", "re-hashing recorded files every %s", interval)
+		}
+	}
+
+	// The addresses must be free, unless a running server shares them
+	addresses := parseList(option("listen"))
+	if len(addresses) == 0 {
+		addresses = []string{listenAddress(option("host"), option("port"))}
+	}
+	network := "tcp"
+	if option("4") == "true" {
+		network = "tcp4"
+	} else if option("6") == "true" {
+		network = "tcp6"
+	}
+	for _, addr := range addresses {
+		if listener, err := net.Listen(network, addr); err != nil {
+			switch {
+			case errors.Is(err, syscall.EADDRINUSE):
+				d.fail("address", "%s is already in use; stop what listens there or choose another -port", addr)
+			case errors.Is(err, os.ErrPermission) || errors.Is(err, syscall.EACCES):
+				d.fail("address", "may not listen on %s; ports below 1024 need privileges (e.g. setcap cap_net_bind_service=+ep)", addr)
+			default:
+				d.fail("address", "%v; fix -host, -port or -listen", err)
+			}
+		} else {
+			listener.Close()
+			d.ok("address", "%s is free", addr)
+		}
+	}
+
+	if redirect := option("redirect-http"); redirect != "" {
+		if option("tls-self-signed") != "true" {
+			d.fail("redirect-http", "-redirect-http requires TLS (-tls-self-signed)")
+		} else if listener, err := net.Listen("tcp", redirect); err != nil {
+			d.fail("redirect-http", "%v; choose another -redirect-http address", err)
+		} else {
+			listener.Close()
+			d.ok("redirect-http", "%s is free", redirect)
+		}
+	}
+
+	if dir := option("templates"); dir != "" {
+		checkTemplates(d, dir)
+	}
+
+	if list := option("trusted-proxies"); list != "" {
+		if _, err := parseNetworks(list); err != nil {
+			d.fail("trusted-proxies", "%v; fix -trusted-proxies", err)
+		}
+	}
+	for _, name := range []string{"allow-cidr", "deny-cidr"} {
+		if list := option(name); list != "" {
+			if _, err := parseNetworks(list); err != nil {
+				d.fail(name, "%v; fix -%s", err, name)
+			}
+		}
+	}
+
+	// Accounts and access rules
+	if file := option("auth"); file != "" {
+		if loaded, err := loadUsers(file); err != nil {
+			d.fail("auth", "%v", err)
+		} else {
+			plain := 0
+			for _, stored := range loaded {
+				if !strings.HasPrefix(stored, "sha256:") && !strings.HasPrefix(stored, "$2") {
+					plain++
+				}
+			}
+			if plain > 0 {
+				d.warn("auth", "%d of %d passwords in %s are stored in plain text; use sha256: digests or bcrypt hashes", plain, len(loaded), file)
+			} else {
+				d.ok("auth", "%d users in %s", len(loaded), file)
+			}
+		}
+	}
+	if file := option("users-db"); file != "" {
+		if _, err := os.Stat(file); os.IsNotExist(err) {
+			d.warn("users-db", "%s doesn't exist yet; add accounts with 'files user add -db %s <name>'", file, file)
+		} else if db, err := openUserDB(file, true); err != nil {
+			d.fail("users-db", "%v", err)
+		} else {
+			loaded, err := readAccounts(db)
+			db.Close()
+			admins := 0
+			for _, acct := range loaded {
+				if acct.Role == roleAdmin.String() {
+					admins++
+				}
+			}
+			switch {
+			case err != nil:
+				d.fail("users-db", "%v", err)
+			case len(loaded) == 0:
+				d.warn("users-db", "%s has no accounts; add some with 'files user add -db %s <name>'", file, file)
+			default:
+				d.ok("users-db", "%d accounts, %d admins", len(loaded), admins)
+			}
+		}
+	}
+	if option("admin") == "true" && option("admin-loopback") != "true" && option("users-db") == "" {
+		d.warn("admin", "no one can use the admin API; add -users-db with an admin account, or -admin-loopback")
+	}
+	if file := option("token-file"); file != "" {
+		if loaded, err := loadUsers(file); err != nil {
+			d.fail("token-file", "%v", err)
+		} else {
+			d.ok("token-file", "%d tokens", len(loaded))
+		}
+	}
+	if file := option("acl"); file != "" {
+		if data, err := os.ReadFile(file); err != nil {
+			d.fail("acl", "%v", err)
+		} else if err := parseACL(string(data)); err != nil {
+			d.fail("acl", "%s: %v", file, err)
+		} else {
+			d.ok("acl", "%d rules, %d groups", len(aclRules), len(aclGroups))
+		}
+	}
+	if file := option("auth-only-file"); file != "" {
+		if data, err := os.ReadFile(file); err != nil {
+			d.fail("auth-only-file", "%v", err)
+		} else if err := parseAuthOnlyPatterns(string(data)); err != nil {
+			d.fail("auth-only-file", "%s: %v", file, err)
+		} else {
+			d.ok("auth-only-file", "%d paths", len(authOnlyPatterns))
+		}
+	}
+	if issuer := option("oidc-issuer"); issuer != "" {
+		if option("oidc-client-id") == "" {
+			d.fail("oidc", "-oidc-issuer requires -oidc-client-id")
+		} else if _, err := discoverOIDC(issuer, option("oidc-client-id"), "", "", ""); err != nil {
+			d.fail("oidc", "%s: %v; the server doesn't start without its provider", issuer, err)
+		} else {
+			d.ok("oidc", "found the provider at %s", issuer)
+		}
+	}
+
+	if file := option("geoip"); file != "" {
+		if db, err := openGeoDB(file); err != nil {
+			d.fail("geoip", "%s: %v", file, err)
+		} else {
+			d.ok("geoip", "%s has %d nodes (IPv%d)", file, db.nodeCount, db.ipVersion)
+		}
+	} else if option("geoip-allow") != "" || option("geoip-deny") != "" {
+		d.fail("geoip", "-geoip-allow and -geoip-deny require -geoip")
+	}
+	if file := option("bandwidth-file"); file != "" {
+		if data, err := os.ReadFile(file); err != nil {
+			d.fail("bandwidth", "%v", err)
+		} else if err := parseBandwidthRules(string(data)); err != nil {
+			d.fail("bandwidth", "%s: %v", file, err)
+		}
+	}
+
+	if value := option("mount"); value != "" {
+		var list mountList
+		if err := list.Set(value); err != nil {
+			d.fail("mount", "%v; fix -mount", err)
+		}
+		readable := 0
+		for _, m := range list {
+			if _, err := os.ReadDir(m.dir); err != nil {
+				d.fail("mount", "%s: %v; fix -mount", m.name, err)
+			} else {
+				readable++
+			}
+		}
+		if readable == len(list) && len(list) > 0 {
+			d.ok("mount", "%d directories are readable", readable)
+		}
+	}
+	if value := option("backend"); value != "" {
+		if store, err := openBackend(value); err != nil {
+			d.fail("backend", "%v; the server doesn't start without its storage", err)
+		} else {
+			d.ok("backend", "%v is reachable", store)
+		}
+	}
+
+	switch {
+	case option("read-header-timeout") == "0s":
+		d.warn("timeouts", "-read-header-timeout is off: clients sending headers slowly can hold connections open for good")
+	case option("write-timeout") != "0s" || option("read-timeout") != "0s":
+		d.warn("timeouts", "-read-timeout %s and -write-timeout %s cut off uploads and downloads that take longer", option("read-timeout"), option("write-timeout"))
+	default:
+		d.ok("timeouts", "request headers must arrive within %s, idle connections are closed after %s", option("read-header-timeout"), option("idle-timeout"))
+	}
+
+	// Options whose values the server checks when it starts
+	var invalid []string
+	check := func(err error) {
+		if err != nil {
+			invalid = append(invalid, err.Error())
+		}
+	}
+	for _, name := range []string{"quota", "monthly-cap", "compress-min-size", "fetch-max-size", "upload-min-rate"} {
+		if value := option(name); value != "" {
+			if _, err := parseSize(value); err != nil {
+				check(fmt.Errorf("-%s: %v", name, err))
+			}
+		}
+	}
+	_, err := parseSanitizeMode(option("sanitize"))
+	check(err)
+	if _, err := parsePrefix(option("prefix")); err != nil {
+		check(fmt.Errorf("-prefix: %v", err))
+	}
+	_, err = parseConflictPolicy(option("on-conflict"))
+	check(err)
+	_, err = parseFsyncPolicy(option("fsync"))
+	check(err)
+	check(parseBandwidthRules(option("bandwidth")))
+	if option("scratch") != "" {
+		if _, err := parseLifetime(option("scratch-lifetime")); err != nil {
+			check(fmt.Errorf("-scratch-lifetime: invalid lifetime %q", option("scratch-lifetime")))
+		}
+		if size, err := parseSize(option("scratch-size")); err != nil || size <= 0 {
+			check(fmt.Errorf("-scratch-size: invalid size %q", option("scratch-size")))
+		}
+	}
+	for _, name := range []string{"max-bandwidth", "max-per-conn"} {
+		if value := option(name); value != "" {
+			if rate, err := parseSize(value); err != nil || rate <= 0 {
+				check(fmt.Errorf("-%s: invalid rate %q", name, value))
+			}
+		}
+	}
+	check(parseAuthOnlyPatterns(option("auth-only")))
+	for _, name := range []string{"geoip-allow", "geoip-deny"} {
+		_, err := parseCountries(option(name))
+		check(err)
+	}
+	if !authConfigured(option) {
+		for _, name := range []string{"home-dirs", "quota"} {
+			if value := option(name); value != "" && value != "false" {
+				check(fmt.Errorf("-%s requires -auth, -users-db, API tokens or -oidc-issuer", name))
+			}
+		}
+		if option("auth-only") != "" || option("auth-only-file") != "" {
+			check(errors.New("-auth-only and -auth-only-file require -auth, -users-db, API tokens or -oidc-issuer"))
+		}
+		if aclNamesUsers() {
+			check(errors.New("-acl rules for users and groups require -auth, -users-db, API tokens or -oidc-issuer"))
+		}
+	}
+	if len(invalid) > 0 {
+		for _, message := range invalid {
+			d.fail("options", "%s", message)
+		}
+	} else {
+		d.ok("options", "all option values are valid")
+	}
+
+	fmt.Printf("\n%d problems, %d warnings\n", d.failures, d.warnings)
+	if d.failures > 0 {
+		os.Exit(1)
+	}
+}
+
+// authConfigured reports whether the flags set up any way to log in
+func authConfigured(option func(string) string) bool {
+	for _, name := range []string{"auth", "users-db", "token", "token-file", "oidc-issuer"} {
+		if option(name) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// checkWritable creates and removes a file in a directory
+func checkWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".files-doctor-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// checkUploadPolicies parses every upload policy file below dir
+func checkUploadPolicies(d *doctorReport, dir string) {
+	count, broken := 0, 0
+	filepath.WalkDir(dir, func(p string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() || entry.Name() != uploadPolicyFile {
+			return nil
+		}
+		count++
+		data, err := os.ReadFile(p)
+		if err == nil {
+			err = (&uploadPolicy{}).parse(string(data))
+		}
+		if err != nil {
+			broken++
+			d.fail("upload-policy", "%s: %v; uploads there are refused until it is fixed", p, err)
+		}
+		return nil
+	})
+	if count > 0 && broken == 0 {
+		d.ok("upload-policy", "%d policy files checked", count)
+	}
+}
+
+// checkTemplates parses the templates of -templates for "files doctor"
+func checkTemplates(d *doctorReport, dir string) {
+	if _, err := os.Stat(dir); err != nil {
+		d.fail("templates", "%v; fix -templates", err)
+		return
+	}
+	if _, err := loadTemplates(dir); err != nil {
+		d.fail("templates", "%v", err)
+		return
+	}
+	d.ok("templates", "%s parses", dir)
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fsync policies for uploads
+const (
+	fsyncOff  = "off"
+	fsyncFile = "file"
+	fsyncFull = "full"
+)
+
+// fsyncPolicy decides what is flushed to stable storage before an upload
+// is reported as successful
+var fsyncPolicy = fsyncOff
+
+// parseFsyncPolicy validates a -fsync value
+func parseFsyncPolicy(policy string) (string, error) {
+	switch policy {
+	case fsyncOff, fsyncFile, fsyncFull:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown fsync policy %q (expected off, file or full)", policy)
+}
+
+// syncDir flushes a directory entry to stable storage, so a new file
+// survives a crash. Windows cannot sync directories; NTFS journals them.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// ChecksumRecord is one line of the checksum log
+type ChecksumRecord struct {
+	Path    string    `json:"path"`
+	SHA256  string    `json:"sha256,omitempty"`
+	Size    int64     `json:"size"`
+	Time    time.Time `json:"time"`
+	Deleted bool      `json:"deleted,omitempty"`
+}
+
+// checksumStore keeps the checksums of uploaded files in an append-only
+// log, dataDir/checksums.jsonl, where later lines supersede earlier ones
+type checksumStore struct {
+	mu      sync.Mutex
+	records map[string]ChecksumRecord
+	file    *os.File
+}
+
+var checksums *checksumStore
+
+// checksumLogPath returns the location of the checksum log in a data directory
+func checksumLogPath(dir string) string {
+	return filepath.Join(dir, "checksums.jsonl")
+}
+
+// readChecksumLog returns the current record of every path in a checksum log
+func readChecksumLog(file string) (map[string]ChecksumRecord, error) {
+	records := make(map[string]ChecksumRecord)
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return records, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	lineScanner := bufio.NewScanner(f)
+	lineScanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for n := 1; lineScanner.Scan(); n++ {
+		var record ChecksumRecord
+		if err := json.Unmarshal(lineScanner.Bytes(), &record); err != nil {
+			// A crash can leave the last line incomplete
+			log.Printf("Skipping line %d of %s: %v", n, file, err)
+			continue
+		}
+		if record.Deleted {
+			delete(records, record.Path)
+		} else {
+			records[record.Path] = record
+		}
+	}
+	return records, lineScanner.Err()
+}
+
+// openChecksumStore loads the checksum log in dataDir and opens it for appending
+func openChecksumStore() (*checksumStore, error) {
+	records, err := readChecksumLog(checksumLogPath(dataDir))
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(checksumLogPath(dataDir), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &checksumStore{records: records, file: f}, nil
+}
+
+// append writes records to the log and syncs it. The caller must hold c.mu.
+func (c *checksumStore) append(records ...ChecksumRecord) error {
+	var buf strings.Builder
+	for _, record := range records {
+		line, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+		if record.Deleted {
+			delete(c.records, record.Path)
+		} else {
+			c.records[record.Path] = record
+		}
+	}
+	if _, err := c.file.WriteString(buf.String()); err != nil {
+		return err
+	}
+	return c.file.Sync()
+}
+
+// record stores the checksum of a file, by its path relative to workingDir
+func (c *checksumStore) record(requestedPath, sum string, size int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.append(ChecksumRecord{Path: path.Clean(filepath.ToSlash(requestedPath)), SHA256: sum, Size: size, Time: time.Now()})
+}
+
+// lookup returns the recorded checksum of a file of the given size
+func (c *checksumStore) lookup(requestedPath string, size int64) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	record, ok := c.records[path.Clean(filepath.ToSlash(requestedPath))]
+	if !ok || record.Size != size {
+		return "", false
+	}
+	return record.SHA256, true
+}
+
+// has reports whether a file of the given size has a recorded checksum
+func (c *checksumStore) has(requestedPath string, size int64) bool {
+	_, ok := c.lookup(requestedPath, size)
+	return ok
+}
+
+// relocate carries the records of src, or of everything below it, over to
+// dst after a move or copy; a move drops the old records
+func (c *checksumStore) relocate(src, dst string, move bool) error {
+	src, dst = path.Clean(filepath.ToSlash(src)), path.Clean(filepath.ToSlash(dst))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var changes []ChecksumRecord
+	for p, record := range c.records {
+		rest, ok := strings.CutPrefix(p, src)
+		if !ok || (rest != "" && !strings.HasPrefix(rest, "/")) {
+			continue
+		}
+		moved := record
+		moved.Path = dst + rest
+		changes = append(changes, moved)
+		if move {
+			changes = append(changes, ChecksumRecord{Path: p, Time: time.Now(), Deleted: true})
+		}
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+	return c.append(changes...)
+}
+
+// storeFile copies src into an uploaded file and flushes it as -fsync
+// asks. It returns the bytes written and their SHA-256.
+func storeFile(dst *os.File, src io.Reader) (int64, string, error) {
+	hash := sha256.New()
+	written, err := io.Copy(io.MultiWriter(dst, hash), src)
+	if err != nil {
+		return written, "", err
+	}
+	if fsyncPolicy != fsyncOff {
+		if err := dst.Sync(); err != nil {
+			return written, "", err
+		}
+	}
+	return written, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// hashFile returns the size and SHA-256 of a file
+func hashFile(fullPath string) (int64, string, error) {
+	f, err := os.Open(fsPath(fullPath))
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return 0, "", err
+	}
+	return size, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// recordFileChecksum hashes a whole file and records its checksum
+func recordFileChecksum(requestedPath, fullPath string) error {
+	size, sum, err := hashFile(fullPath)
+	if err != nil {
+		return err
+	}
+	return checksums.record(requestedPath, sum, size)
+}
+
+// syncNewName flushes the directory holding a new or renamed file with
+// the full fsync policy, so the name survives a crash too
+func syncNewName(dir string) error {
+	if fsyncPolicy != fsyncFull {
+		return nil
+	}
+	return syncDir(dir)
+}
+
+// runVerify implements "files verify": it re-hashes every file in the
+// checksum log and reports those that changed or disappeared
+func runVerify(args []string) {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	dirFlag := flags.String("dir", ".", "Directory the server serves")
+	dataDirFlag := flags.String("data-dir", "", "Data directory holding the checksum log (required)")
+	quietFlag := flags.Bool("q", false, "Only report problems")
+	flags.Parse(args)
+	if *dataDirFlag == "" {
+		log.Fatal("verify: -data-dir is required")
+	}
+
+	records, err := readChecksumLog(checksumLogPath(*dataDirFlag))
+	if err != nil {
+		log.Fatal("verify: ", err)
+	}
+	paths := make([]string, 0, len(records))
+	for p := range records {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	var failed int
+	for _, p := range paths {
+		record := records[p]
+		status := verifyFile(filepath.Join(*dirFlag, filepath.FromSlash(path.Clean("/"+p))), record)
+		if status != "OK" {
+			failed++
+		}
+		if status != "OK" || !*quietFlag {
+			fmt.Printf("%-8s %s\n", status, p)
+		}
+	}
+	fmt.Printf("%d files checked, %d problems\n", len(paths), failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// verifyFile compares a file against its record: OK, MISSING, SIZE
+// (size differs), CHANGED (content differs) or ERROR
+func verifyFile(fullPath string, record ChecksumRecord) string {
+	f, err := os.Open(fsPath(fullPath))
+	if os.IsNotExist(err) {
+		return "MISSING"
+	}
+	if err != nil {
+		return "ERROR"
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	switch {
+	case err != nil:
+		return "ERROR"
+	case size != record.Size:
+		return "SIZE"
+	case hex.EncodeToString(h.Sum(nil)) != record.SHA256:
+		return "CHANGED"
+	}
+	return "OK"
+}
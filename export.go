@@ -0,0 +1,244 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// exportColumns are the columns of an exported listing
+var exportColumns = []string{"path", "type", "size", "modified", "sha256"}
+
+// exportRow is one file or folder of an exported listing
+type exportRow struct {
+	Path    string
+	IsDir   bool
+	Size    int64
+	ModTime time.Time
+	SHA256  string
+}
+
+// cells returns a row as text, in the order of exportColumns
+func (row exportRow) cells() []string {
+	if row.IsDir {
+		return []string{row.Path, "folder", "", row.ModTime.UTC().Format(time.RFC3339), ""}
+	}
+	return []string{row.Path, "file", strconv.FormatInt(row.Size, 10), row.ModTime.UTC().Format(time.RFC3339), row.SHA256}
+}
+
+// collectExportRows lists a directory, or with recursive the whole tree
+// below it, leaving out what the request may not see. Files get their
+// recorded SHA-256; with hash, files without one are hashed on the spot.
+func collectExportRows(r *http.Request, fullPath, requestedPath string, recursive, hash bool) ([]exportRow, error) {
+	var rows []exportRow
+	if recursive {
+		files, _, err := collectArchiveFiles(r, fullPath, requestedPath, requestedPath)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			if file.FullPath == fullPath {
+				continue
+			}
+			rows = append(rows, exportRow{
+				Path:    strings.TrimSuffix(file.Name, "/"),
+				IsDir:   file.Info.IsDir(),
+				Size:    file.Info.Size(),
+				ModTime: file.Info.ModTime(),
+			})
+		}
+	} else {
+		page, err := listDirectory(fullPath, requestedPath, "", 0, archiveMaxEntries, authenticatedUser(r), listFilter{})
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range page.Files {
+			rows = append(rows, exportRow{Path: file.Path, IsDir: file.IsDir, Size: file.Size, ModTime: file.ModTime})
+		}
+	}
+
+	for i := range rows {
+		row := &rows[i]
+		if row.IsDir {
+			continue
+		}
+		if checksums != nil {
+			row.SHA256, _ = checksums.lookup(row.Path, row.Size)
+		}
+		if row.SHA256 == "" && hash {
+			if fullPath, err := resolvePath(row.Path); err == nil {
+				if _, sum, err := hashFile(fullPath); err == nil {
+					row.SHA256 = sum
+				}
+			}
+		}
+	}
+	return rows, nil
+}
+
+// csvCell keeps spreadsheets from taking a file name for a formula
+func csvCell(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+// writeExportCSV writes a listing as CSV with a header line
+func writeExportCSV(w io.Writer, rows []exportRow) error {
+	cw := csv.NewWriter(w)
+	cw.Write(exportColumns)
+	for _, row := range rows {
+		cells := row.cells()
+		cells[0] = csvCell(cells[0])
+		cw.Write(cells)
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// xlsxParts are the fixed parts of a workbook with one worksheet
+var xlsxParts = []struct{ name, content string }{
+	{"[Content_Types].xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"><Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/><Default Extension="xml" ContentType="application/xml"/><Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/><Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/></Types>`},
+	{"_rels/.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/></Relationships>`},
+	{"xl/workbook.xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets><sheet name="Listing" sheetId="1" r:id="rId1"/></sheets></workbook>`},
+	{"xl/_rels/workbook.xml.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/></Relationships>`},
+}
+
+// writeExportXLSX writes a listing as an Excel workbook. Sizes are numbers;
+// everything else is inline text, so no shared strings or styles are needed.
+func writeExportXLSX(w io.Writer, rows []exportRow) error {
+	zw := zip.NewWriter(w)
+	for _, part := range xlsxParts {
+		entry, err := zw.Create(part.name)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(entry, part.content); err != nil {
+			return err
+		}
+	}
+
+	entry, err := zw.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return err
+	}
+	sheet := bufio.NewWriter(entry)
+	sheet.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n")
+	sheet.WriteString(`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	writeRow := func(cells []string, numeric int) {
+		sheet.WriteString("<row>")
+		for i, cell := range cells {
+			switch {
+			case cell == "":
+				sheet.WriteString("<c/>")
+			case i == numeric:
+				sheet.WriteString("<c><v>" + cell + "</v></c>")
+			default:
+				sheet.WriteString(`<c t="inlineStr"><is><t xml:space="preserve">`)
+				xml.EscapeText(sheet, []byte(cell))
+				sheet.WriteString("</t></is></c>")
+			}
+		}
+		sheet.WriteString("</row>")
+	}
+	writeRow(exportColumns, -1)
+	for _, row := range rows {
+		writeRow(row.cells(), 2)
+	}
+	sheet.WriteString("</sheetData></worksheet>")
+	if err := sheet.Flush(); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// exportHandler exports a directory listing (/api/export/<path>) as CSV,
+// or as an Excel workbook with ?format=xlsx: path, type, size, modification
+// time and SHA-256 of every entry. With ?recursive=1 it covers the whole
+// tree below the directory, with ?hash=1 files without a recorded checksum
+// are hashed as well.
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	if format != "csv" && format != "xlsx" {
+		http.Error(w, "Unknown export format", http.StatusBadRequest)
+		return
+	}
+	recursive := r.URL.Query().Get("recursive") == "1"
+	hash := r.URL.Query().Get("hash") == "1"
+
+	requestedPath := strings.Trim(pathParam(r, "path"), "/")
+
+	// Security check: ensure the path is within workingDir
+	fullPath, err := resolvePath(requestedPath)
+	if err != nil {
+		writePathError(w, err)
+		return
+	}
+
+	// Paths the user may not see look nonexistent
+	user := authenticatedUser(r)
+	info, err := os.Stat(fullPath)
+	if err != nil || !canRead(user, requestedPath) {
+		if err == nil || os.IsNotExist(err) {
+			http.Error(w, "Path not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Error accessing path", http.StatusInternalServerError)
+		return
+	}
+	if !info.IsDir() {
+		http.Error(w, "Not a directory", http.StatusBadRequest)
+		return
+	}
+
+	// Walking or hashing a tree is as much work as archiving it, so it
+	// waits for an archive worker
+	if recursive || hash {
+		release := startArchive(w, r, requestedPath)
+		if release == nil {
+			return
+		}
+		defer release()
+	}
+
+	rows, err := collectExportRows(r, fullPath, requestedPath, recursive, hash)
+	if err != nil {
+		writeArchiveError(w, err)
+		return
+	}
+
+	name := archiveName(requestedPath) + "-listing." + format
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, name))
+	w.Header().Set("Cache-Control", "no-store")
+	if format == "xlsx" {
+		w.Header().Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+		err = writeExportXLSX(w, rows)
+	} else {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		err = writeExportCSV(w, rows)
+	}
+	if err != nil {
+		log.Printf("Export error for %s: %v", requestedPath, err)
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var (
+	// fetchEnabled allows importing files from URLs (-fetch)
+	fetchEnabled bool
+	// fetchMaxSize is the largest file imported from a URL (-fetch-max-size)
+	fetchMaxSize int64 = 1 << 30
+	// fetchPrivate allows imports from loopback and private addresses
+	// (-fetch-private)
+	fetchPrivate bool
+)
+
+var errFetchAddress = errors.New("address not allowed")
+
+// fetchClient downloads imported files. Its dialer refuses loopback,
+// private and link-local addresses unless -fetch-private is set, which
+// also covers redirects and host names resolving to such addresses. It
+// connects directly: through a proxy, the dialer would only see the
+// proxy's address.
+var fetchClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy: nil,
+		DialContext: (&net.Dialer{
+			Timeout: 30 * time.Second,
+			Control: func(network, address string, c syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if ip := net.ParseIP(host); ip == nil || (!fetchPrivate && !publicAddress(ip)) {
+					return fmt.Errorf("%s: %w", host, errFetchAddress)
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout:   30 * time.Second,
+		ResponseHeaderTimeout: time.Minute,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 10 {
+			return errors.New("too many redirects")
+		}
+		if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+			return fmt.Errorf("redirect to %s URL", req.URL.Scheme)
+		}
+		return nil
+	},
+}
+
+// sharedAddressSpace is the carrier-grade NAT range (RFC 6598), which
+// like private ranges leads into the provider's network
+var _, sharedAddressSpace, _ = net.ParseCIDR("100.64.0.0/10")
+
+// publicAddress reports whether an IP address is reachable on the internet
+// rather than the host itself or a local network
+func publicAddress(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsUnspecified() &&
+		!ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() && !ip.IsMulticast() &&
+		!sharedAddressSpace.Contains(ip)
+}
+
+// fetchName picks the name of an imported file: the filename of the
+// response's Content-Disposition, else the last segment of the final URL
+func fetchName(resp *http.Response) string {
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		return path.Base(filepath.ToSlash(params["filename"]))
+	}
+	if name := path.Base(resp.Request.URL.Path); name != "/" && name != "." {
+		return name
+	}
+	return "download"
+}
+
+// fetchHandler imports a file from a URL (POST /api/fetch) into a directory.
+// It takes the form fields url, directory (relative to workingDir) and
+// optionally name, and responds with the new file as JSON once it is
+// stored. Sent with X-Upload-ID, the import reports its progress at
+// /api/uploads/<id> like an upload. An existing file is not replaced; the
+// import gets a " (n)" suffix instead.
+func fetchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user := authenticatedUser(r)
+	if usage.overCap(user) {
+		writeCapExceeded(w, r, user)
+		return
+	}
+
+	source, err := url.Parse(strings.TrimSpace(r.FormValue("url")))
+	if err != nil || (source.Scheme != "http" && source.Scheme != "https") || source.Host == "" {
+		http.Error(w, "Invalid URL (http and https only)", http.StatusBadRequest)
+		return
+	}
+	dir := strings.Trim(r.FormValue("directory"), "/")
+
+	// Security check: ensure the path is within workingDir
+	targetDir, err := resolvePath(dir)
+	if err != nil {
+		writePathError(w, err)
+		return
+	}
+	if dir != "" && !canRead(user, dir) {
+		http.Error(w, "Directory not found", http.StatusNotFound)
+		return
+	}
+	if info, err := os.Stat(targetDir); err != nil || !info.IsDir() {
+		http.Error(w, "Directory not found", http.StatusNotFound)
+		return
+	}
+
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, source.String(), nil)
+	if err != nil {
+		http.Error(w, "Invalid URL", http.StatusBadRequest)
+		return
+	}
+	req.Header.Set("User-Agent", "files")
+	resp, err := fetchClient.Do(req)
+	if err != nil {
+		if errors.Is(err, errFetchAddress) {
+			http.Error(w, "Fetching from local addresses is not allowed", http.StatusForbidden)
+			return
+		}
+		http.Error(w, "Error fetching URL: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		http.Error(w, "Error fetching URL: "+resp.Status, http.StatusBadGateway)
+		return
+	}
+	if resp.ContentLength > fetchMaxSize {
+		http.Error(w, "File is larger than "+formatSize(fetchMaxSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	name := r.FormValue("name")
+	if name == "" {
+		name = fetchName(resp)
+	}
+	name = normalizeUploadName(targetDir, sanitizeUploadName(name))
+	if name == "" || name == "." || name == ".." {
+		http.Error(w, "Invalid file name", http.StatusBadRequest)
+		return
+	}
+	requestedPath := path.Join(dir, name)
+	// Imports must not land on paths the user may not write
+	if !canWrite(user, requestedPath) {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+	policy, policyErr := checkUploadPolicy(dir, user, name, resp.ContentLength)
+	if policyErr != nil {
+		http.Error(w, policyErr.message, policyErr.status)
+		return
+	}
+	original := ""
+	if policy.uniqueNames {
+		original, name = name, uniqueUploadName(name)
+		requestedPath = path.Join(dir, name)
+		if !canWrite(user, requestedPath) {
+			http.Error(w, "Access denied", http.StatusForbidden)
+			return
+		}
+	}
+	limit := fetchMaxSize
+	if policy.maxSize >= 0 && policy.maxSize < limit {
+		limit = policy.maxSize
+	}
+	owner, fits := checkQuotaFor(requestedPath, max(resp.ContentLength, 0))
+	if !fits {
+		writeQuotaExceeded(w, r, owner)
+		return
+	}
+
+	transfer := stats.startTransfer("upload", requestedPath, clientHost(r), user, resp.ContentLength)
+	defer stats.endTransfer(transfer)
+	defer progress.track(uploadID(r), transfer, 0, resp.ContentLength)()
+
+	tmp, err := os.CreateTemp(fsPath(targetDir), "."+name+".*.tmp")
+	if err != nil {
+		http.Error(w, "Error creating file: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	// One byte more than allowed tells an oversized body without a
+	// Content-Length apart
+	written, sum, err := storeFile(tmp, transfer.reader(io.LimitReader(resp.Body, limit+1)))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	switch {
+	case transfer.canceled.Load():
+		http.Error(w, "Import canceled by the administrator", http.StatusServiceUnavailable)
+		return
+	case err != nil:
+		http.Error(w, "Error fetching URL: "+err.Error(), http.StatusBadGateway)
+		return
+	case written > limit:
+		http.Error(w, "File is larger than "+formatSize(limit), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if owner != "" {
+		if _, fits := checkQuotaFor(requestedPath, written); !fits {
+			writeQuotaExceeded(w, r, owner)
+			return
+		}
+	}
+
+	// Existing files are kept; the import takes the next free name
+	unlock := lockWrite(filepath.Join(targetDir, name))
+	dstPath := availablePath(filepath.Join(targetDir, name))
+	err = os.Rename(tmp.Name(), fsPath(dstPath))
+	unlock()
+	if err != nil {
+		http.Error(w, "Error saving file: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	requestedPath = path.Join(dir, filepath.Base(dstPath))
+	if owner != "" {
+		quotas.add(owner, written)
+	}
+	if original != "" {
+		if err := originalNames.record(fsPath(targetDir), filepath.Base(dstPath), original); err != nil {
+			http.Error(w, "Error recording name: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := syncNewName(targetDir); err != nil {
+		http.Error(w, "Error syncing file: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if checksums != nil {
+		if err := checksums.record(requestedPath, sum, written); err != nil {
+			http.Error(w, "Error recording checksum: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	auditLogf("fetch client=%s url=%q path=%q size=%d", clientHost(r), source.Redacted(), requestedPath, written)
+	journal.note(requestedPath)
+
+	writeFileInfo(w, http.StatusCreated, requestedPath)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPublicAddress(t *testing.T) {
+	tests := []struct {
+		ip     string
+		public bool
+	}{
+		{"93.184.216.34", true},
+		{"8.8.8.8", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"100.63.255.255", true},
+		{"100.128.0.0", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"fd00::1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"224.0.0.1", false},
+		{"ff02::1", false},
+		{"100.64.0.1", false},
+		{"100.127.255.254", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:10.0.0.1", false},
+	}
+	for _, tt := range tests {
+		if got := publicAddress(net.ParseIP(tt.ip)); got != tt.public {
+			t.Errorf("publicAddress(%s) = %v, want %v", tt.ip, got, tt.public)
+		}
+	}
+}
+
+func TestFetchClientRefusesLoopback(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	old := fetchPrivate
+	t.Cleanup(func() { fetchPrivate = old })
+	for _, private := range []bool{false, true} {
+		fetchPrivate = private
+		resp, err := fetchClient.Get(server.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		if refused := errors.Is(err, errFetchAddress); refused == private {
+			t.Errorf("with fetchPrivate %v: error = %v", private, err)
+		}
+	}
+}
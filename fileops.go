@@ -0,0 +1,1076 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// writeFileInfo responds with the JSON description of a path relative to
+// workingDir after a file operation
+func writeFileInfo(w http.ResponseWriter, status int, requestedPath string) {
+	info, err := served.Stat(storageName(requestedPath))
+	if err != nil {
+		http.Error(w, "Error accessing path", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !info.IsDir() {
+		setValidators(w, info)
+	}
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(newFileInfo(requestedPath, info)); err != nil {
+		log.Printf("JSON encoding error: %v", err)
+	}
+}
+
+// isWithin reports whether path is dir itself or lies below it
+func isWithin(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// moveHandler renames or moves a file or directory. It takes the form
+// fields src and dst, both relative to workingDir, and responds with the
+// moved entry as JSON.
+func moveHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	src := strings.Trim(r.FormValue("src"), "/")
+	dst := strings.Trim(r.FormValue("dst"), "/")
+	if src == "" || dst == "" {
+		http.Error(w, "Missing src or dst", http.StatusBadRequest)
+		return
+	}
+
+	// Security check: ensure both paths are within workingDir
+	srcPath, err := resolvePath(src)
+	if err != nil {
+		writePathError(w, err)
+		return
+	}
+	dstPath, err := resolvePath(dst)
+	if err != nil {
+		writePathError(w, err)
+		return
+	}
+
+	// Paths the user may not see look nonexistent
+	user := authenticatedUser(r)
+	if !canRead(user, src) || !canRead(user, dst) {
+		http.Error(w, "Path not found", http.StatusNotFound)
+		return
+	}
+	if !canWrite(user, src) || !canWrite(user, dst) {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+	// Mounts are usually on filesystems of their own, which a rename can't
+	// cross
+	if mountOf(src) != mountOf(dst) {
+		http.Error(w, "Cannot move between mounts; copy instead", http.StatusBadRequest)
+		return
+	}
+
+	srcInfo, err := os.Lstat(srcPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.Error(w, "Path not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Error accessing path", http.StatusInternalServerError)
+		return
+	}
+	if isWithin(workingDir, srcPath) {
+		http.Error(w, "Cannot move the root directory", http.StatusBadRequest)
+		return
+	}
+	if srcInfo.IsDir() && !treeReadable(user, src, srcPath) {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+	if policyErr := checkMovePolicy(user, src, dst); policyErr != nil {
+		http.Error(w, policyErr.message, policyErr.status)
+		return
+	}
+
+	// A rename that only changes case or Unicode form finds the source
+	// itself at the destination on some filesystems
+	if dstInfo, err := os.Lstat(dstPath); err == nil && !os.SameFile(srcInfo, dstInfo) {
+		http.Error(w, "Destination already exists", http.StatusConflict)
+		return
+	}
+	if srcInfo.IsDir() && isWithin(dstPath, srcPath) {
+		http.Error(w, "Cannot move a directory into itself", http.StatusBadRequest)
+		return
+	}
+
+	// Moving between home directories transfers the storage to the
+	// destination's owner
+	srcOwner, dstOwner := homeOwner(src), homeOwner(dst)
+	var size int64
+	if userQuota > 0 && srcOwner != dstOwner {
+		size = treeSize(srcPath)
+		if owner, fits := checkQuotaFor(dst, size); !fits {
+			writeQuotaExceeded(w, r, owner)
+			return
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil {
+		http.Error(w, "Error creating directory: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := os.Rename(srcPath, dstPath); err != nil {
+		http.Error(w, "Error moving: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if size > 0 {
+		quotas.add(srcOwner, -size)
+		quotas.add(dstOwner, size)
+	}
+	if checksums != nil {
+		if err := checksums.relocate(src, dst, true); err != nil {
+			log.Printf("Failed to record checksums: %v", err)
+		}
+	}
+	auditLogf("move client=%s src=%q dst=%q", clientHost(r), src, dst)
+	journal.note(src)
+	journal.note(dst)
+
+	writeFileInfo(w, http.StatusOK, dst)
+}
+
+// treeReadable reports whether a user may read everything in the tree at
+// requestedPath. Moved or copied elsewhere, entries the access rules or
+// -auth-only hide would fall under the rules of their new path.
+func treeReadable(user, requestedPath, fullPath string) bool {
+	readable := true
+	filepath.WalkDir(fullPath, func(p string, d fs.DirEntry, err error) error {
+		rel, relErr := filepath.Rel(fullPath, p)
+		if relErr != nil {
+			return relErr
+		}
+		if !canRead(user, path.Join(requestedPath, filepath.ToSlash(rel))) {
+			readable = false
+			return fs.SkipAll
+		}
+		return nil
+	})
+	return readable
+}
+
+// availablePath returns fullPath, or if something already exists there the
+// first free variant with a " (n)" suffix before the extension
+func availablePath(fullPath string) string {
+	if _, err := os.Lstat(fullPath); os.IsNotExist(err) {
+		return fullPath
+	}
+	ext := filepath.Ext(fullPath)
+	stem := strings.TrimSuffix(fullPath, ext)
+	for n := 1; ; n++ {
+		candidate := fmt.Sprintf("%s (%d)%s", stem, n, ext)
+		if _, err := os.Lstat(candidate); os.IsNotExist(err) {
+			return candidate
+		}
+	}
+}
+
+// copiedSize returns the bytes a copy of a tree takes up. Unlike treeSize
+// it counts every hard link, since copyTree writes each as a file of its own.
+func copiedSize(root string) int64 {
+	var size int64
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// errLinkOutside refuses copying a symbolic link that leads out of the
+// copied tree: in the copy, it would lead somewhere else
+var errLinkOutside = errors.New("symbolic link leads outside the copied tree")
+
+// copyTree copies a file, symbolic link or directory tree from src to dst,
+// keeping permissions and modification times. Symbolic links must lead
+// within the tree; in the copy they lead to the same place in the copy.
+func copyTree(src, dst string) error {
+	return copyEntry(src, dst, src, dst)
+}
+
+// copyEntry copies src, within the tree copied from srcRoot to dstRoot
+func copyEntry(srcRoot, dstRoot, src, dst string) error {
+	info, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		// Files in cold storage are copied, not linked to twice
+		if tiers != nil {
+			if cold, ok := tiers.stub(src); ok {
+				return copyTree(cold, dst)
+			}
+		}
+		target, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		resolved := target
+		if !filepath.IsAbs(target) {
+			resolved = filepath.Join(filepath.Dir(src), target)
+		}
+		rel, err := filepath.Rel(srcRoot, resolved)
+		if err != nil || !isWithin(resolved, srcRoot) {
+			return errLinkOutside
+		}
+		copied := filepath.Join(dstRoot, rel)
+		if !filepath.IsAbs(target) {
+			if copied, err = filepath.Rel(filepath.Dir(dst), copied); err != nil {
+				return err
+			}
+		}
+		return os.Symlink(copied, dst)
+
+	case info.IsDir():
+		entries, err := os.ReadDir(src)
+		if err != nil {
+			return err
+		}
+		if err := os.Mkdir(dst, info.Mode().Perm()|0700); err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := copyEntry(srcRoot, dstRoot, filepath.Join(src, entry.Name()), filepath.Join(dst, entry.Name())); err != nil {
+				return err
+			}
+		}
+
+	default:
+		if err := copyFile(src, dst, info.Mode().Perm()); err != nil {
+			return err
+		}
+	}
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
+
+// copyFile copies the contents of a regular file to a new file
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// copyHandler duplicates a file or recursively copies a directory. It
+// takes the form fields src and dst, both relative to workingDir; if dst
+// exists, a " (n)" suffix is added. It responds with the copy as JSON.
+func copyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	src := strings.Trim(r.FormValue("src"), "/")
+	dst := strings.Trim(r.FormValue("dst"), "/")
+	if src == "" || dst == "" {
+		http.Error(w, "Missing src or dst", http.StatusBadRequest)
+		return
+	}
+
+	// Security check: ensure both paths are within workingDir
+	srcPath, err := resolvePath(src)
+	if err != nil {
+		writePathError(w, err)
+		return
+	}
+	dstPath, err := resolvePath(dst)
+	if err != nil {
+		writePathError(w, err)
+		return
+	}
+
+	// Paths the user may not see look nonexistent
+	user := authenticatedUser(r)
+	if !canRead(user, src) || !canRead(user, dst) {
+		http.Error(w, "Path not found", http.StatusNotFound)
+		return
+	}
+	if !canWrite(user, dst) {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	srcInfo, err := os.Lstat(srcPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.Error(w, "Path not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Error accessing path", http.StatusInternalServerError)
+		return
+	}
+	if srcInfo.IsDir() && isWithin(dstPath, srcPath) {
+		http.Error(w, "Cannot copy a directory into itself", http.StatusBadRequest)
+		return
+	}
+	if srcInfo.IsDir() && !treeReadable(user, src, srcPath) {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+	if policyErr := checkMovePolicy(user, src, dst); policyErr != nil {
+		http.Error(w, policyErr.message, policyErr.status)
+		return
+	}
+
+	size := copiedSize(srcPath)
+	owner, fits := checkQuotaFor(dst, size)
+	if !fits {
+		writeQuotaExceeded(w, r, owner)
+		return
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil {
+		http.Error(w, "Error creating directory: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	dstPath = availablePath(dstPath)
+	dst = path.Join(path.Dir(dst), filepath.Base(dstPath))
+	if err := copyTree(srcPath, dstPath); err != nil {
+		// Don't leave a partial copy behind, unless another request
+		// created the destination in the meantime
+		if !os.IsExist(err) {
+			os.RemoveAll(dstPath)
+		}
+		if errors.Is(err, errLinkOutside) {
+			http.Error(w, "Cannot copy symbolic links that lead outside the copied folder", http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "Error copying: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if owner != "" {
+		quotas.add(owner, size)
+	}
+	if checksums != nil {
+		if err := checksums.relocate(src, dst, false); err != nil {
+			log.Printf("Failed to record checksums: %v", err)
+		}
+	}
+	auditLogf("copy client=%s src=%q dst=%q size=%d", clientHost(r), src, dst, size)
+	journal.note(dst)
+
+	writeFileInfo(w, http.StatusOK, dst)
+}
+
+// mkdirHandler creates a directory, including missing parents. It takes
+// the form field path, relative to workingDir, and responds with the
+// directory as JSON.
+func mkdirHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	requestedPath := strings.Trim(r.FormValue("path"), "/")
+	if requestedPath == "" {
+		http.Error(w, "Missing path", http.StatusBadRequest)
+		return
+	}
+
+	// Security check: ensure the path is within workingDir
+	_, err := resolvePath(requestedPath)
+	if err != nil {
+		writePathError(w, err)
+		return
+	}
+
+	// Paths the user may not see look nonexistent
+	user := authenticatedUser(r)
+	if !canRead(user, requestedPath) {
+		http.Error(w, "Path not found", http.StatusNotFound)
+		return
+	}
+	if !canWrite(user, requestedPath) {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	if info, err := served.Stat(storageName(requestedPath)); err == nil {
+		if !info.IsDir() {
+			http.Error(w, "A file with that name already exists", http.StatusConflict)
+			return
+		}
+		// Creating an existing directory succeeds, like mkdir -p
+		writeFileInfo(w, http.StatusOK, requestedPath)
+		return
+	}
+
+	store, ok := served.(writableStorage)
+	if !ok {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+	if err := store.MkdirAll(storageName(requestedPath), 0755); err != nil {
+		http.Error(w, "Error creating directory: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	auditLogf("mkdir client=%s path=%q", clientHost(r), requestedPath)
+	journal.note(requestedPath)
+
+	writeFileInfo(w, http.StatusCreated, requestedPath)
+}
+
+// putHandler stores the request body as a file (PUT /upload/<path>),
+// creating missing directories. If-Match, If-None-Match and
+// If-Unmodified-Since make the write conditional. The file is written
+// under a temporary name and renamed into place, so readers never see it
+// half-written. It responds with the file as JSON: 201 Created for a new
+// file, 200 OK for a replaced one. With Content-Range, the body is one
+// chunk of a larger file (see putChunk).
+func putHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := authenticatedUser(r)
+	if usage.overCap(user) {
+		writeCapExceeded(w, r, user)
+		return
+	}
+
+	dir, name := path.Split(strings.Trim(pathParam(r, "path"), "/"))
+	dir = strings.Trim(dir, "/")
+	if name == "" {
+		http.Error(w, "Missing file name", http.StatusBadRequest)
+		return
+	}
+
+	// Security check: ensure the path is within workingDir
+	targetDir, err := resolvePath(dir)
+	if err != nil {
+		writePathError(w, err)
+		return
+	}
+	if dir != "" && !canRead(user, dir) {
+		http.Error(w, "Directory not found", http.StatusNotFound)
+		return
+	}
+	name = normalizeUploadName(targetDir, sanitizeUploadName(name))
+	requestedPath := path.Join(dir, name)
+	// Uploads must not replace files the user may not write, such as
+	// authenticated-only ones
+	if !canWrite(user, requestedPath) {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+	// A chunk's Content-Range tells the size of the whole file
+	size := r.ContentLength
+	if _, _, total, err := parseContentRange(r.Header.Get("Content-Range")); err == nil && total >= 0 {
+		size = total
+	}
+	policy, policyErr := checkUploadPolicy(dir, user, name, size)
+	if policyErr != nil {
+		http.Error(w, policyErr.message, policyErr.status)
+		return
+	}
+	// PUT names the file, which uploads here don't choose
+	if policy.uniqueNames {
+		http.Error(w, "Uploads here are stored under generated names; upload with a form instead", http.StatusForbidden)
+		return
+	}
+
+	if err := os.MkdirAll(fsPath(targetDir), 0755); err != nil {
+		http.Error(w, "Error creating directory: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	dstPath := fsPath(filepath.Join(targetDir, name))
+	var replaced int64
+	if info, err := os.Stat(dstPath); err == nil {
+		if info.IsDir() {
+			http.Error(w, "A directory with that name already exists", http.StatusConflict)
+			return
+		}
+		// Visitors of a drop box only add files, and so does everyone in a
+		// directory whose upload policy keeps existing files
+		if !canBrowse(r) || (policy.onConflict != "" && policy.onConflict != conflictOverwrite) {
+			http.Error(w, "A file with that name already exists", http.StatusConflict)
+			return
+		}
+		replaced = info.Size()
+	}
+
+	// Fail early if the preconditions don't hold; they are checked again
+	// when the file is renamed into place
+	if !writePreconditionsHold(r, dstPath) {
+		http.Error(w, "Precondition failed", http.StatusPreconditionFailed)
+		return
+	}
+	if r.Header.Get("Content-Range") != "" {
+		putChunk(w, r, user, requestedPath, dstPath, replaced)
+		return
+	}
+
+	// Writes into a home directory count against its owner's quota, which
+	// needs the size up front
+	owner, fits := checkQuotaFor(requestedPath, r.ContentLength-replaced)
+	if owner != "" && r.ContentLength < 0 {
+		http.Error(w, "Length required", http.StatusLengthRequired)
+		return
+	}
+	if !fits {
+		writeQuotaExceeded(w, r, owner)
+		return
+	}
+
+	transfer := stats.startTransfer("upload", requestedPath, clientHost(r), user, r.ContentLength)
+	defer stats.endTransfer(transfer)
+	defer progress.track(uploadID(r), transfer, 0, r.ContentLength)()
+
+	tmp, err := os.CreateTemp(fsPath(targetDir), "."+name+".*.tmp")
+	if err != nil {
+		http.Error(w, "Error creating file: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	var body io.Reader = r.Body
+	if policy.maxSize >= 0 {
+		body = io.LimitReader(r.Body, policy.maxSize+1)
+	}
+	stopWatching := watchUpload(w, transfer)
+	defer stopWatching()
+	written, sum, err := storeFile(tmp, transfer.reader(body))
+	stopWatching()
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err == nil && policy.maxSize >= 0 && written > policy.maxSize {
+		policyErr := policy.check(user, name, written)
+		http.Error(w, policyErr.message, policyErr.status)
+		return
+	}
+	if err != nil {
+		if status, message := transfer.interrupted(); status != 0 {
+			http.Error(w, message, status)
+			return
+		}
+		http.Error(w, "Error saving file: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	finishPut(w, r, requestedPath, tmp.Name(), dstPath, written, 0, sum)
+}
+
+// finishPut renames a completely written file into place if the request's
+// preconditions still hold, records it and responds with it as JSON.
+// charged is how much of it already counts towards the quota.
+func finishPut(w http.ResponseWriter, r *http.Request, requestedPath, tmpPath, dstPath string, written, charged int64, sum string) {
+	unlock := lockWrite(dstPath)
+	var replaced int64
+	info, err := os.Stat(dstPath)
+	exists := err == nil
+	if exists {
+		replaced = info.Size()
+	}
+	// Visitors of a drop box only add files
+	if exists && !canBrowse(r) {
+		unlock()
+		http.Error(w, "A file with that name already exists", http.StatusConflict)
+		return
+	}
+	if !writePreconditionsHold(r, dstPath) {
+		unlock()
+		http.Error(w, "Precondition failed", http.StatusPreconditionFailed)
+		return
+	}
+	err = os.Rename(tmpPath, dstPath)
+	unlock()
+	if err != nil {
+		http.Error(w, "Error saving file: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if owner := homeOwner(requestedPath); owner != "" {
+		quotas.add(owner, written-charged-replaced)
+	}
+	if err := syncNewName(filepath.Dir(dstPath)); err != nil {
+		http.Error(w, "Error syncing file: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if checksums != nil {
+		if err := checksums.record(requestedPath, sum, written); err != nil {
+			http.Error(w, "Error recording checksum: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	auditLogf("upload client=%s path=%q size=%d", clientHost(r), requestedPath, written)
+	journal.note(requestedPath)
+
+	status := http.StatusOK
+	if !exists {
+		status = http.StatusCreated
+	}
+	writeFileInfo(w, status, requestedPath)
+}
+
+// ChunkStatus reports how much of a chunked upload has arrived
+type ChunkStatus struct {
+	Path   string `json:"path"`
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+}
+
+// putChunk stores one chunk of a file uploaded in pieces: PUT
+// /upload/<path> with "Content-Range: bytes <start>-<end>/<total>" and an
+// upload ID. Chunks are appended in order to a hidden partial file named
+// after the ID and answered with 202 Accepted; the last one moves the file
+// into place. A chunk that doesn't continue the partial file is refused
+// with 409 Conflict and the partial file's length in Upload-Offset, which
+// is where the client resumes, e.g. after a dropped connection.
+func putChunk(w http.ResponseWriter, r *http.Request, user, requestedPath, dstPath string, replaced int64) {
+	id := uploadID(r)
+	if id == "" {
+		http.Error(w, "Chunked uploads need an X-Upload-ID", http.StatusBadRequest)
+		return
+	}
+	start, end, total, err := parseContentRange(r.Header.Get("Content-Range"))
+	if err != nil || total < 0 {
+		http.Error(w, "Invalid Content-Range", http.StatusBadRequest)
+		return
+	}
+	length := end - start + 1
+	if r.ContentLength >= 0 && r.ContentLength != length {
+		http.Error(w, "Body length doesn't match Content-Range", http.StatusBadRequest)
+		return
+	}
+
+	partPath := filepath.Join(filepath.Dir(dstPath), "."+filepath.Base(dstPath)+"."+id+".part")
+	unlock := lockWrite(partPath)
+	var offset int64
+	if info, err := os.Stat(partPath); err == nil {
+		offset = info.Size()
+	}
+	if start != offset {
+		unlock()
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		http.Error(w, "Chunk doesn't continue the upload", http.StatusConflict)
+		return
+	}
+	// The partial file counts towards the quota as it grows, so each chunk
+	// has to fit; the file it replaces is freed once the upload completes
+	if start == 0 {
+		if owner, fits := checkQuotaFor(requestedPath, total-replaced); !fits {
+			unlock()
+			writeQuotaExceeded(w, r, owner)
+			return
+		}
+	}
+	owner, fits := checkQuotaFor(requestedPath, length-replaced)
+	if !fits {
+		unlock()
+		writeQuotaExceeded(w, r, owner)
+		return
+	}
+
+	f, err := os.OpenFile(partPath, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		unlock()
+		http.Error(w, "Error creating file: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	transfer := stats.startTransfer("upload", requestedPath, clientHost(r), user, length)
+	defer stats.endTransfer(transfer)
+	defer progress.track(id, transfer, start, total)()
+	stopWatching := watchUpload(w, transfer)
+	defer stopWatching()
+	written, err := io.CopyN(io.NewOffsetWriter(f, start), transfer.reader(r.Body), length)
+	stopWatching()
+	if owner != "" {
+		quotas.add(owner, written)
+	}
+	if err == nil && end+1 == total && fsyncPolicy != fsyncOff {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	unlock()
+	w.Header().Set("Upload-Offset", strconv.FormatInt(start+written, 10))
+	if err != nil {
+		// What arrived is kept; the client resumes at Upload-Offset
+		status, message := transfer.interrupted()
+		switch {
+		case status != 0:
+			http.Error(w, message, status)
+		case err == io.EOF || err == io.ErrUnexpectedEOF:
+			http.Error(w, "Body shorter than Content-Range", http.StatusBadRequest)
+		default:
+			http.Error(w, "Error saving file: "+err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if end+1 < total {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		if err := json.NewEncoder(w).Encode(ChunkStatus{Path: requestedPath, Offset: end + 1, Size: total}); err != nil {
+			log.Printf("JSON encoding error: %v", err)
+		}
+		return
+	}
+
+	size, sum, err := hashFile(partPath)
+	if err != nil {
+		http.Error(w, "Error reading file: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	finishPut(w, r, requestedPath, partPath, dstPath, size, size, sum)
+}
+
+// partialUploadLifetime is how long the partial file of a chunked upload
+// is kept after its last chunk (-partial-upload-lifetime); 0 keeps them
+var partialUploadLifetime time.Duration
+
+// partialSweepInterval is how often partial files are checked for expiry
+const partialSweepInterval = time.Hour
+
+// partialUploadName matches the names putChunk gives partial files
+var partialUploadName = regexp.MustCompile(`^\..+\.[A-Za-z0-9_-]{1,64}\.part$`)
+
+// startPartialUploadSweep removes partial files of chunked uploads that
+// were abandoned, e.g. when a client started over under a new ID
+func startPartialUploadSweep() {
+	ticker := time.NewTicker(partialSweepInterval)
+	go func() {
+		for ; ; <-ticker.C {
+			sweepPartialUploads()
+		}
+	}()
+}
+
+// sweepPartialUploads removes the partial files older than
+// partialUploadLifetime
+func sweepPartialUploads() {
+	walkServed(workingDir, "", func(p, rel string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !partialUploadName.MatchString(d.Name()) {
+			return nil
+		}
+		partPath := fsPath(p)
+		// A chunk may be arriving right now
+		unlock := lockWrite(partPath)
+		defer unlock()
+		info, err := os.Stat(partPath)
+		if err != nil || time.Since(info.ModTime()) <= partialUploadLifetime {
+			return nil
+		}
+		if err := os.Remove(partPath); err != nil {
+			log.Printf("Failed to remove abandoned upload %s: %v", rel, err)
+			return nil
+		}
+		quotas.add(homeOwner(rel), -info.Size())
+		auditLogf("upload-expired path=%q size=%d", rel, info.Size())
+		return nil
+	})
+}
+
+// parseContentRange parses a Content-Range header of the form
+// "bytes <start>-<end>/<total>", where total may be "*" (returned as -1)
+func parseContentRange(header string) (start, end, total int64, err error) {
+	spec, ok := strings.CutPrefix(header, "bytes ")
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("invalid content range")
+	}
+	span, length, ok := strings.Cut(spec, "/")
+	first, last, ok2 := strings.Cut(span, "-")
+	if !ok || !ok2 {
+		return 0, 0, 0, fmt.Errorf("invalid content range")
+	}
+	if start, err = strconv.ParseInt(first, 10, 64); err != nil {
+		return 0, 0, 0, err
+	}
+	if end, err = strconv.ParseInt(last, 10, 64); err != nil {
+		return 0, 0, 0, err
+	}
+	total = -1
+	if length != "*" {
+		if total, err = strconv.ParseInt(length, 10, 64); err != nil {
+			return 0, 0, 0, err
+		}
+	}
+	if start < 0 || end < start || (total >= 0 && total <= end) {
+		return 0, 0, 0, fmt.Errorf("invalid content range")
+	}
+	return start, end, total, nil
+}
+
+// patchHandler writes the request body into an existing file at the
+// offsets given by Content-Range (PATCH /upload/<path>), which lets tools
+// update or append to large files without sending them again. The range
+// may start anywhere up to the end of the file; a total length other than
+// "*" sets the file's new size. Only authenticated users may patch files.
+func patchHandler(w http.ResponseWriter, r *http.Request) {
+	user := authenticatedUser(r)
+	if user == "" {
+		if authEnabled() {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", authRealm))
+			http.Error(w, "Authentication required", http.StatusUnauthorized)
+			return
+		}
+		http.Error(w, "Range writes require -auth", http.StatusForbidden)
+		return
+	}
+	if usage.overCap(user) {
+		writeCapExceeded(w, r, user)
+		return
+	}
+
+	start, end, total, err := parseContentRange(r.Header.Get("Content-Range"))
+	if err != nil {
+		http.Error(w, "Invalid Content-Range", http.StatusBadRequest)
+		return
+	}
+	length := end - start + 1
+	if r.ContentLength >= 0 && r.ContentLength != length {
+		http.Error(w, "Body length doesn't match Content-Range", http.StatusBadRequest)
+		return
+	}
+
+	requestedPath := strings.Trim(pathParam(r, "path"), "/")
+
+	// Security check: ensure the path is within workingDir
+	fullPath, err := resolvePath(requestedPath)
+	if err != nil {
+		writePathError(w, err)
+		return
+	}
+	if !canRead(user, requestedPath) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if !canWrite(user, requestedPath) {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	// The preconditions are checked and the file written under its lock
+	unlock := lockWrite(fullPath)
+	defer unlock()
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Error accessing path", http.StatusInternalServerError)
+		return
+	}
+	if info.IsDir() {
+		http.Error(w, "Cannot patch a directory", http.StatusConflict)
+		return
+	}
+	if !writePreconditionsHold(r, fullPath) {
+		http.Error(w, "Precondition failed", http.StatusPreconditionFailed)
+		return
+	}
+	// Ranges may overwrite or extend a file, but not leave a hole in it
+	if start > info.Size() {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", info.Size()))
+		http.Error(w, "Range starts beyond the end of the file", http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+
+	newSize := max(info.Size(), end+1)
+	if total >= 0 {
+		newSize = total
+	}
+	if _, policyErr := checkUploadPolicy(path.Dir(requestedPath), user, path.Base(requestedPath), newSize); policyErr != nil {
+		http.Error(w, policyErr.message, policyErr.status)
+		return
+	}
+	owner, fits := checkQuotaFor(requestedPath, newSize-info.Size())
+	if !fits {
+		writeQuotaExceeded(w, r, owner)
+		return
+	}
+
+	f, err := os.OpenFile(fsPath(fullPath), os.O_WRONLY, 0)
+	if err != nil {
+		http.Error(w, "Error opening file: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	transfer := stats.startTransfer("upload", requestedPath, clientHost(r), user, length)
+	defer stats.endTransfer(transfer)
+	stopWatching := watchUpload(w, transfer)
+	defer stopWatching()
+	written, err := io.CopyN(io.NewOffsetWriter(f, start), transfer.reader(r.Body), length)
+	stopWatching()
+	if err != nil {
+		// What arrived is written; the client can retry the rest. Only
+		// what it added beyond the end of the file takes up space.
+		if owner != "" {
+			quotas.add(owner, max(0, start+written-info.Size()))
+		}
+		if status, message := transfer.interrupted(); status != 0 {
+			http.Error(w, fmt.Sprintf("%s after %d bytes", message, written), status)
+			return
+		}
+		status := http.StatusInternalServerError
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			status = http.StatusBadRequest
+		}
+		http.Error(w, fmt.Sprintf("Error writing range after %d bytes: %v", written, err), status)
+		return
+	}
+	if total >= 0 {
+		if err := f.Truncate(total); err != nil {
+			http.Error(w, "Error resizing file: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if fsyncPolicy != fsyncOff {
+		if err := f.Sync(); err != nil {
+			http.Error(w, "Error syncing file: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if owner != "" {
+		quotas.add(owner, newSize-info.Size())
+	}
+	if checksums != nil {
+		// The recorded checksum covers the whole file
+		if err := recordFileChecksum(requestedPath, fullPath); err != nil {
+			http.Error(w, "Error recording checksum: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	auditLogf("patch client=%s path=%q range=%d-%d size=%d", clientHost(r), requestedPath, start, end, newSize)
+	journal.note(requestedPath)
+
+	writeFileInfo(w, http.StatusOK, requestedPath)
+}
+
+// ResumeInfo describes a file for a client about to resume downloading it
+type ResumeInfo struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	ETag    string    `json:"etag"`
+	// Prefix is the number of leading bytes hashed into PrefixSHA256
+	Prefix       int64  `json:"prefix,omitempty"`
+	PrefixSHA256 string `json:"prefixSha256,omitempty"`
+}
+
+// resumeHandler describes a file (/api/resume/<path>) so a download tool
+// can check that a partial local copy still matches before resuming it
+// with a Range request. With ?prefix=<bytes> it also returns the SHA-256
+// of the first bytes of the file.
+func resumeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	requestedPath := strings.Trim(pathParam(r, "path"), "/")
+
+	// Security check: ensure the path is within workingDir
+	fullPath, err := resolvePath(requestedPath)
+	if err != nil {
+		writePathError(w, err)
+		return
+	}
+	if !canRead(authenticatedUser(r), requestedPath) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	f, err := os.Open(fsPath(fullPath))
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Error opening file", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, "Error getting file info", http.StatusInternalServerError)
+		return
+	}
+	if info.IsDir() {
+		http.Error(w, "Not a file", http.StatusBadRequest)
+		return
+	}
+
+	result := ResumeInfo{
+		Path:    requestedPath,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		ETag:    fileETag(info),
+	}
+	if value := r.URL.Query().Get("prefix"); value != "" {
+		prefix, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || prefix < 0 {
+			http.Error(w, "Invalid prefix", http.StatusBadRequest)
+			return
+		}
+		if prefix > info.Size() {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", info.Size()))
+			http.Error(w, "Prefix is longer than the file", http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		h := sha256.New()
+		if _, err := io.CopyN(h, f, prefix); err != nil {
+			http.Error(w, "Error reading file", http.StatusInternalServerError)
+			return
+		}
+		result.Prefix = prefix
+		result.PrefixSHA256 = hex.EncodeToString(h.Sum(nil))
+	}
+
+	setValidators(w, info)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		log.Printf("JSON encoding error: %v", err)
+	}
+}
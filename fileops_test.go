@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPutChunkResume(t *testing.T) {
+	root := useWorkingDir(t)
+	content := "0123456789"
+
+	steps := []struct {
+		name string
+		id   string
+		// contentRange and body make up the chunk; a short body is sent
+		// without a length, as by a client whose connection broke
+		contentRange string
+		body         string
+		short        bool
+		status       int
+		offset       string
+	}{
+		{"missing ID", "", "bytes 0-3/10", "0123", false, http.StatusBadRequest, ""},
+		{"invalid range", "a", "bytes 3-0/10", "", false, http.StatusBadRequest, ""},
+		{"first chunk", "a", "bytes 0-3/10", "0123", false, http.StatusAccepted, "4"},
+		{"repeated chunk", "a", "bytes 0-3/10", "0123", false, http.StatusConflict, "4"},
+		{"gap", "a", "bytes 6-9/10", "6789", false, http.StatusConflict, "4"},
+		{"other upload", "b", "bytes 4-9/10", "456789", false, http.StatusConflict, "0"},
+		{"length mismatch", "a", "bytes 4-5/10", "456", false, http.StatusBadRequest, ""},
+		{"interrupted", "a", "bytes 4-7/10", "45", true, http.StatusBadRequest, "6"},
+		{"resumed", "a", "bytes 6-7/10", "67", false, http.StatusAccepted, "8"},
+		{"last chunk", "a", "bytes 8-9/10", "89", false, http.StatusCreated, "10"},
+	}
+	for _, step := range steps {
+		r := httptest.NewRequest(http.MethodPut, "/upload/big.bin", strings.NewReader(step.body))
+		r = r.WithContext(context.WithValue(r.Context(), routeParamsKey{}, map[string]string{"path": "big.bin"}))
+		r.Header.Set("Content-Range", step.contentRange)
+		if step.id != "" {
+			r.Header.Set("X-Upload-ID", step.id)
+		}
+		if step.short {
+			r.ContentLength = -1
+		}
+		w := httptest.NewRecorder()
+		putHandler(w, r)
+		if w.Code != step.status {
+			t.Errorf("%s: status = %d, want %d (%s)", step.name, w.Code, step.status, strings.TrimSpace(w.Body.String()))
+		}
+		if got := w.Header().Get("Upload-Offset"); got != step.offset {
+			t.Errorf("%s: Upload-Offset = %q, want %q", step.name, got, step.offset)
+		}
+	}
+
+	got, err := os.ReadFile(filepath.Join(root, "big.bin"))
+	if err != nil || string(got) != content {
+		t.Errorf("uploaded file = %q, %v; want %q", got, err, content)
+	}
+	if _, err := os.Stat(filepath.Join(root, ".big.bin.a.part")); !os.IsNotExist(err) {
+		t.Errorf("partial file left behind: %v", err)
+	}
+}
+
+func TestPatchChargesQuotaOnce(t *testing.T) {
+	root := useWorkingDir(t)
+	oldUsers, oldQuota, oldQuotas := users, userQuota, quotas
+	users, userQuota = map[string]string{"alice": "secret"}, 1<<20
+	quotas = &quotaTracker{used: make(map[string]int64), checked: make(map[string]time.Time)}
+	t.Cleanup(func() { users, userQuota, quotas = oldUsers, oldQuota, oldQuotas })
+	if err := os.Mkdir(filepath.Join(root, "alice"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "alice", "data.bin"), make([]byte, 1000), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := quotas.stored("alice"); got != 1000 {
+		t.Fatalf("stored before patching = %d, want 1000", got)
+	}
+
+	steps := []struct {
+		name         string
+		contentRange string
+		stored       int64
+	}{
+		{"overwrite", "bytes 0-99/*", 1000},
+		{"overwrite again", "bytes 0-99/*", 1000},
+		{"overwrite and extend", "bytes 950-1049/*", 1050},
+		{"truncate", "bytes 0-9/500", 500},
+	}
+	for _, step := range steps {
+		start, end, _, _ := parseContentRange(step.contentRange)
+		r := httptest.NewRequest(http.MethodPatch, "/upload/alice/data.bin", strings.NewReader(strings.Repeat("x", int(end-start+1))))
+		r = r.WithContext(context.WithValue(r.Context(), routeParamsKey{}, map[string]string{"path": "alice/data.bin"}))
+		r.Header.Set("Content-Range", step.contentRange)
+		r.SetBasicAuth("alice", "secret")
+		w := httptest.NewRecorder()
+		patchHandler(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d (%s)", step.name, w.Code, strings.TrimSpace(w.Body.String()))
+		}
+		if got := quotas.stored("alice"); got != step.stored {
+			t.Errorf("%s: stored = %d, want %d", step.name, got, step.stored)
+		}
+	}
+}
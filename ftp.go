@@ -0,0 +1,798 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// FTP server settings (-ftp-passive-ports, -ftp-public-host)
+var (
+	// ftpPassivePorts is the range of ports passive data connections
+	// listen on, or 0 to 0 for any free port
+	ftpPassivePorts [2]int
+	// ftpPublicHost is the IPv4 address passive replies name, for servers
+	// behind NAT, or "" for the address the client connected to
+	ftpPublicHost string
+	// ftpTLS is the configuration of AUTH TLS, or nil without TLS
+	ftpTLS *tls.Config
+)
+
+// ftpIdleTimeout is how long a control connection may stay silent, and
+// ftpDataTimeout how long a data connection may take to open
+const (
+	ftpIdleTimeout = 5 * time.Minute
+	ftpDataTimeout = 30 * time.Second
+)
+
+// parsePortRange parses a range of ports such as "50000-50100"
+func parsePortRange(s string) ([2]int, error) {
+	first, last, _ := strings.Cut(s, "-")
+	low, err1 := strconv.Atoi(strings.TrimSpace(first))
+	high, err2 := strconv.Atoi(strings.TrimSpace(last))
+	if err1 != nil || err2 != nil || low < 1 || high > 65535 || low > high {
+		return [2]int{}, fmt.Errorf("invalid port range %q (expected e.g. 50000-50100)", s)
+	}
+	return [2]int{low, high}, nil
+}
+
+// serveFTP runs the FTP listener of -ftp. While a replaced process still
+// holds the address after an upgrade, it retries.
+func serveFTP(address string) {
+	var l net.Listener
+	for logged := false; ; time.Sleep(time.Second) {
+		var err error
+		if l, err = net.Listen("tcp", address); err == nil {
+			break
+		}
+		if !errors.Is(err, syscall.EADDRINUSE) {
+			log.Fatal("FTP listener failed:", err)
+		}
+		if !logged {
+			log.Printf("%s is in use, retrying the FTP listener", address)
+			logged = true
+		}
+	}
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			log.Fatal("FTP listener failed:", err)
+		}
+		go serveFTPConn(conn)
+	}
+}
+
+// ftpSession is the state of an FTP control connection
+type ftpSession struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	client string
+	// pendingUser is the name of USER until PASS
+	pendingUser string
+	loggedIn    bool
+	user        string
+	// dir is the current directory, relative to the served root
+	dir string
+	// passive listens for the next data connection (PASV, EPSV); active
+	// is the address to connect it to (PORT, EPRT)
+	passive net.Listener
+	active  string
+	// restart is the offset of the next download (REST)
+	restart    int64
+	renameFrom string
+	// secure is set once the control connection is encrypted (AUTH TLS),
+	// and protected once data connections are to be (PROT P)
+	secure    bool
+	protected bool
+	failures  int
+}
+
+// serveFTPConn runs the commands of an FTP control connection
+func serveFTPConn(conn net.Conn) {
+	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	if !addressAllowed(host) {
+		auditLogf("ip-denied client=%s path=%q", host, "ftp")
+		fmt.Fprintf(conn, "421 Access from your address is not allowed\r\n")
+		conn.Close()
+		return
+	}
+	s := &ftpSession{conn: conn, reader: bufio.NewReaderSize(conn, 4096), client: host}
+	defer func() {
+		s.closePassive()
+		s.conn.Close()
+	}()
+
+	s.reply(220, "Files FTP server ready")
+	for {
+		s.conn.SetReadDeadline(time.Now().Add(ftpIdleTimeout))
+		line, err := s.reader.ReadSlice('\n')
+		if err != nil {
+			var netErr net.Error
+			switch {
+			case errors.Is(err, bufio.ErrBufferFull):
+				s.reply(500, "Command line too long")
+			case errors.As(err, &netErr) && netErr.Timeout():
+				s.reply(421, "Timeout, closing the connection")
+			}
+			return
+		}
+		verb, arg, _ := strings.Cut(strings.TrimRight(string(line), "\r\n"), " ")
+		if !s.command(strings.ToUpper(verb), arg) {
+			return
+		}
+	}
+}
+
+// reply sends a one-line reply
+func (s *ftpSession) reply(code int, message string) {
+	fmt.Fprintf(s.conn, "%d %s\r\n", code, message)
+}
+
+// command runs one command and reports whether to keep the connection
+func (s *ftpSession) command(verb, arg string) bool {
+	switch verb {
+	case "QUIT":
+		s.reply(221, "Goodbye")
+		return false
+	case "NOOP":
+		s.reply(200, "OK")
+		return true
+	case "SYST":
+		s.reply(215, "UNIX Type: L8")
+		return true
+	case "FEAT":
+		features := []string{"EPRT", "EPSV", "MDTM", "MLST type*;size*;modify*;", "PASV", "REST STREAM", "SIZE", "UTF8"}
+		if ftpTLS != nil {
+			features = append(features, "AUTH TLS", "PBSZ", "PROT")
+		}
+		fmt.Fprintf(s.conn, "211-Features:\r\n %s\r\n211 End\r\n", strings.Join(features, "\r\n "))
+		return true
+	case "OPTS":
+		if strings.EqualFold(strings.TrimSpace(arg), "UTF8 ON") {
+			s.reply(200, "UTF-8 is always on")
+		} else {
+			s.reply(501, "Option not understood")
+		}
+		return true
+	case "AUTH":
+		return s.auth(arg)
+	case "PBSZ":
+		s.reply(200, "PBSZ=0")
+		return true
+	case "PROT":
+		switch strings.ToUpper(strings.TrimSpace(arg)) {
+		case "C":
+			s.protected = false
+			s.reply(200, "Data connections are not protected")
+		case "P":
+			if !s.secure {
+				s.reply(503, "Use AUTH TLS first")
+				return true
+			}
+			s.protected = true
+			s.reply(200, "Data connections are protected")
+		default:
+			s.reply(504, "Protection level not supported")
+		}
+		return true
+	case "USER":
+		s.pendingUser, s.loggedIn, s.user = arg, false, ""
+		s.reply(331, "Password required")
+		return true
+	case "PASS":
+		return s.login(arg)
+	}
+
+	if !s.loggedIn {
+		s.reply(530, "Log in with USER and PASS")
+		return true
+	}
+	// Like HTTP requests, the commands that read or change files are logged
+	switch verb {
+	case "LIST", "NLST", "MLSD", "RETR", "STOR", "DELE", "MKD", "XMKD", "RMD", "XRMD", "RNFR", "RNTO":
+		log.Printf("[FTP %s] /%s %s", verb, s.resolve(withoutOptions(arg)), s.client)
+	}
+	fsys := &userFS{user: s.user, client: s.client}
+	ctx := context.Background()
+	switch verb {
+	case "PWD", "XPWD":
+		s.reply(257, fmt.Sprintf("%s is the current directory", ftpQuote("/"+s.dir)))
+	case "CWD", "XCWD", "CDUP", "XCUP":
+		target := s.resolve(arg)
+		if verb == "CDUP" || verb == "XCUP" {
+			target = s.resolve("..")
+		}
+		if info, err := fsys.Stat(ctx, target); err != nil || !info.IsDir() || !s.canBrowse() {
+			s.reply(550, "No such directory")
+			return true
+		}
+		s.dir = target
+		s.reply(250, "Directory changed to /"+target)
+	case "TYPE":
+		// Files are sent as they are in both types, as most servers do
+		switch fields := strings.Fields(strings.ToUpper(arg)); {
+		case len(fields) > 0 && (fields[0] == "A" || fields[0] == "I" || fields[0] == "L"):
+			s.reply(200, "Type set")
+		default:
+			s.reply(504, "Type not supported")
+		}
+	case "MODE", "STRU":
+		if strings.EqualFold(arg, "S") || strings.EqualFold(arg, "F") {
+			s.reply(200, "OK")
+		} else {
+			s.reply(504, "Only stream mode and file structure are supported")
+		}
+	case "ALLO":
+		s.reply(202, "No storage allocation necessary")
+	case "PASV", "EPSV":
+		s.enterPassive(verb == "EPSV")
+	case "PORT", "EPRT":
+		s.setActive(verb == "EPRT", arg)
+	case "REST":
+		offset, err := strconv.ParseInt(strings.TrimSpace(arg), 10, 64)
+		if err != nil || offset < 0 {
+			s.reply(501, "Invalid offset")
+			return true
+		}
+		s.restart = offset
+		s.reply(350, fmt.Sprintf("Restarting at %d", offset))
+	case "LIST", "NLST", "MLSD":
+		s.list(fsys, verb, arg)
+	case "MLST":
+		target := s.resolve(arg)
+		info, err := fsys.Stat(ctx, target)
+		if err != nil || !s.canBrowse() {
+			s.reply(550, "No such file or directory")
+			return true
+		}
+		fmt.Fprintf(s.conn, "250-Listing %s\r\n %s\r\n250 End\r\n", "/"+target, mlstFacts(info, "/"+target))
+	case "SIZE", "MDTM":
+		info, err := fsys.Stat(ctx, s.resolve(arg))
+		if err != nil || info.IsDir() || !s.canBrowse() {
+			s.reply(550, "No such file")
+			return true
+		}
+		if verb == "SIZE" {
+			s.reply(213, strconv.FormatInt(info.Size(), 10))
+		} else {
+			s.reply(213, info.ModTime().UTC().Format("20060102150405"))
+		}
+	case "RETR":
+		s.retrieve(fsys, s.resolve(arg))
+	case "STOR":
+		s.store(fsys, s.resolve(arg))
+	case "MKD", "XMKD":
+		target := s.resolve(arg)
+		if err := fsys.Mkdir(ctx, target, 0755); err != nil {
+			s.replyError(err)
+			return true
+		}
+		s.reply(257, ftpQuote("/"+target)+" created")
+	case "DELE":
+		target := s.resolve(arg)
+		if info, err := fsys.Stat(ctx, target); err == nil && info.IsDir() {
+			s.reply(550, "Is a directory; use RMD")
+			return true
+		}
+		if err := fsys.RemoveAll(ctx, target); err != nil {
+			s.replyError(err)
+			return true
+		}
+		s.reply(250, "Deleted")
+	case "RMD", "XRMD":
+		target := s.resolve(arg)
+		f, err := fsys.OpenFile(ctx, target, os.O_RDONLY, 0)
+		if err != nil {
+			s.replyError(err)
+			return true
+		}
+		entries, err := f.Readdir(0)
+		f.Close()
+		switch {
+		case err != nil:
+			s.reply(550, "Not a directory")
+		case len(entries) > 0:
+			s.reply(550, "Directory not empty")
+		default:
+			if err := fsys.RemoveAll(ctx, target); err != nil {
+				s.replyError(err)
+				return true
+			}
+			s.reply(250, "Directory removed")
+		}
+	case "RNFR":
+		target := s.resolve(arg)
+		if _, err := fsys.Stat(ctx, target); err != nil {
+			s.replyError(err)
+			return true
+		}
+		s.renameFrom = target
+		s.reply(350, "Ready for RNTO")
+	case "RNTO":
+		src := s.renameFrom
+		s.renameFrom = ""
+		if src == "" {
+			s.reply(503, "Use RNFR first")
+			return true
+		}
+		dst := s.resolve(arg)
+		// Moves never replace an existing destination, as in the web
+		// interface
+		if _, err := fsys.Stat(ctx, dst); err == nil {
+			s.reply(550, "Destination already exists")
+			return true
+		}
+		if err := fsys.Rename(ctx, src, dst); err != nil {
+			s.replyError(err)
+			return true
+		}
+		s.reply(250, "Renamed")
+	case "ABOR":
+		s.reply(226, "No transfer to abort")
+	case "HELP":
+		s.reply(214, "See FEAT for the supported extensions")
+	default:
+		s.reply(502, "Command not implemented")
+	}
+	return true
+}
+
+// replyError reports a failed file command
+func (s *ftpSession) replyError(err error) {
+	var uploadErr *uploadError
+	switch {
+	case errors.As(err, &uploadErr):
+		s.reply(552, uploadErr.message)
+	case errors.Is(err, fs.ErrNotExist):
+		s.reply(550, "No such file or directory")
+	case errors.Is(err, fs.ErrExist):
+		s.reply(550, "Already exists")
+	case errors.Is(err, fs.ErrPermission):
+		s.reply(550, "Access denied")
+	case errors.Is(err, errQuotaExceeded):
+		s.reply(552, "Storage quota exceeded")
+	default:
+		s.reply(451, "Error: "+err.Error())
+	}
+}
+
+// ftpQuote quotes a path for a 257 reply, doubling its quotes
+func ftpQuote(p string) string {
+	return `"` + strings.ReplaceAll(p, `"`, `""`) + `"`
+}
+
+// auth switches the control connection to TLS (AUTH TLS)
+func (s *ftpSession) auth(arg string) bool {
+	mechanism := strings.ToUpper(strings.TrimSpace(arg))
+	if ftpTLS == nil || (mechanism != "TLS" && mechanism != "TLS-C" && mechanism != "SSL") {
+		s.reply(504, "TLS is not available")
+		return true
+	}
+	if s.secure {
+		s.reply(503, "Already using TLS")
+		return true
+	}
+	s.reply(234, "Starting TLS")
+	conn := tls.Server(s.conn, ftpTLS)
+	conn.SetDeadline(time.Now().Add(ftpDataTimeout))
+	if err := conn.Handshake(); err != nil {
+		return false
+	}
+	conn.SetDeadline(time.Time{})
+	s.conn, s.secure = conn, true
+	s.reader = bufio.NewReaderSize(conn, 4096)
+	return true
+}
+
+// login checks the password of USER (PASS). Without users, everyone gets
+// in anonymously; with them, "anonymous" and "ftp" get what anonymous
+// visitors of the web interface get.
+func (s *ftpSession) login(password string) bool {
+	name := s.pendingUser
+	if name == "" {
+		s.reply(503, "Use USER first")
+		return true
+	}
+	user := ""
+	if authEnabled() && name != "anonymous" && name != "ftp" {
+		if user = loginUser(name, password); user == "" {
+			auditLogf("login-failed client=%s user=%q", s.client, name)
+			s.failures++
+			// Guessing passwords takes a new connection every three tries
+			time.Sleep(time.Second)
+			s.reply(530, "Login incorrect")
+			return s.failures < 3
+		}
+		auditLogf("login client=%s user=%q", s.client, user)
+	}
+	s.loggedIn, s.user, s.dir = true, user, ""
+
+	// Users kept in their home directory start there
+	if user != "" && confined(user) {
+		if store, ok := served.(writableStorage); ok {
+			if err := store.MkdirAll(storageName(user), 0755); err != nil {
+				s.reply(421, "Error creating home directory")
+				return false
+			}
+		}
+		s.dir = user
+	}
+	s.reply(230, "Logged in")
+	return true
+}
+
+// canBrowse reports whether the user may list and download, which
+// anonymous visitors of a drop box may not
+func (s *ftpSession) canBrowse() bool {
+	return !uploadOnly || s.user != ""
+}
+
+// resolve returns the path relative to the served root that an argument
+// names, relative to the current directory
+func (s *ftpSession) resolve(arg string) string {
+	if strings.HasPrefix(arg, "/") {
+		return userPath(arg)
+	}
+	return userPath(path.Join("/"+s.dir, arg))
+}
+
+// closePassive stops listening for a passive data connection
+func (s *ftpSession) closePassive() {
+	if s.passive != nil {
+		s.passive.Close()
+		s.passive = nil
+	}
+}
+
+// enterPassive listens for the next data connection (PASV, EPSV)
+func (s *ftpSession) enterPassive(extended bool) {
+	s.closePassive()
+	s.active = ""
+	localIP := s.conn.LocalAddr().(*net.TCPAddr).IP
+	if !extended && localIP.To4() == nil && ftpPublicHost == "" {
+		s.reply(425, "Use EPSV over IPv6")
+		return
+	}
+	var l net.Listener
+	var err error
+	if ftpPassivePorts[0] == 0 {
+		l, err = net.Listen("tcp", net.JoinHostPort(localIP.String(), "0"))
+	} else {
+		for port := ftpPassivePorts[0]; port <= ftpPassivePorts[1]; port++ {
+			if l, err = net.Listen("tcp", net.JoinHostPort(localIP.String(), strconv.Itoa(port))); err == nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		s.reply(425, "Cannot open a data connection")
+		return
+	}
+	s.passive = l
+	port := l.Addr().(*net.TCPAddr).Port
+	if extended {
+		s.reply(229, fmt.Sprintf("Entering Extended Passive Mode (|||%d|)", port))
+		return
+	}
+	ip := localIP.To4()
+	if ftpPublicHost != "" {
+		ip = net.ParseIP(ftpPublicHost).To4()
+	}
+	s.reply(227, fmt.Sprintf("Entering Passive Mode (%d,%d,%d,%d,%d,%d)", ip[0], ip[1], ip[2], ip[3], port>>8, port&0xff))
+}
+
+// setActive takes the address to connect the next data connection to
+// (PORT, EPRT). Only the client's own address is accepted, so the server
+// can't be made to connect elsewhere.
+func (s *ftpSession) setActive(extended bool, arg string) {
+	s.closePassive()
+	var host, port string
+	if extended {
+		// |protocol|address|port|
+		fields := strings.Split(arg, "|")
+		if len(fields) != 5 {
+			s.reply(501, "Invalid EPRT argument")
+			return
+		}
+		host, port = fields[2], fields[3]
+	} else {
+		fields := strings.Split(arg, ",")
+		if len(fields) != 6 {
+			s.reply(501, "Invalid PORT argument")
+			return
+		}
+		high, err1 := strconv.Atoi(fields[4])
+		low, err2 := strconv.Atoi(fields[5])
+		if err1 != nil || err2 != nil || high < 0 || high > 255 || low < 0 || low > 255 {
+			s.reply(501, "Invalid PORT argument")
+			return
+		}
+		host, port = strings.Join(fields[:4], "."), strconv.Itoa(high<<8|low)
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !ip.Equal(net.ParseIP(s.client)) {
+		s.reply(504, "Data connections go to the client's own address only")
+		return
+	}
+	s.active = net.JoinHostPort(ip.String(), port)
+	s.reply(200, "OK")
+}
+
+// openData announces a transfer and opens its data connection, encrypted
+// after PROT P
+func (s *ftpSession) openData() (net.Conn, error) {
+	s.reply(150, "Opening data connection")
+	var conn net.Conn
+	switch {
+	case s.passive != nil:
+		l := s.passive
+		s.passive = nil
+		defer l.Close()
+		l.(*net.TCPListener).SetDeadline(time.Now().Add(ftpDataTimeout))
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return nil, err
+			}
+			// Only the client may take the connection
+			host, _, _ := net.SplitHostPort(c.RemoteAddr().String())
+			if net.ParseIP(host).Equal(net.ParseIP(s.client)) {
+				conn = c
+				break
+			}
+			c.Close()
+		}
+	case s.active != "":
+		c, err := net.DialTimeout("tcp", s.active, ftpDataTimeout)
+		if err != nil {
+			return nil, err
+		}
+		conn = c
+	default:
+		return nil, errors.New("use PASV or PORT first")
+	}
+	if s.protected {
+		tlsConn := tls.Server(conn, ftpTLS)
+		tlsConn.SetDeadline(time.Now().Add(ftpDataTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		tlsConn.SetDeadline(time.Time{})
+		conn = tlsConn
+	}
+	return conn, nil
+}
+
+// acquireTransfer waits for one of -max-transfers, and returns its release
+// function, or nil after replying that there is none
+func (s *ftpSession) acquireTransfer(verb, target string) func() {
+	if transferSlots == nil {
+		return func() {}
+	}
+	settingsMu.RLock()
+	timeout := transferQueueTimeout
+	settingsMu.RUnlock()
+	release, position := transferSlots.acquire(context.Background(), s.client, verb+" /"+target, timeout)
+	if release == nil {
+		s.reply(421, fmt.Sprintf("Too many transfers in progress; you are number %d in line, try again later", position))
+	}
+	return release
+}
+
+// list sends a listing of a directory, or of a single file for LIST and
+// NLST
+func (s *ftpSession) list(fsys *userFS, verb, arg string) {
+	target := s.resolve(withoutOptions(arg))
+	if !s.canBrowse() {
+		s.reply(550, "No such file or directory")
+		return
+	}
+	info, err := fsys.Stat(context.Background(), target)
+	if err != nil {
+		s.replyError(err)
+		return
+	}
+	entries := []fs.FileInfo{info}
+	if info.IsDir() {
+		f, err := fsys.OpenFile(context.Background(), target, os.O_RDONLY, 0)
+		if err == nil {
+			entries, err = f.Readdir(0)
+			f.Close()
+		}
+		if err != nil {
+			s.replyError(err)
+			return
+		}
+	} else if verb == "MLSD" {
+		s.reply(501, "Not a directory")
+		return
+	}
+
+	conn, err := s.openData()
+	if err != nil {
+		s.reply(425, "Cannot open data connection: "+err.Error())
+		return
+	}
+	w := bufio.NewWriter(conn)
+	for _, entry := range entries {
+		switch verb {
+		case "NLST":
+			name := entry.Name()
+			if !info.IsDir() {
+				name = "/" + target
+			}
+			fmt.Fprintf(w, "%s\r\n", name)
+		case "MLSD":
+			fmt.Fprintf(w, "%s\r\n", mlstFacts(entry, entry.Name()))
+		default:
+			fmt.Fprintf(w, "%s\r\n", lsLine(entry))
+		}
+	}
+	err = w.Flush()
+	if closeErr := conn.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		s.reply(426, "Connection closed; transfer aborted")
+		return
+	}
+	s.reply(226, "Transfer complete")
+}
+
+// withoutOptions strips the "ls" options such as "-la" that clients send
+// with LIST and NLST
+func withoutOptions(arg string) string {
+	for strings.HasPrefix(arg, "-") {
+		_, arg, _ = strings.Cut(arg, " ")
+	}
+	return arg
+}
+
+// lsLine formats an entry the way "ls -l" does, which FTP clients parse
+func lsLine(info fs.FileInfo) string {
+	mode := "-rw-r--r--"
+	if info.IsDir() {
+		mode = "drwxr-xr-x"
+	}
+	modTime := info.ModTime()
+	stamp := modTime.Format("Jan _2 15:04")
+	if age := time.Since(modTime); age > 180*24*time.Hour || age < -time.Hour {
+		stamp = modTime.Format("Jan _2  2006")
+	}
+	return fmt.Sprintf("%s 1 ftp ftp %12d %s %s", mode, info.Size(), stamp, info.Name())
+}
+
+// mlstFacts formats an entry for MLSD and MLST
+func mlstFacts(info fs.FileInfo, name string) string {
+	kind := "file"
+	if info.IsDir() {
+		kind = "dir"
+	}
+	return fmt.Sprintf("type=%s;size=%d;modify=%s; %s", kind, info.Size(), info.ModTime().UTC().Format("20060102150405"), name)
+}
+
+// retrieve sends a file (RETR), from the offset of REST
+func (s *ftpSession) retrieve(fsys *userFS, target string) {
+	offset := s.restart
+	s.restart = 0
+	if usage.overCap(s.user) {
+		auditLogf("cap-exceeded client=%s user=%q path=%q", s.client, s.user, "/"+target)
+		s.reply(550, "Monthly transfer cap exceeded")
+		return
+	}
+	info, err := fsys.Stat(context.Background(), target)
+	if err != nil || info.IsDir() || !s.canBrowse() {
+		s.reply(550, "No such file")
+		return
+	}
+	release := s.acquireTransfer("RETR", target)
+	if release == nil {
+		return
+	}
+	defer release()
+	fsys.transfer = stats.startTransfer("download", target, s.client, s.user, info.Size()-offset)
+	defer stats.endTransfer(fsys.transfer)
+	f, err := fsys.OpenFile(context.Background(), target, os.O_RDONLY, 0)
+	if err != nil {
+		s.replyError(err)
+		return
+	}
+	defer f.Close()
+	if offset > 0 {
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			s.reply(554, "Cannot restart at that offset")
+			return
+		}
+	}
+
+	conn, err := s.openData()
+	if err != nil {
+		s.reply(425, "Cannot open data connection: "+err.Error())
+		return
+	}
+	_, err = io.Copy(conn, f)
+	if closeErr := conn.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		s.reply(426, "Transfer aborted")
+		return
+	}
+	s.reply(226, "Transfer complete")
+}
+
+// store receives a file (STOR). It is stored once complete, so an aborted
+// upload leaves any previous file in place.
+func (s *ftpSession) store(fsys *userFS, target string) {
+	offset := s.restart
+	s.restart = 0
+	if offset > 0 {
+		s.reply(504, "Uploads can't be resumed")
+		return
+	}
+	if usage.overCap(s.user) {
+		auditLogf("cap-exceeded client=%s user=%q path=%q", s.client, s.user, "/"+target)
+		s.reply(552, "Monthly transfer cap exceeded")
+		return
+	}
+	if path.Base("/"+target) == "/" {
+		s.reply(553, "Missing file name")
+		return
+	}
+	// Visitors of a drop box only add files
+	if err := fsys.checkUpload(target, -1, s.canBrowse()); err != nil {
+		s.reply(553, err.message)
+		return
+	}
+	release := s.acquireTransfer("STOR", target)
+	if release == nil {
+		return
+	}
+	defer release()
+	fsys.transfer = stats.startTransfer("upload", target, s.client, s.user, -1)
+	defer stats.endTransfer(fsys.transfer)
+	f, err := fsys.OpenFile(context.Background(), target, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		s.replyError(err)
+		return
+	}
+
+	conn, err := s.openData()
+	if err != nil {
+		fsys.body = &uploadBody{err: err}
+		f.Close()
+		s.reply(425, "Cannot open data connection: "+err.Error())
+		return
+	}
+	fsys.body = &uploadBody{Reader: fsys.transfer.reader(conn)}
+	_, copyErr := io.Copy(f, fsys.body)
+	conn.Close()
+	err = f.Close()
+	switch {
+	case fsys.body.err != nil:
+		s.reply(426, "Connection closed; transfer aborted")
+	case copyErr != nil:
+		s.replyError(copyErr)
+	case err != nil:
+		s.replyError(err)
+	default:
+		s.reply(226, "Transfer complete")
+	}
+}
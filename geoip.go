@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// geoMetadataMarker starts the metadata section at the end of a MaxMind DB
+var geoMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// geoDB is a MaxMind DB (.mmdb) file, such as GeoLite2-Country or
+// GeoLite2-City, held in memory. Only what looking up a country needs is
+// implemented: the binary search tree and the data section decoder.
+type geoDB struct {
+	data       []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	// dataStart is the offset of the data section
+	dataStart uint
+	// ipv4Start is the tree node IPv4 addresses start at in an IPv6 tree
+	ipv4Start uint
+}
+
+var (
+	// geoip is the country database of -geoip, nil if none
+	geoip *geoDB
+	// geoAllow and geoDeny are the ISO country codes of -geoip-allow and
+	// -geoip-deny
+	geoAllow, geoDeny map[string]bool
+)
+
+// openGeoDB reads a MaxMind DB file
+func openGeoDB(file string) (*geoDB, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	start := bytes.LastIndex(data, geoMetadataMarker)
+	if start < 0 {
+		return nil, errors.New("not a MaxMind DB file")
+	}
+	db := &geoDB{data: data}
+	metadata, _, err := db.decode(uint(start + len(geoMetadataMarker)))
+	if err != nil {
+		return nil, fmt.Errorf("metadata: %v", err)
+	}
+	fields, ok := metadata.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("metadata: not a map")
+	}
+	number := func(name string) uint {
+		n, _ := fields[name].(uint64)
+		return uint(n)
+	}
+	db.nodeCount, db.recordSize, db.ipVersion = number("node_count"), number("record_size"), number("ip_version")
+	if db.recordSize != 24 && db.recordSize != 28 && db.recordSize != 32 {
+		return nil, fmt.Errorf("unsupported record size %d", db.recordSize)
+	}
+	treeSize := db.nodeCount * db.recordSize / 4
+	db.dataStart = treeSize + 16
+	if db.dataStart > uint(start) {
+		return nil, errors.New("search tree larger than the file")
+	}
+
+	// IPv4 addresses are found under ::/96 in IPv6 databases
+	if db.ipVersion == 6 {
+		for i := 0; i < 96 && db.ipv4Start < db.nodeCount; i++ {
+			db.ipv4Start = db.record(db.ipv4Start, 0)
+		}
+	}
+	return db, nil
+}
+
+// record reads the left (0) or right (1) record of a search tree node
+func (db *geoDB) record(node, bit uint) uint {
+	offset := node * db.recordSize / 4
+	b := db.data[offset:]
+	switch db.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4:]))
+	}
+}
+
+// lookup returns the data record of an address, or nil if the database
+// has none
+func (db *geoDB) lookup(ip net.IP) (interface{}, error) {
+	node := uint(0)
+	address := ip.To4()
+	if address != nil && db.ipVersion == 6 {
+		node = db.ipv4Start
+	} else if address == nil {
+		if db.ipVersion != 6 {
+			return nil, nil
+		}
+		address = ip.To16()
+	}
+
+	for i := 0; i < len(address)*8 && node < db.nodeCount; i++ {
+		bit := uint(address[i/8]>>(7-i%8)) & 1
+		node = db.record(node, bit)
+	}
+	if node <= db.nodeCount {
+		return nil, nil
+	}
+	value, _, err := db.decode(db.dataStart + node - db.nodeCount - 16)
+	return value, err
+}
+
+// decode decodes the value at an offset of the file and returns the offset
+// after it. Maps, arrays and strings become Go maps, slices and strings;
+// unsigned integers become uint64.
+func (db *geoDB) decode(offset uint) (interface{}, uint, error) {
+	if offset >= uint(len(db.data)) {
+		return nil, 0, errors.New("offset out of range")
+	}
+	control := db.data[offset]
+	offset++
+	kind := uint(control >> 5)
+	if kind == 0 {
+		if offset >= uint(len(db.data)) {
+			return nil, 0, errors.New("offset out of range")
+		}
+		kind = 7 + uint(db.data[offset])
+		offset++
+	}
+
+	if kind == 1 {
+		// A pointer into the data section
+		size := uint(control>>3) & 3
+		if offset+size+1 > uint(len(db.data)) {
+			return nil, 0, errors.New("offset out of range")
+		}
+		b := db.data[offset : offset+size+1]
+		var target uint
+		switch size {
+		case 0:
+			target = uint(control&7)<<8 | uint(b[0])
+		case 1:
+			target = (uint(control&7)<<16 | uint(b[0])<<8 | uint(b[1])) + 2048
+		case 2:
+			target = (uint(control&7)<<24 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])) + 526336
+		default:
+			target = uint(binary.BigEndian.Uint32(b))
+		}
+		value, _, err := db.decode(db.dataStart + target)
+		return value, offset + size + 1, err
+	}
+
+	size := uint(control & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if offset+n > uint(len(db.data)) {
+			return nil, 0, errors.New("offset out of range")
+		}
+		extra := uint(0)
+		for _, b := range db.data[offset : offset+n] {
+			extra = extra<<8 | uint(b)
+		}
+		size = []uint{29, 285, 65821}[n-1] + extra
+		offset += n
+	}
+
+	switch kind {
+	case 7: // map
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			key, next, err := db.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			name, ok := key.(string)
+			if !ok {
+				return nil, 0, errors.New("map key is not a string")
+			}
+			m[name], offset, err = db.decode(next)
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+		return m, offset, nil
+	case 11: // array
+		a := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			value, next, err := db.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, value)
+			offset = next
+		}
+		return a, offset, nil
+	case 14: // boolean, stored in the size
+		return size != 0, offset, nil
+	}
+
+	if offset+size > uint(len(db.data)) {
+		return nil, 0, errors.New("offset out of range")
+	}
+	b := db.data[offset : offset+size]
+	offset += size
+	switch kind {
+	case 2: // UTF-8 string
+		return string(b), offset, nil
+	case 3: // double
+		if size != 8 {
+			return nil, 0, errors.New("invalid double")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case 15: // float
+		if size != 4 {
+			return nil, 0, errors.New("invalid float")
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset, nil
+	case 4: // bytes
+		return b, offset, nil
+	case 5, 6, 9, 10: // unsigned integers; 128-bit ones keep their low half
+		n := uint64(0)
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+		return n, offset, nil
+	case 8: // int32
+		n := int32(0)
+		for _, c := range b {
+			n = n<<8 | int32(c)
+		}
+		return int64(n), offset, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported data type %d", kind)
+}
+
+// country returns the ISO code of the country an address is in, or "" if
+// the database doesn't know it. Country databases and city databases both
+// have a country record; the registered country stands in for addresses
+// without one, such as those of anycast networks.
+func (db *geoDB) country(ip net.IP) string {
+	value, err := db.lookup(ip)
+	if err != nil {
+		return ""
+	}
+	record, _ := value.(map[string]interface{})
+	for _, field := range []string{"country", "registered_country"} {
+		country, _ := record[field].(map[string]interface{})
+		if code, _ := country["iso_code"].(string); code != "" {
+			return code
+		}
+	}
+	return ""
+}
+
+// clientCountry returns the country of a request's client, or "" without
+// -geoip or if it is unknown
+func clientCountry(r *http.Request) string {
+	if geoip == nil {
+		return ""
+	}
+	ip := net.ParseIP(clientHost(r))
+	if ip == nil {
+		return ""
+	}
+	return geoip.country(ip)
+}
+
+// parseCountries parses a comma-separated list of ISO country codes
+func parseCountries(input string) (map[string]bool, error) {
+	var countries map[string]bool
+	for _, code := range parseList(strings.ToUpper(input)) {
+		if len(code) != 2 || code[0] < 'A' || code[0] > 'Z' || code[1] < 'A' || code[1] > 'Z' {
+			return nil, fmt.Errorf("invalid country code %q (expected e.g. DE)", code)
+		}
+		if countries == nil {
+			countries = make(map[string]bool)
+		}
+		countries[code] = true
+	}
+	return countries, nil
+}
+
+// countryAllowed reports whether a client may connect from where it is.
+// Denied countries are refused; with an allow list, so are clients from
+// anywhere else, except on loopback and private networks, which have no
+// country.
+func countryAllowed(ip net.IP, country string, allow, deny map[string]bool) bool {
+	if deny[country] {
+		return false
+	}
+	if allow == nil || allow[country] {
+		return true
+	}
+	return country == "" && ip != nil && (ip.IsLoopback() || ip.IsPrivate())
+}
+
+// geoMiddleware refuses clients from countries that -geoip-allow and
+// -geoip-deny shut out with 403 Forbidden
+func geoMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		country := clientCountry(r)
+		if !countryAllowed(net.ParseIP(clientHost(r)), country, geoAllow, geoDeny) {
+			if country == "" {
+				country = "-"
+			}
+			auditLogf("geo-denied client=%s country=%s path=%q", clientHost(r), country, r.URL.Path)
+			http.Error(w, "Access from your country is not allowed", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestGeoDBDecode(t *testing.T) {
+	long := strings.Repeat("x", 32)
+	tests := []struct {
+		name string
+		data []byte
+		want interface{}
+		next uint
+	}{
+		{"string", []byte("\x43abc"), "abc", 4},
+		{"empty string", []byte("\x40"), "", 1},
+		{"long string", append([]byte("\x5d\x03"), long...), long, 34},
+		{"uint16", []byte("\xa2\x01\x02"), uint64(258), 3},
+		{"uint32", []byte("\xc1\xff"), uint64(255), 2},
+		{"uint64", []byte("\x02\x02\x01\x00"), uint64(256), 4},
+		{"uint128", []byte("\x01\x03\x05"), uint64(5), 3},
+		{"int32", []byte("\x04\x01\xff\xff\xff\xfe"), int64(-2), 6},
+		{"double", []byte("\x68\x3f\xf8\x00\x00\x00\x00\x00\x00"), 1.5, 9},
+		{"float", []byte("\x04\x08\x3f\xc0\x00\x00"), 1.5, 6},
+		{"true", []byte("\x01\x07"), true, 2},
+		{"false", []byte("\x00\x07"), false, 2},
+		{"bytes", []byte("\x82\xde\xad"), []byte{0xde, 0xad}, 3},
+		{"array", []byte("\x02\x04\x41x\xa1\x07"), []interface{}{"x", uint64(7)}, 6},
+		{"map", []byte("\xe2\x41k\x41v\x41n\xc0"), map[string]interface{}{"k": "v", "n": uint64(0)}, 8},
+		{"pointer", []byte("\x20\x03\x00\x42hi"), "hi", 2},
+	}
+	for _, tt := range tests {
+		db := &geoDB{data: tt.data}
+		got, next, err := db.decode(0)
+		if err != nil {
+			t.Errorf("%s: decode error: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) || next != tt.next {
+			t.Errorf("%s: decode = %#v, %d; want %#v, %d", tt.name, got, next, tt.want, tt.next)
+		}
+	}
+}
+
+func TestGeoDBDecodeErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"short string", []byte("\x45ab")},
+		{"short extended type", []byte("\x00")},
+		{"short size", []byte("\x5d")},
+		{"short pointer", []byte("\x28\x00")},
+		{"pointer out of range", []byte("\x20\x40")},
+		{"map key not a string", []byte("\xe1\xa1\x01\x41v")},
+		{"short map", []byte("\xe2\x41k\x41v")},
+		{"invalid double", []byte("\x64\x00\x00\x00\x00")},
+		{"unsupported type", []byte("\x00\x05")},
+	}
+	for _, tt := range tests {
+		db := &geoDB{data: tt.data}
+		if value, _, err := db.decode(0); err == nil {
+			t.Errorf("%s: decode = %#v, want an error", tt.name, value)
+		}
+	}
+}
+
+// mmdbEncode encodes strings, unsigned integers and maps of them in the
+// MaxMind DB data format; sizes stay below 29
+func mmdbEncode(v interface{}) []byte {
+	control := func(kind, size int) []byte {
+		if kind > 7 {
+			return []byte{byte(size), byte(kind - 7)}
+		}
+		return []byte{byte(kind<<5 | size)}
+	}
+	switch v := v.(type) {
+	case string:
+		return append(control(2, len(v)), v...)
+	case uint64:
+		var b []byte
+		for ; v > 0; v >>= 8 {
+			b = append([]byte{byte(v)}, b...)
+		}
+		return append(control(6, len(b)), b...)
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		out := control(7, len(v))
+		for _, key := range keys {
+			out = append(out, mmdbEncode(key)...)
+			out = append(out, mmdbEncode(v[key])...)
+		}
+		return out
+	}
+	panic("mmdbEncode: unsupported value")
+}
+
+// writeTestMMDB writes a MaxMind DB with 24-bit records that maps networks,
+// which may not overlap, to country records, and returns its file name.
+// IPv4 networks sit under ::/96 in an IPv6 database.
+func writeTestMMDB(t *testing.T, ipVersion uint64, networks map[string]map[string]interface{}) string {
+	t.Helper()
+	// Records hold -1 while empty and -2-i for the data of network i until
+	// the number of nodes is known
+	nodes := [][2]int{{-1, -1}}
+	var data []byte
+	var offsets []int
+	cidrs := make([]string, 0, len(networks))
+	for cidr := range networks {
+		cidrs = append(cidrs, cidr)
+	}
+	sort.Strings(cidrs)
+	for i, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ones, _ := network.Mask.Size()
+		address := []byte(network.IP)
+		if ipVersion == 6 && len(address) == net.IPv4len {
+			address, ones = append(make([]byte, 12), address...), ones+96
+		}
+		node := 0
+		for bit := 0; bit < ones; bit++ {
+			b := int(address[bit/8]>>(7-bit%8)) & 1
+			if bit == ones-1 {
+				nodes[node][b] = -2 - i
+				break
+			}
+			if nodes[node][b] < 0 {
+				nodes = append(nodes, [2]int{-1, -1})
+				nodes[node][b] = len(nodes) - 1
+			}
+			node = nodes[node][b]
+		}
+		offsets = append(offsets, len(data))
+		data = append(data, mmdbEncode(networks[cidr])...)
+	}
+
+	var file []byte
+	for _, node := range nodes {
+		for _, record := range node {
+			value := record
+			switch {
+			case record == -1:
+				value = len(nodes)
+			case record < -1:
+				value = len(nodes) + 16 + offsets[-2-record]
+			}
+			file = append(file, byte(value>>16), byte(value>>8), byte(value))
+		}
+	}
+	file = append(file, make([]byte, 16)...)
+	file = append(file, data...)
+	file = append(file, geoMetadataMarker...)
+	file = append(file, mmdbEncode(map[string]interface{}{
+		"node_count":  uint64(len(nodes)),
+		"record_size": uint64(24),
+		"ip_version":  ipVersion,
+	})...)
+
+	name := filepath.Join(t.TempDir(), "test.mmdb")
+	if err := os.WriteFile(name, file, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestGeoDBCountry(t *testing.T) {
+	iso := func(code string) map[string]interface{} {
+		return map[string]interface{}{"iso_code": code}
+	}
+	networks := map[string]map[string]interface{}{
+		"1.0.0.0/8":     {"country": iso("AU")},
+		"2.0.0.0/16":    {"registered_country": iso("FR")},
+		"2.1.0.0/16":    {"country": iso("BE"), "registered_country": iso("FR")},
+		"2001:db8::/32": {"country": iso("DE")},
+	}
+
+	tests := []struct {
+		ip     string
+		v4, v6 string
+	}{
+		{"1.2.3.4", "AU", "AU"},
+		{"1.255.255.255", "AU", "AU"},
+		{"2.0.9.9", "FR", "FR"},
+		{"2.1.200.1", "BE", "BE"},
+		{"2.2.0.0", "", ""},
+		{"3.3.3.3", "", ""},
+		{"::ffff:1.2.3.4", "AU", "AU"},
+		{"2001:db8::1", "", "DE"},
+		{"2001:db9::1", "", ""},
+	}
+	for _, version := range []uint64{4, 6} {
+		db, err := openGeoDB(writeTestMMDB(t, version, networks))
+		if err != nil {
+			t.Fatalf("IPv%d: openGeoDB: %v", version, err)
+		}
+		for _, tt := range tests {
+			want := tt.v4
+			if version == 6 {
+				want = tt.v6
+			}
+			if got := db.country(net.ParseIP(tt.ip)); got != want {
+				t.Errorf("IPv%d: country(%s) = %q, want %q", version, tt.ip, got, want)
+			}
+		}
+	}
+}
+
+func TestOpenGeoDBErrors(t *testing.T) {
+	metadata := func(recordSize uint64) []byte {
+		return mmdbEncode(map[string]interface{}{"node_count": uint64(1), "record_size": recordSize, "ip_version": uint64(4)})
+	}
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"no metadata", []byte("not a database")},
+		{"metadata not a map", append(append([]byte{}, geoMetadataMarker...), "\x41x"...)},
+		{"record size", append(append(make([]byte, 22), geoMetadataMarker...), metadata(20)...)},
+		{"tree too large", append(append([]byte{}, geoMetadataMarker...), metadata(32)...)},
+	}
+	for _, tt := range tests {
+		name := filepath.Join(t.TempDir(), "test.mmdb")
+		if err := os.WriteFile(name, tt.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := openGeoDB(name); err == nil {
+			t.Errorf("%s: openGeoDB succeeded, want an error", tt.name)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Paths inside a git directory that the dumb HTTP protocol fetches
+var (
+	gitLooseObjectPattern = regexp.MustCompile(`^objects/[0-9a-f]{2}/[0-9a-f]{38}([0-9a-f]{24})?$`)
+	gitPackPattern        = regexp.MustCompile(`^objects/pack/pack-[0-9a-f]{40}([0-9a-f]{24})?\.(pack|idx)$`)
+)
+
+// gitDirFor returns the git directory backing dir: dir itself for bare
+// repositories (and .git directories), dir/.git for working trees, or ""
+func gitDirFor(dir string) string {
+	isGitDir := func(p string) bool {
+		head, err := os.Stat(filepath.Join(p, "HEAD"))
+		if err != nil || head.IsDir() {
+			return false
+		}
+		for _, sub := range []string{"objects", "refs"} {
+			if info, err := os.Stat(filepath.Join(p, sub)); err != nil || !info.IsDir() {
+				return false
+			}
+		}
+		return true
+	}
+
+	if isGitDir(dir) {
+		return dir
+	}
+	if dotGit := filepath.Join(dir, ".git"); isGitDir(dotGit) {
+		return dotGit
+	}
+	return ""
+}
+
+// isGitDumbPath reports whether rest (relative to a repository URL) is a
+// resource the dumb HTTP protocol requests
+func isGitDumbPath(rest string) bool {
+	switch rest {
+	case "HEAD", "info/refs", "objects/info/packs", "objects/info/alternates", "objects/info/http-alternates":
+		return true
+	}
+	return gitLooseObjectPattern.MatchString(rest) || gitPackPattern.MatchString(rest)
+}
+
+// serveGit answers dumb git HTTP protocol requests for repositories inside
+// workingDir, so `git clone http://host/repo.git` works against the served
+// tree. It returns false when requestedPath is not such a request.
+func serveGit(w http.ResponseWriter, r *http.Request, requestedPath string) bool {
+	parts := strings.Split(path.Clean("/" + requestedPath)[1:], "/")
+
+	// Try every split of the path into repository and protocol resource
+	for i := 0; i < len(parts); i++ {
+		rest := strings.Join(parts[i:], "/")
+		if !isGitDumbPath(rest) {
+			continue
+		}
+
+		repoDir, err := resolvePath(strings.Join(parts[:i], "/"))
+		if err != nil {
+			continue
+		}
+		gitDir := gitDirFor(repoDir)
+		if gitDir == "" {
+			continue
+		}
+
+		serveGitResource(w, r, gitDir, rest)
+		return true
+	}
+	return false
+}
+
+// serveGitResource writes a single dumb protocol resource from gitDir
+func serveGitResource(w http.ResponseWriter, r *http.Request, gitDir, rest string) {
+	switch rest {
+	case "info/refs":
+		// Generated on the fly instead of relying on `git update-server-info`
+		refs, err := gitInfoRefs(gitDir)
+		if err != nil {
+			http.Error(w, "Error reading refs", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Write(refs)
+		return
+	case "objects/info/packs":
+		packs, err := gitInfoPacks(gitDir)
+		if err != nil {
+			http.Error(w, "Error reading packs", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Write(packs)
+		return
+	}
+
+	contentType := "text/plain"
+	switch {
+	case gitLooseObjectPattern.MatchString(rest):
+		contentType = "application/x-git-loose-object"
+	case strings.HasSuffix(rest, ".pack"):
+		contentType = "application/x-git-packed-objects"
+	case strings.HasSuffix(rest, ".idx"):
+		contentType = "application/x-git-packed-objects-toc"
+	}
+
+	file, err := os.Open(filepath.Join(gitDir, filepath.FromSlash(rest)))
+	if err != nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	if contentType == "text/plain" {
+		w.Header().Set("Cache-Control", "no-cache")
+	} else {
+		// Objects are immutable once written
+		w.Header().Set("Cache-Control", "public, max-age=31536000")
+	}
+	http.ServeContent(w, r, "", info.ModTime(), file)
+}
+
+// gitInfoRefs builds the info/refs listing from loose and packed refs
+func gitInfoRefs(gitDir string) ([]byte, error) {
+	refs := make(map[string]string)
+
+	// Packed refs first, loose refs override them
+	if packed, err := os.Open(filepath.Join(gitDir, "packed-refs")); err == nil {
+		scanner := bufio.NewScanner(packed)
+		last := ""
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case line == "" || strings.HasPrefix(line, "#"):
+				continue
+			case strings.HasPrefix(line, "^"):
+				// Peeled value of the preceding annotated tag
+				if last != "" {
+					refs[last+"^{}"] = strings.TrimPrefix(line, "^")
+				}
+			default:
+				fields := strings.Fields(line)
+				if len(fields) == 2 {
+					refs[fields[1]] = fields[0]
+					last = fields[1]
+				}
+			}
+		}
+		packed.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	refsDir := filepath.Join(gitDir, "refs")
+	err := filepath.WalkDir(refsDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		value := strings.TrimSpace(string(content))
+		if strings.HasPrefix(value, "ref:") {
+			// Symbolic refs are not advertised
+			return nil
+		}
+		rel, err := filepath.Rel(gitDir, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		refs[name] = value
+		// A loose ref invalidates any stale peeled value from packed-refs
+		delete(refs, name+"^{}")
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(refs))
+	for name := range refs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	for _, name := range names {
+		buf.WriteString(refs[name] + "\t" + name + "\n")
+	}
+	return buf.Bytes(), nil
+}
+
+// gitInfoPacks builds the objects/info/packs listing
+func gitInfoPacks(gitDir string) ([]byte, error) {
+	matches, err := filepath.Glob(filepath.Join(gitDir, "objects", "pack", "pack-*.pack"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(matches)
+
+	var buf bytes.Buffer
+	for _, match := range matches {
+		buf.WriteString("P " + filepath.Base(match) + "\n")
+	}
+	buf.WriteString("\n")
+	return buf.Bytes(), nil
+}
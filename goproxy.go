@@ -0,0 +1,284 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// goproxyDir is the root of the module directory served under /goproxy/.
+// It uses the same layout as $GOMODCACHE/cache/download:
+// <escaped module path>/@v/<escaped version>.{info,mod,zip}
+var goproxyDir string
+
+// pseudoVersionPattern matches the timestamp-revision suffix of pseudo-versions
+var pseudoVersionPattern = regexp.MustCompile(`\d{14}-[0-9a-f]{12}(\+incompatible)?$`)
+
+// moduleInfo is the JSON document returned for .info and @latest queries
+type moduleInfo struct {
+	Version string
+	Time    time.Time
+}
+
+// goproxyHandler serves modules following the GOPROXY protocol, so
+// GOPROXY=http://host:port/goproxy can be used on air-gapped networks
+func goproxyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	requestedPath := pathParam(r, "path")
+
+	// <module>/@latest
+	if modulePath, ok := strings.CutSuffix(requestedPath, "/@latest"); ok {
+		versionDir, err := resolvePathIn(goproxyDir, modulePath+"/@v")
+		if err != nil {
+			writePathError(w, err)
+			return
+		}
+		versions := goproxyVersions(versionDir)
+		if len(versions) == 0 {
+			http.Error(w, "Module not found", http.StatusNotFound)
+			return
+		}
+		latest := versions[len(versions)-1]
+		// Prefer the newest release over pre-releases
+		for i := len(versions) - 1; i >= 0; i-- {
+			if !strings.Contains(strings.SplitN(versions[i], "+", 2)[0], "-") {
+				latest = versions[i]
+				break
+			}
+		}
+		writeModuleInfo(w, versionDir, latest)
+		return
+	}
+
+	idx := strings.LastIndex(requestedPath, "/@v/")
+	if idx < 0 {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	modulePath := requestedPath[:idx]
+	file := requestedPath[idx+len("/@v/"):]
+
+	versionDir, err := resolvePathIn(goproxyDir, modulePath+"/@v")
+	if err != nil {
+		writePathError(w, err)
+		return
+	}
+	if strings.ContainsAny(file, `/\`) {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case file == "list":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, version := range goproxyVersions(versionDir) {
+			if !pseudoVersionPattern.MatchString(version) {
+				io.WriteString(w, version+"\n")
+			}
+		}
+	case strings.HasSuffix(file, ".info"):
+		writeModuleInfo(w, versionDir, strings.TrimSuffix(file, ".info"))
+	case strings.HasSuffix(file, ".mod"):
+		writeModuleGoMod(w, r, versionDir, modulePath, strings.TrimSuffix(file, ".mod"))
+	case strings.HasSuffix(file, ".zip"):
+		serveModuleFile(w, r, filepath.Join(versionDir, file), "application/zip")
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+// goproxyVersions returns the (escaped) versions in versionDir that have a
+// module zip, sorted in semantic version order
+func goproxyVersions(versionDir string) []string {
+	matches, _ := filepath.Glob(filepath.Join(versionDir, "*.zip"))
+	versions := make([]string, 0, len(matches))
+	for _, match := range matches {
+		versions = append(versions, strings.TrimSuffix(filepath.Base(match), ".zip"))
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return compareSemver(unescapeModulePath(versions[i]), unescapeModulePath(versions[j])) < 0
+	})
+	return versions
+}
+
+// writeModuleInfo serves <version>.info, synthesizing it from the zip's
+// modification time when the directory only holds the zip and go.mod
+func writeModuleInfo(w http.ResponseWriter, versionDir, version string) {
+	base := filepath.Join(versionDir, version)
+	if content, err := os.ReadFile(base + ".info"); err == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(content)
+		return
+	}
+
+	var modTime time.Time
+	if info, err := os.Stat(base + ".zip"); err == nil {
+		modTime = info.ModTime()
+	} else if info, err := os.Stat(base + ".mod"); err == nil {
+		modTime = info.ModTime()
+	} else {
+		http.Error(w, "Version not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(moduleInfo{
+		Version: unescapeModulePath(version),
+		Time:    modTime.UTC(),
+	})
+}
+
+// writeModuleGoMod serves <version>.mod, falling back to the go.mod inside
+// the module zip, or a bare module line for modules without one
+func writeModuleGoMod(w http.ResponseWriter, r *http.Request, versionDir, modulePath, version string) {
+	base := filepath.Join(versionDir, version)
+	if _, err := os.Stat(base + ".mod"); err == nil {
+		serveModuleFile(w, r, base+".mod", "text/plain; charset=utf-8")
+		return
+	}
+
+	archive, err := zip.OpenReader(base + ".zip")
+	if err != nil {
+		http.Error(w, "Version not found", http.StatusNotFound)
+		return
+	}
+	defer archive.Close()
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	goMod := unescapeModulePath(modulePath) + "@" + unescapeModulePath(version) + "/go.mod"
+	for _, f := range archive.File {
+		if f.Name != goMod {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			http.Error(w, "Error reading module zip", http.StatusInternalServerError)
+			return
+		}
+		defer rc.Close()
+		io.Copy(w, rc)
+		return
+	}
+	io.WriteString(w, "module "+strconv.Quote(unescapeModulePath(modulePath))+"\n")
+}
+
+// serveModuleFile serves a file from the module directory
+func serveModuleFile(w http.ResponseWriter, r *http.Request, path, contentType string) {
+	file, err := os.Open(path)
+	if err != nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	http.ServeContent(w, r, "", info.ModTime(), file)
+}
+
+// unescapeModulePath reverses the case-encoding of module paths and
+// versions ("!a" stands for "A")
+func unescapeModulePath(escaped string) string {
+	var b strings.Builder
+	bang := false
+	for _, c := range escaped {
+		if bang {
+			bang = false
+			if c >= 'a' && c <= 'z' {
+				c -= 'a' - 'A'
+			}
+		} else if c == '!' {
+			bang = true
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// compareSemver compares two semantic versions of the form
+// vMAJOR.MINOR.PATCH[-prerelease][+build], returning -1, 0 or 1
+func compareSemver(a, b string) int {
+	parse := func(v string) (core []string, pre string) {
+		v = strings.TrimPrefix(v, "v")
+		v, _, _ = strings.Cut(v, "+")
+		v, pre, _ = strings.Cut(v, "-")
+		return strings.Split(v, "."), pre
+	}
+	compareIdent := func(x, y string) int {
+		xn, xerr := strconv.ParseUint(x, 10, 64)
+		yn, yerr := strconv.ParseUint(y, 10, 64)
+		switch {
+		case xerr == nil && yerr == nil:
+			switch {
+			case xn < yn:
+				return -1
+			case xn > yn:
+				return 1
+			}
+			return 0
+		case xerr == nil:
+			// Numeric identifiers sort before alphanumeric ones
+			return -1
+		case yerr == nil:
+			return 1
+		}
+		return strings.Compare(x, y)
+	}
+
+	aCore, aPre := parse(a)
+	bCore, bPre := parse(b)
+	for i := 0; i < len(aCore) || i < len(bCore); i++ {
+		x, y := "0", "0"
+		if i < len(aCore) {
+			x = aCore[i]
+		}
+		if i < len(bCore) {
+			y = bCore[i]
+		}
+		if c := compareIdent(x, y); c != 0 {
+			return c
+		}
+	}
+
+	// A version without pre-release sorts after one with a pre-release
+	switch {
+	case aPre == bPre:
+		return 0
+	case aPre == "":
+		return 1
+	case bPre == "":
+		return -1
+	}
+	aIdents := strings.Split(aPre, ".")
+	bIdents := strings.Split(bPre, ".")
+	for i := 0; i < len(aIdents) && i < len(bIdents); i++ {
+		if c := compareIdent(aIdents[i], bIdents[i]); c != 0 {
+			return c
+		}
+	}
+	switch {
+	case len(aIdents) < len(bIdents):
+		return -1
+	case len(aIdents) > len(bIdents):
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net"
+	"net/http"
+)
+
+// allowNetworks and denyNetworks restrict which client addresses may
+// connect (-allow-cidr, -deny-cidr)
+var allowNetworks, denyNetworks []*net.IPNet
+
+// addressAllowed reports whether a client address may connect. Denied
+// networks are refused; with an allow list, so is every address outside
+// it.
+func addressAllowed(host string) bool {
+	if networksContain(denyNetworks, host) {
+		return false
+	}
+	return allowNetworks == nil || networksContain(allowNetworks, host)
+}
+
+// ipFilterMiddleware refuses clients that -allow-cidr and -deny-cidr shut
+// out with 403 Forbidden
+func ipFilterMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !addressAllowed(clientHost(r)) {
+			auditLogf("ip-denied client=%s path=%q", clientHost(r), r.URL.Path)
+			http.Error(w, "Access from your address is not allowed", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
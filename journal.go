@@ -0,0 +1,588 @@
+package main
+
+import (
+	"encoding/json"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+const (
+	// journalSettle is how long a path watched by the journal has to stay
+	// unchanged before it is recorded, so a file being written is recorded
+	// once it is complete rather than on every write
+	journalSettle = time.Second
+	// journalMaxRecords is how many changes the journal keeps; clients
+	// further behind have to list the tree again
+	journalMaxRecords = 100000
+	// changesPageSize is the most changes returned by one /api/changes call
+	changesPageSize = 1000
+)
+
+// journalInterval is how often the change journal is reconciled with the
+// disk (-journal); 0 disables the journal
+var journalInterval time.Duration
+
+// Change is one record of the change journal
+type Change struct {
+	Seq     int64     `json:"seq"`
+	Op      string    `json:"op"` // create, modify or delete
+	Path    string    `json:"path"`
+	IsDir   bool      `json:"isDir"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+}
+
+// ChangesPage is the response of /api/changes
+type ChangesPage struct {
+	// Journal identifies this journal; it changes when the server restarts
+	Journal string `json:"journal"`
+	// Seq is the value to pass as since in the next call
+	Seq     int64    `json:"seq"`
+	Changes []Change `json:"changes"`
+	// More is set when further changes are waiting
+	More bool `json:"more"`
+}
+
+// journalEntry is the state of a path as last seen by the journal
+type journalEntry struct {
+	size    int64
+	modTime time.Time
+	isDir   bool
+}
+
+// changeJournal keeps sequence-numbered records of what was created,
+// modified or deleted below workingDir. Changes made through the server
+// are picked up right away, and others as the filesystem notifies them;
+// reconciliation walks every journalInterval catch whatever notifications
+// missed.
+type changeJournal struct {
+	mu      sync.Mutex
+	id      string
+	seq     int64
+	records []Change
+	entries map[string]journalEntry
+	ready   bool
+	pending chan string
+
+	// watcher notifies changes to the watched directories; nil if the
+	// filesystem can't be watched
+	watcher *fsnotify.Watcher
+	watched map[string]bool
+	// changed holds the paths notified and when they last changed
+	changed map[string]time.Time
+}
+
+var journal *changeJournal
+
+// startJournal builds the initial snapshot of workingDir in the background
+// and starts reconciling it
+func startJournal() *changeJournal {
+	j := &changeJournal{
+		id:      strconv.FormatInt(time.Now().UnixNano(), 36),
+		entries: make(map[string]journalEntry),
+		pending: make(chan string, 256),
+		watched: make(map[string]bool),
+		changed: make(map[string]time.Time),
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Printf("Change journal can't watch the disk, relying on reconciliation: %v", err)
+	} else {
+		j.watcher = watcher
+	}
+	go j.run()
+	return j
+}
+
+// note asks the journal to look at a path changed by the server, and
+// drops the cached sizes of the directories holding it and the package
+// index if it is in -pypi; the journal part is a no-op when the journal
+// is disabled
+func (j *changeJournal) note(requestedPath string) {
+	dirSizes.invalidate(requestedPath)
+	pypiCache.invalidate(requestedPath)
+	if j == nil {
+		return
+	}
+	select {
+	case j.pending <- path.Clean(filepath.ToSlash(requestedPath)):
+	default:
+		// The next reconciliation walk catches up
+	}
+}
+
+// run owns all walks, so a full reconciliation and a noted path never
+// race each other
+func (j *changeJournal) run() {
+	start := time.Now()
+	j.reconcile("")
+	j.watch("")
+	j.mu.Lock()
+	log.Printf("Change journal ready: %d entries in %v, watching %d directories", len(j.entries), time.Since(start).Round(time.Millisecond), len(j.watched))
+	j.mu.Unlock()
+
+	var events chan fsnotify.Event
+	var errs chan error
+	if j.watcher != nil {
+		events, errs = j.watcher.Events, j.watcher.Errors
+	}
+	ticker := time.NewTicker(journalInterval)
+	settle := time.NewTicker(journalSettle / 2)
+	for {
+		select {
+		case <-ticker.C:
+			j.reconcile("")
+			j.watch("")
+		case p := <-j.pending:
+			root := j.newAncestor(p)
+			j.reconcile(root)
+			j.watch(root)
+		case event := <-events:
+			// Uploads in progress are recorded once they are renamed
+			// into place
+			if base := filepath.Base(event.Name); strings.HasPrefix(base, ".") && (strings.HasSuffix(base, ".tmp") || strings.HasSuffix(base, ".part")) {
+				continue
+			}
+			if p, ok := servedPathOf(event.Name); ok {
+				if event.Has(fsnotify.Rename) || event.Has(fsnotify.Remove) {
+					j.unwatch(p)
+				}
+				j.changed[p] = time.Now()
+			}
+		case err := <-errs:
+			// Notifications were lost, e.g. the kernel's queue overflowed
+			log.Printf("Change journal watcher: %v", err)
+			j.reconcile("")
+			j.watch("")
+		case now := <-settle.C:
+			for p, changed := range j.changed {
+				if now.Sub(changed) < journalSettle {
+					continue
+				}
+				delete(j.changed, p)
+				root := j.newAncestor(p)
+				j.reconcile(root)
+				j.watch(root)
+			}
+		}
+	}
+}
+
+// watch adds the directories of a subtree ("" for all of workingDir)
+// known to the journal to the watcher. Watches of removed directories
+// go away by themselves.
+func (j *changeJournal) watch(root string) {
+	if j.watcher == nil {
+		return
+	}
+	j.mu.Lock()
+	dirs := []string{}
+	if root == "" {
+		dirs = append(dirs, "")
+	}
+	for p, entry := range j.entries {
+		if entry.isDir && journalWithin(p, root) {
+			dirs = append(dirs, p)
+		}
+	}
+	for p := range j.watched {
+		if _, ok := j.entries[p]; !ok && p != "" {
+			delete(j.watched, p)
+		}
+	}
+	j.mu.Unlock()
+
+	for _, p := range dirs {
+		if j.watched[p] {
+			continue
+		}
+		if err := j.watcher.Add(localPath(p)); err != nil {
+			// Out of watches (fs.inotify.max_user_watches on Linux): the
+			// rest is left to reconciliation
+			log.Printf("Change journal can't watch %s, relying on reconciliation: %v", localPath(p), err)
+			return
+		}
+		j.watched[p] = true
+	}
+}
+
+// unwatch drops the watches of a directory moved or removed, and of those
+// below it. Watches follow a moved directory but keep reporting its old
+// path, so it is watched anew under its new path.
+func (j *changeJournal) unwatch(root string) {
+	for p := range j.watched {
+		if p != "" && journalWithin(p, root) {
+			j.watcher.Remove(localPath(p))
+			delete(j.watched, p)
+		}
+	}
+}
+
+// servedPathOf returns the journal path of a file notified by the
+// watcher, the inverse of localPath
+func servedPathOf(name string) (string, bool) {
+	for _, m := range mounts {
+		if isWithin(name, m.dir) {
+			rel, _ := filepath.Rel(m.dir, name)
+			return path.Join(m.name, filepath.ToSlash(rel)), true
+		}
+	}
+	rel, err := filepath.Rel(workingDir, name)
+	if err != nil || !isWithin(name, workingDir) || rel == "." {
+		return "", false
+	}
+	if dataDir != "" && isWithin(name, dataDir) {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
+
+// newAncestor returns the topmost directory of a path that the journal
+// doesn't know yet, so parents are recorded before their children
+func (j *changeJournal) newAncestor(p string) string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for {
+		parent := path.Dir(p)
+		if parent == "." || parent == "/" {
+			return p
+		}
+		if _, ok := j.entries[parent]; ok {
+			return p
+		}
+		p = parent
+	}
+}
+
+// reconcile walks a subtree ("" for all of workingDir) and records how it
+// differs from the journal's snapshot
+func (j *changeJournal) reconcile(root string) {
+	current := make(map[string]journalEntry)
+	// Unreadable directories are left alone rather than reported deleted
+	var unreadable []string
+	walkServed(localPath(root), root, func(p, rel string, d fs.DirEntry, err error) error {
+		rel = path.Join(root, rel)
+		if err != nil {
+			if d != nil && d.IsDir() {
+				unreadable = append(unreadable, rel)
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if rel == "." {
+			return nil
+		}
+		if d.IsDir() && dataDir != "" && filepath.Clean(p) == filepath.Clean(dataDir) {
+			// Server state saved in the tree is not a change worth syncing
+			return fs.SkipDir
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		current[rel] = journalEntry{size: info.Size(), modTime: info.ModTime(), isDir: d.IsDir()}
+		return nil
+	})
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var created, modified, deleted []string
+	for p, entry := range j.entries {
+		if !journalWithin(p, root) || journalUnder(p, unreadable) {
+			continue
+		}
+		now, ok := current[p]
+		switch {
+		case !ok || now.isDir != entry.isDir:
+			deleted = append(deleted, p)
+		case !entry.isDir && (now.size != entry.size || !now.modTime.Equal(entry.modTime)):
+			// A directory's own modification time only reflects its
+			// children, which are reported themselves
+			modified = append(modified, p)
+		}
+	}
+	for p, now := range current {
+		if entry, ok := j.entries[p]; !ok || now.isDir != entry.isDir {
+			created = append(created, p)
+		}
+	}
+
+	// The first walk only takes the snapshot
+	record := j.ready
+	j.ready = true
+
+	// Children are deleted before their parents and created after them
+	sort.Sort(sort.Reverse(sort.StringSlice(deleted)))
+	sort.Strings(modified)
+	sort.Strings(created)
+	for _, p := range deleted {
+		if record {
+			j.append("delete", p, j.entries[p])
+		}
+		delete(j.entries, p)
+	}
+	for _, p := range modified {
+		j.entries[p] = current[p]
+		j.append("modify", p, current[p])
+	}
+	for _, p := range created {
+		j.entries[p] = current[p]
+		if record {
+			j.append("create", p, current[p])
+		}
+	}
+}
+
+// append adds a record to the journal. The caller must hold j.mu.
+func (j *changeJournal) append(op, p string, entry journalEntry) {
+	j.seq++
+	j.records = append(j.records, Change{
+		Seq:     j.seq,
+		Op:      op,
+		Path:    p,
+		IsDir:   entry.isDir,
+		Size:    entry.size,
+		ModTime: entry.modTime,
+	})
+	if len(j.records) > journalMaxRecords {
+		// Drop the oldest tenth at once, so trimming stays cheap
+		j.records = append(j.records[:0], j.records[len(j.records)-journalMaxRecords*9/10:]...)
+	}
+}
+
+// journalWithin reports whether a journal path is root or lies below it
+func journalWithin(p, root string) bool {
+	return root == "" || p == root || strings.HasPrefix(p, root+"/")
+}
+
+// journalUnder reports whether a journal path lies below one of the directories
+func journalUnder(p string, dirs []string) bool {
+	for _, dir := range dirs {
+		if dir == "." || strings.HasPrefix(p, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// changesHandler returns the journal records after ?since=<seq>. Without
+// since it returns the current sequence number only, which a client that
+// has just listed the tree uses as its starting point. 410 Gone tells the
+// client to list the tree again: the journal was restarted (?journal=
+// doesn't match) or no longer reaches back far enough.
+func changesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	journal.mu.Lock()
+	defer journal.mu.Unlock()
+	if !journal.ready {
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, "Change journal is being built", http.StatusServiceUnavailable)
+		return
+	}
+
+	page := ChangesPage{Journal: journal.id, Seq: journal.seq, Changes: []Change{}}
+	query := r.URL.Query()
+	if id := query.Get("journal"); id != "" && id != journal.id {
+		http.Error(w, "Change journal was restarted", http.StatusGone)
+		return
+	}
+	if query.Get("since") != "" {
+		since, err := strconv.ParseInt(query.Get("since"), 10, 64)
+		if err != nil || since < 0 || since > journal.seq {
+			http.Error(w, "Invalid since", http.StatusBadRequest)
+			return
+		}
+		oldest := journal.seq + 1
+		if len(journal.records) > 0 {
+			oldest = journal.records[0].Seq
+		}
+		if since < oldest-1 {
+			http.Error(w, "Change journal no longer reaches back that far", http.StatusGone)
+			return
+		}
+
+		// Records are numbered consecutively, so the first one after
+		// since can be found directly
+		user := authenticatedUser(r)
+		page.Seq = since
+		for _, change := range journal.records[since-oldest+1:] {
+			if len(page.Changes) == changesPageSize {
+				page.More = true
+				break
+			}
+			page.Seq = change.Seq
+			if canRead(user, change.Path) {
+				page.Changes = append(page.Changes, change)
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(page); err != nil {
+		log.Printf("JSON encoding error: %v", err)
+	}
+}
+
+// ListDelta is the response of /api/list-delta: how the entries of a
+// directory changed since a token
+type ListDelta struct {
+	Path string `json:"path"`
+	// Token is the value to pass as since in the next call
+	Token   string     `json:"token"`
+	Added   []FileInfo `json:"added"`
+	Changed []FileInfo `json:"changed"`
+	// Removed holds the names of the entries that are gone
+	Removed []string `json:"removed"`
+}
+
+// deltaToken returns the token of a journal position
+func (j *changeJournal) deltaToken(seq int64) string {
+	return j.id + "." + strconv.FormatInt(seq, 10)
+}
+
+// listDeltaHandler returns the entries of a directory added, changed or
+// removed since ?since=<token>, from the change journal, so clients
+// keeping a large listing up to date don't have to fetch it again. Without
+// since it returns the current token only, which a client that has just
+// listed the directory uses as its starting point. 410 Gone tells the
+// client to list the directory again, as for /api/changes.
+func listDeltaHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	requestedPath := strings.Trim(pathParam(r, "path"), "/")
+	fullPath, err := resolvePath(requestedPath)
+	if err != nil {
+		writePathError(w, err)
+		return
+	}
+	user := authenticatedUser(r)
+	if !canRead(user, requestedPath) {
+		http.Error(w, "Path not found", http.StatusNotFound)
+		return
+	}
+	if info, err := os.Stat(fullPath); err != nil || !info.IsDir() {
+		http.Error(w, "Directory not found", http.StatusNotFound)
+		return
+	}
+
+	journal.mu.Lock()
+	if !journal.ready {
+		journal.mu.Unlock()
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, "Change journal is being built", http.StatusServiceUnavailable)
+		return
+	}
+	delta := ListDelta{Path: requestedPath, Token: journal.deltaToken(journal.seq), Added: []FileInfo{}, Changed: []FileInfo{}, Removed: []string{}}
+
+	// Whether each entry changed since the token existed then and now
+	type existence struct{ before, now bool }
+	entries := make(map[string]*existence)
+	if token := r.URL.Query().Get("since"); token != "" {
+		i := strings.LastIndex(token, ".")
+		since, err := strconv.ParseInt(token[i+1:], 10, 64)
+		switch {
+		case i < 0 || err != nil || since < 0:
+			journal.mu.Unlock()
+			http.Error(w, "Invalid since", http.StatusBadRequest)
+			return
+		case token[:i] != journal.id:
+			journal.mu.Unlock()
+			http.Error(w, "Change journal was restarted", http.StatusGone)
+			return
+		case since > journal.seq:
+			journal.mu.Unlock()
+			http.Error(w, "Invalid since", http.StatusBadRequest)
+			return
+		}
+		oldest := journal.seq + 1
+		if len(journal.records) > 0 {
+			oldest = journal.records[0].Seq
+		}
+		if since < oldest-1 {
+			journal.mu.Unlock()
+			http.Error(w, "Change journal no longer reaches back that far", http.StatusGone)
+			return
+		}
+
+		dir := requestedPath
+		if dir == "" {
+			dir = "."
+		}
+		for _, change := range journal.records[since-oldest+1:] {
+			if path.Dir(change.Path) != dir {
+				continue
+			}
+			name := path.Base(change.Path)
+			entry := entries[name]
+			if entry == nil {
+				entry = &existence{before: change.Op != "create"}
+				entries[name] = entry
+			}
+			entry.now = change.Op != "delete"
+		}
+	}
+	journal.mu.Unlock()
+
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	originals := originalNames.lookup(fsPath(fullPath))
+	for _, name := range names {
+		entry := entries[name]
+		entryPath := path.Join(requestedPath, name)
+		if !canRead(user, entryPath) {
+			continue
+		}
+		// The disk has the final say: the journal may not have seen the
+		// latest changes yet
+		info, err := os.Stat(localPath(entryPath))
+		if err != nil || !entry.now {
+			if entry.before {
+				delta.Removed = append(delta.Removed, name)
+			}
+			continue
+		}
+		if isMountPoint(entryPath) {
+			info = mountInfo{info, name}
+		}
+		file := newFileInfo(entryPath, info)
+		if file.IsDir {
+			file.DirSize = dirSizes.lookup(file.Path)
+		} else {
+			file.OriginalName = originals[name]
+		}
+		if entry.before {
+			delta.Changed = append(delta.Changed, file)
+		} else {
+			delta.Added = append(delta.Added, file)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(delta); err != nil {
+		log.Printf("JSON encoding error: %v", err)
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// limitedIdleTimeout is the default -idle-timeout under -max-conns, which
+// closes idle keep-alive connections sooner, since each holds one of the
+// connections allowed
+const limitedIdleTimeout = 15 * time.Second
+
+// connSlots holds a token for every open connection, at most -max-conns;
+// nil means unlimited
+var connSlots chan struct{}
+
+// limitListener stops accepting connections while connSlots is full, which
+// leaves further clients waiting in the listen backlog until one closes
+func limitListener(l net.Listener, slots chan struct{}) net.Listener {
+	return &slotListener{Listener: l, slots: slots}
+}
+
+type slotListener struct {
+	net.Listener
+	slots chan struct{}
+}
+
+func (l *slotListener) Accept() (net.Conn, error) {
+	l.slots <- struct{}{}
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		<-l.slots
+		return nil, err
+	}
+	return &slotConn{Conn: conn, slots: l.slots}, nil
+}
+
+// slotConn gives its token back when it is closed
+type slotConn struct {
+	net.Conn
+	slots chan struct{}
+	once  sync.Once
+}
+
+func (c *slotConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() { <-c.slots })
+	return err
+}
+
+// transferTicketHold is how long a transfer refused after -transfer-queue
+// keeps its place in line for the client to try again
+const transferTicketHold = time.Minute
+
+// transferSlots admits at most -max-transfers downloads and uploads at
+// once; nil means unlimited
+var transferSlots *transferQueue
+
+// transferQueueTimeout is how long a transfer waits for a slot before it
+// is refused (-transfer-queue)
+var transferQueueTimeout time.Duration
+
+// transferQueue hands out transfer slots fairly: clients waiting for one
+// take turns, so a client asking for many transfers at once doesn't hold
+// up everyone else. Each waiting transfer has a ticket, which keeps its
+// place for a while after the client gives up waiting, so a retry
+// continues where it left off.
+type transferQueue struct {
+	mu      sync.Mutex
+	slots   int
+	running int
+	// clients lists the clients with tickets, in the order of their turns
+	clients []string
+	tickets map[string][]*transferTicket
+}
+
+// transferTicket is a transfer waiting for a slot
+type transferTicket struct {
+	key string
+	// granted is closed once the ticket has a slot
+	granted chan struct{}
+	// waiting is set while a request waits on the ticket; a ticket
+	// nobody waits on is skipped, and dropped after expires
+	waiting bool
+	expires time.Time
+}
+
+func newTransferQueue(slots int) *transferQueue {
+	return &transferQueue{slots: slots, tickets: make(map[string][]*transferTicket)}
+}
+
+// acquire waits up to timeout for a slot for the transfer key of client.
+// It returns the slot's release function, or nil and the transfer's place
+// in line if it got none.
+func (q *transferQueue) acquire(ctx context.Context, client, key string, timeout time.Duration) (release func(), position int) {
+	q.mu.Lock()
+	ticket := q.ticket(client, key)
+	if ticket == nil && q.running < q.slots && len(q.clients) == 0 {
+		q.running++
+		q.mu.Unlock()
+		return q.release, 0
+	}
+	if ticket == nil {
+		ticket = &transferTicket{key: key, granted: make(chan struct{})}
+		if len(q.tickets[client]) == 0 {
+			q.clients = append(q.clients, client)
+		}
+		q.tickets[client] = append(q.tickets[client], ticket)
+	}
+	ticket.waiting = true
+	q.dispatch()
+	q.mu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-ticket.granted:
+		return q.release, 0
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	select {
+	case <-ticket.granted:
+		// Granted just now
+		return q.release, 0
+	default:
+	}
+	ticket.waiting = false
+	ticket.expires = time.Now().Add(transferTicketHold)
+	return nil, q.position(client, ticket)
+}
+
+// release frees a slot for the next transfer in line
+func (q *transferQueue) release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.running--
+	q.dispatch()
+}
+
+// resize changes the number of transfers run at once. Running transfers
+// carry on; over the new number, waiting ones start as others finish.
+func (q *transferQueue) resize(slots int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.slots = slots
+	q.dispatch()
+}
+
+// ticket finds the ticket of a transfer. The caller must hold q.mu.
+func (q *transferQueue) ticket(client, key string) *transferTicket {
+	for _, ticket := range q.tickets[client] {
+		if ticket.key == key {
+			return ticket
+		}
+	}
+	return nil
+}
+
+// dispatch grants free slots to the first waiting ticket of each client in
+// turn, and drops tickets nobody came back for. The caller must hold q.mu.
+func (q *transferQueue) dispatch() {
+	now := time.Now()
+	for i := 0; i < len(q.clients); {
+		client := q.clients[i]
+		tickets := q.tickets[client]
+		kept := tickets[:0]
+		for _, ticket := range tickets {
+			if ticket.waiting || now.Before(ticket.expires) {
+				kept = append(kept, ticket)
+			}
+		}
+		q.tickets[client] = kept
+		if len(kept) == 0 {
+			delete(q.tickets, client)
+			q.clients = append(q.clients[:i], q.clients[i+1:]...)
+			continue
+		}
+		i++
+	}
+
+	for q.running < q.slots {
+		granted := false
+		for i, client := range q.clients {
+			tickets := q.tickets[client]
+			for j, ticket := range tickets {
+				if !ticket.waiting {
+					continue
+				}
+				q.running++
+				close(ticket.granted)
+				q.tickets[client] = append(tickets[:j], tickets[j+1:]...)
+				// The client's next transfer waits for the others' turns
+				q.clients = append(q.clients[:i], q.clients[i+1:]...)
+				if len(q.tickets[client]) > 0 {
+					q.clients = append(q.clients, client)
+				} else {
+					delete(q.tickets, client)
+				}
+				granted = true
+				break
+			}
+			if granted {
+				break
+			}
+		}
+		if !granted {
+			return
+		}
+	}
+}
+
+// position returns the place in line of a ticket, counting the transfers
+// that get a slot before it as clients take turns. The caller must hold
+// q.mu.
+func (q *transferQueue) position(client string, ticket *transferTicket) int {
+	turn := 0
+	for i, t := range q.tickets[client] {
+		if t == ticket {
+			turn = i
+		}
+	}
+	position := 1
+	before := true
+	for _, other := range q.clients {
+		if other == client {
+			before = false
+		}
+		ahead := turn
+		if before {
+			ahead++
+		}
+		position += min(len(q.tickets[other]), ahead)
+	}
+	return position
+}
+
+// transferLimitMiddleware lets at most -max-transfers downloads and uploads
+// run at once. Others wait in line up to -transfer-queue, then are refused
+// with 503 Service Unavailable and their place in line (X-Queue-Position),
+// which they keep for a minute. HEAD requests don't transfer anything and
+// pass.
+func transferLimitMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if transferSlots == nil || r.Method == http.MethodHead {
+			next(w, r)
+			return
+		}
+		settingsMu.RLock()
+		timeout := transferQueueTimeout
+		settingsMu.RUnlock()
+		release, position := transferSlots.acquire(r.Context(), clientHost(r), r.Method+" "+r.URL.RequestURI(), timeout)
+		if release == nil {
+			if r.Context().Err() != nil {
+				return
+			}
+			retry := strconv.Itoa(int(max(timeout, 5*time.Second) / time.Second))
+			w.Header().Set("Retry-After", retry)
+			w.Header().Set("X-Queue-Position", strconv.Itoa(position))
+			if strings.Contains(r.Header.Get("Accept"), "text/html") {
+				// Browsers try again by themselves
+				w.Header().Set("Refresh", retry)
+			}
+			http.Error(w, fmt.Sprintf("Too many transfers in progress. You are number %d in line; try again in %s seconds to keep your place", position, retry), http.StatusServiceUnavailable)
+			return
+		}
+		defer release()
+		next(w, r)
+	}
+}
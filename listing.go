@@ -0,0 +1,353 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultListLimit is the number of entries per listing window
+	defaultListLimit = 200
+	// maxListLimit caps the window size a client may request
+	maxListLimit = 1000
+)
+
+// ListPage is one window of a directory listing
+type ListPage struct {
+	Path   string     `json:"path"`
+	Total  int        `json:"total"`
+	Offset int        `json:"offset"`
+	Files  []FileInfo `json:"files"`
+	Next   string     `json:"next,omitempty"`
+}
+
+// encodeCursor turns the name of the last entry of a window into an opaque token
+func encodeCursor(name string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(name))
+}
+
+// decodeCursor recovers the entry name from a cursor token
+func decodeCursor(token string) (string, error) {
+	name, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return "", err
+	}
+	return string(name), nil
+}
+
+// categoryIcons are the icons of the file categories
+var categoryIcons = map[string]string{
+	"folder":   "📁",
+	"image":    "🖼️",
+	"audio":    "🎵",
+	"video":    "🎬",
+	"document": "📄",
+	"archive":  "📦",
+	"code":     "📝",
+	"other":    "📄",
+}
+
+// linkCounts adds the hard link counts of files to listings (-link-counts)
+var linkCounts bool
+
+// newFileInfo describes a file or directory for listings and API
+// responses, so pages and scripts don't need to know about extensions
+func newFileInfo(requestedPath string, info os.FileInfo) FileInfo {
+	file := FileInfo{
+		Name:     info.Name(),
+		Path:     requestedPath,
+		Size:     info.Size(),
+		ModTime:  info.ModTime(),
+		IsDir:    info.IsDir(),
+		Category: "folder",
+	}
+	if !info.IsDir() {
+		file.MIMEType, _ = getMIMEType(requestedPath)
+		_, file.Viewable = viewableType(requestedPath)
+		file.Category = fileCategory(requestedPath)
+		file.HasChecksum = checksums != nil && checksums.has(requestedPath, info.Size())
+		if _, links := fileLinks(info); linkCounts && links > 1 {
+			file.Links = links
+		}
+	}
+	file.Icon = categoryIcons[file.Category]
+	return file
+}
+
+// listFilter narrows a listing to entries of some types, sizes or ages
+// (?type=, ?min-size= and ?modified-after=)
+type listFilter struct {
+	// types are file categories, "dir" for directories and "file" for any
+	// file
+	types         map[string]bool
+	minSize       int64
+	modifiedAfter time.Time
+	// query holds the parameters as given, to pass on to further windows
+	query url.Values
+}
+
+// parseListFilter reads the filter of a listing request. Types are
+// comma-separated; modified-after is a date, a time (RFC 3339) or an age
+// such as "24h" or "7d".
+func parseListFilter(query url.Values) (listFilter, error) {
+	filter := listFilter{query: url.Values{}}
+	for _, value := range query["type"] {
+		if value == "" {
+			continue
+		}
+		for _, t := range strings.Split(value, ",") {
+			t = strings.ToLower(strings.TrimSpace(t))
+			if t == "" {
+				continue
+			}
+			if t == "folder" {
+				t = "dir"
+			}
+			if _, ok := categoryIcons[t]; !ok && t != "dir" && t != "file" {
+				return filter, fmt.Errorf("unknown type %q", t)
+			}
+			if filter.types == nil {
+				filter.types = make(map[string]bool)
+			}
+			filter.types[t] = true
+		}
+		filter.query.Add("type", value)
+	}
+	if value := query.Get("min-size"); value != "" {
+		size, err := parseSize(value)
+		if err != nil {
+			return filter, fmt.Errorf("invalid min-size %q", value)
+		}
+		filter.minSize = size
+		filter.query.Set("min-size", value)
+	}
+	if value := query.Get("modified-after"); value != "" {
+		if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+			filter.modifiedAfter = t
+		} else if t, err := time.Parse(time.RFC3339, value); err == nil {
+			filter.modifiedAfter = t
+		} else if age, err := parseLifetime(value); err == nil {
+			filter.modifiedAfter = time.Now().Add(-age)
+		} else {
+			return filter, fmt.Errorf("invalid modified-after %q", value)
+		}
+		filter.query.Set("modified-after", value)
+	}
+	return filter, nil
+}
+
+// active reports whether the filter leaves anything out
+func (f listFilter) active() bool {
+	return len(f.query) > 0
+}
+
+// matches reports whether a directory entry passes the filter. Sizes and
+// times are those of the entry itself, so min-size leaves out directories.
+func (f listFilter) matches(entry os.DirEntry) bool {
+	if f.types != nil {
+		kind := "dir"
+		if !entry.IsDir() {
+			kind = fileCategory(entry.Name())
+		}
+		if !f.types[kind] && !(kind != "dir" && f.types["file"]) {
+			return false
+		}
+	}
+	if f.minSize > 0 || !f.modifiedAfter.IsZero() {
+		info, err := entry.Info()
+		if err != nil || info.Size() < f.minSize || !info.ModTime().After(f.modifiedAfter) {
+			return false
+		}
+	}
+	return true
+}
+
+// linkedEntry is a directory entry for a symbolic link that describes
+// what the link points to, as downloads see it
+type linkedEntry struct {
+	fs.DirEntry
+	info fs.FileInfo
+}
+
+func (e linkedEntry) IsDir() bool                { return e.info.IsDir() }
+func (e linkedEntry) Type() fs.FileMode          { return e.info.Mode().Type() }
+func (e linkedEntry) Info() (fs.FileInfo, error) { return e.info, nil }
+
+// followSymlink returns the entry of a symbolic link in dir as what it
+// points to, or as the link if that is missing
+func followSymlink(dir string, entry fs.DirEntry) fs.DirEntry {
+	info, err := os.Stat(filepath.Join(dir, entry.Name()))
+	if err != nil {
+		return entry
+	}
+	return linkedEntry{DirEntry: entry, info: info}
+}
+
+// listDirectory returns a window of at most limit entries of the directory
+// requestedPath; fullPath, where it is on disk, finds the original names of
+// its files.
+// Entries are ordered by name, so a cursor (the name of the last entry the
+// client has seen) stays valid while files are added or removed elsewhere
+// in the directory. Offset skips further entries after the cursor.
+// Entries the user ("" for anonymous) may not see, or that don't pass the
+// filter, are left out.
+func listDirectory(fullPath, requestedPath, cursor string, offset, limit int, user string, filter listFilter) (ListPage, error) {
+	// The storage returns entries sorted by name; only the entries in the
+	// window are stat'ed, which keeps huge directories cheap
+	entries, err := served.ReadDir(storageName(requestedPath))
+	if err != nil {
+		return ListPage{}, err
+	}
+	settingsMu.RLock()
+	restricted := len(authOnlyPatterns) > 0 || len(aclRules) > 0
+	settingsMu.RUnlock()
+	if restricted || homeDirs || filter.active() {
+		visible := entries[:0]
+		for _, entry := range entries {
+			if canRead(user, path.Join(requestedPath, entry.Name())) && filter.matches(entry) {
+				visible = append(visible, entry)
+			}
+		}
+		entries = visible
+	}
+
+	start := 0
+	if cursor != "" {
+		start = sort.Search(len(entries), func(i int) bool {
+			return entries[i].Name() > cursor
+		})
+	}
+	start += offset
+	if start > len(entries) {
+		start = len(entries)
+	}
+	end := start + limit
+	if end > len(entries) {
+		end = len(entries)
+	}
+
+	files := make([]FileInfo, 0, end-start)
+	names := originalNames.lookup(fsPath(fullPath))
+	for _, entry := range entries[start:end] {
+		entryInfo, err := entry.Info()
+		if err != nil {
+			continue
+		}
+
+		file := newFileInfo(path.Join(requestedPath, entry.Name()), entryInfo)
+		if file.IsDir {
+			file.DirSize = dirSizes.lookup(file.Path)
+		} else {
+			file.OriginalName = names[file.Name]
+		}
+		files = append(files, file)
+	}
+
+	page := ListPage{
+		Path:   requestedPath,
+		Total:  len(entries),
+		Offset: start,
+		Files:  files,
+	}
+	if end < len(entries) && end > 0 {
+		page.Next = encodeCursor(entries[end-1].Name())
+	}
+	return page, nil
+}
+
+// listHandler serves a window of a directory listing as JSON.
+// Query parameters: cursor (token from a previous page), offset and limit,
+// and the filters type, min-size and modified-after.
+func listHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	requestedPath := strings.Trim(pathParam(r, "path"), "/")
+
+	// Security check: ensure the path is within workingDir
+	fullPath, err := resolvePath(requestedPath)
+	if err != nil {
+		writePathError(w, err)
+		return
+	}
+
+	// Paths the user may not see look nonexistent
+	info, err := served.Stat(storageName(requestedPath))
+	if err != nil || !canSee(r, requestedPath) {
+		if err == nil || errors.Is(err, fs.ErrNotExist) {
+			http.Error(w, "Path not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Error accessing path", http.StatusInternalServerError)
+		return
+	}
+	if !info.IsDir() {
+		http.Error(w, "Not a directory", http.StatusBadRequest)
+		return
+	}
+
+	// Parse window parameters
+	query := r.URL.Query()
+	offset := 0
+	if v := query.Get("offset"); v != "" {
+		offset, err = strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			http.Error(w, "Invalid offset", http.StatusBadRequest)
+			return
+		}
+	}
+	limit := defaultListLimit
+	if v := query.Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		if limit > maxListLimit {
+			limit = maxListLimit
+		}
+	}
+	cursor := ""
+	if v := query.Get("cursor"); v != "" {
+		cursor, err = decodeCursor(v)
+		if err != nil {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+	}
+
+	filter, err := parseListFilter(query)
+	if err != nil {
+		http.Error(w, "Invalid filter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	page, err := listDirectory(fullPath, requestedPath, cursor, offset, limit, authenticatedUser(r), filter)
+	if err != nil {
+		http.Error(w, "Error reading directory", http.StatusInternalServerError)
+		return
+	}
+	if listingNotModified(w, r, listingETag(page, page.Path)) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(page); err != nil {
+		log.Printf("JSON encoding error: %v", err)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+)
+
+// journaldSocket is where systemd-journald accepts native protocol datagrams
+const journaldSocket = "/run/systemd/journal/socket"
+
+// Syslog severities used for the two kinds of records
+const (
+	severityNotice = 5
+	severityInfo   = 6
+)
+
+// syslogFacilities maps facility names to their syslog codes
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// logSink receives access and audit records in addition to the console log
+type logSink interface {
+	Access(msg string) error
+	Audit(msg string) error
+}
+
+// logSinks are the configured external log outputs
+var logSinks []logSink
+
+// parseSyslogFacility returns the code of a facility name such as "local0"
+func parseSyslogFacility(name string) (int, error) {
+	facility, ok := syslogFacilities[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("unknown syslog facility %q", name)
+	}
+	return facility, nil
+}
+
+// accessLogf sends a completed-request record to the external log outputs
+func accessLogf(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	for _, sink := range logSinks {
+		if err := sink.Access(msg); err != nil {
+			log.Printf("Log output error: %v", err)
+		}
+	}
+}
+
+// auditLogf records a security-relevant event (writes, denied access, admin
+// actions) on the console and the external log outputs
+func auditLogf(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	log.Printf("Audit: %s", msg)
+	for _, sink := range logSinks {
+		if err := sink.Audit(msg); err != nil {
+			log.Printf("Log output error: %v", err)
+		}
+	}
+}
+
+// journaldSink writes records to systemd-journald using its native protocol
+type journaldSink struct {
+	conn     *net.UnixConn
+	facility int
+	tag      string
+}
+
+// newJournaldSink connects to the local journald socket
+func newJournaldSink(facility int, tag string) (logSink, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journaldSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &journaldSink{conn: conn, facility: facility, tag: tag}, nil
+}
+
+func (j *journaldSink) Access(msg string) error {
+	return j.send(severityInfo, "access", msg)
+}
+
+func (j *journaldSink) Audit(msg string) error {
+	return j.send(severityNotice, "audit", msg)
+}
+
+// send writes one journal entry; values containing newlines use the
+// length-prefixed binary field encoding
+func (j *journaldSink) send(priority int, logType, msg string) error {
+	var buf bytes.Buffer
+	writeField := func(name, value string) {
+		if !strings.Contains(value, "\n") {
+			buf.WriteString(name + "=" + value + "\n")
+			return
+		}
+		buf.WriteString(name + "\n")
+		binary.Write(&buf, binary.LittleEndian, uint64(len(value)))
+		buf.WriteString(value + "\n")
+	}
+
+	writeField("MESSAGE", msg)
+	writeField("PRIORITY", fmt.Sprint(priority))
+	writeField("SYSLOG_FACILITY", fmt.Sprint(j.facility))
+	writeField("SYSLOG_IDENTIFIER", j.tag)
+	writeField("FILES_LOG_TYPE", logType)
+
+	_, err := j.conn.Write(buf.Bytes())
+	return err
+}
@@ -1,18 +1,30 @@
 package main
 
 import (
+	"crypto/tls"
 	"embed"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"html/template"
 	"io"
+	"io/fs"
 	"log"
+	"math"
+	"mime"
+	"mime/multipart"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
+
+	"golang.org/x/crypto/ssh"
 )
 
 //go:embed templates/*
@@ -21,37 +33,77 @@ var templateFS embed.FS
 var templates *template.Template
 
 var (
-	addr               string
+	addresses          []string
 	workingDir         string
 	intelligentMIME    bool
 	customMIMETypes    map[string]string
 	customMIMEViewable map[string]bool
+	// forceDownloadExts are extensions always sent as attachments
+	// (-force-download), whatever the MIME settings say
+	forceDownloadExts map[string]bool
 )
 
 type FileInfo struct {
-	Name    string
-	Path    string
-	Size    int64
-	ModTime time.Time
-	IsDir   bool
+	Name    string    `json:"name"`
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	IsDir   bool      `json:"isDir"`
+	// MIMEType and Category (image, audio, video, document, archive, code,
+	// other, or folder) are derived from the extension
+	MIMEType string `json:"mimeType,omitempty"`
+	Category string `json:"category"`
+	// Viewable is set when downloads of the file are shown in the browser
+	Viewable bool `json:"viewable,omitempty"`
+	// Icon is an emoji suited to the category
+	Icon string `json:"icon"`
+	// HasChecksum is set when the checksum log has the file's SHA-256
+	HasChecksum bool `json:"hasChecksum,omitempty"`
+	// DirSize is what a directory holds, in listings once it is measured
+	DirSize *DirSize `json:"dirSize,omitempty"`
+	// Links is the number of hard links to a file that has several, with
+	// -link-counts
+	Links uint64 `json:"links,omitempty"`
+	// OriginalName is the name a file stored under a generated name was
+	// uploaded with (-unique-names)
+	OriginalName string `json:"originalName,omitempty"`
 }
 
 type PageData struct {
+	Page
 	CurrentPath string
 	ParentPath  string
 	Files       []FileInfo
+	// Offset is the position of the first of Files in the directory
+	Offset      int
+	Total       int
+	NextCursor  string
 	Error       string
+	AuthEnabled bool
+	User        string
+	Quota       int64
+	Stored      int64
+	// FetchEnabled shows the "Import URL" button
+	FetchEnabled bool
+	// Filter holds the listing filter (type, min-size and modified-after)
+	// as given in the query
+	Filter url.Values
+	// Session shows the "Log out" button to users logged in with the login
+	// page or OpenID Connect
+	Session bool
+	// TwoFactor links users logged in with a password to their two-factor
+	// authentication settings
+	TwoFactor bool
 }
 
+var (
+	errInvalidPath  = errors.New("invalid path")
+	errAccessDenied = errors.New("access denied")
+)
+
 func init() {
 	var err error
-	funcMap := template.FuncMap{
-		"formatSize": formatSize,
-		"formatDate": formatDate,
-		"splitPath":  splitPath,
-		"joinPath":   joinPath,
-	}
-	templates, err = template.New("").Funcs(funcMap).ParseFS(templateFS, "templates/*.html")
+	templates, err = loadTemplates("")
 	if err != nil {
 		log.Fatal("Failed to parse templates:", err)
 	}
@@ -71,49 +123,356 @@ func formatSize(size int64) string {
 	return fmt.Sprintf("%.1f %cB", float64(size)/float64(div), "KMGTPE"[exp])
 }
 
+// formatRate formats a transfer rate given in bytes per second
+func formatRate(rate float64) string {
+	return formatSize(int64(rate)) + "/s"
+}
+
+// percent returns part as a percentage of total
+func percent(part, total int64) float64 {
+	if total <= 0 {
+		return 0
+	}
+	return float64(part) * 100 / float64(total)
+}
+
 // formatDate formats time in human-readable format
 func formatDate(t time.Time) string {
 	return t.Format("2006-01-02 15:04:05")
 }
 
-// splitPath splits a path into components
-func splitPath(path string) []string {
-	return strings.Split(filepath.Clean(path), string(filepath.Separator))
+// splitPath splits a URL path into components. URL paths always use
+// slashes, whatever the separator of the server's filesystem.
+func splitPath(p string) []string {
+	return strings.Split(path.Clean(p), "/")
 }
 
-// joinPath joins path components
+// joinPath joins URL path components
 func joinPath(parts ...string) string {
-	return filepath.Join(parts...)
+	return path.Join(parts...)
+}
+
+// options holds the command-line flags of the server, after -config
+type options struct {
+	host                  *string
+	port                  *string
+	qr                    *bool
+	ipv4                  *bool
+	ipv6                  *bool
+	listen                *addressList
+	dir                   *string
+	mount                 *mountList
+	backend               *string
+	contentHost           *string
+	forceDownload         *string
+	intelligentMIME       *string
+	goproxy               *string
+	dataDir               *string
+	reusePort             *bool
+	listeners             *int
+	linkCounts            *bool
+	tlsSelfSigned         *bool
+	redirectHTTP          *string
+	shutdownTimeout       *time.Duration
+	fsync                 *string
+	checksums             *bool
+	scratch               *string
+	scratchLifetime       *string
+	scratchSize           *string
+	tier                  *string
+	tierAfter             *string
+	tierPath              *string
+	scrub                 *string
+	scrubWebhook          *string
+	templates             *string
+	artifactCache         *string
+	journal               *time.Duration
+	admin                 *bool
+	adminLoopback         *bool
+	scanInterval          *time.Duration
+	compress              *bool
+	compressMinSize       *string
+	compressExcludeTypes  *string
+	compressExcludePaths  *string
+	sanitize              *string
+	onConflict            *string
+	maxNameLength         *int
+	syslog                *string
+	journald              *bool
+	syslogFacility        *string
+	syslogTag             *string
+	auth                  *string
+	usersDB               *string
+	token                 *string
+	tokenFile             *string
+	oidcIssuer            *string
+	oidcClientID          *string
+	oidcClientSecret      *string
+	oidcRedirectURL       *string
+	oidcUserClaim         *string
+	sessionLifetime       *time.Duration
+	secureCookies         *bool
+	authOnly              *string
+	acl                   *string
+	authOnlyFile          *string
+	geoip                 *string
+	geoipAllow            *string
+	geoipDeny             *string
+	rateLimit             *float64
+	rateBurst             *int
+	allowCIDR             *string
+	denyCIDR              *string
+	prefix                *string
+	trustedProxies        *string
+	crawlLimit            *int
+	maxConns              *int
+	maxTransfers          *int
+	transferQueue         *time.Duration
+	readHeaderTimeout     *time.Duration
+	readTimeout           *time.Duration
+	writeTimeout          *time.Duration
+	idleTimeout           *time.Duration
+	maxBandwidth          *string
+	maxPerConn            *string
+	bandwidth             *string
+	bandwidthFile         *string
+	quota                 *string
+	monthlyCap            *string
+	archiveWorkers        *int
+	archiveQueue          *int
+	fetch                 *bool
+	fetchMaxSize          *string
+	fetchPrivate          *bool
+	ftp                   *string
+	ftpPassivePorts       *string
+	ftpPublicHost         *string
+	sftp                  *string
+	sftpHostKey           *string
+	webdav                *bool
+	uploadTimeout         *time.Duration
+	partialUploadLifetime *time.Duration
+	uploadMinRate         *string
+	homeDirs              *bool
+	uploadOnly            *bool
+	uniqueNames           *bool
+	pypi                  *string
+	config                *string
+}
+
+// parseOptions defines the server's flags, parses the command line and
+// applies -config beneath it
+func parseOptions() *options {
+	opts := &options{}
+	opts.host = flag.String("host", "", "Address to listen on; IPv6 addresses may be in brackets (default: all interfaces, IPv4 and IPv6)")
+	opts.port = flag.String("port", "8080", "Port to listen on")
+	opts.qr = flag.Bool("qr", true, "Print a QR code of the server's network URL at startup when the output is a terminal")
+	opts.ipv4 = flag.Bool("4", false, "Listen on IPv4 only")
+	opts.ipv6 = flag.Bool("6", false, "Listen on IPv6 only")
+	opts.listen = &addressList{}
+	flag.Var(opts.listen, "listen", "Address to listen on as host:port, replacing -host and -port; repeat it or separate addresses with commas to listen on several")
+	opts.dir = flag.String("dir", "", "Working directory to serve files from (default: current directory)")
+	opts.mount = &mountList{}
+	opts.backend = flag.String("backend", "", "Storage to serve instead of a directory: an S3 or MinIO bucket as s3://bucket/prefix (credentials from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY, AWS_REGION, AWS_ENDPOINT_URL), or a directory of an SSH server as sftp://user@host/path (keys from the SSH agent or ~/.ssh, or SFTP_PASSWORD)")
+	flag.Var(opts.mount, "mount", "Directory to serve as a top-level folder of its own, as name=path; repeat it for several (without -dir, the root holds only these)")
+	opts.contentHost = flag.String("content-host", "", "Separate host name (and port) from which files are shown in the browser, e.g. usercontent.example.com; it must reach this server too")
+	opts.forceDownload = flag.String("force-download", ".html,.htm,.xhtml,.svg,.xml", "Comma-separated extensions always downloaded as application/octet-stream, never shown in the browser")
+	opts.intelligentMIME = flag.String("i", "", "Enable intelligent MIME recognition. Use 'true' for defaults, or specify custom mappings like 'ext1,ext2:mime/type;ext3:mime/type2,v' (,v indicates viewable)")
+	opts.goproxy = flag.String("goproxy", "", "Serve a directory of Go modules (module cache download layout) as a GOPROXY under /goproxy/")
+	opts.dataDir = flag.String("data-dir", "", "Directory for state kept across restarts, such as statistics (default: none)")
+	opts.reusePort = flag.Bool("reuseport", false, "Listen with SO_REUSEPORT, allowing several accept loops and a replacement process on the same address")
+	opts.listeners = flag.Int("listeners", 1, "Number of listening sockets and accept loops with -reuseport")
+	opts.linkCounts = flag.Bool("link-counts", false, "Report the number of hard links of files that have several in listings")
+	opts.tlsSelfSigned = flag.Bool("tls-self-signed", false, "Serve HTTPS with a certificate generated at startup for this host's names and addresses, kept in memory only")
+	opts.redirectHTTP = flag.String("redirect-http", "", "With TLS, also listen for plain HTTP on this address (e.g. :80) and redirect it to HTTPS")
+	opts.shutdownTimeout = flag.Duration("shutdown-timeout", 30*time.Second, "How long to wait for requests in progress when stopping")
+	opts.fsync = flag.String("fsync", "off", "Flush uploads to stable storage before reporting success: off, file or full (file and directory)")
+	opts.checksums = flag.Bool("checksums", false, "Record the SHA-256 of every upload in -data-dir for 'files verify'")
+	opts.scratch = flag.String("scratch", "", "Directory for temporary workspaces at /tmp that pass files between devices (default: off)")
+	opts.scratchLifetime = flag.String("scratch-lifetime", "24h", "How long an unused workspace is kept, e.g. 24h or 7d")
+	opts.scratchSize = flag.String("scratch-size", "1G", "Most a workspace may hold")
+	opts.tier = flag.String("tier", "", "Comma-separated directories whose unused files are moved to -tier-path, e.g. videos,archive (default: none)")
+	opts.tierAfter = flag.String("tier-after", "30d", "How long a file in a -tier directory may go unmodified and undownloaded before it is moved")
+	opts.tierPath = flag.String("tier-path", "", "Directory on secondary storage that -tier moves files to")
+	opts.scrub = flag.String("scrub", "", "Re-hash the files recorded by -checksums this often in the background, e.g. 7d, and report mismatches (default: off)")
+	opts.scrubWebhook = flag.String("scrub-webhook", "", "URL to post a JSON report to when a scrub finds mismatches")
+	opts.templates = flag.String("templates", "", "Directory of page templates (*.html) replacing the built-in ones of the same name (default: built-in only)")
+	opts.artifactCache = flag.String("artifact-cache", "", "Keep up to this much of the generated archives in -data-dir, e.g. 2G, to send them again without rebuilding them (default: off)")
+	opts.journal = flag.Duration("journal", 0, "Keep a change journal for /api/changes, reconciled with the disk at this interval (0 disables it)")
+	opts.admin = flag.Bool("admin", false, "Enable the admin API under /api/admin/ (admins of -users-db only)")
+	opts.adminLoopback = flag.Bool("admin-loopback", false, "Treat clients on the loopback interface as admins, e.g. for files top on the server (not behind a proxy on the same host)")
+	opts.scanInterval = flag.Duration("scan-interval", 10*time.Minute, "How long background directory scans (disk usage and file-type reports) are cached")
+	opts.compress = flag.Bool("compress", false, "Gzip responses for clients that accept it")
+	opts.compressMinSize = flag.String("compress-min-size", "1K", "Smallest response body to compress")
+	opts.compressExcludeTypes = flag.String("compress-exclude-types", strings.Join(compressExcludeTypes, ","), "Comma-separated content types sent uncompressed (type/* matches a whole type)")
+	opts.compressExcludePaths = flag.String("compress-exclude-paths", "", "Comma-separated URL paths (wildcards allowed) whose responses are sent uncompressed")
+	opts.sanitize = flag.String("sanitize", "basic", "Upload file name sanitization: basic, strict, translit or slug")
+	opts.onConflict = flag.String("on-conflict", "overwrite", "What an upload named like an existing file does: overwrite, reject or rename (adds a \" (n)\" suffix)")
+	opts.maxNameLength = flag.Int("max-name-length", 255, "Maximum length of uploaded file names in bytes")
+	opts.syslog = flag.String("syslog", "", "Send access and audit logs to syslog: 'local', udp://host:port or tcp://host:port")
+	opts.journald = flag.Bool("journald", false, "Send access and audit logs to systemd-journald")
+	opts.syslogFacility = flag.String("syslog-facility", "daemon", "Syslog facility for -syslog and -journald (e.g. daemon, local0)")
+	opts.syslogTag = flag.String("syslog-tag", "files", "Syslog identifier for -syslog and -journald")
+	opts.auth = flag.String("auth", "", "Users file with one name:password per line; enables logging in")
+	opts.usersDB = flag.String("users-db", "", "User database with accounts and roles, managed with 'files user'")
+	opts.token = flag.String("token", "", "Comma-separated name:token API tokens for scripts, sent as 'Authorization: Bearer <token>'")
+	opts.tokenFile = flag.String("token-file", "", "File with one name:token API token per line")
+	opts.oidcIssuer = flag.String("oidc-issuer", "", "OpenID Connect provider to log users in with, e.g. https://accounts.example.com")
+	opts.oidcClientID = flag.String("oidc-client-id", "", "Client ID registered with the -oidc-issuer provider")
+	opts.oidcClientSecret = flag.String("oidc-client-secret", "", "Client secret registered with the -oidc-issuer provider (default: none, a public client)")
+	opts.oidcRedirectURL = flag.String("oidc-redirect-url", "", "Redirect URL registered with the provider (default: <scheme>://<host>/oidc/callback of the request)")
+	opts.oidcUserClaim = flag.String("oidc-user-claim", "sub", "ID token claim used as the user name; email is only taken when email_verified is true")
+	opts.sessionLifetime = flag.Duration("session-lifetime", 12*time.Hour, "How long a login through the login page or -oidc-issuer lasts")
+	opts.secureCookies = flag.Bool("secure-cookies", false, "Send session cookies over HTTPS only, even if the server itself is reached over HTTP (behind a TLS proxy)")
+	opts.authOnly = flag.String("auth-only", "", "Comma-separated paths (wildcards allowed) visible to authenticated users only")
+	opts.acl = flag.String("acl", "", "Access control file with per-path deny, read or write rules for users and groups")
+	opts.authOnlyFile = flag.String("auth-only-file", "", "File listing paths visible to authenticated users only, one per line")
+	opts.geoip = flag.String("geoip", "", "MaxMind country or city database (.mmdb) to log client countries with")
+	opts.geoipAllow = flag.String("geoip-allow", "", "Comma-separated ISO country codes of the only countries allowed to connect, e.g. DE,AT,CH (requires -geoip)")
+	opts.geoipDeny = flag.String("geoip-deny", "", "Comma-separated ISO country codes refused with 403 (requires -geoip)")
+	// Named like -allow-cidr and -deny-cidr
+	flag.StringVar(opts.geoipAllow, "allow-countries", "", "Same as -geoip-allow")
+	flag.StringVar(opts.geoipDeny, "deny-countries", "", "Same as -geoip-deny")
+	opts.rateLimit = flag.Float64("rate-limit", 0, "Requests per second each client address may make on average; more are refused with 429 (default: unlimited)")
+	opts.rateBurst = flag.Int("rate-burst", 0, "Requests a client may make at once under -rate-limit (default: twice the rate)")
+	opts.allowCIDR = flag.String("allow-cidr", "", "Comma-separated addresses or networks of the only clients allowed to connect, e.g. 192.168.1.0/24,127.0.0.1")
+	opts.denyCIDR = flag.String("deny-cidr", "", "Comma-separated addresses or networks of clients refused with 403")
+	opts.prefix = flag.String("prefix", "", "Path to serve everything under, e.g. /files, for mounting behind a reverse proxy at a sub-path")
+	opts.trustedProxies = flag.String("trusted-proxies", "", "Comma-separated addresses or networks of reverse proxies whose X-Forwarded-For or X-Real-IP names the client, e.g. 127.0.0.1,10.0.0.0/8")
+	opts.crawlLimit = flag.Int("crawl-limit", 0, "Listings and downloads an anonymous client may request per minute before it is slowed down, then blocked (default: unlimited)")
+	opts.maxConns = flag.Int("max-conns", 0, "Connections served at once; more wait until one closes (default: unlimited)")
+	opts.maxTransfers = flag.Int("max-transfers", 0, "Downloads and uploads run at once; more wait in a fair line up to -transfer-queue (default: unlimited)")
+	opts.transferQueue = flag.Duration("transfer-queue", 10*time.Second, "How long a transfer waits for one of -max-transfers before it is refused with 503")
+	opts.readHeaderTimeout = flag.Duration("read-header-timeout", 10*time.Second, "Close connections that take longer than this to send a request's headers (0: no limit)")
+	opts.readTimeout = flag.Duration("read-timeout", 0, "Most time to read a whole request, body included; it also bounds uploads (default: no limit)")
+	opts.writeTimeout = flag.Duration("write-timeout", 0, "Most time to write a response after the request's headers; it also bounds downloads (default: no limit)")
+	opts.idleTimeout = flag.Duration("idle-timeout", 2*time.Minute, "Close keep-alive connections idle for longer than this (15s by default with -max-conns)")
+	opts.maxBandwidth = flag.String("max-bandwidth", "", "Rate all downloads together may use at most, e.g. 10M, below any -bandwidth rule (default: unlimited)")
+	opts.maxPerConn = flag.String("max-per-conn", "", "Rate each download may use at most, e.g. 2M (default: unlimited)")
+	opts.bandwidth = flag.String("bandwidth", "", "Comma-separated download rate caps by time of day, e.g. 'mon-fri 09:00-18:00=5M' (default: unlimited)")
+	opts.bandwidthFile = flag.String("bandwidth-file", "", "File listing download rate caps by time of day, one rule per line")
+	opts.quota = flag.String("quota", "", "Bytes each user may store in their home directory (<dir>/<name>), e.g. 10G (default: unlimited)")
+	opts.monthlyCap = flag.String("monthly-cap", "", "Bytes each authenticated user may transfer per month, e.g. 50G (default: unlimited)")
+	opts.archiveWorkers = flag.Int("archive-workers", 4, "Number of zip and tar.gz archives built at the same time")
+	opts.archiveQueue = flag.Int("archive-queue", 32, "Number of archive requests that may wait for a worker; more are refused with 503")
+	opts.fetch = flag.Bool("fetch", false, "Allow importing files from http and https URLs (POST /api/fetch)")
+	opts.fetchMaxSize = flag.String("fetch-max-size", "1G", "Largest file imported from a URL")
+	opts.fetchPrivate = flag.Bool("fetch-private", false, "Allow imports from loopback and private network addresses")
+	opts.ftp = flag.String("ftp", "", "Also serve the files over FTP on this address for devices that speak nothing else, e.g. :2121 (default: off)")
+	opts.ftpPassivePorts = flag.String("ftp-passive-ports", "", "Range of ports for passive FTP data connections, e.g. 50000-50100 (default: any free port)")
+	opts.ftpPublicHost = flag.String("ftp-public-host", "", "IPv4 address passive FTP replies name, for a server behind NAT (default: the address the client connected to)")
+	opts.sftp = flag.String("sftp", "", "Also serve the files over SFTP on this address for sftp and scp, e.g. :2022 (default: off)")
+	opts.sftpHostKey = flag.String("sftp-host-key", "", "SSH host key file of -sftp, created if missing (default: sftp_host_key in -data-dir, else a new key each start)")
+	opts.webdav = flag.Bool("webdav", false, "Serve the files over WebDAV at /dav/ for mounting them as a network drive (Finder, Windows Explorer, rclone)")
+	opts.uploadTimeout = flag.Duration("upload-timeout", 0, "Abort upload requests that take longer than this, e.g. 2h (default: no limit)")
+	opts.partialUploadLifetime = flag.Duration("partial-upload-lifetime", 24*time.Hour, "Remove the partial files of chunked uploads after this long without a new chunk (0 keeps them)")
+	opts.uploadMinRate = flag.String("upload-min-rate", "", "Abort uploads arriving slower than this many bytes per second over 30 seconds, e.g. 10K (default: no limit)")
+	opts.homeDirs = flag.Bool("home-dirs", false, "Keep each signed-in user in their home directory (<dir>/<name>); admins of -users-db see everything")
+	opts.uploadOnly = flag.Bool("upload-only", false, "Drop box mode: anonymous visitors may upload files but not list or download anything")
+	opts.uniqueNames = flag.Bool("unique-names", false, "Store every upload under a generated name (time and random), recording the name it was sent with")
+	opts.pypi = flag.String("pypi", "", "Serve a directory of wheels and sdists as a PEP 503 simple index under /simple/")
+	opts.config = flag.String("config", "", "YAML file setting options by their flag names; flags given on the command line override it")
+	flag.Parse()
+	if *opts.config != "" {
+		if err := loadConfig(*opts.config); err != nil {
+			log.Fatalf("Invalid -config %s: %v", *opts.config, err)
+		}
+	}
+	return opts
 }
 
 func main() {
+	// Subcommands; "doctor" takes the server's flags
+	doctor := false
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "top":
+			runTop(os.Args[2:])
+			return
+		case "verify":
+			runVerify(os.Args[2:])
+			return
+		case "user":
+			runUser(os.Args[2:])
+			return
+		case "bench":
+			runBench(os.Args[2:])
+			return
+		case "mount":
+			runMount(os.Args[2:])
+			return
+		case "get":
+			runGet(os.Args[2:])
+			return
+		case "put":
+			runPut(os.Args[2:])
+			return
+		case "doctor":
+			doctor = true
+			os.Args = append(os.Args[:1], os.Args[2:]...)
+		}
+	}
+
 	// Parse command-line flags
-	hostFlag := flag.String("host", "0.0.0.0", "Address to listen on")
-	portFlag := flag.String("port", "8080", "Port to listen on")
-	dirFlag := flag.String("dir", "", "Working directory to serve files from (default: current directory)")
-	intelligentMIMEFlag := flag.String("i", "", "Enable intelligent MIME recognition. Use 'true' for defaults, or specify custom mappings like 'ext1,ext2:mime/type;ext3:mime/type2,v' (,v indicates viewable)")
-	flag.Parse()
+	opts := parseOptions()
+	if doctor {
+		runDoctor()
+		return
+	}
 
-	// Initialize custom MIME types map
-	customMIMETypes = make(map[string]string)
-	customMIMEViewable = make(map[string]bool)
+	linkCounts = *opts.linkCounts
 
-	// Process the -i flag
-	if *intelligentMIMEFlag != "" {
-		intelligentMIME = true
-		if *intelligentMIMEFlag != "true" {
-			// Parse custom MIME type mappings
-			parseCustomMIMETypes(*intelligentMIMEFlag)
+	setMIMEOptions(*opts.intelligentMIME, *opts.forceDownload)
+
+	contentHost = *opts.contentHost
+	adminEnabled = *opts.admin
+	adminLoopback = *opts.adminLoopback
+
+	// Set up external log outputs
+	if *opts.syslog != "" || *opts.journald {
+		facility, err := parseSyslogFacility(*opts.syslogFacility)
+		if err != nil {
+			log.Fatal(err)
 		}
+		if *opts.syslog != "" {
+			sink, err := newSyslogSink(*opts.syslog, facility, *opts.syslogTag)
+			if err != nil {
+				log.Fatal("Failed to connect to syslog:", err)
+			}
+			logSinks = append(logSinks, sink)
+		}
+		if *opts.journald {
+			sink, err := newJournaldSink(facility, *opts.syslogTag)
+			if err != nil {
+				log.Fatal("Failed to connect to journald:", err)
+			}
+			logSinks = append(logSinks, sink)
+		}
+	}
+	treeScanInterval = *opts.scanInterval
+	journalInterval = *opts.journal
+
+	// Set addresses; all of them share one server
+	addresses = *opts.listen
+	if len(addresses) == 0 {
+		addresses = []string{listenAddress(*opts.host, *opts.port)}
+	}
+	switch {
+	case *opts.ipv4 && *opts.ipv6:
+		log.Fatal("-4 and -6 exclude each other; leave both out to listen on IPv4 and IPv6")
+	case *opts.ipv4:
+		listenNetwork = "tcp4"
+	case *opts.ipv6:
+		listenNetwork = "tcp6"
 	}
 
-	// Set address
-	addr = fmt.Sprintf("%s:%s", *hostFlag, strings.TrimPrefix(*portFlag, ":"))
+	var err error
+	if urlPrefix, err = parsePrefix(*opts.prefix); err != nil {
+		log.Fatal("Invalid -prefix: ", err)
+	}
 
 	// Set working directory
-	var err error
-	if *dirFlag != "" {
-		workingDir, err = filepath.Abs(*dirFlag)
+	if *opts.dir != "" {
+		workingDir, err = filepath.Abs(*opts.dir)
 		if err != nil {
 			log.Fatal("Failed to resolve directory path:", err)
 		}
@@ -129,29 +488,783 @@ func main() {
 			log.Fatal("Failed to get working directory:", err)
 		}
 	}
+	if err := prepareMounts(*opts.mount, *opts.dir != ""); err != nil {
+		log.Fatal("Invalid -mount: ", err)
+	}
+	if *opts.backend != "" {
+		if *opts.dir != "" || len(mounts) > 0 {
+			log.Fatal("-backend serves the files instead of -dir and -mount")
+		}
+		if *opts.quota != "" || *opts.uniqueNames {
+			log.Fatal("-quota and -unique-names need files on the local disk, not -backend")
+		}
+		store, err := openBackend(*opts.backend)
+		if err != nil {
+			log.Fatal("Invalid -backend: ", err)
+		}
+		served = store
+		// Features that work on the local disk find an empty directory
+		if workingDir, err = os.MkdirTemp("", "files-root-"); err != nil {
+			log.Fatal(err)
+		}
+		os.Chmod(workingDir, 0555)
+	}
+
+	// Set upload name sanitization policy
+	sanitizeMode, err = parseSanitizeMode(*opts.sanitize)
+	if err != nil {
+		log.Fatal(err)
+	}
+	maxNameLength = *opts.maxNameLength
+	onConflict, err = parseConflictPolicy(*opts.onConflict)
+	if err != nil {
+		log.Fatal(err)
+	}
+	uploadOnly = *opts.uploadOnly
+	uniqueNames = *opts.uniqueNames
+	if uploadOnly {
+		// Visitors of a drop box must not replace each other's files,
+		// unless -on-conflict says otherwise
+		explicit := false
+		flag.Visit(func(f *flag.Flag) { explicit = explicit || f.Name == "on-conflict" })
+		if !explicit {
+			onConflict = conflictRename
+		}
+	}
+
+	// Load user accounts and authenticated-only paths
+	if *opts.auth != "" {
+		users, err = loadUsers(*opts.auth)
+		if err != nil {
+			log.Fatal("Failed to load users:", err)
+		}
+	}
+	if *opts.usersDB != "" {
+		accounts, err = loadAccountStore(*opts.usersDB)
+		if err != nil {
+			log.Fatal("Failed to open user database:", err)
+		}
+	}
+	if *opts.tokenFile != "" {
+		tokens, err = loadUsers(*opts.tokenFile)
+		if err != nil {
+			log.Fatal("Failed to load tokens:", err)
+		}
+	}
+	if *opts.token != "" {
+		listed, err := parseTokens(*opts.token)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if tokens == nil {
+			tokens = listed
+		}
+		for name, token := range listed {
+			tokens[name] = token
+		}
+	}
+	if *opts.oidcIssuer != "" {
+		if *opts.oidcClientID == "" {
+			log.Fatal("-oidc-issuer requires -oidc-client-id")
+		}
+		oidc, err = discoverOIDC(*opts.oidcIssuer, *opts.oidcClientID, *opts.oidcClientSecret, *opts.oidcRedirectURL, *opts.oidcUserClaim)
+		if err != nil {
+			log.Fatal("Failed to discover OpenID Connect provider:", err)
+		}
+	}
+	if err := parseAuthOnlyPatterns(*opts.authOnly); err != nil {
+		log.Fatal(err)
+	}
+	if *opts.authOnlyFile != "" {
+		data, err := os.ReadFile(*opts.authOnlyFile)
+		if err != nil {
+			log.Fatal("Failed to read auth-only file:", err)
+		}
+		if err := parseAuthOnlyPatterns(string(data)); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *opts.acl != "" {
+		data, err := os.ReadFile(*opts.acl)
+		if err != nil {
+			log.Fatal("Failed to read access control file:", err)
+		}
+		if err := parseACL(string(data)); err != nil {
+			log.Fatal(err)
+		}
+		if aclNamesUsers() && !authEnabled() {
+			log.Fatal("-acl rules for users and groups require -auth, -users-db, API tokens or -oidc-issuer")
+		}
+	}
+	if len(authOnlyPatterns) > 0 && !authEnabled() {
+		log.Fatal("-auth-only and -auth-only-file require -auth, -users-db, API tokens or -oidc-issuer")
+	}
+	if err := parseBandwidthRules(*opts.bandwidth); err != nil {
+		log.Fatal(err)
+	}
+	if *opts.maxConns < 0 || *opts.maxTransfers < 0 || *opts.transferQueue < 0 {
+		log.Fatal("-max-conns, -max-transfers and -transfer-queue must not be negative")
+	}
+	if *opts.readHeaderTimeout < 0 || *opts.readTimeout < 0 || *opts.writeTimeout < 0 || *opts.idleTimeout < 0 {
+		log.Fatal("-read-header-timeout, -read-timeout, -write-timeout and -idle-timeout must not be negative")
+	}
+	if *opts.maxConns > 0 {
+		connSlots = make(chan struct{}, *opts.maxConns)
+		// Idle connections hold one of the connections allowed, so they are
+		// closed sooner unless -idle-timeout says otherwise
+		explicit := false
+		flag.Visit(func(f *flag.Flag) { explicit = explicit || f.Name == "idle-timeout" })
+		if !explicit {
+			*opts.idleTimeout = limitedIdleTimeout
+		}
+	}
+	if *opts.maxTransfers > 0 {
+		transferSlots = newTransferQueue(*opts.maxTransfers)
+		transferQueueTimeout = *opts.transferQueue
+	}
+	for _, limit := range []struct {
+		name, value string
+		rate        *int64
+	}{{"max-bandwidth", *opts.maxBandwidth, &bandwidth.max}, {"max-per-conn", *opts.maxPerConn, &bandwidth.perTransfer}} {
+		if limit.value == "" {
+			continue
+		}
+		if *limit.rate, err = parseSize(limit.value); err != nil || *limit.rate <= 0 {
+			log.Fatalf("Invalid -%s %q", limit.name, limit.value)
+		}
+	}
+	if *opts.bandwidthFile != "" {
+		data, err := os.ReadFile(*opts.bandwidthFile)
+		if err != nil {
+			log.Fatal("Failed to read bandwidth file:", err)
+		}
+		if err := parseBandwidthRules(string(data)); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *opts.geoip != "" {
+		geoip, err = openGeoDB(*opts.geoip)
+		if err != nil {
+			log.Fatal("Failed to open GeoIP database:", err)
+		}
+	}
+	if geoAllow, err = parseCountries(*opts.geoipAllow); err != nil {
+		log.Fatal(err)
+	}
+	if geoDeny, err = parseCountries(*opts.geoipDeny); err != nil {
+		log.Fatal(err)
+	}
+	if (geoAllow != nil || geoDeny != nil) && geoip == nil {
+		log.Fatal("-geoip-allow and -geoip-deny require -geoip")
+	}
+	if *opts.crawlLimit < 0 {
+		log.Fatal("-crawl-limit must not be negative")
+	}
+	crawlLimit = *opts.crawlLimit
+	if crawlLimit > 0 {
+		startCrawlPruning()
+	}
+	trustedProxies, err = parseNetworks(*opts.trustedProxies)
+	if err != nil {
+		log.Fatal("Invalid -trusted-proxies: ", err)
+	}
+	if allowNetworks, err = parseNetworks(*opts.allowCIDR); err != nil {
+		log.Fatal("Invalid -allow-cidr: ", err)
+	}
+	if denyNetworks, err = parseNetworks(*opts.denyCIDR); err != nil {
+		log.Fatal("Invalid -deny-cidr: ", err)
+	}
+	if *opts.rateLimit < 0 || *opts.rateBurst < 0 {
+		log.Fatal("-rate-limit and -rate-burst must not be negative")
+	}
+	if *opts.rateLimit > 0 {
+		burst := *opts.rateBurst
+		if burst == 0 {
+			burst = max(1, int(math.Ceil(2**opts.rateLimit)))
+		}
+		rateLimits = newRateLimiter(*opts.rateLimit, burst)
+	}
+	homeDirs = *opts.homeDirs
+	if homeDirs && !authEnabled() {
+		log.Fatal("-home-dirs requires -auth, -users-db, API tokens or -oidc-issuer")
+	}
+	if *opts.quota != "" {
+		if !authEnabled() {
+			log.Fatal("-quota requires -auth, -users-db, API tokens or -oidc-issuer")
+		}
+		userQuota, err = parseSize(*opts.quota)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *opts.monthlyCap != "" {
+		monthlyTransferCap, err = parseSize(*opts.monthlyCap)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Set up response compression
+	compressMinSize, err = parseSize(*opts.compressMinSize)
+	if err != nil {
+		log.Fatal(err)
+	}
+	compressExcludeTypes = parseList(strings.ToLower(*opts.compressExcludeTypes))
+	compressExcludePaths = parseList(*opts.compressExcludePaths)
+
+	// Limit concurrent archive builds
+	if *opts.archiveWorkers < 1 || *opts.archiveQueue < 0 {
+		log.Fatal("-archive-workers must be at least 1 and -archive-queue at least 0")
+	}
+	archives.workers = *opts.archiveWorkers
+	archives.maxWaiting = *opts.archiveQueue
+
+	// Set up importing from URLs
+	fetchEnabled = *opts.fetch
+	fetchPrivate = *opts.fetchPrivate
+	fetchMaxSize, err = parseSize(*opts.fetchMaxSize)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *opts.ftpPassivePorts != "" {
+		if ftpPassivePorts, err = parsePortRange(*opts.ftpPassivePorts); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *opts.ftpPublicHost != "" {
+		if ip := net.ParseIP(*opts.ftpPublicHost); ip == nil || ip.To4() == nil {
+			log.Fatal("-ftp-public-host must be an IPv4 address")
+		}
+		ftpPublicHost = *opts.ftpPublicHost
+	}
+
+	// Set up the limits on slow and stalled uploads
+	uploadTimeout = *opts.uploadTimeout
+	partialUploadLifetime = *opts.partialUploadLifetime
+	if *opts.uploadMinRate != "" {
+		uploadMinRate, err = parseSize(*opts.uploadMinRate)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Restore state saved by a previous run
+	if *opts.dataDir != "" {
+		dataDir, err = filepath.Abs(*opts.dataDir)
+		if err != nil {
+			log.Fatal("Failed to resolve data directory path:", err)
+		}
+		if err := os.MkdirAll(dataDir, 0700); err != nil {
+			log.Fatal("Failed to create data directory:", err)
+		}
+		if err := loadPersistentState(); err != nil {
+			log.Fatal("Failed to load saved state:", err)
+		}
+		persistState()
+	}
+	if sessionsEnabled() {
+		if *opts.sessionLifetime <= 0 {
+			log.Fatal("-session-lifetime must be positive")
+		}
+		sessionLifetime = *opts.sessionLifetime
+		secureCookies = *opts.secureCookies
+		if err := loadSessionKey(); err != nil {
+			log.Fatal("Failed to load session key:", err)
+		}
+	}
+
+	// Set upload durability
+	fsyncPolicy, err = parseFsyncPolicy(*opts.fsync)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *opts.checksums {
+		if dataDir == "" {
+			log.Fatal("-checksums requires -data-dir")
+		}
+		checksums, err = openChecksumStore()
+		if err != nil {
+			log.Fatal("Failed to open checksum log:", err)
+		}
+	}
+	if *opts.scratch != "" {
+		lifetime, err := parseLifetime(*opts.scratchLifetime)
+		if err != nil {
+			log.Fatalf("Invalid -scratch-lifetime %q", *opts.scratchLifetime)
+		}
+		size, err := parseSize(*opts.scratchSize)
+		if err != nil || size <= 0 {
+			log.Fatalf("Invalid -scratch-size %q", *opts.scratchSize)
+		}
+		root, err := filepath.Abs(*opts.scratch)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if rel, err := filepath.Rel(workingDir, root); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			log.Fatal("-scratch must be outside the served directory")
+		}
+		scratch, err = startScratchSpace(root, lifetime, size)
+		if err != nil {
+			log.Fatal("Failed to create scratch directory:", err)
+		}
+	}
+	if *opts.tier != "" {
+		if dataDir == "" || *opts.tierPath == "" {
+			log.Fatal("-tier requires -data-dir and -tier-path")
+		}
+		after, err := parseLifetime(*opts.tierAfter)
+		if err != nil {
+			log.Fatalf("Invalid -tier-after %q", *opts.tierAfter)
+		}
+		coldDir, err := filepath.Abs(*opts.tierPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if rel, err := filepath.Rel(workingDir, coldDir); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			log.Fatal("-tier-path must be outside the served directory")
+		}
+		var dirs []string
+		for _, dir := range strings.Split(*opts.tier, ",") {
+			dir = path.Clean("/" + strings.TrimSpace(dir))
+			if info, err := os.Stat(filepath.Join(workingDir, filepath.FromSlash(dir))); err != nil || !info.IsDir() {
+				log.Fatalf("Invalid -tier: %s is not a directory", dir)
+			}
+			dirs = append(dirs, dir)
+		}
+		tiers, err = startColdStorage(dirs, after, coldDir)
+		if err != nil {
+			log.Fatal("Failed to start cold storage:", err)
+		}
+	}
+	if *opts.scrub != "" {
+		if checksums == nil {
+			log.Fatal("-scrub requires -checksums")
+		}
+		interval, err := parseLifetime(*opts.scrub)
+		if err != nil {
+			log.Fatalf("Invalid -scrub %q", *opts.scrub)
+		}
+		if *opts.scrubWebhook != "" {
+			if u, err := url.Parse(*opts.scrubWebhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				log.Fatalf("Invalid -scrub-webhook %q", *opts.scrubWebhook)
+			}
+		}
+		scrubber, err = startScrubber(interval, *opts.scrubWebhook)
+		if err != nil {
+			log.Fatal("Failed to load scrub state:", err)
+		}
+	} else if *opts.scrubWebhook != "" {
+		log.Fatal("-scrub-webhook requires -scrub")
+	}
+	if *opts.templates != "" {
+		templates, err = loadTemplates(*opts.templates)
+		if err != nil {
+			log.Fatal("Failed to parse templates:", err)
+		}
+	}
+	if *opts.artifactCache != "" {
+		if dataDir == "" {
+			log.Fatal("-artifact-cache requires -data-dir")
+		}
+		size, err := parseSize(*opts.artifactCache)
+		if err != nil || size <= 0 {
+			log.Fatalf("Invalid -artifact-cache %q", *opts.artifactCache)
+		}
+		artifacts, err = openArtifactCache(filepath.Join(dataDir, "artifacts"), size)
+		if err != nil {
+			log.Fatal("Failed to open artifact cache:", err)
+		}
+	}
 
-	http.HandleFunc("/", logRequestMiddleware(browseHandler))
-	http.HandleFunc("/download/", logRequestMiddleware(downloadHandler))
-	http.HandleFunc("/upload", logRequestMiddleware(uploadHandler))
+	// Set Go module proxy directory
+	if *opts.goproxy != "" {
+		goproxyDir, err = filepath.Abs(*opts.goproxy)
+		if err != nil {
+			log.Fatal("Failed to resolve Go module proxy path:", err)
+		}
+		if info, err := os.Stat(goproxyDir); err != nil {
+			log.Fatal("Go module proxy directory does not exist:", err)
+		} else if !info.IsDir() {
+			log.Fatal("Go module proxy path is not a directory:", goproxyDir)
+		}
+	}
+
+	// Set Python package directory
+	if *opts.pypi != "" {
+		pypiDir, err = filepath.Abs(*opts.pypi)
+		if err != nil {
+			log.Fatal("Failed to resolve package index path:", err)
+		}
+		if info, err := os.Stat(pypiDir); err != nil {
+			log.Fatal("Package index directory does not exist:", err)
+		} else if !info.IsDir() {
+			log.Fatal("Package index path is not a directory:", pypiDir)
+		}
+	}
+
+	if partialUploadLifetime > 0 && *opts.backend == "" {
+		startPartialUploadSweep()
+	}
+	if journalInterval > 0 {
+		journal = startJournal()
+	}
+	mux := serverRoutes(*opts.webdav)
+
+	// A client that never finishes its request or never reads the response
+	// would otherwise hold its connection for good. Timeouts of 0 leave
+	// whole requests and responses unbounded, since large transfers take
+	// long; -upload-timeout and -upload-min-rate bound uploads more finely.
+	server := &http.Server{
+		ReadHeaderTimeout: *opts.readHeaderTimeout,
+		ReadTimeout:       *opts.readTimeout,
+		WriteTimeout:      *opts.writeTimeout,
+		IdleTimeout:       *opts.idleTimeout,
+	}
+	if connSlots != nil {
+		log.Printf("Serving at most %d connections at once", cap(connSlots))
+	}
+	if transferSlots != nil {
+		log.Printf("Running at most %d transfers at once, queueing others for %v", transferSlots.slots, transferQueueTimeout)
+	}
+	scheme := "http"
+	if *opts.tlsSelfSigned {
+		hosts := make([]string, len(addresses))
+		for i, address := range addresses {
+			hosts[i], _, _ = net.SplitHostPort(address)
+		}
+		cert, names, fingerprint, err := selfSignedCertificate(hosts)
+		if err != nil {
+			log.Fatal("Failed to generate a certificate:", err)
+		}
+		server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+		scheme = "https"
+		log.Printf("Using a self-signed certificate for %s", strings.Join(names, ", "))
+		log.Printf("Certificate SHA-256 fingerprint: %s", fingerprint)
+	}
 
-	log.Printf("Server starting on http://%s", addr)
-	log.Printf("Serving files from: %s", workingDir)
+	var urls []string
+	for _, address := range addresses {
+		for _, u := range reachableURLs(scheme, address) {
+			urls = append(urls, u+urlPrefix)
+		}
+	}
+	for _, url := range urls {
+		log.Printf("Server starting on %s", url)
+	}
+	lanURL = pickLANURL(urls)
+	if *opts.qr {
+		printQRCode()
+	}
+	if *opts.redirectHTTP != "" {
+		if server.TLSConfig == nil {
+			log.Fatal("-redirect-http requires TLS (-tls-self-signed)")
+		}
+		log.Printf("Redirecting http://%s to HTTPS", *opts.redirectHTTP)
+		_, httpsPort, _ := net.SplitHostPort(addresses[0])
+		go serveRedirects(*opts.redirectHTTP, httpsPort)
+	}
+	if *opts.ftp != "" {
+		if server.TLSConfig != nil {
+			ftpTLS = server.TLSConfig.Clone()
+			log.Printf("Serving FTP on %s, with AUTH TLS", *opts.ftp)
+		} else {
+			log.Printf("Serving FTP on %s", *opts.ftp)
+		}
+		go serveFTP(*opts.ftp)
+	}
+	if *opts.sftp != "" {
+		keyFile := *opts.sftpHostKey
+		if keyFile == "" && dataDir != "" {
+			keyFile = filepath.Join(dataDir, "sftp_host_key")
+		}
+		if keyFile == "" {
+			log.Printf("No -sftp-host-key or -data-dir, so the SFTP host key changes on every start")
+		}
+		hostKey, err := loadHostKey(keyFile)
+		if err != nil {
+			log.Fatal("Failed to load the SFTP host key: ", err)
+		}
+		log.Printf("Serving SFTP on %s, host key %s", *opts.sftp, ssh.FingerprintSHA256(hostKey.PublicKey()))
+		go serveSFTP(*opts.sftp, sshServerConfig(hostKey))
+	}
+	if virtualRoot {
+		log.Printf("Serving %d mounts at the root", len(mounts))
+	} else if !diskBacked() {
+		log.Printf("Serving files from: %v", served)
+	} else {
+		log.Printf("Serving files from: %s", workingDir)
+	}
+	for _, m := range mounts {
+		log.Printf("Serving %s at /%s/", m.dir, m.name)
+	}
 	if intelligentMIME {
 		log.Printf("Intelligent MIME recognition enabled")
 	}
-	if err := http.ListenAndServe(addr, nil); err != nil {
+	if authEnabled() {
+		log.Printf("Loaded %d users, %d API tokens, %d authenticated-only paths, %d access rules", len(knownUsers()), len(tokens), len(authOnlyPatterns), len(aclRules))
+	}
+	if oidc != nil {
+		log.Printf("Logging users in with OpenID Connect provider %s", oidc.issuer)
+	}
+	if dataDir != "" {
+		log.Printf("Keeping state in %s", dataDir)
+	}
+	if scratch != nil {
+		log.Printf("Workspaces at /tmp kept in %s for %s after their last use", scratch.root, *opts.scratchLifetime)
+	}
+	if tiers != nil {
+		log.Printf("Moving files unused for %s from %s to %s", *opts.tierAfter, strings.Join(tiers.dirs, ", "), tiers.dir)
+	}
+	if scrubber != nil {
+		log.Printf("Scrubbing recorded checksums every %s", *opts.scrub)
+	}
+	if len(bandwidth.rules) > 0 {
+		log.Printf("Limiting downloads by %d bandwidth rules, now %s", len(bandwidth.rules), describeRate(bandwidth.rate(time.Now())))
+	} else if bandwidth.max > 0 {
+		log.Printf("Limiting downloads to %s", describeRate(bandwidth.max))
+	}
+	if bandwidth.perTransfer > 0 {
+		log.Printf("Limiting each download to %s", describeRate(bandwidth.perTransfer))
+	}
+	if adminEnabled && adminLoopback {
+		log.Printf("Admin API enabled for admins and loopback clients")
+	} else if adminEnabled {
+		log.Printf("Admin API enabled for admins")
+	}
+	if goproxyDir != "" {
+		log.Printf("Go module proxy serving %s at /goproxy/", goproxyDir)
+	}
+	if pypiDir != "" {
+		log.Printf("Package index serving %s at /simple/", pypiDir)
+	}
+	if *opts.webdav {
+		log.Printf("WebDAV enabled at /dav/")
+	}
+	var handler http.Handler = mux
+	if contentHost != "" {
+		log.Printf("Showing files in the browser from http://%s", contentHost)
+		contentMux := newRouter()
+		contentMux.handle(http.MethodGet, "/download/{path...}", logRequestMiddleware(transferLimitMiddleware(contentHandler)))
+		handler = contentMiddleware(mux, contentMux)
+	}
+	if allowNetworks != nil || denyNetworks != nil {
+		log.Printf("Filtering clients by address (%d networks allowed, %d denied)", len(allowNetworks), len(denyNetworks))
+		handler = ipFilterMiddleware(handler)
+	}
+	if geoip != nil {
+		log.Printf("Looking up client countries in %s (%d allowed, %d denied)", *opts.geoip, len(geoAllow), len(geoDeny))
+		if geoAllow != nil || geoDeny != nil {
+			handler = geoMiddleware(handler)
+		}
+	}
+	if rateLimits != nil {
+		log.Printf("Limiting each client to %g requests per second, %d at once", rateLimits.rate, int(rateLimits.burst))
+		handler = rateLimitMiddleware(handler)
+	}
+	handler = apiErrorMiddleware(handler)
+	if *opts.compress {
+		log.Printf("Compressing responses of %s and more", formatSize(compressMinSize))
+		handler = compressMiddleware(handler)
+	}
+	if urlPrefix != "" {
+		log.Printf("Serving everything below %s/", urlPrefix)
+		handler = prefixMiddleware(handler)
+	}
+	if *opts.reusePort && !reusePortSupported {
+		log.Fatal("-reuseport is not supported on this platform")
+	}
+	if *opts.listeners < 1 {
+		log.Fatal("-listeners must be at least 1")
+	}
+	if *opts.listeners > 1 && !*opts.reusePort {
+		log.Fatal("-listeners requires -reuseport")
+	}
+	shutdownTimeout = *opts.shutdownTimeout
+	listeners, err := listen(addresses, *opts.listeners, *opts.reusePort)
+	if err != nil {
+		log.Fatal("Server failed:", err)
+	}
+	if *opts.reusePort {
+		log.Printf("Accepting connections on %d SO_REUSEPORT listeners", len(listeners))
+	}
+	watchReloadSignal()
+	server.Handler = handler
+	if err := serve(server, listeners); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		log.Fatal("Server failed:", err)
 	}
+	if virtualRoot || !diskBacked() {
+		os.Remove(workingDir)
+	}
+}
+
+// serverRoutes registers the server's routes on a private router rather
+// than http.DefaultServeMux. Routes wrapped in dropBoxMiddleware read or
+// rearrange files; they are hidden from the visitors of a drop box
+// (-upload-only). Listings and downloads are throttled by crawlMiddleware
+// (-crawl-limit).
+func serverRoutes(webdav bool) *router {
+	mux := newRouter()
+	mux.handle(http.MethodGet, "/{path...}", logRequestMiddleware(dropBoxMiddleware(crawlMiddleware(browseHandler))))
+	mux.handle(http.MethodGet, "/download/{path...}", logRequestMiddleware(dropBoxMiddleware(crawlMiddleware(transferLimitMiddleware(downloadHandler)))))
+	mux.handle(http.MethodGet, "/upload", logRequestMiddleware(uploadHandler))
+	mux.handle(http.MethodPost, "/upload", logRequestMiddleware(transferLimitMiddleware(uploadHandler)))
+	mux.handle(http.MethodPost, "/upload/{path...}", logRequestMiddleware(transferLimitMiddleware(uploadHandler)))
+	mux.handle(http.MethodPut, "/upload/{path...}", logRequestMiddleware(diskMiddleware(transferLimitMiddleware(putHandler))))
+	mux.handle(http.MethodPatch, "/upload/{path...}", logRequestMiddleware(diskMiddleware(dropBoxMiddleware(transferLimitMiddleware(patchHandler)))))
+	mux.handle(http.MethodGet, "/archive/{path...}", logRequestMiddleware(diskMiddleware(dropBoxMiddleware(crawlMiddleware(transferLimitMiddleware(zipHandler))))))
+	mux.handle(http.MethodGet, "/zip/{path...}", logRequestMiddleware(diskMiddleware(dropBoxMiddleware(crawlMiddleware(transferLimitMiddleware(zipHandler))))))
+	mux.handle(http.MethodPost, "/api/archive", logRequestMiddleware(diskMiddleware(dropBoxMiddleware(crawlMiddleware(transferLimitMiddleware(archiveSelectionHandler))))))
+	mux.handle(http.MethodGet, "/api/archive/queue", logRequestMiddleware(archiveQueueHandler))
+	mux.handle(http.MethodGet, "/api/list/{path...}", logRequestMiddleware(dropBoxMiddleware(crawlMiddleware(listHandler))))
+	mux.handle(http.MethodGet, "/api/export/{path...}", logRequestMiddleware(diskMiddleware(dropBoxMiddleware(crawlMiddleware(exportHandler)))))
+	mux.handle(http.MethodPost, "/api/move", logRequestMiddleware(diskMiddleware(dropBoxMiddleware(moveHandler))))
+	mux.handle(http.MethodPost, "/api/copy", logRequestMiddleware(diskMiddleware(dropBoxMiddleware(copyHandler))))
+	mux.handle(http.MethodPost, "/api/mkdir", logRequestMiddleware(dropBoxMiddleware(mkdirHandler)))
+	mux.handle(http.MethodGet, "/api/resume/{path...}", logRequestMiddleware(diskMiddleware(dropBoxMiddleware(resumeHandler))))
+	mux.handle(http.MethodGet, "/api/uploads/{id}", logRequestMiddleware(uploadProgressHandler))
+	mux.handle(http.MethodGet, "/qr", logRequestMiddleware(qrHandler))
+	if scratch != nil {
+		mux.handle(http.MethodGet, "/tmp", logRequestMiddleware(scratchHandler))
+		mux.handle(http.MethodPost, "/tmp", logRequestMiddleware(scratchCreateHandler))
+		mux.handle(http.MethodGet, "/tmp/{id}", logRequestMiddleware(scratchPageHandler))
+		mux.handle(http.MethodPost, "/tmp/{id}", logRequestMiddleware(transferLimitMiddleware(scratchPageHandler)))
+		mux.handle(http.MethodGet, "/tmp/{id}/{name}", logRequestMiddleware(transferLimitMiddleware(scratchFileHandler)))
+	}
+	if fetchEnabled {
+		mux.handle(http.MethodPost, "/api/fetch", logRequestMiddleware(diskMiddleware(transferLimitMiddleware(fetchHandler))))
+	}
+	if webdav {
+		mux.handle("", "/dav/{path...}", logRequestMiddleware(dropBoxMiddleware(davHandler)))
+	}
+	if journalInterval > 0 {
+		mux.handle(http.MethodGet, "/api/changes", logRequestMiddleware(dropBoxMiddleware(changesHandler)))
+		mux.handle(http.MethodGet, "/api/list-delta/{path...}", logRequestMiddleware(dropBoxMiddleware(crawlMiddleware(listDeltaHandler))))
+	}
+	if authEnabled() {
+		mux.handle(http.MethodGet, "/login", logRequestMiddleware(loginHandler))
+		if passwordLogin() {
+			mux.handle(http.MethodPost, "/login", logRequestMiddleware(passwordLoginHandler))
+			mux.handle(http.MethodGet, "/account/2fa", logRequestMiddleware(twoFactorHandler))
+			mux.handle(http.MethodPost, "/account/2fa", logRequestMiddleware(twoFactorHandler))
+		}
+		mux.handle(http.MethodGet, "/api/shares", logRequestMiddleware(sharesHandler))
+		mux.handle(http.MethodPost, "/api/shares", logRequestMiddleware(sharesHandler))
+		mux.handle(http.MethodDelete, "/api/shares/{id}", logRequestMiddleware(shareDeleteHandler))
+		mux.handle(http.MethodGet, "/s/{id}", logRequestMiddleware(transferLimitMiddleware(shareDownloadHandler)))
+	}
+	if oidc != nil {
+		mux.handle(http.MethodGet, "/oidc/callback", logRequestMiddleware(oidcCallbackHandler))
+	}
+	if sessionsEnabled() {
+		mux.handle(http.MethodPost, "/logout", logRequestMiddleware(logoutHandler))
+	}
+	if adminEnabled {
+		// The JSON endpoints are not logged: monitoring clients poll them continuously
+		mux.handle(http.MethodGet, "/api/admin/stats", adminMiddleware(adminStatsHandler))
+		mux.handle(http.MethodGet, "/api/admin/transfers", adminMiddleware(adminTransfersHandler))
+		mux.handle(http.MethodDelete, "/api/admin/transfers/{id}", logRequestMiddleware(adminMiddleware(adminCancelTransferHandler)))
+		mux.handle(http.MethodGet, "/api/admin/disk", adminMiddleware(adminDiskHandler))
+		mux.handle("", "/admin/disk", logRequestMiddleware(adminMiddleware(adminDiskPageHandler)))
+		mux.handle(http.MethodGet, "/api/admin/types", adminMiddleware(adminTypesHandler))
+		mux.handle("", "/admin/types", logRequestMiddleware(adminMiddleware(adminTypesPageHandler)))
+		mux.handle(http.MethodGet, "/api/admin/usage", adminMiddleware(adminUsageHandler))
+		mux.handle(http.MethodGet, "/admin/usage", logRequestMiddleware(adminMiddleware(adminUsagePageHandler)))
+		if scrubber != nil {
+			mux.handle(http.MethodPost, "/api/admin/scrub", logRequestMiddleware(adminMiddleware(adminScrubHandler)))
+		}
+		mux.handle(http.MethodPost, "/api/admin/reload", logRequestMiddleware(adminMiddleware(adminReloadHandler)))
+	}
+	if goproxyDir != "" {
+		mux.handle(http.MethodGet, "/goproxy/{path...}", logRequestMiddleware(goproxyHandler))
+	}
+	if pypiDir != "" {
+		mux.handle(http.MethodGet, "/simple/{path...}", logRequestMiddleware(pypiHandler))
+	}
+	return mux
 }
 
-// logRequestMiddleware wraps a handler to log HTTP requests
+// logRequestMiddleware wraps a handler to log HTTP requests and record them
+// in the server statistics
 func logRequestMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
 		log.Printf("[%s] %s %s", r.Method, r.URL.Path, r.RemoteAddr)
-		next(w, r)
-		log.Printf("[%s] %s completed in %v", r.Method, r.URL.Path, time.Since(start))
+
+		recorder := &statusRecorder{ResponseWriter: w}
+		r.Body = &countingReadCloser{
+			countingReader: countingReader{Reader: r.Body, count: &stats.bytesReceived},
+			Closer:         r.Body,
+		}
+		next(recorder, r)
+
+		duration := time.Since(start)
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		stats.recordRequest(RequestRecord{
+			Time:     start,
+			Method:   r.Method,
+			Path:     r.URL.Path,
+			Client:   clientHost(r),
+			Status:   recorder.status,
+			Bytes:    recorder.bytes,
+			Duration: duration,
+		})
+		log.Printf("[%s] %s completed with %d in %v (request %s)", r.Method, r.URL.Path, recorder.status, duration, requestID(r))
+		if geoip != nil {
+			// The country is appended, so the fields before it keep their place
+			country := clientCountry(r)
+			if country == "" {
+				country = "-"
+			}
+			accessLogf("%s %s %q %d %d %v %s", clientHost(r), r.Method, r.URL.Path, recorder.status, recorder.bytes, duration, country)
+			return
+		}
+		accessLogf("%s %s %q %d %d %v", clientHost(r), r.Method, r.URL.Path, recorder.status, recorder.bytes, duration)
+	}
+}
+
+// resolvePath maps a path relative to workingDir onto the filesystem,
+// rejecting anything that would escape workingDir; paths below a mount
+// (-mount) map into its directory instead
+func resolvePath(requestedPath string) (string, error) {
+	root, rest, _ := splitMount(requestedPath)
+	return resolvePathIn(root, rest)
+}
+
+// resolvePathIn maps a path relative to root onto the filesystem,
+// rejecting anything that would escape root
+func resolvePathIn(root, requestedPath string) (string, error) {
+	if err := checkPathComponents(requestedPath); err != nil {
+		return "", err
+	}
+	cleanRoot, err := filepath.Abs(root)
+	if err != nil {
+		return "", errInvalidPath
+	}
+	cleanPath, err := filepath.Abs(filepath.Join(cleanRoot, requestedPath))
+	if err != nil {
+		return "", errInvalidPath
+	}
+	rel, err := filepath.Rel(cleanRoot, cleanPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errAccessDenied
+	}
+
+	// Fall back to a canonically equivalent name (NFC vs NFD)
+	if _, err := os.Lstat(fsPath(cleanPath)); err != nil {
+		cleanPath = resolveNormalized(cleanRoot, cleanPath)
 	}
+	return fsPath(cleanPath), nil
+}
+
+// writePathError reports a resolvePath failure to the client
+func writePathError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errAccessDenied) {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+	http.Error(w, "Invalid path", http.StatusBadRequest)
 }
 
 // browseHandler handles file browsing requests
@@ -162,25 +1275,43 @@ func browseHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get the requested path (relative to workingDir)
-	requestedPath := strings.TrimPrefix(r.URL.Path, "/")
-	fullPath := filepath.Join(workingDir, requestedPath)
+	requestedPath := pathParam(r, "path")
 
 	// Security check: ensure the path is within workingDir
-	cleanPath, err := filepath.Abs(fullPath)
+	fullPath, err := resolvePath(requestedPath)
 	if err != nil {
-		http.Error(w, "Invalid path", http.StatusBadRequest)
+		writePathError(w, err)
 		return
 	}
-	cleanWorkingDir, _ := filepath.Abs(workingDir)
-	if !strings.HasPrefix(cleanPath, cleanWorkingDir) {
-		http.Error(w, "Access denied", http.StatusForbidden)
+
+	// Paths the user may not see look nonexistent
+	user := authenticatedUser(r)
+	if !canRead(user, requestedPath) {
+		http.Error(w, "Path not found", http.StatusNotFound)
+		return
+	}
+
+	// Users kept in their home directory start there
+	if requestedPath == "" && user != "" && confined(user) {
+		if store, ok := served.(writableStorage); ok {
+			if err := store.MkdirAll(storageName(user), 0755); err != nil {
+				http.Error(w, "Error creating home directory: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		http.Redirect(w, r, (&url.URL{Path: "/" + user + "/"}).String(), http.StatusFound)
+		return
+	}
+
+	// Git clients talk the dumb HTTP protocol to repositories in the tree
+	if serveGit(w, r, requestedPath) {
 		return
 	}
 
 	// Check if path exists
-	info, err := os.Stat(fullPath)
+	info, err := served.Stat(storageName(requestedPath))
 	if err != nil {
-		if os.IsNotExist(err) {
+		if errors.Is(err, fs.ErrNotExist) {
 			http.Error(w, "Path not found", http.StatusNotFound)
 			return
 		}
@@ -190,50 +1321,78 @@ func browseHandler(w http.ResponseWriter, r *http.Request) {
 
 	// If it's a file, redirect to download
 	if !info.IsDir() {
-		http.Redirect(w, r, "/download/"+requestedPath, http.StatusFound)
+		http.Redirect(w, r, (&url.URL{Path: "/download/" + requestedPath}).String(), http.StatusFound)
 		return
 	}
 
-	// List directory contents
-	entries, err := os.ReadDir(fullPath)
+	// List the first window of the directory; the page fetches the rest
+	// from the listing API as the user scrolls. The plain page (?plain=1),
+	// which has no scripts, lists larger windows and links to the next.
+	filter, err := parseListFilter(r.URL.Query())
 	if err != nil {
-		http.Error(w, "Error reading directory", http.StatusInternalServerError)
+		http.Error(w, "Invalid filter: "+err.Error(), http.StatusBadRequest)
 		return
 	}
-
-	var files []FileInfo
-	for _, entry := range entries {
-		entryInfo, err := entry.Info()
-		if err != nil {
-			continue
+	plain := r.URL.Query().Get("plain") == "1"
+	cursor, limit := "", defaultListLimit
+	if plain {
+		limit = maxListLimit
+		if token := r.URL.Query().Get("cursor"); token != "" {
+			if cursor, err = decodeCursor(token); err != nil {
+				http.Error(w, "Invalid cursor", http.StatusBadRequest)
+				return
+			}
 		}
-
-		files = append(files, FileInfo{
-			Name:    entry.Name(),
-			Path:    filepath.Join(requestedPath, entry.Name()),
-			Size:    entryInfo.Size(),
-			ModTime: entryInfo.ModTime(),
-			IsDir:   entry.IsDir(),
-		})
+	}
+	page, err := listDirectory(fullPath, requestedPath, cursor, 0, limit, user, filter)
+	if err != nil {
+		http.Error(w, "Error reading directory", http.StatusInternalServerError)
+		return
 	}
 
 	// Calculate parent path
 	parentPath := ""
 	if requestedPath != "" {
-		parentPath = filepath.Dir(requestedPath)
+		parentPath = path.Dir(requestedPath)
 		if parentPath == "." {
 			parentPath = ""
 		}
 	}
 
 	data := PageData{
-		CurrentPath: requestedPath,
-		ParentPath:  parentPath,
-		Files:       files,
+		CurrentPath:  requestedPath,
+		ParentPath:   parentPath,
+		Files:        page.Files,
+		Offset:       page.Offset,
+		Total:        page.Total,
+		NextCursor:   page.Next,
+		AuthEnabled:  authEnabled(),
+		User:         user,
+		FetchEnabled: fetchEnabled,
+		Filter:       filter.query,
+	}
+	if sessionsEnabled() && user != "" {
+		sessionUser, kind := readSession(r)
+		data.Session = sessionUser == user
+		data.TwoFactor = data.Session && kind != sessionOIDC
+	}
+	if user != "" && userQuota > 0 {
+		data.Quota = userQuota
+		data.Stored = quotas.stored(user)
 	}
 
+	name := "browse.html"
+	if plain {
+		name = "plain.html"
+	}
+	// Revisits of an unchanged folder get 304 Not Modified
+	etag := listingETag(page, name, r.URL.RawQuery, user, strconv.FormatBool(isAdmin(r)),
+		strconv.FormatBool(data.Session), strconv.FormatBool(data.TwoFactor), strconv.FormatInt(data.Stored, 10))
+	if listingNotModified(w, r, etag) {
+		return
+	}
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	if err := templates.ExecuteTemplate(w, "browse.html", data); err != nil {
+	if err := renderTemplate(w, r, name, &data); err != nil {
 		log.Printf("Template error: %v", err)
 		http.Error(w, "Error rendering page", http.StatusInternalServerError)
 	}
@@ -247,25 +1406,37 @@ func downloadHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get the requested file path
-	requestedPath := strings.TrimPrefix(r.URL.Path, "/download/")
-	fullPath := filepath.Join(workingDir, requestedPath)
+	requestedPath := pathParam(r, "path")
 
 	// Security check: ensure the path is within workingDir
-	cleanPath, err := filepath.Abs(fullPath)
-	if err != nil {
-		http.Error(w, "Invalid path", http.StatusBadRequest)
+	if _, err := resolvePath(requestedPath); err != nil {
+		writePathError(w, err)
 		return
 	}
-	cleanWorkingDir, _ := filepath.Abs(workingDir)
-	if !strings.HasPrefix(cleanPath, cleanWorkingDir) {
-		http.Error(w, "Access denied", http.StatusForbidden)
+	user := authenticatedUser(r)
+	granted, signed := contentUser(r)
+	link := sharedLink(r)
+	switch {
+	case signed:
+		// A signed link from the main origin stands in for credentials
+		user = granted
+	case link != nil:
+		// So does a share link, on behalf of its owner
+		user = link.Owner
+	}
+	if !canRead(user, requestedPath) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodHead && usage.overCap(user) {
+		writeCapExceeded(w, r, user)
 		return
 	}
 
 	// Open the file
-	file, err := os.Open(fullPath)
+	file, err := served.Open(storageName(requestedPath))
 	if err != nil {
-		if os.IsNotExist(err) {
+		if errors.Is(err, fs.ErrNotExist) {
 			http.Error(w, "File not found", http.StatusNotFound)
 			return
 		}
@@ -288,23 +1459,32 @@ func downloadHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	fileSize := fileInfo.Size()
-	fileName := filepath.Base(fullPath)
+	fileName := fileInfo.Name()
 
 	// Determine content type and disposition
 	contentType := "application/octet-stream"
 	disposition := "attachment"
 
-	if intelligentMIME {
-		if mimeType, isViewable := getMIMEType(fullPath); isViewable {
-			contentType = mimeType
-			disposition = "inline"
+	if mimeType, isViewable := viewableType(fileName); isViewable {
+		// Content shown in the browser comes from the content origin if
+		// there is one; share links are served here, where their policies
+		// apply
+		if contentHost != "" && !signed && link == nil {
+			http.Redirect(w, r, contentURL(r, requestedPath, user), http.StatusFound)
+			return
 		}
+		contentType = mimeType
+		disposition = "inline"
+		sandboxInline(w, contentType)
 	}
+	// Browsers must not guess a type that renders uploaded markup or scripts
+	w.Header().Set("X-Content-Type-Options", "nosniff")
 
 	// Set headers for file download
 	w.Header().Set("Content-Disposition", fmt.Sprintf(`%s; filename="%s"`, disposition, fileName))
 	w.Header().Set("Accept-Ranges", "bytes")
 	w.Header().Set("Content-Type", contentType)
+	setValidators(w, fileInfo)
 
 	// Handle range requests for resume support
 	rangeHeader := r.Header.Get("Range")
@@ -313,7 +1493,10 @@ func downloadHandler(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Length", strconv.FormatInt(fileSize, 10))
 		w.WriteHeader(http.StatusOK)
 		if r.Method != http.MethodHead {
-			io.Copy(w, file)
+			transfer := stats.startTransfer("download", requestedPath, clientHost(r), user, fileSize)
+			defer stats.endTransfer(transfer)
+			transfer.share = link
+			io.Copy(w, transfer.reader(file))
 		}
 		return
 	}
@@ -330,8 +1513,14 @@ func downloadHandler(w http.ResponseWriter, r *http.Request) {
 	end := ranges[0].end
 	contentLength := end - start + 1
 
-	// Seek to start position
-	if _, err := file.Seek(start, 0); err != nil {
+	// Seek to start position; files of storages that can't seek are read
+	// up to it
+	if seeker, ok := file.(io.Seeker); ok {
+		_, err = seeker.Seek(start, io.SeekStart)
+	} else {
+		_, err = io.CopyN(io.Discard, file, start)
+	}
+	if err != nil {
 		http.Error(w, "Error seeking file", http.StatusInternalServerError)
 		return
 	}
@@ -343,16 +1532,78 @@ func downloadHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Send the requested range
 	if r.Method != http.MethodHead {
-		io.CopyN(w, file, contentLength)
+		transfer := stats.startTransfer("download", requestedPath, clientHost(r), user, contentLength)
+		defer stats.endTransfer(transfer)
+		transfer.share = link
+		io.CopyN(w, transfer.reader(file), contentLength)
 	}
 }
 
-// uploadHandler handles file uploads
+// UploadResult reports the outcome of one file of an upload request
+type UploadResult struct {
+	Name   string `json:"name"`
+	Path   string `json:"path,omitempty"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256,omitempty"`
+	// URL downloads the stored file
+	URL string `json:"url,omitempty"`
+	// Action tells how the name was resolved: created, replaced (an
+	// existing file), renamed (stored next to one, see -on-conflict) or
+	// generated (see -unique-names)
+	Action string `json:"action,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Policies for uploads named like an existing file (-on-conflict)
+const (
+	conflictOverwrite = "overwrite"
+	conflictReject    = "reject"
+	conflictRename    = "rename"
+)
+
+// onConflict is what happens when a form upload is named like an existing file
+var onConflict = conflictOverwrite
+
+// parseConflictPolicy validates an -on-conflict value
+func parseConflictPolicy(policy string) (string, error) {
+	switch policy {
+	case conflictOverwrite, conflictReject, conflictRename:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown conflict policy %q (expected overwrite, reject or rename)", policy)
+}
+
+// UploadReport is the result of an upload request: the outcome of each
+// file, and how fast the request body was received
+type UploadReport struct {
+	Page
+	Directory string         `json:"directory"`
+	Files     []UploadResult `json:"files"`
+	Bytes     int64          `json:"bytes"`
+	Duration  time.Duration  `json:"duration"`
+	Rate      float64        `json:"rate"`
+	// Browse tells the result page whether to link to the stored files
+	Browse bool `json:"-"`
+}
+
+// uploadError is an upload failure with the status it is reported with
+type uploadError struct {
+	status  int
+	message string
+}
+
+func (e *uploadError) Error() string {
+	return e.message
+}
+
+// uploadHandler handles file uploads. A request may carry several file
+// parts; each is stored on its own and reported separately, on a result
+// page or as JSON.
 func uploadHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodGet {
 		// Show upload form
 		w.Header().Set("Content-Type", "text/html; charset=utf-8")
-		if err := templates.ExecuteTemplate(w, "upload.html", nil); err != nil {
+		if err := renderTemplate(w, r, "upload.html", &Page{}); err != nil {
 			log.Printf("Template error: %v", err)
 			http.Error(w, "Error rendering page", http.StatusInternalServerError)
 		}
@@ -364,68 +1615,361 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Parse multipart form (max 100MB in memory)
-	if err := r.ParseMultipartForm(100 << 20); err != nil {
-		http.Error(w, "Error parsing form: "+err.Error(), http.StatusBadRequest)
+	user := authenticatedUser(r)
+	if usage.overCap(user) {
+		writeCapExceeded(w, r, user)
 		return
 	}
 
-	// Get the uploaded file
-	file, header, err := r.FormFile("file")
+	// Track the upload from the first byte of the request body
+	transfer := stats.startTransfer("upload", "", clientHost(r), user, r.ContentLength)
+	defer stats.endTransfer(transfer)
+	defer progress.track(uploadID(r), transfer, 0, r.ContentLength)()
+	r.Body = &readCloser{Reader: transfer.reader(r.Body), Closer: r.Body}
+	stopWatching := watchUpload(w, transfer)
+	defer stopWatching()
+
+	// The parts are streamed to disk as they arrive rather than parsed
+	// into memory and temporary files first
+	reader, err := r.MultipartReader()
 	if err != nil {
-		http.Error(w, "Error retrieving file: "+err.Error(), http.StatusBadRequest)
+		http.Error(w, "Error parsing form: "+err.Error(), http.StatusBadRequest)
 		return
 	}
-	defer file.Close()
 
-	// Get optional subdirectory
-	subDir := r.FormValue("directory")
+	// Get optional subdirectory: /upload/<dir> or the directory field,
+	// which must come before the files
+	subDir := strings.Trim(pathParam(r, "path"), "/")
+	fromPath := subDir != ""
 	targetDir := workingDir
-	if subDir != "" {
-		// Clean and validate subdirectory path
-		subDir = filepath.Clean(subDir)
-		targetDir = filepath.Join(workingDir, subDir)
-
-		// Security check
-		cleanTargetDir, err := filepath.Abs(targetDir)
+	report := UploadReport{Browse: canBrowse(r)}
+	var failed []*uploadError
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
 		if err != nil {
-			http.Error(w, "Invalid directory path", http.StatusBadRequest)
+			if status, message := transfer.interrupted(); status != 0 {
+				http.Error(w, message, status)
+				return
+			}
+			http.Error(w, "Error parsing form: "+err.Error(), http.StatusBadRequest)
 			return
 		}
-		cleanWorkingDir, _ := filepath.Abs(workingDir)
-		if !strings.HasPrefix(cleanTargetDir, cleanWorkingDir) {
-			http.Error(w, "Access denied", http.StatusForbidden)
-			return
+		if part.FileName() == "" {
+			if part.FormName() == "directory" && !fromPath {
+				// The files before it are already stored elsewhere
+				if len(report.Files) > 0 {
+					http.Error(w, "The directory field must come before the files", http.StatusBadRequest)
+					return
+				}
+				value, _ := io.ReadAll(io.LimitReader(part, 4096))
+				subDir = string(value)
+			}
+			continue
 		}
 
-		// Create directory if it doesn't exist
-		if err := os.MkdirAll(targetDir, 0755); err != nil {
-			http.Error(w, "Error creating directory: "+err.Error(), http.StatusInternalServerError)
-			return
+		if len(report.Files) == 0 && !fromPath && user != "" && confined(user) && (subDir == "" || !homeAllows(user, subDir)) {
+			// Users kept in their home directory upload there, and the
+			// directory field is relative to it
+			subDir = path.Join(user, subDir)
 		}
-	}
+		if len(report.Files) == 0 && subDir != "" {
+			// Clean and validate subdirectory path
+			subDir = path.Clean(subDir)
 
-	// Create destination file
-	dstPath := filepath.Join(targetDir, filepath.Base(header.Filename))
-	dst, err := os.Create(dstPath)
-	if err != nil {
-		http.Error(w, "Error creating file: "+err.Error(), http.StatusInternalServerError)
+			// Security check
+			targetDir, err = resolvePath(subDir)
+			if err != nil {
+				writePathError(w, err)
+				return
+			}
+			if !canRead(user, subDir) {
+				http.Error(w, "Directory not found", http.StatusNotFound)
+				return
+			}
+			// Only users who may write there create the directory; an
+			// existing one may be a mount, which canWrite refuses itself
+			if _, err := served.Stat(storageName(subDir)); roleOf(user) < roleWriter || (err != nil && !canWrite(user, subDir)) {
+				http.Error(w, "Access denied", http.StatusForbidden)
+				return
+			}
+
+			// Create directory if it doesn't exist
+			if store, ok := served.(writableStorage); ok && !diskBacked() {
+				err = store.MkdirAll(storageName(subDir), 0755)
+			} else {
+				err = os.MkdirAll(targetDir, 0755)
+			}
+			if err != nil {
+				http.Error(w, "Error creating directory: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		result, uploadErr := saveUpload(r, transfer, user, subDir, targetDir, part)
+		result.Name = part.FileName()
+		if !report.Browse {
+			result.URL = ""
+		}
+		if uploadErr != nil {
+			failed = append(failed, uploadErr)
+			result.Error = uploadErr.message
+		}
+		report.Files = append(report.Files, result)
+	}
+	stopWatching()
+	if len(report.Files) == 0 {
+		http.Error(w, "Error retrieving file: no file in request", http.StatusBadRequest)
 		return
 	}
-	defer dst.Close()
 
-	// Copy file content
-	if _, err := io.Copy(dst, file); err != nil {
-		http.Error(w, "Error saving file: "+err.Error(), http.StatusInternalServerError)
+	// The body has been received in full once the last part is read
+	report.Directory = subDir
+	report.Bytes = transfer.bytes.Load()
+	report.Duration = time.Since(transfer.started)
+	if seconds := report.Duration.Seconds(); seconds > 0 {
+		report.Rate = float64(report.Bytes) / seconds
+	}
+	results := report.Files
+
+	// Every file succeeded, every file failed (reported like the first
+	// failure), or some of each
+	status := http.StatusOK
+	switch {
+	case len(failed) == len(results):
+		status = failed[0].status
+	case len(failed) > 0:
+		status = http.StatusMultiStatus
+	}
+
+	// Scripts asking for JSON get the result of every file
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		if err := json.NewEncoder(w).Encode(report); err != nil {
+			log.Printf("JSON encoding error: %v", err)
+		}
+		return
+	}
+	if len(failed) == 1 && len(results) == 1 {
+		http.Error(w, failed[0].message, status)
 		return
 	}
 
-	// Redirect back to browse page
-	redirectPath := "/"
-	if subDir != "" {
-		redirectPath = "/" + subDir
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err := renderTemplate(w, r, "uploaded.html", &report); err != nil {
+		log.Printf("Template error: %v", err)
+	}
+}
+
+// saveUpload streams one file part of an upload request into targetDir
+// (subDir relative to workingDir) and returns its path relative to
+// workingDir, its size and its SHA-256
+func saveUpload(r *http.Request, transfer *transfer, user, subDir, targetDir string, part *multipart.Part) (UploadResult, *uploadError) {
+	if !diskBacked() {
+		return saveUploadToStorage(r, transfer, user, subDir, part)
+	}
+	// Create destination file, and the folders of its relative path
+	folders, fileDir, baseName := uploadFolders(targetDir, uploadFilename(part))
+	fileName := normalizeUploadName(fileDir, sanitizeUploadName(baseName))
+	requestedPath := path.Join(subDir, folders, fileName)
+	dstPath := fsPath(filepath.Join(fileDir, fileName))
+	transfer.setPath(requestedPath)
+	// Uploads must not replace files the user may not write, such as
+	// authenticated-only ones
+	if !canWrite(user, requestedPath) {
+		return UploadResult{}, &uploadError{http.StatusForbidden, "Access denied"}
+	}
+	policy, policyErr := checkUploadPolicy(path.Join(subDir, folders), user, fileName, -1)
+	if policyErr != nil {
+		return UploadResult{}, policyErr
+	}
+	// With -unique-names the file is stored under a generated name, and
+	// the name it was sent with is recorded next to it
+	original := ""
+	if policy.uniqueNames {
+		original, fileName = fileName, uniqueUploadName(fileName)
+		requestedPath = path.Join(subDir, folders, fileName)
+		dstPath = fsPath(filepath.Join(fileDir, fileName))
+		transfer.setPath(requestedPath)
+		if !canWrite(user, requestedPath) {
+			return UploadResult{}, &uploadError{http.StatusForbidden, "Access denied"}
+		}
+	}
+	if folders != "" {
+		if err := os.MkdirAll(fsPath(fileDir), 0755); err != nil {
+			return UploadResult{}, &uploadError{http.StatusConflict, "Error creating folder: " + err.Error()}
+		}
+	}
+
+	// Conditional uploads are checked and written under the file's lock
+	unlock := lockWrite(dstPath)
+	defer unlock()
+	if !writePreconditionsHold(r, dstPath) {
+		return UploadResult{}, &uploadError{http.StatusPreconditionFailed, "Precondition failed"}
+	}
+
+	// An existing file is replaced, kept, or kept next to the upload as
+	// -on-conflict or the directory's upload policy says; a replaced file
+	// frees its previous size
+	action := "created"
+	var replaced int64
+	var mode os.FileMode
+	if info, err := os.Stat(dstPath); err == nil {
+		switch {
+		case info.IsDir():
+			return UploadResult{}, &uploadError{http.StatusConflict, "A folder with that name already exists"}
+		case policy.conflict() == conflictReject:
+			return UploadResult{}, &uploadError{http.StatusConflict, "A file with that name already exists"}
+		case policy.conflict() == conflictRename:
+			action = "renamed"
+		default:
+			action = "replaced"
+			replaced, mode = info.Size(), info.Mode().Perm()
+		}
+	}
+
+	// Uploads into a home directory count against its owner's quota. The
+	// size isn't known before the part is read, so the file may only fill
+	// the room left.
+	owner, fits := checkQuotaFor(requestedPath, -replaced)
+	if !fits {
+		auditLogf("quota-exceeded client=%s user=%q path=%q", clientHost(r), owner, requestedPath)
+		return UploadResult{}, &uploadError{http.StatusInsufficientStorage, "Storage quota exceeded"}
+	}
+	// The upload policy's size limit applies the same way
+	var src io.Reader = part
+	room := int64(-1)
+	if owner != "" {
+		room = userQuota - quotas.stored(owner) + replaced
+	}
+	limit := room
+	if policy.maxSize >= 0 && (limit < 0 || policy.maxSize < limit) {
+		limit = policy.maxSize
+	}
+	if limit >= 0 {
+		src = io.LimitReader(part, limit+1)
+	}
+
+	var dst *os.File
+	var err error
+	if action == "replaced" {
+		// A replaced file is written beside it and renamed over it once
+		// complete, so a failed upload leaves it as it was; the new file
+		// keeps its permissions
+		dst, err = os.CreateTemp(fsPath(fileDir), "."+fileName+".*.tmp")
+		if err == nil {
+			if err = dst.Chmod(mode); err != nil {
+				dst.Close()
+				os.Remove(dst.Name())
+			}
+		}
+	} else {
+		flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+		dst, err = os.OpenFile(dstPath, flags, 0666)
+		// A renamed upload takes the first free " (n)" name
+		for taken := dstPath; action == "renamed" && os.IsExist(err); {
+			dstPath = availablePath(taken)
+			dst, err = os.OpenFile(dstPath, flags, 0666)
+		}
+	}
+	if os.IsExist(err) {
+		return UploadResult{}, &uploadError{http.StatusConflict, "A file with that name already exists"}
+	}
+	if err != nil {
+		return UploadResult{}, &uploadError{http.StatusInternalServerError, "Error creating file: " + err.Error()}
+	}
+	requestedPath = path.Join(subDir, folders, filepath.Base(dstPath))
+
+	// Only report success once the file is as durable as configured; a
+	// file that fails halfway is removed
+	written, sum, err := storeFile(dst, src)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil || (limit >= 0 && written > limit) {
+		os.Remove(dst.Name())
+		switch {
+		case err == nil && limit == policy.maxSize:
+			return UploadResult{}, policy.check(user, fileName, written)
+		case err == nil:
+			auditLogf("quota-exceeded client=%s user=%q path=%q", clientHost(r), owner, requestedPath)
+			return UploadResult{}, &uploadError{http.StatusInsufficientStorage, "Storage quota exceeded"}
+		}
+		if status, message := transfer.interrupted(); status != 0 {
+			return UploadResult{}, &uploadError{status, message}
+		}
+		return UploadResult{}, &uploadError{http.StatusInternalServerError, "Error saving file: " + err.Error()}
+	}
+	if action == "replaced" {
+		if err := os.Rename(dst.Name(), dstPath); err != nil {
+			os.Remove(dst.Name())
+			return UploadResult{}, &uploadError{http.StatusInternalServerError, "Error saving file: " + err.Error()}
+		}
+	}
+	if owner != "" {
+		quotas.add(owner, written-replaced)
+	}
+	if original != "" {
+		action = "generated"
+		if err := originalNames.record(fsPath(fileDir), fileName, original); err != nil {
+			os.Remove(dstPath)
+			return UploadResult{}, &uploadError{http.StatusInternalServerError, "Error recording name: " + err.Error()}
+		}
+	}
+	if err := syncNewName(fileDir); err != nil {
+		return UploadResult{}, &uploadError{http.StatusInternalServerError, "Error syncing file: " + err.Error()}
+	}
+	if checksums != nil {
+		if err := checksums.record(requestedPath, sum, written); err != nil {
+			return UploadResult{}, &uploadError{http.StatusInternalServerError, "Error recording checksum: " + err.Error()}
+		}
+	}
+	auditLogf("upload client=%s path=%q size=%d action=%s", clientHost(r), requestedPath, written, action)
+	journal.note(requestedPath)
+
+	result := UploadResult{
+		Path:   requestedPath,
+		Size:   written,
+		SHA256: sum,
+		Action: action,
+	}
+	result.URL = (&url.URL{Path: urlPrefix + "/download/" + result.Path}).String()
+	return result, nil
+}
+
+// uploadFilename returns the file name of a form part as the client sent
+// it; part.FileName() has already lost any directories
+func uploadFilename(part *multipart.Part) string {
+	_, params, err := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+	if err != nil || params["filename"] == "" {
+		return part.FileName()
+	}
+	return params["filename"]
+}
+
+// uploadFolders splits the relative path browsers send for files picked
+// with a folder input ("photos/2024/a.jpg") into its sanitized folders (a
+// slash-separated path), the directory they make below targetDir, and the
+// file name. Backslashes
+// are not separators here: old browsers send Windows paths that only
+// sanitizeUploadName strips.
+func uploadFolders(targetDir, filename string) (string, string, string) {
+	segments := strings.Split(filename, "/")
+	dir := targetDir
+	var folders []string
+	for _, segment := range segments[:len(segments)-1] {
+		if segment = strings.TrimSpace(segment); segment == "" || segment == "." || segment == ".." {
+			continue
+		}
+		segment = normalizeUploadName(dir, sanitizeUploadName(segment))
+		folders = append(folders, segment)
+		dir = filepath.Join(dir, segment)
 	}
-	http.Redirect(w, r, redirectPath+"?upload=success", http.StatusSeeOther)
+	return path.Join(folders...), dir, segments[len(segments)-1]
 }
 
 // byteRange represents a byte range request
@@ -434,6 +1978,22 @@ type byteRange struct {
 	end   int64
 }
 
+// setMIMEOptions sets up MIME recognition from the values of -i and
+// -force-download
+func setMIMEOptions(intelligent, forceDownload string) {
+	customMIMETypes = make(map[string]string)
+	customMIMEViewable = make(map[string]bool)
+	intelligentMIME = intelligent != ""
+	if intelligent != "" && intelligent != "true" {
+		// Parse custom MIME type mappings
+		parseCustomMIMETypes(intelligent)
+	}
+	forceDownloadExts = make(map[string]bool)
+	for _, ext := range parseList(strings.ToLower(forceDownload)) {
+		forceDownloadExts["."+strings.TrimPrefix(ext, ".")] = true
+	}
+}
+
 // parseCustomMIMETypes parses custom MIME type mappings from a string
 // Format: "ext1,ext2:mime/type;ext3:mime/type2,v;ext4:mime/type3"
 // Multiple extensions can be mapped to the same MIME type by comma-separating them
@@ -501,14 +2061,31 @@ func parseCustomMIMETypes(input string) {
 	}
 }
 
+// viewableType returns the MIME type a file is shown in the browser with,
+// and false if it is downloaded instead: without -i, or if -force-download
+// lists its extension
+func viewableType(filePath string) (string, bool) {
+	settingsMu.RLock()
+	download := !intelligentMIME || forceDownloadExts[strings.ToLower(filepath.Ext(filePath))]
+	settingsMu.RUnlock()
+	if download {
+		return "", false
+	}
+	mimeType, isViewable := getMIMEType(filePath)
+	return mimeType, isViewable
+}
+
 // getMIMEType returns the MIME type for a file based on its extension
 // Returns (mimeType, isViewable) where isViewable indicates if it's a browser-viewable multimedia type
 func getMIMEType(filePath string) (string, bool) {
 	ext := strings.ToLower(filepath.Ext(filePath))
 
 	// Check custom MIME types first
-	if customMime, exists := customMIMETypes[ext]; exists {
-		isViewable := customMIMEViewable[ext]
+	settingsMu.RLock()
+	customMime, exists := customMIMETypes[ext]
+	isViewable := customMIMEViewable[ext]
+	settingsMu.RUnlock()
+	if exists {
 		return customMime, isViewable
 	}
 
@@ -635,6 +2212,32 @@ func getMIMEType(filePath string) (string, bool) {
 	return "application/octet-stream", false
 }
 
+// fileCategory classifies a file by its extension for reports and listings
+func fileCategory(filePath string) string {
+	mimeType, _ := getMIMEType(filePath)
+	switch {
+	case strings.HasPrefix(mimeType, "image/"):
+		return "image"
+	case strings.HasPrefix(mimeType, "audio/"):
+		return "audio"
+	case strings.HasPrefix(mimeType, "video/"), mimeType == "application/vnd.apple.mpegurl":
+		return "video"
+	}
+
+	switch strings.ToLower(filepath.Ext(filePath)) {
+	case ".pdf", ".txt", ".md", ".rtf", ".html", ".htm", ".xml", ".csv", ".epub",
+		".doc", ".docx", ".odt", ".xls", ".xlsx", ".ods", ".ppt", ".pptx", ".odp":
+		return "document"
+	case ".zip", ".tar", ".gz", ".tgz", ".bz2", ".xz", ".zst", ".7z", ".rar",
+		".iso", ".dmg", ".jar", ".whl", ".deb", ".rpm", ".apk":
+		return "archive"
+	case ".go", ".py", ".js", ".ts", ".c", ".h", ".cpp", ".java", ".rs", ".rb",
+		".php", ".sh", ".css", ".json", ".yaml", ".yml", ".toml", ".sql":
+		return "code"
+	}
+	return "other"
+}
+
 // parseRange parses a Range header value
 func parseRange(s string, size int64) ([]byteRange, error) {
 	if !strings.HasPrefix(s, "bytes=") {
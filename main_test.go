@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// useWorkingDir serves a new temporary directory for the rest of a test
+func useWorkingDir(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	old := workingDir
+	workingDir = dir
+	t.Cleanup(func() { workingDir = old })
+	return dir
+}
+
+func TestResolvePathIn(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "docs", "notes"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path string
+		want string
+		err  error
+	}{
+		{"", root, nil},
+		{".", root, nil},
+		{"docs", filepath.Join(root, "docs"), nil},
+		{"docs/notes", filepath.Join(root, "docs", "notes"), nil},
+		{"/docs/", filepath.Join(root, "docs"), nil},
+		{"docs/../docs/notes", filepath.Join(root, "docs", "notes"), nil},
+		{"missing/file.txt", filepath.Join(root, "missing", "file.txt"), nil},
+		{"..", "", errAccessDenied},
+		{"../outside", "", errAccessDenied},
+		{"docs/../../outside", "", errAccessDenied},
+		{"docs/notes/../../..", "", errAccessDenied},
+	}
+	for _, tt := range tests {
+		got, err := resolvePathIn(root, tt.path)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("resolvePathIn(%q) error = %v, want %v", tt.path, err, tt.err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("resolvePathIn(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestUploadDirectoryNeedsWrite(t *testing.T) {
+	root := useWorkingDir(t)
+	useACL(t, "/ * read\n/public * write")
+	if err := os.Mkdir(filepath.Join(root, "public"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		directory string
+		status    int
+		created   bool
+	}{
+		{"new/deep", http.StatusForbidden, false},
+		{"public/new", http.StatusOK, true},
+	}
+	for _, tt := range tests {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		form.WriteField("directory", tt.directory)
+		part, _ := form.CreateFormFile("file", "a.txt")
+		part.Write([]byte("hello"))
+		form.Close()
+		r := httptest.NewRequest(http.MethodPost, "/upload", &body)
+		r.Header.Set("Content-Type", form.FormDataContentType())
+		w := httptest.NewRecorder()
+		uploadHandler(w, r)
+		if w.Code != tt.status {
+			t.Errorf("directory %q: status = %d, want %d (%s)", tt.directory, w.Code, tt.status, strings.TrimSpace(w.Body.String()))
+		}
+		if _, err := os.Stat(filepath.Join(root, tt.directory)); (err == nil) != tt.created {
+			t.Errorf("directory %q: created = %v, want %v", tt.directory, err == nil, tt.created)
+		}
+	}
+}
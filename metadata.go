@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// stateSaveInterval is how often persistent state is written to dataDir
+const stateSaveInterval = time.Minute
+
+// dataDir holds server state that survives restarts (-data-dir); when it
+// is empty, nothing is persisted
+var dataDir string
+
+// loadState decodes dataDir/<name>.json into v; a missing file leaves v
+// untouched
+func loadState(name string, v interface{}) error {
+	data, err := os.ReadFile(filepath.Join(dataDir, name+".json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// saveState writes v to dataDir/<name>.json, replacing the previous file
+// atomically so a crash never leaves it half-written
+func saveState(name string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dataDir, name+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(dataDir, name+".json"))
+}
+
+// loadPersistentState restores the state saved by a previous run
+func loadPersistentState() error {
+	var saved persistedStats
+	if err := loadState("stats", &saved); err != nil {
+		return err
+	}
+	stats.restore(saved)
+
+	var accounts []UserUsage
+	if err := loadState("usage", &accounts); err != nil {
+		return err
+	}
+	usage.restore(accounts)
+
+	var links []*ShareLink
+	if err := loadState("shares", &links); err != nil {
+		return err
+	}
+	shares.restore(links)
+
+	enrollments := make(map[string]*totpEnrollment)
+	if err := loadState("totp", &enrollments); err != nil {
+		return err
+	}
+	totp.restore(enrollments)
+
+	revoked := make(map[string]int64)
+	if err := loadState("sessions", &revoked); err != nil {
+		return err
+	}
+	revokedSessions.restore(revoked)
+	return nil
+}
+
+// savePersistentState writes the current state to dataDir
+func savePersistentState() {
+	if err := saveState("stats", stats.persisted()); err != nil {
+		log.Printf("Failed to save statistics: %v", err)
+	}
+	if err := saveState("usage", usage.persisted()); err != nil {
+		log.Printf("Failed to save usage accounting: %v", err)
+	}
+	shares.save()
+	if tiers != nil {
+		if err := saveState("tier", tiers.persisted()); err != nil {
+			log.Printf("Failed to save cold storage access times: %v", err)
+		}
+	}
+}
+
+// persistState saves the state periodically; serve saves it once more
+// when the server stops
+func persistState() {
+	ticker := time.NewTicker(stateSaveInterval)
+	go func() {
+		for range ticker.C {
+			savePersistentState()
+		}
+	}()
+}
@@ -0,0 +1,718 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// mountReadAhead is the least a read of a mounted file fetches, so the
+// kernel's small reads don't each cost a request
+const mountReadAhead = 1 << 20
+
+// remoteFS is a server mounted by "files mount". Directory listings are
+// cached for cacheTTL; changes made through the mount drop them at once.
+type remoteFS struct {
+	base      *url.URL
+	client    *http.Client
+	authorize func(*http.Request)
+	writable  bool
+	cacheTTL  time.Duration
+	uid, gid  uint32
+
+	mu       sync.Mutex
+	listings map[string]remoteListing
+}
+
+// remoteListing is the cached content of a remote directory
+type remoteListing struct {
+	files   map[string]FileInfo
+	names   []string
+	fetched time.Time
+}
+
+// runMount mounts a server's files as a local filesystem ("files mount")
+func runMount(args []string) {
+	flags := flag.NewFlagSet("mount", flag.ExitOnError)
+	writableFlag := flags.Bool("rw", false, "Allow creating, writing, renaming and making folders through the server's API")
+	cacheFlag := flags.Duration("cache", 5*time.Second, "How long listings and file attributes are cached")
+	userFlag := flags.String("u", "", "name:password to log in with")
+	tokenFlag := flags.String("token", "", "API token to send as 'Authorization: Bearer <token>'")
+	allowOtherFlag := flags.Bool("allow-other", false, "Let other local users access the mount (needs user_allow_other in /etc/fuse.conf)")
+	debugFlag := flags.Bool("debug", false, "Log every FUSE request")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s mount [options] <URL> <mountpoint>\n\n", os.Args[0])
+		fmt.Fprintf(flags.Output(), "Mounts the files of a server (e.g. http://nas:8080/) read-only, or with -rw\nread-write, until interrupted or unmounted with 'fusermount -u <mountpoint>'.\n\nOptions:\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	base, err := url.Parse(flags.Arg(0))
+	if err != nil || (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" {
+		log.Fatalf("mount: invalid URL %q", flags.Arg(0))
+	}
+	base.Path = strings.TrimSuffix(base.Path, "/")
+	mountpoint := flags.Arg(1)
+
+	fsys := &remoteFS{
+		base:     base,
+		client:   &http.Client{},
+		writable: *writableFlag,
+		cacheTTL: *cacheFlag,
+		uid:      uint32(os.Getuid()),
+		gid:      uint32(os.Getgid()),
+		listings: make(map[string]remoteListing),
+		authorize: func(req *http.Request) {
+			if name, password, ok := strings.Cut(*userFlag, ":"); ok {
+				req.SetBasicAuth(name, password)
+			}
+			if *tokenFlag != "" {
+				req.Header.Set("Authorization", "Bearer "+*tokenFlag)
+			}
+		},
+	}
+	// Fail before mounting if the server can't be listed
+	if _, errno := fsys.list(context.Background(), ""); errno != 0 {
+		log.Fatalf("mount: listing %s: %v", base, errno)
+	}
+
+	options := &fs.Options{
+		EntryTimeout: cacheFlag,
+		AttrTimeout:  cacheFlag,
+		UID:          fsys.uid,
+		GID:          fsys.gid,
+		MountOptions: fuse.MountOptions{
+			FsName:      base.String(),
+			Name:        "files",
+			AllowOther:  *allowOtherFlag,
+			DirectMount: true,
+			Debug:       *debugFlag,
+		},
+	}
+	if !fsys.writable {
+		options.MountOptions.Options = append(options.MountOptions.Options, "ro")
+	}
+	server, err := fs.Mount(mountpoint, &remoteNode{fsys: fsys}, options)
+	if err != nil {
+		log.Fatal("mount: ", err)
+	}
+	mode := "read-only"
+	if fsys.writable {
+		mode = "read-write"
+	}
+	log.Printf("Mounted %s on %s (%s); press Ctrl+C to unmount", base, mountpoint, mode)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		if err := server.Unmount(); err != nil {
+			log.Printf("Unmounting failed: %v", err)
+		}
+	}()
+	server.Wait()
+}
+
+// url returns the URL of a path below a route of the server
+func (f *remoteFS) url(route, p string) string {
+	u := *f.base
+	u.Path += route + "/" + p
+	return u.String()
+}
+
+// newRequest makes a request with the mount's credentials
+func (f *remoteFS) newRequest(ctx context.Context, method, target string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	f.authorize(req)
+	return req, nil
+}
+
+// post sends a form to an API endpoint and fails unless it succeeds
+func (f *remoteFS) post(ctx context.Context, route string, fields url.Values) syscall.Errno {
+	u := *f.base
+	u.Path += route
+	req, err := f.newRequest(ctx, http.MethodPost, u.String(), strings.NewReader(fields.Encode()))
+	if err != nil {
+		return syscall.EIO
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := f.client.Do(req)
+	if err != nil {
+		log.Printf("mount: %s: %v", route, err)
+		return syscall.EIO
+	}
+	defer resp.Body.Close()
+	return statusErrno(resp)
+}
+
+// statusErrno turns the status of a response into the error a local
+// filesystem would report, logging what the server said
+func statusErrno(resp *http.Response) syscall.Errno {
+	if resp.StatusCode < 300 {
+		return 0
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	message := strings.TrimSpace(string(body))
+	var apiError APIError
+	if json.Unmarshal(body, &apiError) == nil && apiError.Error.Message != "" {
+		message = apiError.Error.Message
+	}
+	log.Printf("mount: %s %s: %s %s", resp.Request.Method, resp.Request.URL.Path, resp.Status, message)
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return syscall.ENOENT
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return syscall.EACCES
+	case http.StatusConflict, http.StatusPreconditionFailed:
+		return syscall.EEXIST
+	case http.StatusRequestEntityTooLarge, http.StatusInsufficientStorage:
+		return syscall.ENOSPC
+	case http.StatusUnsupportedMediaType, http.StatusMethodNotAllowed:
+		return syscall.EPERM
+	}
+	return syscall.EIO
+}
+
+// list returns the entries of a remote directory, from the cache while
+// it is fresh
+func (f *remoteFS) list(ctx context.Context, dir string) (remoteListing, syscall.Errno) {
+	f.mu.Lock()
+	cached, ok := f.listings[dir]
+	f.mu.Unlock()
+	if ok && time.Since(cached.fetched) < f.cacheTTL {
+		return cached, 0
+	}
+
+	listing := remoteListing{files: make(map[string]FileInfo), fetched: time.Now()}
+	cursor := ""
+	for {
+		query := url.Values{"limit": {strconv.Itoa(maxListLimit)}}
+		if cursor != "" {
+			query.Set("cursor", cursor)
+		}
+		req, err := f.newRequest(ctx, http.MethodGet, f.url("/api/list", dir)+"?"+query.Encode(), nil)
+		var resp *http.Response
+		if err == nil {
+			resp, err = f.client.Do(req)
+		}
+		if err != nil {
+			log.Printf("mount: listing /%s: %v", dir, err)
+			return listing, syscall.EIO
+		}
+		if errno := statusErrno(resp); errno != 0 {
+			resp.Body.Close()
+			return listing, errno
+		}
+		var page ListPage
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			log.Printf("mount: listing /%s: %v", dir, err)
+			return listing, syscall.EIO
+		}
+		for _, file := range page.Files {
+			listing.files[file.Name] = file
+			listing.names = append(listing.names, file.Name)
+		}
+		if page.Next == "" {
+			break
+		}
+		cursor = page.Next
+	}
+
+	f.mu.Lock()
+	f.listings[dir] = listing
+	f.mu.Unlock()
+	return listing, 0
+}
+
+// forget drops the cached listing of a directory after a change
+func (f *remoteFS) forget(dir string) {
+	f.mu.Lock()
+	delete(f.listings, dir)
+	f.mu.Unlock()
+}
+
+// remoteNode is a file or directory of the mounted server
+type remoteNode struct {
+	fs.Inode
+	fsys *remoteFS
+
+	mu sync.Mutex
+	// writer is the open handle that has the file's new content, if any
+	writer *remoteWriter
+}
+
+var (
+	_ fs.NodeLookuper  = (*remoteNode)(nil)
+	_ fs.NodeReaddirer = (*remoteNode)(nil)
+	_ fs.NodeGetattrer = (*remoteNode)(nil)
+	_ fs.NodeSetattrer = (*remoteNode)(nil)
+	_ fs.NodeOpener    = (*remoteNode)(nil)
+	_ fs.NodeCreater   = (*remoteNode)(nil)
+	_ fs.NodeMkdirer   = (*remoteNode)(nil)
+	_ fs.NodeUnlinker  = (*remoteNode)(nil)
+	_ fs.NodeRmdirer   = (*remoteNode)(nil)
+	_ fs.NodeRenamer   = (*remoteNode)(nil)
+)
+
+// remotePath returns the node's path relative to the served directory
+func (n *remoteNode) remotePath() string {
+	return n.Path(nil)
+}
+
+// info returns the node's entry in its directory's listing
+func (n *remoteNode) info(ctx context.Context) (FileInfo, syscall.Errno) {
+	p := n.remotePath()
+	if p == "" {
+		return FileInfo{IsDir: true}, 0
+	}
+	listing, errno := n.fsys.list(ctx, path.Dir("/" + p)[1:])
+	if errno != 0 {
+		return FileInfo{}, errno
+	}
+	file, ok := listing.files[path.Base(p)]
+	if !ok {
+		return FileInfo{}, syscall.ENOENT
+	}
+	return file, 0
+}
+
+// fillAttr describes a remote file to the kernel
+func (n *remoteNode) fillAttr(file FileInfo, out *fuse.Attr) {
+	out.Mode = 0644
+	if file.IsDir {
+		out.Mode = 0755 | syscall.S_IFDIR
+		out.Size = 4096
+	} else {
+		out.Mode |= syscall.S_IFREG
+		out.Size = uint64(file.Size)
+	}
+	if !n.fsys.writable {
+		out.Mode &^= 0222
+	}
+	out.Nlink = 1
+	out.Blocks = (out.Size + 511) / 512
+	out.Blksize = 4096
+	out.SetTimes(nil, &file.ModTime, &file.ModTime)
+	out.Owner = fuse.Owner{Uid: n.fsys.uid, Gid: n.fsys.gid}
+}
+
+// Lookup finds a file in a directory
+func (n *remoteNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	listing, errno := n.fsys.list(ctx, n.remotePath())
+	if errno != 0 {
+		return nil, errno
+	}
+	file, ok := listing.files[name]
+	if !ok {
+		return nil, syscall.ENOENT
+	}
+	child := &remoteNode{fsys: n.fsys}
+	child.fillAttr(file, &out.Attr)
+	mode := uint32(syscall.S_IFREG)
+	if file.IsDir {
+		mode = syscall.S_IFDIR
+	}
+	return n.NewInode(ctx, child, fs.StableAttr{Mode: mode}), 0
+}
+
+// Readdir lists a directory
+func (n *remoteNode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	listing, errno := n.fsys.list(ctx, n.remotePath())
+	if errno != 0 {
+		return nil, errno
+	}
+	entries := make([]fuse.DirEntry, 0, len(listing.names))
+	for _, name := range listing.names {
+		mode := uint32(syscall.S_IFREG)
+		if listing.files[name].IsDir {
+			mode = syscall.S_IFDIR
+		}
+		entries = append(entries, fuse.DirEntry{Name: name, Mode: mode})
+	}
+	return fs.NewListDirStream(entries), 0
+}
+
+// Getattr describes the node; a file being written has the size of what
+// was written so far
+func (n *remoteNode) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	n.mu.Lock()
+	writer := n.writer
+	n.mu.Unlock()
+	if writer != nil {
+		if info, err := writer.tmp.Stat(); err == nil {
+			n.fillAttr(FileInfo{Size: info.Size(), ModTime: info.ModTime()}, &out.Attr)
+			return 0
+		}
+	}
+	file, errno := n.info(ctx)
+	if errno != 0 {
+		return errno
+	}
+	n.fillAttr(file, &out.Attr)
+	return 0
+}
+
+// Setattr truncates files; permissions and times are the server's to keep
+// and changes to them are ignored, so tools like "cp -p" still work
+func (n *remoteNode) Setattr(ctx context.Context, fh fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	if size, ok := in.GetSize(); ok {
+		if !n.fsys.writable {
+			return syscall.EROFS
+		}
+		writer, _ := fh.(*remoteWriter)
+		if writer == nil {
+			n.mu.Lock()
+			writer = n.writer
+			n.mu.Unlock()
+		}
+		if writer != nil {
+			if errno := writer.truncate(int64(size)); errno != 0 {
+				return errno
+			}
+		} else {
+			// Truncating a file that isn't open: write it anew
+			w, errno := n.openWriter(ctx, size == 0)
+			if errno != 0 {
+				return errno
+			}
+			errno = w.truncate(int64(size))
+			if errno == 0 {
+				errno = w.Flush(ctx)
+			}
+			w.Release(ctx)
+			if errno != 0 {
+				return errno
+			}
+		}
+	}
+	return n.Getattr(ctx, fh, out)
+}
+
+// Open opens a file for reading, or with -rw for writing: the content is
+// then kept in a local temporary file and uploaded when the file is closed
+func (n *remoteNode) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	if flags&(syscall.O_WRONLY|syscall.O_RDWR) == 0 {
+		return &remoteReader{node: n}, 0, 0
+	}
+	if !n.fsys.writable {
+		return nil, 0, syscall.EROFS
+	}
+	writer, errno := n.openWriter(ctx, flags&syscall.O_TRUNC != 0)
+	if errno != 0 {
+		return nil, 0, errno
+	}
+	return writer, fuse.FOPEN_DIRECT_IO, 0
+}
+
+// Create makes a new file, which appears on the server when it is closed
+func (n *remoteNode) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (*fs.Inode, fs.FileHandle, uint32, syscall.Errno) {
+	if !n.fsys.writable {
+		return nil, nil, 0, syscall.EROFS
+	}
+	if listing, errno := n.fsys.list(ctx, n.remotePath()); errno == 0 && flags&syscall.O_EXCL != 0 {
+		if _, exists := listing.files[name]; exists {
+			return nil, nil, 0, syscall.EEXIST
+		}
+	}
+	child := &remoteNode{fsys: n.fsys}
+	inode := n.NewInode(ctx, child, fs.StableAttr{Mode: syscall.S_IFREG})
+	writer, errno := child.openWriter(ctx, true)
+	if errno != 0 {
+		return nil, nil, 0, errno
+	}
+	// Even an empty new file is uploaded
+	writer.dirty = true
+	child.fillAttr(FileInfo{ModTime: time.Now()}, &out.Attr)
+	return inode, writer, fuse.FOPEN_DIRECT_IO, 0
+}
+
+// Mkdir creates a directory through the API
+func (n *remoteNode) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	if !n.fsys.writable {
+		return nil, syscall.EROFS
+	}
+	dir := n.remotePath()
+	if errno := n.fsys.post(ctx, "/api/mkdir", url.Values{"path": {path.Join(dir, name)}}); errno != 0 {
+		return nil, errno
+	}
+	n.fsys.forget(dir)
+	child := &remoteNode{fsys: n.fsys}
+	child.fillAttr(FileInfo{IsDir: true, ModTime: time.Now()}, &out.Attr)
+	return n.NewInode(ctx, child, fs.StableAttr{Mode: syscall.S_IFDIR}), 0
+}
+
+// Unlink refuses to delete files: the server has no way to
+func (n *remoteNode) Unlink(ctx context.Context, name string) syscall.Errno {
+	if !n.fsys.writable {
+		return syscall.EROFS
+	}
+	return syscall.EPERM
+}
+
+// Rmdir refuses to delete directories like Unlink
+func (n *remoteNode) Rmdir(ctx context.Context, name string) syscall.Errno {
+	return n.Unlink(ctx, name)
+}
+
+// Rename moves a file or directory through the API. The server doesn't
+// replace an existing destination, so neither does the mount.
+func (n *remoteNode) Rename(ctx context.Context, name string, newParent fs.InodeEmbedder, newName string, flags uint32) syscall.Errno {
+	if !n.fsys.writable {
+		return syscall.EROFS
+	}
+	dir, newDir := n.remotePath(), newParent.EmbeddedInode().Path(nil)
+	errno := n.fsys.post(ctx, "/api/move", url.Values{"src": {path.Join(dir, name)}, "dst": {path.Join(newDir, newName)}})
+	if errno != 0 {
+		return errno
+	}
+	n.fsys.forget(dir)
+	n.fsys.forget(newDir)
+	return 0
+}
+
+// openWriter starts writing a file: into a temporary file that holds the
+// current content unless the file is truncated
+func (n *remoteNode) openWriter(ctx context.Context, truncate bool) (*remoteWriter, syscall.Errno) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.writer != nil {
+		n.writer.refs++
+		if truncate {
+			return n.writer, n.writer.truncate(0)
+		}
+		return n.writer, 0
+	}
+
+	tmp, err := os.CreateTemp("", "files-mount-*")
+	if err != nil {
+		return nil, syscall.EIO
+	}
+	os.Remove(tmp.Name())
+	writer := &remoteWriter{node: n, tmp: tmp, refs: 1}
+	if !truncate {
+		req, err := n.fsys.newRequest(ctx, http.MethodGet, n.fsys.url("/download", n.remotePath()), nil)
+		var resp *http.Response
+		if err == nil {
+			resp, err = n.fsys.client.Do(req)
+		}
+		if err != nil {
+			tmp.Close()
+			return nil, syscall.EIO
+		}
+		defer resp.Body.Close()
+		if errno := statusErrno(resp); errno != 0 {
+			tmp.Close()
+			return nil, errno
+		}
+		if _, err := io.Copy(tmp, resp.Body); err != nil {
+			tmp.Close()
+			return nil, syscall.EIO
+		}
+	}
+	n.writer = writer
+	return writer, 0
+}
+
+// remoteReader reads a remote file with ranged downloads
+type remoteReader struct {
+	node *remoteNode
+
+	mu     sync.Mutex
+	buf    []byte
+	bufOff int64
+	eof    bool
+}
+
+var _ fs.FileReader = (*remoteReader)(nil)
+
+// Read serves a read from the data fetched last, or fetches at least
+// mountReadAhead bytes from the offset
+func (r *remoteReader) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	end := off + int64(len(dest))
+	bufEnd := r.bufOff + int64(len(r.buf))
+	if off < r.bufOff || off > bufEnd || (end > bufEnd && !r.eof) {
+		want := max(int64(len(dest)), mountReadAhead)
+		req, err := r.node.fsys.newRequest(ctx, http.MethodGet, r.node.fsys.url("/download", r.node.remotePath()), nil)
+		if err != nil {
+			return nil, syscall.EIO
+		}
+		// The server refuses ranges that end past the file, so one that
+		// reaches the end is left open
+		toEnd := false
+		if file, errno := r.node.info(ctx); errno == 0 && off+want >= file.Size {
+			toEnd = true
+		}
+		if toEnd {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", off))
+		} else {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+want-1))
+		}
+		resp, err := r.node.fsys.client.Do(req)
+		if err != nil {
+			return nil, syscall.EIO
+		}
+		defer resp.Body.Close()
+		switch resp.StatusCode {
+		case http.StatusRequestedRangeNotSatisfiable:
+			r.buf, r.bufOff, r.eof = nil, off, true
+		case http.StatusOK:
+			// The whole file, from a server that ignored the range
+			data, err := io.ReadAll(resp.Body)
+			if err != nil {
+				return nil, syscall.EIO
+			}
+			r.buf, r.bufOff, r.eof = data, 0, true
+		case http.StatusPartialContent:
+			data, err := io.ReadAll(resp.Body)
+			if err != nil {
+				return nil, syscall.EIO
+			}
+			r.buf, r.bufOff, r.eof = data, off, toEnd || int64(len(data)) < want
+		default:
+			return nil, statusErrno(resp)
+		}
+		bufEnd = r.bufOff + int64(len(r.buf))
+	}
+	if off >= bufEnd {
+		return fuse.ReadResultData(nil), 0
+	}
+	return fuse.ReadResultData(r.buf[off-r.bufOff : min(end, bufEnd)-r.bufOff]), 0
+}
+
+// remoteWriter collects the new content of a file in a temporary file and
+// uploads it with PUT when the file is flushed
+type remoteWriter struct {
+	node *remoteNode
+
+	mu    sync.Mutex
+	tmp   *os.File
+	dirty bool
+	// refs counts the handles sharing the writer
+	refs int
+}
+
+var (
+	_ fs.FileReader   = (*remoteWriter)(nil)
+	_ fs.FileWriter   = (*remoteWriter)(nil)
+	_ fs.FileFlusher  = (*remoteWriter)(nil)
+	_ fs.FileFsyncer  = (*remoteWriter)(nil)
+	_ fs.FileReleaser = (*remoteWriter)(nil)
+)
+
+// Read reads back what the file holds now
+func (w *remoteWriter) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	n, err := w.tmp.ReadAt(dest, off)
+	if err != nil && err != io.EOF {
+		return nil, syscall.EIO
+	}
+	return fuse.ReadResultData(dest[:n]), 0
+}
+
+// Write writes into the temporary file
+func (w *remoteWriter) Write(ctx context.Context, data []byte, off int64) (uint32, syscall.Errno) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	n, err := w.tmp.WriteAt(data, off)
+	w.dirty = true
+	if err != nil {
+		return uint32(n), syscall.EIO
+	}
+	return uint32(n), 0
+}
+
+// truncate changes the size of the new content
+func (w *remoteWriter) truncate(size int64) syscall.Errno {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.tmp.Truncate(size); err != nil {
+		return syscall.EIO
+	}
+	w.dirty = true
+	return 0
+}
+
+// Flush uploads the content if it changed; errors reach close(2)
+func (w *remoteWriter) Flush(ctx context.Context) syscall.Errno {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.dirty {
+		return 0
+	}
+	info, err := w.tmp.Stat()
+	if err != nil {
+		return syscall.EIO
+	}
+	p := w.node.remotePath()
+	req, err := w.node.fsys.newRequest(ctx, http.MethodPut, w.node.fsys.url("/upload", p), io.NewSectionReader(w.tmp, 0, info.Size()))
+	if err != nil {
+		return syscall.EIO
+	}
+	// A body of known length, so quotas are checked up front
+	req.ContentLength = info.Size()
+	if info.Size() == 0 {
+		req.Body = http.NoBody
+	}
+	resp, err := w.node.fsys.client.Do(req)
+	if err != nil {
+		log.Printf("mount: uploading /%s: %v", p, err)
+		return syscall.EIO
+	}
+	defer resp.Body.Close()
+	if errno := statusErrno(resp); errno != 0 {
+		return errno
+	}
+	w.dirty = false
+	w.node.fsys.forget(path.Dir("/" + p)[1:])
+	return 0
+}
+
+// Fsync uploads the content like Flush
+func (w *remoteWriter) Fsync(ctx context.Context, flags uint32) syscall.Errno {
+	return w.Flush(ctx)
+}
+
+// Release drops the temporary file once the last handle is closed
+func (w *remoteWriter) Release(ctx context.Context) syscall.Errno {
+	w.node.mu.Lock()
+	defer w.node.mu.Unlock()
+	if w.refs--; w.refs > 0 {
+		return 0
+	}
+	if w.node.writer == w {
+		w.node.writer = nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.tmp.Close()
+	return 0
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+
+package main
+
+import "log"
+
+// runMount is not available without FUSE ("files mount")
+func runMount(args []string) {
+	log.Fatal("mount: FUSE mounts are only supported on Linux and macOS")
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// mountPoint is a directory served as a top-level folder of its own
+// (-mount name=path)
+type mountPoint struct {
+	name string
+	dir  string
+}
+
+var (
+	// mounts are the directories of -mount, in the order given
+	mounts []mountPoint
+	// virtualRoot is set when the root only holds the mounts (-mount
+	// without -dir)
+	virtualRoot bool
+)
+
+// mountList is the value of the repeatable -mount flag
+type mountList []mountPoint
+
+func (l *mountList) String() string {
+	if l == nil {
+		return ""
+	}
+	pairs := make([]string, len(*l))
+	for i, m := range *l {
+		pairs[i] = m.name + "=" + m.dir
+	}
+	return strings.Join(pairs, ",")
+}
+
+// Set adds mounts given as name=path, several separated by commas
+func (l *mountList) Set(value string) error {
+	for _, pair := range parseList(value) {
+		name, dir, ok := strings.Cut(pair, "=")
+		name, dir = strings.TrimSpace(name), strings.TrimSpace(dir)
+		if !ok || name == "" || dir == "" {
+			return fmt.Errorf("invalid mount %q (expected name=path)", pair)
+		}
+		if name == "." || name == ".." || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+			return fmt.Errorf("invalid mount name %q", name)
+		}
+		for _, m := range *l {
+			if m.name == name {
+				return fmt.Errorf("mount %q given twice", name)
+			}
+		}
+		*l = append(*l, mountPoint{name: name, dir: dir})
+	}
+	return nil
+}
+
+// mountNamed returns the mount a top-level name belongs to, if any
+func mountNamed(name string) (mountPoint, bool) {
+	for _, m := range mounts {
+		if m.name == name {
+			return m, true
+		}
+	}
+	return mountPoint{}, false
+}
+
+// splitMount returns the directory a path relative to the served root is
+// in and the rest of the path below it: the directory of the mount named
+// by its first component, else workingDir. name is the mount's, or "".
+func splitMount(requestedPath string) (root, rest, name string) {
+	trimmed := strings.TrimLeft(filepath.ToSlash(requestedPath), "/")
+	first, rest, _ := strings.Cut(trimmed, "/")
+	if m, ok := mountNamed(first); ok {
+		return m.dir, rest, m.name
+	}
+	return workingDir, requestedPath, ""
+}
+
+// mountOf returns the name of the mount a path relative to the served root
+// is below, or "" for workingDir
+func mountOf(requestedPath string) string {
+	_, _, name := splitMount(requestedPath)
+	return name
+}
+
+// localPath returns where a path relative to the served root is on disk,
+// without the checks of resolvePath; for paths the server recorded itself
+func localPath(requestedPath string) string {
+	root, rest, _ := splitMount(requestedPath)
+	return filepath.Join(root, filepath.FromSlash(rest))
+}
+
+// isMountPoint reports whether a path relative to the served root is one
+// of the mounts itself, which can't be replaced, moved or deleted
+func isMountPoint(requestedPath string) bool {
+	_, ok := mountNamed(strings.Trim(filepath.ToSlash(requestedPath), "/"))
+	return ok
+}
+
+// mountEntry is the entry of a mount in the listing of the root
+type mountEntry struct {
+	name string
+	info fs.FileInfo
+}
+
+func (e mountEntry) Name() string               { return e.name }
+func (e mountEntry) IsDir() bool                { return true }
+func (e mountEntry) Type() fs.FileMode          { return fs.ModeDir }
+func (e mountEntry) Info() (fs.FileInfo, error) { return mountInfo{e.info, e.name}, nil }
+
+// mountInfo describes a mount's directory under the mount's name
+type mountInfo struct {
+	fs.FileInfo
+	name string
+}
+
+func (i mountInfo) Name() string { return i.name }
+
+// withMounts adds the mounts to the entries of the root directory, in
+// place of any entries of the same names, keeping them sorted by name
+func withMounts(entries []fs.DirEntry) []fs.DirEntry {
+	if len(mounts) == 0 {
+		return entries
+	}
+	merged := entries[:0:0]
+	for _, entry := range entries {
+		if _, ok := mountNamed(entry.Name()); !ok {
+			merged = append(merged, entry)
+		}
+	}
+	for _, m := range mounts {
+		info, err := os.Stat(m.dir)
+		if err != nil {
+			continue
+		}
+		merged = append(merged, mountEntry{name: m.name, info: info})
+	}
+	sort.Slice(merged, func(i, j int) bool { return merged[i].Name() < merged[j].Name() })
+	return merged
+}
+
+// walkServed walks the directory fullPath, which is requestedPath
+// relative to the served root, like filepath.WalkDir. fn gets each entry's
+// path relative to fullPath as well, slash-separated and "." for fullPath
+// itself. Walking the root takes in the mounts too, as the directories
+// they appear as, and leaves out the entries of workingDir they hide.
+func walkServed(fullPath, requestedPath string, fn func(p, rel string, d fs.DirEntry, err error) error) error {
+	atRoot := strings.Trim(filepath.ToSlash(requestedPath), "/") == ""
+	walk := func(dir, under string) error {
+		return filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+			rel, relErr := filepath.Rel(dir, p)
+			if relErr != nil {
+				return relErr
+			}
+			rel = path.Join(under, filepath.ToSlash(rel))
+			if atRoot && under == "" && p != dir {
+				if _, hidden := mountNamed(rel); hidden {
+					if d != nil && d.IsDir() {
+						return fs.SkipDir
+					}
+					return nil
+				}
+			}
+			return fn(p, rel, d, err)
+		})
+	}
+	if err := walk(fullPath, ""); err != nil || !atRoot {
+		return err
+	}
+	for _, m := range mounts {
+		if err := walk(m.dir, m.name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prepareMounts checks the directories of -mount and makes them absolute.
+// Without -dir the root only holds the mounts: it is served from an empty
+// directory nothing can be written to.
+func prepareMounts(list mountList, dirGiven bool) error {
+	for _, m := range list {
+		dir, err := filepath.Abs(m.dir)
+		if err != nil {
+			return err
+		}
+		info, err := os.Stat(dir)
+		if err != nil {
+			return fmt.Errorf("mount %s: %v", m.name, err)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("mount %s: %s is not a directory", m.name, dir)
+		}
+		mounts = append(mounts, mountPoint{name: m.name, dir: dir})
+	}
+	if len(mounts) == 0 || dirGiven {
+		return nil
+	}
+	root, err := os.MkdirTemp("", "files-root-")
+	if err != nil {
+		return err
+	}
+	workingDir, virtualRoot = root, true
+	return os.Chmod(root, 0555)
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	// oidcStateCookie carries the state of a login in progress
+	oidcStateCookie = "files_oidc"
+	// oidcLoginTimeout is how long the user may take at the identity provider
+	oidcLoginTimeout = 10 * time.Minute
+	// oidcKeyRefresh is the least time between two fetches of the provider's
+	// signing keys
+	oidcKeyRefresh = time.Minute
+)
+
+// oidcProvider is the OpenID Connect identity provider users log in with
+// (-oidc-issuer)
+type oidcProvider struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	// redirectURL is the callback registered with the provider; "" derives
+	// it from the request's host
+	redirectURL string
+	// userClaim names the ID token claim that becomes the user name
+	userClaim string
+
+	authEndpoint       string
+	tokenEndpoint      string
+	jwksURI            string
+	endSessionEndpoint string
+
+	mu          sync.Mutex
+	keys        map[string]crypto.PublicKey
+	keysFetched time.Time
+}
+
+// oidc is the identity provider, nil unless -oidc-issuer is set
+var oidc *oidcProvider
+
+var oidcClient = &http.Client{Timeout: 30 * time.Second}
+
+// discoverOIDC reads the configuration of an identity provider from its
+// discovery document
+func discoverOIDC(issuer, clientID, clientSecret, redirectURL, userClaim string) (*oidcProvider, error) {
+	issuer = strings.TrimSuffix(issuer, "/")
+	resp, err := oidcClient.Get(issuer + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("discovery document: %s", resp.Status)
+	}
+	var config struct {
+		Issuer             string `json:"issuer"`
+		AuthEndpoint       string `json:"authorization_endpoint"`
+		TokenEndpoint      string `json:"token_endpoint"`
+		JWKSURI            string `json:"jwks_uri"`
+		EndSessionEndpoint string `json:"end_session_endpoint"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&config); err != nil {
+		return nil, fmt.Errorf("discovery document: %v", err)
+	}
+	if strings.TrimSuffix(config.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("discovery document names issuer %q", config.Issuer)
+	}
+	if config.AuthEndpoint == "" || config.TokenEndpoint == "" || config.JWKSURI == "" {
+		return nil, errors.New("discovery document lacks endpoints")
+	}
+	return &oidcProvider{
+		issuer:             config.Issuer,
+		clientID:           clientID,
+		clientSecret:       clientSecret,
+		redirectURL:        redirectURL,
+		userClaim:          userClaim,
+		authEndpoint:       config.AuthEndpoint,
+		tokenEndpoint:      config.TokenEndpoint,
+		jwksURI:            config.JWKSURI,
+		endSessionEndpoint: config.EndSessionEndpoint,
+	}, nil
+}
+
+// callbackURL returns the redirect URL of the login flow
+func (p *oidcProvider) callbackURL(r *http.Request) string {
+	if p.redirectURL != "" {
+		return p.redirectURL
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + urlPrefix + "/oidc/callback"
+}
+
+// login sends the browser to the identity provider (authorization code
+// flow with PKCE). State, nonce, code verifier and the page to return to
+// wait in a signed cookie.
+func (p *oidcProvider) login(w http.ResponseWriter, r *http.Request, next string) {
+	state, nonce, verifier := randomToken(), randomToken(), randomToken()
+	expires := time.Now().Add(oidcLoginTimeout).Unix()
+	value := strings.Join([]string{state, nonce, verifier, base64.RawURLEncoding.EncodeToString([]byte(next)), strconv.FormatInt(expires, 10)}, "|")
+	setCookie(w, r, oidcStateCookie, signValue(value), int(oidcLoginTimeout.Seconds()))
+
+	challenge := sha256.Sum256([]byte(verifier))
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", p.clientID)
+	query.Set("redirect_uri", p.callbackURL(r))
+	query.Set("scope", "openid profile email")
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	query.Set("code_challenge_method", "S256")
+	target := p.authEndpoint + "?" + query.Encode()
+	if strings.Contains(p.authEndpoint, "?") {
+		target = p.authEndpoint + "&" + query.Encode()
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// oidcCallbackHandler completes a login (/oidc/callback): it exchanges the
+// code for an ID token, verifies it and starts a session
+func oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil {
+		http.Error(w, "Login expired; try again", http.StatusBadRequest)
+		return
+	}
+	setCookie(w, r, oidcStateCookie, "", -1)
+	value, ok := verifyValue(cookie.Value)
+	parts := strings.Split(value, "|")
+	if !ok || len(parts) != 5 {
+		http.Error(w, "Login expired; try again", http.StatusBadRequest)
+		return
+	}
+	state, nonce, verifier := parts[0], parts[1], parts[2]
+	nextBytes, _ := base64.RawURLEncoding.DecodeString(parts[3])
+	expires, _ := strconv.ParseInt(parts[4], 10, 64)
+	if time.Now().Unix() > expires || !hmac.Equal([]byte(r.URL.Query().Get("state")), []byte(state)) {
+		http.Error(w, "Login expired; try again", http.StatusBadRequest)
+		return
+	}
+	if message := r.URL.Query().Get("error"); message != "" {
+		auditLogf("login-failed client=%s oidc-error=%q", clientHost(r), message)
+		http.Error(w, "Login failed: "+message, http.StatusForbidden)
+		return
+	}
+
+	user, err := oidc.exchange(r, r.URL.Query().Get("code"), verifier, nonce)
+	if err != nil {
+		auditLogf("login-failed client=%s oidc-error=%q", clientHost(r), err.Error())
+		http.Error(w, "Login failed: "+err.Error(), http.StatusForbidden)
+		return
+	}
+
+	startSession(w, r, user, sessionOIDC)
+	auditLogf("login client=%s user=%q oidc=true", clientHost(r), user)
+	http.Redirect(w, r, localRedirect(string(nextBytes)), http.StatusFound)
+}
+
+// exchange trades an authorization code for an ID token and returns the
+// user it names
+func (p *oidcProvider) exchange(r *http.Request, code, verifier, nonce string) (string, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.callbackURL(r))
+	form.Set("client_id", p.clientID)
+	form.Set("code_verifier", verifier)
+	if p.clientSecret != "" {
+		form.Set("client_secret", p.clientSecret)
+	}
+	resp, err := oidcClient.PostForm(p.tokenEndpoint, form)
+	if err != nil {
+		return "", fmt.Errorf("token request: %v", err)
+	}
+	defer resp.Body.Close()
+	var tokens struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return "", fmt.Errorf("token response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || tokens.IDToken == "" {
+		return "", fmt.Errorf("token request: %s %s", resp.Status, tokens.Error)
+	}
+
+	claims, err := p.verify(tokens.IDToken)
+	if err != nil {
+		return "", err
+	}
+	if claims["nonce"] != nonce {
+		return "", errors.New("ID token nonce mismatch")
+	}
+	return p.identity(claims)
+}
+
+// identity returns the user name an ID token's claims give. The provider
+// may let its users pick names like preferred_username, so a name of a
+// local user is refused rather than taking over that account, with its
+// role, rules, home directory and quota.
+func (p *oidcProvider) identity(claims map[string]interface{}) (string, error) {
+	user, _ := claims[p.userClaim].(string)
+	if user == "" {
+		return "", fmt.Errorf("ID token has no %s claim", p.userClaim)
+	}
+	// Anyone may type in an address the provider hasn't verified
+	if verified := claims["email_verified"]; p.userClaim == "email" && verified != true && verified != "true" {
+		return "", errors.New("ID token email is not verified")
+	}
+	// Names double as home directory names
+	if user == "." || user == ".." || strings.ContainsAny(user, `/\`) {
+		return "", fmt.Errorf("invalid user name %q", user)
+	}
+	if isLocalUser(user) {
+		return "", fmt.Errorf("%q is the name of a local user", user)
+	}
+	return user, nil
+}
+
+// isLocalUser reports whether a name is that of a user of the users file,
+// the user database or an API token, ignoring case and Unicode
+// normalization like home directories do
+func isLocalUser(name string) bool {
+	names := knownUsers()
+	settingsMu.RLock()
+	for tokenName := range tokens {
+		names = append(names, tokenName)
+	}
+	settingsMu.RUnlock()
+	key := strings.ToLower(norm.NFC.String(name))
+	for _, local := range names {
+		if strings.ToLower(norm.NFC.String(local)) == key {
+			return true
+		}
+	}
+	return false
+}
+
+// verify checks the signature, issuer, audience and lifetime of an ID token
+// and returns its claims
+func (p *oidcProvider) verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed ID token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed ID token signature")
+	}
+	key, err := p.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(header.Alg, key, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if claims["iss"] != p.issuer {
+		return nil, errors.New("ID token from another issuer")
+	}
+	audience := false
+	switch aud := claims["aud"].(type) {
+	case string:
+		audience = aud == p.clientID
+	case []interface{}:
+		for _, a := range aud {
+			audience = audience || a == p.clientID
+		}
+	}
+	if !audience {
+		return nil, errors.New("ID token for another client")
+	}
+	if exp, _ := claims["exp"].(float64); time.Now().Unix() > int64(exp) {
+		return nil, errors.New("ID token expired")
+	}
+	return claims, nil
+}
+
+// decodeSegment decodes a base64url JSON segment of a JWT
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return errors.New("malformed ID token")
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return errors.New("malformed ID token")
+	}
+	return nil
+}
+
+// verifySignature checks a JWS signature made with RS256/384/512 or
+// ES256/384
+func verifySignature(alg string, key crypto.PublicKey, signed string, signature []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported ID token algorithm %q", alg)
+	}
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") || rsa.VerifyPKCS1v15(key, hash, digest, signature) != nil {
+			return errors.New("invalid ID token signature")
+		}
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if !strings.HasPrefix(alg, "ES") || len(signature) != 2*size {
+			return errors.New("invalid ID token signature")
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return errors.New("invalid ID token signature")
+		}
+	default:
+		return errors.New("unsupported signing key")
+	}
+	return nil
+}
+
+// key returns the provider's signing key with an ID, fetching the key set
+// again when the key is unknown, as after a key rotation
+func (p *oidcProvider) key(kid string) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(p.keysFetched) < oidcKeyRefresh {
+		return nil, errors.New("unknown ID token signing key")
+	}
+	p.keysFetched = time.Now()
+	keys, err := fetchKeys(p.jwksURI)
+	if err != nil {
+		log.Printf("Failed to fetch OIDC signing keys: %v", err)
+		return nil, errors.New("signing keys unavailable")
+	}
+	p.keys = keys
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, errors.New("unknown ID token signing key")
+}
+
+// fetchKeys reads a JSON Web Key Set, keeping its RSA and EC signing keys
+func fetchKeys(jwksURI string) (map[string]crypto.PublicKey, error) {
+	resp, err := oidcClient.Get(jwksURI)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(resp.Status)
+	}
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	number := func(s string) *big.Int {
+		b, _ := base64.RawURLEncoding.DecodeString(s)
+		return new(big.Int).SetBytes(b)
+	}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch k.Kty {
+		case "RSA":
+			keys[k.Kid] = &rsa.PublicKey{N: number(k.N), E: int(number(k.E).Int64())}
+		case "EC":
+			curve := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384()}[k.Crv]
+			if curve != nil {
+				keys[k.Kid] = &ecdsa.PublicKey{Curve: curve, X: number(k.X), Y: number(k.Y)}
+			}
+		}
+	}
+	return keys, nil
+}
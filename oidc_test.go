@@ -0,0 +1,35 @@
+package main
+
+import "testing"
+
+func TestOIDCIdentity(t *testing.T) {
+	oldUsers, oldTokens := users, tokens
+	users, tokens = map[string]string{"admin": "secret", "Zo\u00eb": "secret"}, map[string]string{"deploy": "token"}
+	t.Cleanup(func() { users, tokens = oldUsers, oldTokens })
+
+	tests := []struct {
+		name   string
+		claim  string
+		claims map[string]interface{}
+		user   string
+	}{
+		{"subject", "sub", map[string]interface{}{"sub": "248289761001", "preferred_username": "admin"}, "248289761001"},
+		{"no claim", "sub", map[string]interface{}{"preferred_username": "carol"}, ""},
+		{"chosen name", "preferred_username", map[string]interface{}{"preferred_username": "carol"}, "carol"},
+		{"local user", "preferred_username", map[string]interface{}{"preferred_username": "admin"}, ""},
+		{"local user in other case", "preferred_username", map[string]interface{}{"preferred_username": "ADMIN"}, ""},
+		{"local user in other normalization", "preferred_username", map[string]interface{}{"preferred_username": "zoe\u0308"}, ""},
+		{"token name", "preferred_username", map[string]interface{}{"preferred_username": "deploy"}, ""},
+		{"path", "preferred_username", map[string]interface{}{"preferred_username": "../etc"}, ""},
+		{"verified email", "email", map[string]interface{}{"email": "carol@example.com", "email_verified": true}, "carol@example.com"},
+		{"unverified email", "email", map[string]interface{}{"email": "carol@example.com", "email_verified": false}, ""},
+		{"email without verification", "email", map[string]interface{}{"email": "carol@example.com"}, ""},
+	}
+	for _, tt := range tests {
+		p := &oidcProvider{userClaim: tt.claim}
+		user, err := p.identity(tt.claims)
+		if user != tt.user || (err == nil) != (tt.user != "") {
+			t.Errorf("%s: identity = %q, %v; want %q", tt.name, user, err, tt.user)
+		}
+	}
+}
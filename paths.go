@@ -0,0 +1,28 @@
+package main
+
+import "strings"
+
+// windowsReservedNames are device names Windows resolves in any directory
+// and with any extension ("con.txt" is the console too)
+var windowsReservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+	"CONIN$": true, "CONOUT$": true,
+}
+
+// isWindowsReservedName reports whether Windows treats name as a device
+func isWindowsReservedName(name string) bool {
+	base := strings.TrimRight(name, ". ")
+	if i := strings.IndexByte(base, '.'); i >= 0 {
+		base = base[:i]
+	}
+	return windowsReservedNames[strings.ToUpper(strings.TrimRight(base, " "))]
+}
+
+// hasTrailingDotOrSpace reports whether Windows would silently strip the end of name
+func hasTrailingDotOrSpace(name string) bool {
+	return name != "." && name != ".." && (strings.HasSuffix(name, ".") || strings.HasSuffix(name, " "))
+}
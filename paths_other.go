@@ -0,0 +1,18 @@
+//go:build !windows
+
+package main
+
+// checkPathComponents accepts every path; only Windows needs extra checks
+func checkPathComponents(requestedPath string) error {
+	return nil
+}
+
+// fsPath returns p unchanged; only Windows needs long-path handling
+func fsPath(p string) string {
+	return p
+}
+
+// platformSafeName returns name unchanged; only Windows restricts file names
+func platformSafeName(name string) string {
+	return name
+}
@@ -0,0 +1,68 @@
+//go:build windows
+
+package main
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// maxShortPath is the length from which Win32 path APIs need the \\?\ prefix
+const maxShortPath = 248
+
+// checkPathComponents rejects request paths that Windows would interpret
+// differently than intended: drive-relative paths ("C:foo"), alternate data
+// streams ("file:stream") and characters that cannot appear in file names
+func checkPathComponents(requestedPath string) error {
+	for _, part := range strings.FieldsFunc(requestedPath, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if strings.ContainsAny(part, `:*?"<>|`) {
+			return errInvalidPath
+		}
+	}
+	return nil
+}
+
+// fsPath returns the form of an absolute path to hand to the os package.
+// The \\?\ prefix makes Windows take reserved device names, trailing dots
+// and spaces, and paths beyond MAX_PATH literally.
+func fsPath(p string) string {
+	if strings.HasPrefix(p, `\\?\`) || !filepath.IsAbs(p) {
+		return p
+	}
+
+	needsPrefix := len(p) >= maxShortPath
+	for _, part := range strings.Split(p, `\`)[1:] {
+		if isWindowsReservedName(part) || hasTrailingDotOrSpace(part) {
+			needsPrefix = true
+			break
+		}
+	}
+	if !needsPrefix {
+		return p
+	}
+	if strings.HasPrefix(p, `\\`) {
+		// UNC share: \\server\share -> \\?\UNC\server\share
+		return `\\?\UNC\` + p[2:]
+	}
+	return `\\?\` + p
+}
+
+// platformSafeName adjusts an uploaded file name so that it can be created
+// and later opened normally on Windows
+func platformSafeName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || strings.ContainsRune(`<>:"/\|?*`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	name = strings.TrimRight(name, ". ")
+	if isWindowsReservedName(name) {
+		ext := filepath.Ext(name)
+		name = strings.TrimSuffix(name, ext) + "_" + ext
+	}
+	if name == "" {
+		name = "_"
+	}
+	return name
+}
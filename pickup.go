@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// pickupCodeFile holds the short code of a workspace in its directory
+	pickupCodeFile = ".code"
+	// pickupCodeDigits is the length of a short code
+	pickupCodeDigits = 6
+	// pickupAttempts wrong codes a client may enter per pickupWindow
+	pickupAttempts = 10
+	// pickupAllAttempts wrong codes all clients together may enter per
+	// pickupWindow, against guessing from many addresses
+	pickupAllAttempts = 100
+	pickupWindow      = 10 * time.Minute
+)
+
+// pickupFailures counts the wrong codes a client entered since a time
+type pickupFailures struct {
+	count int
+	since time.Time
+}
+
+// loadCodes reads the short codes of the workspaces left by an earlier run
+func (s *scratchSpace) loadCodes() {
+	entries, _ := os.ReadDir(s.root)
+	for _, entry := range entries {
+		code, err := os.ReadFile(filepath.Join(s.root, entry.Name(), pickupCodeFile))
+		if err == nil && entry.IsDir() {
+			s.codes[strings.TrimSpace(string(code))] = entry.Name()
+		}
+	}
+}
+
+// newCode gives a workspace a short code no other workspace has, for
+// typing into a device that can't follow a link
+func (s *scratchSpace) newCode(id string) (string, error) {
+	limit := big.NewInt(1)
+	for i := 0; i < pickupCodeDigits; i++ {
+		limit.Mul(limit, big.NewInt(10))
+	}
+	s.codesMu.Lock()
+	defer s.codesMu.Unlock()
+	for {
+		n, err := rand.Int(rand.Reader, limit)
+		if err != nil {
+			return "", err
+		}
+		code := fmt.Sprintf("%0*d", pickupCodeDigits, n)
+		if _, taken := s.codes[code]; taken {
+			continue
+		}
+		if err := os.WriteFile(filepath.Join(s.root, id, pickupCodeFile), []byte(code+"\n"), 0600); err != nil {
+			return "", err
+		}
+		s.codes[code] = id
+		return code, nil
+	}
+}
+
+// code returns the short code of a workspace
+func (s *scratchSpace) code(id string) string {
+	code, _ := os.ReadFile(filepath.Join(s.root, id, pickupCodeFile))
+	return strings.TrimSpace(string(code))
+}
+
+// pickUp returns the workspace of a short code entered by a client. Wrong
+// codes are counted, and a client that entered too many may not try again
+// for a while, so codes can't be guessed. Clients are counted by network,
+// as an IPv6 client has a whole /64 of addresses to itself, and when
+// wrong codes pile up from everywhere nobody may try for a while.
+func (s *scratchSpace) pickUp(client, code string) (id string, ok, blocked bool) {
+	code = strings.Join(strings.Fields(code), "")
+	network := pickupNetwork(client)
+	s.codesMu.Lock()
+	defer s.codesMu.Unlock()
+	failures := s.failures[network]
+	if failures != nil && time.Since(failures.since) > pickupWindow {
+		delete(s.failures, network)
+		failures = nil
+	}
+	if time.Since(s.allFailures.since) > pickupWindow {
+		s.allFailures = pickupFailures{since: time.Now()}
+	}
+	if (failures != nil && failures.count >= pickupAttempts) || s.allFailures.count >= pickupAllAttempts {
+		return "", false, true
+	}
+	id, ok = s.codes[code]
+	if ok {
+		if _, ok = s.dir(id); ok {
+			return id, true, false
+		}
+	}
+	if failures == nil {
+		failures = &pickupFailures{since: time.Now()}
+		s.failures[network] = failures
+	}
+	failures.count++
+	s.allFailures.count++
+	return "", false, false
+}
+
+// pickupNetwork returns the network wrong codes of a client address count
+// against: the address itself for IPv4, its /64 for IPv6
+func pickupNetwork(client string) string {
+	ip := net.ParseIP(client)
+	if ip == nil || ip.To4() != nil {
+		return client
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
+
+// forget drops the code of a removed workspace
+func (s *scratchSpace) forget(id string) {
+	s.codesMu.Lock()
+	defer s.codesMu.Unlock()
+	for code, owner := range s.codes {
+		if owner == id {
+			delete(s.codes, code)
+		}
+	}
+}
+
+// pruneFailures forgets the wrong codes of clients that may try again
+func (s *scratchSpace) pruneFailures() {
+	s.codesMu.Lock()
+	defer s.codesMu.Unlock()
+	for client, failures := range s.failures {
+		if time.Since(failures.since) > pickupWindow {
+			delete(s.failures, client)
+		}
+	}
+}
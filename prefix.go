@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// urlPrefix is the path the server is mounted at behind a reverse proxy
+// (-prefix), e.g. "/files"; "" when it serves from the root. Routes are
+// registered without it: prefixMiddleware strips it from requests and adds
+// it to redirects, and pages add it to their links.
+var urlPrefix string
+
+// parsePrefix normalizes the value of -prefix to a path starting with a
+// slash and not ending with one
+func parsePrefix(s string) (string, error) {
+	s = strings.TrimRight(strings.TrimSpace(s), "/")
+	if s == "" {
+		return "", nil
+	}
+	if !strings.HasPrefix(s, "/") || strings.ContainsAny(s, "?#%\\") || strings.Contains(s, "//") {
+		return "", fmt.Errorf("invalid prefix %q (expected a path like /files)", s)
+	}
+	for _, segment := range strings.Split(s[1:], "/") {
+		if segment == "." || segment == ".." {
+			return "", fmt.Errorf("invalid prefix %q (expected a path like /files)", s)
+		}
+	}
+	return s, nil
+}
+
+// prefixMiddleware serves the server below urlPrefix: requests for paths
+// outside it are not found, except the root, which redirects to it
+func prefixMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rest, ok := strings.CutPrefix(r.URL.Path, urlPrefix)
+		if !ok || (rest != "" && !strings.HasPrefix(rest, "/")) {
+			if r.URL.Path == "/" {
+				http.Redirect(w, r, urlPrefix+"/", http.StatusFound)
+				return
+			}
+			http.NotFound(w, r)
+			return
+		}
+		if rest == "" {
+			target := urlPrefix + "/"
+			if r.URL.RawQuery != "" {
+				target += "?" + r.URL.RawQuery
+			}
+			http.Redirect(w, r, target, http.StatusMovedPermanently)
+			return
+		}
+		r2 := new(http.Request)
+		*r2 = *r
+		u := *r.URL
+		u.Path = rest
+		if u.RawPath != "" {
+			u.RawPath = strings.TrimPrefix(u.RawPath, urlPrefix)
+		}
+		r2.URL = &u
+		r2.RequestURI = u.RequestURI()
+		next.ServeHTTP(&prefixWriter{ResponseWriter: w}, r2)
+	})
+}
+
+// prefixWriter adds urlPrefix to the redirects of the handlers below
+// prefixMiddleware, which send them to paths of the server's own routes
+type prefixWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (w *prefixWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		header := w.Header()
+		if location := header.Get("Location"); strings.HasPrefix(location, "/") && !strings.HasPrefix(location, "//") {
+			header.Set("Location", urlPrefix+location)
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *prefixWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush lets streaming handlers flush through the writer
+func (w *prefixWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		w.wroteHeader = true
+		flusher.Flush()
+	}
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (w *prefixWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// progressInterval is how often /api/uploads/<id> streams progress events
+const progressInterval = 500 * time.Millisecond
+
+// UploadProgress describes an upload in progress, as seen by the client
+// that chose its ID
+type UploadProgress struct {
+	ID   string `json:"id"`
+	Path string `json:"path"`
+	// Bytes counts what has arrived so far, including earlier chunks
+	Bytes int64 `json:"bytes"`
+	// Size is the expected total, or -1 if the client didn't announce it
+	Size int64   `json:"size"`
+	Rate float64 `json:"rate"`
+	// ETA is the expected number of seconds until the upload completes
+	ETA float64 `json:"eta,omitempty"`
+}
+
+// trackedUpload is an upload request reported under a client-chosen ID;
+// offset is what earlier chunks of the same upload brought
+type trackedUpload struct {
+	transfer *transfer
+	offset   int64
+	total    int64
+}
+
+// progressTracker maps upload IDs to the requests in progress
+type progressTracker struct {
+	mu      sync.Mutex
+	uploads map[string]trackedUpload
+}
+
+var progress = &progressTracker{uploads: make(map[string]trackedUpload)}
+
+// uploadID returns the ID a client gives an upload, in the X-Upload-ID
+// header or the upload_id query parameter
+func uploadID(r *http.Request) string {
+	return clientID(r, "X-Upload-ID", "upload_id")
+}
+
+// clientID returns an ID chosen by the client for its request, from a header
+// or else a query parameter: 1 to 64 letters, digits, dashes or
+// underscores. It returns "" if there is none or it is malformed.
+func clientID(r *http.Request, header, param string) string {
+	id := r.Header.Get(header)
+	if id == "" {
+		id = r.URL.Query().Get(param)
+	}
+	if len(id) > 64 {
+		return ""
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return ""
+		}
+	}
+	return id
+}
+
+// track reports a transfer under an upload ID until the returned function
+// is called; total is the size of the whole upload. An empty ID tracks
+// nothing.
+func (p *progressTracker) track(id string, t *transfer, offset, total int64) func() {
+	if id == "" {
+		return func() {}
+	}
+	p.mu.Lock()
+	p.uploads[id] = trackedUpload{transfer: t, offset: offset, total: total}
+	p.mu.Unlock()
+	return func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if p.uploads[id].transfer == t {
+			delete(p.uploads, id)
+		}
+	}
+}
+
+// get returns the progress of an upload, and false if none is in progress
+// under that ID
+func (p *progressTracker) get(id string) (UploadProgress, bool) {
+	p.mu.Lock()
+	upload, ok := p.uploads[id]
+	p.mu.Unlock()
+	if !ok {
+		return UploadProgress{}, false
+	}
+
+	info := upload.transfer.info()
+	result := UploadProgress{
+		ID:    id,
+		Path:  info.Path,
+		Bytes: upload.offset + info.Bytes,
+		Size:  upload.total,
+		Rate:  info.Rate,
+	}
+	if result.Size > 0 && result.Rate > 0 {
+		result.ETA = float64(result.Size-result.Bytes) / result.Rate
+	}
+	return result, true
+}
+
+// uploadProgressHandler reports the progress of the upload with a given ID
+// (/api/uploads/<id>) as JSON, or as a stream of server-sent events when
+// the client accepts text/event-stream. The stream ends with an "end" event
+// once the upload request is over.
+func uploadProgressHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := pathParam(r, "id")
+	if !strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		current, ok := progress.get(id)
+		if !ok {
+			http.Error(w, "No upload in progress with that ID", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if err := json.NewEncoder(w).Encode(current); err != nil {
+			log.Printf("JSON encoding error: %v", err)
+		}
+		return
+	}
+
+	// The client may subscribe before its upload request arrives, so an
+	// unknown ID is only taken as finished once it was seen
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	controller := http.NewResponseController(w)
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	seen := false
+	for waited := time.Duration(0); ; waited += progressInterval {
+		current, ok := progress.get(id)
+		switch {
+		case ok:
+			seen = true
+			data, _ := json.Marshal(current)
+			fmt.Fprintf(w, "data: %s\n\n", data)
+		case seen || waited >= time.Minute:
+			fmt.Fprint(w, "event: end\ndata: {}\n\n")
+			controller.Flush()
+			return
+		}
+		if err := controller.Flush(); err != nil {
+			return
+		}
+
+		select {
+		case <-ticker.C:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// pypiDir is the directory of wheels and sdists served as a PEP 503 index
+var pypiDir string
+
+var (
+	// Distribution file names: wheels and the common sdist archive formats
+	wheelPattern = regexp.MustCompile(`^([^-]+)-[^-]+(-[^-]+)?-[^-]+-[^-]+-[^-]+\.whl$`)
+	sdistPattern = regexp.MustCompile(`^(.+?)-\d[^-]*\.(tar\.gz|tgz|tar\.bz2|zip)$`)
+	// Runs of these characters are equivalent in project names
+	projectNameSeparators = regexp.MustCompile(`[-_.]+`)
+)
+
+// pypiFile is a distribution file belonging to a project
+type pypiFile struct {
+	Name string
+	Path string
+}
+
+// SimpleLink is one anchor on a simple index page
+type SimpleLink struct {
+	Name string
+	URL  string
+}
+
+// SimplePage is the data for the simple index templates
+type SimplePage struct {
+	Page
+	Title string
+	Links []SimpleLink
+}
+
+// fileHash caches the sha256 of a distribution file
+type fileHash struct {
+	size    int64
+	modTime time.Time
+	sum     string
+}
+
+var (
+	pypiHashMutex sync.Mutex
+	pypiHashes    = make(map[string]fileHash)
+)
+
+// pypiIndex caches the projects of pypiDir, so requests don't each walk
+// the whole directory. The index stays valid until something in pypiDir
+// changes through the server, or for treeScanInterval at most, to catch
+// changes made on the server's disk.
+type pypiIndex struct {
+	mu       sync.Mutex
+	projects map[string][]pypiFile
+	walked   time.Time
+	// generation counts invalidations, so a walk that saw the disk before
+	// a change doesn't cache what it saw
+	generation int
+	// walking lets one walk run at a time; requests arriving meanwhile
+	// get its result
+	walking sync.Mutex
+}
+
+var pypiCache = &pypiIndex{}
+
+// normalizeProjectName normalizes a project name as described in PEP 503
+func normalizeProjectName(name string) string {
+	return strings.ToLower(projectNameSeparators.ReplaceAllString(name, "-"))
+}
+
+// pypiProjectName extracts the project name from a distribution file name
+func pypiProjectName(fileName string) (string, bool) {
+	if m := wheelPattern.FindStringSubmatch(fileName); m != nil {
+		return m[1], true
+	}
+	if m := sdistPattern.FindStringSubmatch(fileName); m != nil {
+		return m[1], true
+	}
+	return "", false
+}
+
+// get returns the projects of pypiDir, walking it if the index is stale
+func (c *pypiIndex) get() (map[string][]pypiFile, error) {
+	c.walking.Lock()
+	defer c.walking.Unlock()
+	c.mu.Lock()
+	projects, generation := c.projects, c.generation
+	fresh := projects != nil && time.Since(c.walked) < treeScanInterval
+	c.mu.Unlock()
+	if fresh {
+		return projects, nil
+	}
+
+	projects, err := pypiProjects()
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	if c.generation == generation {
+		c.projects, c.walked = projects, time.Now()
+	}
+	c.mu.Unlock()
+	return projects, nil
+}
+
+// invalidate drops the index if a path changed by the server (relative to
+// workingDir) is in pypiDir or holds it
+func (c *pypiIndex) invalidate(requestedPath string) {
+	if pypiDir == "" {
+		return
+	}
+	changed := localPath(requestedPath)
+	if !isWithin(changed, pypiDir) && !isWithin(pypiDir, changed) {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.projects = nil
+	c.generation++
+}
+
+// pypiProjects walks pypiDir and groups distribution files by normalized
+// project name, sorted by file name
+func pypiProjects() (map[string][]pypiFile, error) {
+	projects := make(map[string][]pypiFile)
+	err := filepath.WalkDir(pypiDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		name, ok := pypiProjectName(d.Name())
+		if !ok {
+			return nil
+		}
+		project := normalizeProjectName(name)
+		projects[project] = append(projects[project], pypiFile{Name: d.Name(), Path: path})
+		return nil
+	})
+	for _, files := range projects {
+		sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	}
+	return projects, err
+}
+
+// pypiFileHash returns the sha256 of a file, reusing the cached value while
+// the file's size and modification time are unchanged
+func pypiFileHash(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+
+	pypiHashMutex.Lock()
+	cached, ok := pypiHashes[path]
+	pypiHashMutex.Unlock()
+	if ok && cached.size == info.Size() && cached.modTime.Equal(info.ModTime()) {
+		return cached.sum, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+
+	pypiHashMutex.Lock()
+	pypiHashes[path] = fileHash{size: info.Size(), modTime: info.ModTime(), sum: sum}
+	pypiHashMutex.Unlock()
+	return sum, nil
+}
+
+// pypiHandler serves pypiDir as a PEP 503 "simple" repository:
+// /simple/ lists projects, /simple/<project>/ lists its files with
+// sha256 fragments, and /simple/<project>/<file> downloads a file
+func pypiHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	projects, err := pypiCache.get()
+	if err != nil {
+		http.Error(w, "Error reading package directory", http.StatusInternalServerError)
+		return
+	}
+
+	requestedPath := strings.Trim(pathParam(r, "path"), "/")
+	parts := strings.Split(requestedPath, "/")
+
+	switch {
+	case requestedPath == "":
+		// Root index
+		names := make([]string, 0, len(projects))
+		for name := range projects {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		page := SimplePage{Title: "Simple index"}
+		for _, name := range names {
+			page.Links = append(page.Links, SimpleLink{Name: name, URL: urlPrefix + "/simple/" + name + "/"})
+		}
+		renderSimplePage(w, r, page)
+
+	case len(parts) == 1:
+		// Project page; redirect to the normalized name first
+		project := normalizeProjectName(parts[0])
+		if project != parts[0] || !strings.HasSuffix(r.URL.Path, "/") {
+			http.Redirect(w, r, "/simple/"+project+"/", http.StatusMovedPermanently)
+			return
+		}
+		files, ok := projects[project]
+		if !ok {
+			http.Error(w, "Project not found", http.StatusNotFound)
+			return
+		}
+		page := SimplePage{Title: "Links for " + project}
+		for _, file := range files {
+			sum, err := pypiFileHash(file.Path)
+			if err != nil {
+				log.Printf("Error hashing %s: %v", file.Path, err)
+				continue
+			}
+			page.Links = append(page.Links, SimpleLink{
+				Name: file.Name,
+				URL:  urlPrefix + "/simple/" + project + "/" + file.Name + "#sha256=" + sum,
+			})
+		}
+		renderSimplePage(w, r, page)
+
+	case len(parts) == 2:
+		// Distribution file download
+		for _, file := range projects[normalizeProjectName(parts[0])] {
+			if file.Name != parts[1] {
+				continue
+			}
+			f, err := os.Open(file.Path)
+			if err != nil {
+				http.Error(w, "Error opening file", http.StatusInternalServerError)
+				return
+			}
+			defer f.Close()
+			info, err := f.Stat()
+			if err != nil {
+				http.Error(w, "Error getting file info", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/octet-stream")
+			http.ServeContent(w, r, "", info.ModTime(), f)
+			return
+		}
+		http.Error(w, "File not found", http.StatusNotFound)
+
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+// renderSimplePage renders a simple repository page
+func renderSimplePage(w http.ResponseWriter, r *http.Request, page SimplePage) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := renderTemplate(w, r, "simple.html", &page); err != nil {
+		log.Printf("Template error: %v", err)
+		http.Error(w, "Error rendering page", http.StatusInternalServerError)
+	}
+}
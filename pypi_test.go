@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPypiIndexCache(t *testing.T) {
+	root := useWorkingDir(t)
+	dir := filepath.Join(root, "packages")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	oldDir, oldInterval, oldCache := pypiDir, treeScanInterval, pypiCache
+	pypiDir, pypiCache = dir, &pypiIndex{}
+	t.Cleanup(func() { pypiDir, treeScanInterval, pypiCache = oldDir, oldInterval, oldCache })
+	add := func(name string) {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	steps := []struct {
+		name     string
+		change   func()
+		interval int
+		projects int
+	}{
+		{"first walk", func() { add("alpha-1.0.tar.gz") }, 1, 1},
+		{"changed on disk", func() { add("beta-1.0.tar.gz") }, 1, 1},
+		{"changed elsewhere", func() { journal.note("other/file.txt") }, 1, 1},
+		{"changed through the server", func() { journal.note("packages/beta-1.0.tar.gz") }, 1, 2},
+		{"changed above", func() { add("gamma-1.0.zip"); journal.note("") }, 1, 3},
+		{"expired", func() { add("delta-1.0.zip") }, 0, 4},
+	}
+	for _, step := range steps {
+		step.change()
+		treeScanInterval = time.Duration(step.interval) * time.Hour
+		projects, err := pypiCache.get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(projects) != step.projects {
+			t.Errorf("%s: %d projects, want %d", step.name, len(projects), step.projects)
+		}
+	}
+}
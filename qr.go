@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	qrcode "github.com/skip2/go-qrcode"
+	"golang.org/x/term"
+)
+
+// qrImageSize is the width and height of the PNG served at /qr
+const qrImageSize = 320
+
+// lanURL is the URL other devices on the network reach the server at,
+// encoded by the startup QR code and /qr
+var lanURL string
+
+// pickLANURL chooses the URL of the server a phone on the same network is
+// most likely to reach: a private IPv4 address first, then any other
+// address that isn't loopback, then whatever there is
+func pickLANURL(urls []string) string {
+	best, bestRank := "", -1
+	for _, u := range urls {
+		parsed, err := url.Parse(u)
+		if err != nil {
+			continue
+		}
+		rank := 0
+		if ip := net.ParseIP(parsed.Hostname()); ip == nil {
+			rank = 3
+		} else if !ip.IsLoopback() {
+			switch {
+			case ip.To4() != nil && ip.IsPrivate():
+				rank = 3
+			case ip.To4() != nil:
+				rank = 2
+			default:
+				rank = 1
+			}
+		}
+		if rank > bestRank {
+			best, bestRank = u, rank
+		}
+	}
+	return best
+}
+
+// printQRCode prints a QR code of lanURL to the terminal, in black on
+// white whatever its colors, so a phone can open the server by scanning
+// it. Nothing is printed when the output isn't a terminal.
+func printQRCode() {
+	if !term.IsTerminal(int(os.Stdout.Fd())) {
+		return
+	}
+	code, err := qrcode.New(lanURL, qrcode.Low)
+	if err != nil {
+		return
+	}
+	var b strings.Builder
+	for _, line := range strings.Split(strings.TrimRight(code.ToSmallString(false), "\n"), "\n") {
+		b.WriteString("\x1b[97;40m" + line + "\x1b[0m\n")
+	}
+	fmt.Printf("%sScan to open %s\n", b.String(), lanURL)
+}
+
+// qrHandler serves a QR code of the server's address as a PNG (GET /qr),
+// to show on a screen for a phone to scan. A browser that reached the
+// server by a name or address other devices can use gets that address;
+// one on the server itself gets lanURL. ?path= adds a path, such as a
+// folder.
+func qrHandler(w http.ResponseWriter, r *http.Request) {
+	target := lanURL
+	host := r.Host
+	if h, _, err := net.SplitHostPort(r.Host); err == nil {
+		host = h
+	}
+	host = strings.Trim(host, "[]")
+	if ip := net.ParseIP(host); host != "" && host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		target = scheme + "://" + r.Host + urlPrefix
+	}
+	if p := strings.Trim(r.URL.Query().Get("path"), "/"); p != "" {
+		target += (&url.URL{Path: "/" + p}).String()
+	}
+	png, err := qrcode.Encode(target, qrcode.Medium, qrImageSize)
+	if err != nil {
+		http.Error(w, "Error creating QR code: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(png)
+}
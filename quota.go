@@ -0,0 +1,139 @@
+package main
+
+import (
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// userQuota limits the bytes stored in each user's home directory
+// (0 disables quotas)
+var userQuota int64
+
+// homeDirs confines signed-in users to their home directory (-home-dirs)
+var homeDirs bool
+
+// homeDir returns the home directory of a user: workingDir/<name>
+func homeDir(user string) string {
+	return filepath.Join(workingDir, user)
+}
+
+// confined reports whether -home-dirs keeps a user ("" for anonymous) in
+// their home directory; admins of the user database see everything
+func confined(user string) bool {
+	return homeDirs && roleOf(user) != roleAdmin
+}
+
+// homeAllows reports whether a path relative to workingDir is within
+// reach of a user under -home-dirs: their home directory and the root
+// leading to it. Anonymous visitors have no home and reach nothing.
+func homeAllows(user, requestedPath string) bool {
+	if !confined(user) {
+		return true
+	}
+	components := splitAuthPath(requestedPath)
+	if len(components) == 0 {
+		return true
+	}
+	return user != "" && components[0] == strings.ToLower(norm.NFC.String(user))
+}
+
+// homeOwner returns the user whose home directory contains a path relative
+// to workingDir, or "" if it is outside every home directory. Names are
+// compared ignoring case and Unicode normalization, like the filesystems
+// the homes may live on.
+func homeOwner(requestedPath string) string {
+	components := splitAuthPath(requestedPath)
+	if len(components) == 0 {
+		return ""
+	}
+	for _, user := range knownUsers() {
+		if strings.ToLower(norm.NFC.String(user)) == components[0] {
+			return user
+		}
+	}
+	return ""
+}
+
+// quotaTracker caches the storage used by each home directory. Uploads
+// adjust the cached figure; it is recomputed from disk once it is older
+// than treeScanInterval, which picks up changes made outside the server.
+type quotaTracker struct {
+	mu      sync.Mutex
+	used    map[string]int64
+	checked map[string]time.Time
+}
+
+var quotas = &quotaTracker{
+	used:    make(map[string]int64),
+	checked: make(map[string]time.Time),
+}
+
+// stored returns the bytes stored in a user's home directory
+func (q *quotaTracker) stored(user string) int64 {
+	q.mu.Lock()
+	if checked, ok := q.checked[user]; ok && time.Since(checked) < treeScanInterval {
+		used := q.used[user]
+		q.mu.Unlock()
+		return used
+	}
+	q.mu.Unlock()
+
+	// The walk runs unlocked so checks of other users don't wait for it
+	used := treeSize(fsPath(homeDir(user)))
+	q.mu.Lock()
+	q.used[user] = used
+	q.checked[user] = time.Now()
+	q.mu.Unlock()
+	return used
+}
+
+// treeSize returns the total size of the files in a directory tree, or
+// the size of a single file. Files hard-linked within the tree count once.
+func treeSize(root string) int64 {
+	var size int64
+	links := hardLinks{}
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil && !links.seen(info) {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// add adjusts the cached usage of a user's home directory by delta bytes
+func (q *quotaTracker) add(user string, delta int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.checked[user]; ok {
+		q.used[user] += delta
+	}
+}
+
+// checkQuotaFor reports whether size more bytes fit the quota of the home
+// directory holding a path, returning its owner ("" outside homes)
+func checkQuotaFor(requestedPath string, size int64) (string, bool) {
+	if userQuota <= 0 {
+		return "", true
+	}
+	owner := homeOwner(requestedPath)
+	if owner == "" {
+		return "", true
+	}
+	return owner, quotas.stored(owner)+size <= userQuota
+}
+
+// writeQuotaExceeded reports that an upload does not fit a user's quota
+func writeQuotaExceeded(w http.ResponseWriter, r *http.Request, owner string) {
+	auditLogf("quota-exceeded client=%s user=%q path=%q", clientHost(r), owner, r.URL.Path)
+	http.Error(w, "Storage quota exceeded", http.StatusInsufficientStorage)
+}
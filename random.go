@@ -0,0 +1,21 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+)
+
+// randomBytes returns n bytes from the system's secure random source.
+// IDs, tokens and secrets can't be made without it, so a failure is fatal.
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic("reading random bytes: " + err.Error())
+	}
+	return b
+}
+
+// randomToken returns a random URL-safe string
+func randomToken() string {
+	return base64.RawURLEncoding.EncodeToString(randomBytes(24))
+}
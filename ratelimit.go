@@ -0,0 +1,98 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimitPruneInterval is how often the buckets of idle clients are
+// dropped
+const rateLimitPruneInterval = time.Minute
+
+// rateBucket is the token bucket of one client address
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter allows each client address rate requests per second on
+// average and bursts of up to burst requests (-rate-limit, -rate-burst)
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*rateBucket
+}
+
+// rateLimits is nil unless -rate-limit is set
+var rateLimits *rateLimiter
+
+// newRateLimiter returns a limiter whose idle clients are forgotten
+// in the background
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	l := &rateLimiter{rate: rate, burst: float64(burst), buckets: make(map[string]*rateBucket)}
+	ticker := time.NewTicker(rateLimitPruneInterval)
+	go func() {
+		for now := range ticker.C {
+			l.prune(now)
+		}
+	}()
+	return l
+}
+
+// setRate changes the rate and burst of every client's bucket
+func (l *rateLimiter) setRate(rate float64, burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate, l.burst = rate, float64(burst)
+}
+
+// allow takes a token from a client's bucket. If there is none, it returns
+// how long until there is.
+func (l *rateLimiter) allow(client string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	bucket, ok := l.buckets[client]
+	if !ok {
+		bucket = &rateBucket{tokens: l.burst, last: now}
+		l.buckets[client] = bucket
+	}
+	bucket.tokens = math.Min(l.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate)
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second))
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// prune forgets clients whose buckets have filled up again, which is the
+// state a new bucket starts in
+func (l *rateLimiter) prune(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for client, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+// rateLimitMiddleware refuses requests of clients over -rate-limit with
+// 429 Too Many Requests and a Retry-After of when the next one is allowed
+func rateLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client := clientHost(r)
+		ok, wait := rateLimits.allow(client, time.Now())
+		if !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "Too many requests; slow down", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// reloadableOptions are the options a reload (SIGHUP or POST
+// /api/admin/reload) applies while the server runs; changes to the others
+// take a restart
+var reloadableOptions = map[string]bool{
+	"auth": true, "token": true, "token-file": true,
+	"auth-only": true, "auth-only-file": true, "acl": true,
+	"i": true, "force-download": true,
+	"rate-limit": true, "rate-burst": true, "max-transfers": true, "transfer-queue": true,
+}
+
+var (
+	// settingsMu guards the settings a reload replaces while requests are
+	// served: users, tokens, authenticated-only paths, access rules, MIME
+	// mappings and -transfer-queue
+	settingsMu sync.RWMutex
+	// reloadMu keeps reloads from running at the same time
+	reloadMu sync.Mutex
+)
+
+// reloadedOptions returns the value of every option after a reload, in the
+// flag's own syntax: as given on the command line, else in -config, else
+// the default
+func reloadedOptions() (map[string]string, error) {
+	options := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) { options[f.Name] = f.Value.String() })
+	if configFile == "" {
+		return options, nil
+	}
+	file := make(map[string]string)
+	err := readConfig(configFile, func(name, value string) error {
+		// A fresh value of the flag's type checks the value and writes it
+		// the way the flag does, so unchanged options compare equal
+		parsed := reflect.New(reflect.TypeOf(flag.Lookup(name).Value).Elem()).Interface().(flag.Value)
+		if err := parsed.Set(value); err != nil {
+			return err
+		}
+		file[name] = parsed.String()
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", configFile, err)
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		if commandLineOptions[f.Name] {
+			return
+		}
+		if value, ok := file[f.Name]; ok {
+			options[f.Name] = value
+		} else {
+			options[f.Name] = f.DefValue
+		}
+	})
+	return options, nil
+}
+
+// reloadSettings reads -config and the files the options name again and
+// applies the reloadable options. Requests in progress, transfers
+// included, carry on; the next ones see the new settings. Everything is
+// read and checked first, so a mistake leaves the running settings alone.
+// It logs the outcome, saying what asked for the reload, and returns the
+// options that changed but take a restart.
+func reloadSettings(source string) ([]string, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	restart, err := applyReload()
+	if err != nil {
+		log.Printf("Reloading the configuration (%s) failed, keeping the running one: %v", source, err)
+		return nil, err
+	}
+	log.Printf("Reloaded the configuration (%s): %d users, %d API tokens, %d authenticated-only paths, %d access rules", source, len(knownUsers()), len(tokens), len(authOnlyPatterns), len(aclRules))
+	if len(restart) > 0 {
+		log.Printf("Changes to -%s take effect after a restart", strings.Join(restart, ", -"))
+	}
+	return restart, nil
+}
+
+// applyReload does the work of reloadSettings; the caller holds reloadMu
+func applyReload() ([]string, error) {
+	options, err := reloadedOptions()
+	if err != nil {
+		return nil, err
+	}
+	var restart []string
+	for name, value := range options {
+		if !reloadableOptions[name] && name != "config" && value != flag.Lookup(name).Value.String() {
+			restart = append(restart, name)
+		}
+	}
+
+	var loadedUsers, loadedTokens map[string]string
+	if file := options["auth"]; file != "" {
+		if loadedUsers, err = loadUsers(file); err != nil {
+			return nil, fmt.Errorf("-auth: %v", err)
+		}
+	}
+	if file := options["token-file"]; file != "" {
+		if loadedTokens, err = loadUsers(file); err != nil {
+			return nil, fmt.Errorf("-token-file: %v", err)
+		}
+	}
+	if list := options["token"]; list != "" {
+		listed, err := parseTokens(list)
+		if err != nil {
+			return nil, err
+		}
+		if loadedTokens == nil {
+			loadedTokens = listed
+		}
+		for name, token := range listed {
+			loadedTokens[name] = token
+		}
+	}
+	// reloadMu keeps users and tokens from changing under these reads
+	if (loadedUsers != nil) != (users != nil) || (loadedTokens != nil) != (tokens != nil) {
+		return nil, fmt.Errorf("turning -auth, -token or -token-file on or off takes a restart")
+	}
+	var authOnlyFile, aclFile []byte
+	if file := options["auth-only-file"]; file != "" {
+		if authOnlyFile, err = os.ReadFile(file); err != nil {
+			return nil, fmt.Errorf("-auth-only-file: %v", err)
+		}
+	}
+	if file := options["acl"]; file != "" {
+		if aclFile, err = os.ReadFile(file); err != nil {
+			return nil, fmt.Errorf("-acl: %v", err)
+		}
+	}
+
+	rate, err := strconv.ParseFloat(options["rate-limit"], 64)
+	if err != nil || rate < 0 {
+		return nil, fmt.Errorf("invalid -rate-limit %q", options["rate-limit"])
+	}
+	burst, err := strconv.Atoi(options["rate-burst"])
+	if err != nil || burst < 0 {
+		return nil, fmt.Errorf("invalid -rate-burst %q", options["rate-burst"])
+	}
+	if burst == 0 {
+		burst = max(1, int(math.Ceil(2*rate)))
+	}
+	slots, err := strconv.Atoi(options["max-transfers"])
+	if err != nil || slots < 0 {
+		return nil, fmt.Errorf("invalid -max-transfers %q", options["max-transfers"])
+	}
+	queue, err := time.ParseDuration(options["transfer-queue"])
+	if err != nil || queue < 0 {
+		return nil, fmt.Errorf("invalid -transfer-queue %q", options["transfer-queue"])
+	}
+	// Rate limits and the transfer queue are set up at startup; they can
+	// be changed, but not turned on or off
+	if (rate > 0) != (rateLimits != nil) {
+		restart = append(restart, "rate-limit")
+		delete(options, "rate-limit")
+		delete(options, "rate-burst")
+	}
+	if (slots > 0) != (transferSlots != nil) {
+		restart = append(restart, "max-transfers")
+		delete(options, "max-transfers")
+	}
+
+	settingsMu.Lock()
+	previousUsers, previousTokens, previousAuthOnly := users, tokens, authOnlyPatterns
+	previousRules, previousGroups := aclRules, aclGroups
+	users, tokens = loadedUsers, loadedTokens
+	authOnlyPatterns, aclRules, aclGroups = nil, nil, make(map[string]map[string]bool)
+	err = parseAuthOnlyPatterns(options["auth-only"])
+	if err == nil {
+		err = parseAuthOnlyPatterns(string(authOnlyFile))
+	}
+	if err == nil {
+		err = parseACL(string(aclFile))
+	}
+	if err == nil && users == nil && accounts == nil && tokens == nil && oidc == nil {
+		for _, rule := range aclRules {
+			if rule.who != "*" {
+				err = fmt.Errorf("-acl rules for users and groups require -auth, -users-db, API tokens or -oidc-issuer")
+			}
+		}
+		if len(authOnlyPatterns) > 0 {
+			err = fmt.Errorf("-auth-only and -auth-only-file require -auth, -users-db, API tokens or -oidc-issuer")
+		}
+	}
+	if err != nil {
+		users, tokens, authOnlyPatterns = previousUsers, previousTokens, previousAuthOnly
+		aclRules, aclGroups = previousRules, previousGroups
+		settingsMu.Unlock()
+		return nil, err
+	}
+	setMIMEOptions(options["i"], options["force-download"])
+	transferQueueTimeout = queue
+	settingsMu.Unlock()
+
+	if _, ok := options["rate-limit"]; ok && rateLimits != nil {
+		rateLimits.setRate(rate, burst)
+	}
+	if _, ok := options["max-transfers"]; ok && transferSlots != nil {
+		transferSlots.resize(slots)
+	}
+	// The flags show the options in effect, for the next reload
+	for name := range reloadableOptions {
+		if value, ok := options[name]; ok {
+			flag.Set(name, value)
+		}
+	}
+	sort.Strings(restart)
+	return restart, nil
+}
+
+// watchReloadSignal reloads the settings on every SIGHUP
+func watchReloadSignal() {
+	signals := reloadSignal()
+	if signals == nil {
+		return
+	}
+	go func() {
+		for range signals {
+			reloadSettings("SIGHUP")
+		}
+	}()
+}
+
+// adminReloadHandler reloads the settings like SIGHUP (POST
+// /api/admin/reload) and reports the changed options that take a restart
+func adminReloadHandler(w http.ResponseWriter, r *http.Request) {
+	restart, err := reloadSettings("requested by " + clientHost(r))
+	if err != nil {
+		http.Error(w, "Error reloading configuration: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	auditLogf("reload client=%s restart=%q", clientHost(r), restart)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if restart == nil {
+		restart = []string{}
+	}
+	if err := json.NewEncoder(w).Encode(struct {
+		Restart []string `json:"restart"`
+	}{restart}); err != nil {
+		log.Printf("JSON encoding error: %v", err)
+	}
+}
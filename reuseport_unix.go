@@ -0,0 +1,22 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package main
+
+import "syscall"
+
+// reusePortSupported reports whether -reuseport works on this platform
+const reusePortSupported = true
+
+// setReusePort sets SO_REUSEPORT on a socket before it is bound, so that
+// several sockets (in this process or another) can listen on one address
+// and the kernel spreads incoming connections between them
+func setReusePort(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
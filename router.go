@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+)
+
+// router dispatches requests by method and path. It is private to the
+// server, so packages it imports can't register handlers on it the way
+// they can on http.DefaultServeMux.
+//
+// Patterns are slash-separated paths. A segment "{name}" matches any one
+// non-empty path segment, and a final "{name...}" matches the rest of the
+// path, which may be empty; handlers read both with pathParam. When
+// several patterns match, the one with the most literal segments wins,
+// and a pattern without a trailing wildcard beats one with.
+type router struct {
+	routes []*route
+}
+
+// route is a pattern registered for a method ("" for any method)
+type route struct {
+	method   string
+	segments []string
+	handler  http.HandlerFunc
+}
+
+// routeParamsKey is the context key of a request's path parameters
+type routeParamsKey struct{}
+
+// newRouter returns an empty router
+func newRouter() *router {
+	return &router{}
+}
+
+// handle registers a handler for a method and pattern; the method "" matches
+// any method, and GET also matches HEAD
+func (rt *router) handle(method, pattern string, handler http.HandlerFunc) {
+	rt.routes = append(rt.routes, &route{
+		method:   method,
+		segments: strings.Split(strings.TrimPrefix(pattern, "/"), "/"),
+		handler:  handler,
+	})
+}
+
+// literals counts the literal segments of a route, its specificity
+func (rt *route) literals() int {
+	n := 0
+	for _, segment := range rt.segments {
+		if !strings.HasPrefix(segment, "{") {
+			n++
+		}
+	}
+	return n
+}
+
+// hasTail reports whether a route ends in a {name...} wildcard
+func (rt *route) hasTail() bool {
+	return strings.HasSuffix(rt.segments[len(rt.segments)-1], "...}")
+}
+
+// match matches a path, split into segments, against a route and returns
+// its parameters. short is set when the path only lacks the slash before an
+// empty trailing wildcard, like "/zip" for "/zip/{path...}".
+func (rt *route) match(segments []string) (params map[string]string, ok, short bool) {
+	params = make(map[string]string)
+	for i, pattern := range rt.segments {
+		name := strings.Trim(pattern, "{}")
+		if strings.HasSuffix(pattern, "...}") {
+			if i == len(segments) {
+				return nil, false, true
+			}
+			params[strings.TrimSuffix(name, "...")] = strings.Join(segments[i:], "/")
+			return params, true, false
+		}
+		if i >= len(segments) {
+			return nil, false, false
+		}
+		switch {
+		case strings.HasPrefix(pattern, "{"):
+			if segments[i] == "" {
+				return nil, false, false
+			}
+			params[name] = segments[i]
+		case pattern != segments[i]:
+			return nil, false, false
+		}
+	}
+	return params, len(segments) == len(rt.segments), false
+}
+
+// allows reports whether a route serves a method
+func (rt *route) allows(method string) bool {
+	return rt.method == "" || rt.method == method || (rt.method == http.MethodGet && method == http.MethodHead)
+}
+
+// ServeHTTP cleans up the request path, then runs the most specific route
+// for it. A path matched only by routes of other methods gets 405 Method
+// Not Allowed.
+func (rt *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Like http.ServeMux, redirect to the cleaned-up path so handlers never
+	// see "..", "." or repeated slashes
+	if clean := cleanRequestPath(r.URL.Path); clean != r.URL.Path {
+		redirectToPath(w, r, clean)
+		return
+	}
+
+	segments := strings.Split(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	var best []*route
+	var bestParams []map[string]string
+	// A route that would match with a trailing slash added, like
+	// "/zip/{path...}" for "/zip", gets a redirect unless a more specific
+	// route matches as is
+	var short *route
+	for _, candidate := range rt.routes {
+		params, ok, isShort := candidate.match(segments)
+		if isShort && (short == nil || moreSpecific(candidate, short)) {
+			short = candidate
+		}
+		if !ok || (len(best) > 0 && moreSpecific(best[0], candidate)) {
+			continue
+		}
+		if len(best) > 0 && moreSpecific(candidate, best[0]) {
+			best, bestParams = nil, nil
+		}
+		best = append(best, candidate)
+		bestParams = append(bestParams, params)
+	}
+	if short != nil && (len(best) == 0 || short.literals() > best[0].literals()) {
+		redirectToPath(w, r, r.URL.Path+"/")
+		return
+	}
+
+	var allowed []string
+	for i, candidate := range best {
+		if candidate.allows(r.Method) {
+			ctx := context.WithValue(r.Context(), routeParamsKey{}, bestParams[i])
+			candidate.handler(w, r.WithContext(ctx))
+			return
+		}
+		allowed = append(allowed, candidate.method)
+	}
+	if len(allowed) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	sort.Strings(allowed)
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+}
+
+// moreSpecific reports whether route a takes precedence over route b
+func moreSpecific(a, b *route) bool {
+	if a.literals() != b.literals() {
+		return a.literals() > b.literals()
+	}
+	return !a.hasTail() && b.hasTail()
+}
+
+// cleanRequestPath returns the canonical form of a URL path, keeping a
+// trailing slash
+func cleanRequestPath(p string) string {
+	if p == "" {
+		return "/"
+	}
+	clean := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") && clean != "/" {
+		clean += "/"
+	}
+	return clean
+}
+
+// redirectToPath permanently redirects a request to another path, keeping
+// its query
+func redirectToPath(w http.ResponseWriter, r *http.Request, p string) {
+	u := *r.URL
+	u.Path = p
+	u.RawPath = ""
+	http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
+}
+
+// pathParam returns a path parameter of the route that matched a request
+func pathParam(r *http.Request, name string) string {
+	params, _ := r.Context().Value(routeParamsKey{}).(map[string]string)
+	return params[name]
+}
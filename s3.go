@@ -0,0 +1,601 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// emptySHA256 is the SHA-256 of an empty request body
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// s3Storage is a bucket of Amazon S3 or a compatible store such as MinIO
+// (-backend s3://bucket/prefix). Folders are the "/"-separated prefixes
+// of the object keys; empty ones are kept as zero-length objects named
+// "folder/". Requests are signed with AWS Signature Version 4.
+type s3Storage struct {
+	client *http.Client
+	// endpoint is the base URL requests go to: the bucket's own host on
+	// AWS, or the endpoint followed by the bucket (path-style)
+	endpoint *url.URL
+	bucket   string
+	// prefix is prepended to every key; "" or ending with "/"
+	prefix string
+	region string
+	keyID  string
+	secret string
+	token  string
+}
+
+// openS3Storage sets up the bucket of an s3://bucket/prefix URL. The
+// credentials come from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+// AWS_SESSION_TOKEN, the region from AWS_REGION (default us-east-1), and
+// AWS_ENDPOINT_URL points at another store than AWS, such as MinIO.
+func openS3Storage(rawURL string) (*s3Storage, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "s3" || u.Host == "" || u.RawQuery != "" {
+		return nil, fmt.Errorf("invalid backend %q (expected s3://bucket/prefix)", rawURL)
+	}
+	s := &s3Storage{
+		client: &http.Client{},
+		bucket: u.Host,
+		region: firstEnv("AWS_REGION", "AWS_DEFAULT_REGION"),
+		keyID:  os.Getenv("AWS_ACCESS_KEY_ID"),
+		secret: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		token:  os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if prefix := strings.Trim(u.Path, "/"); prefix != "" {
+		s.prefix = prefix + "/"
+	}
+	if s.region == "" {
+		s.region = "us-east-1"
+	}
+	if s.keyID == "" || s.secret == "" {
+		return nil, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+	if endpoint := firstEnv("AWS_ENDPOINT_URL_S3", "AWS_ENDPOINT_URL"); endpoint != "" {
+		if s.endpoint, err = url.Parse(strings.TrimRight(endpoint, "/")); err != nil || s.endpoint.Host == "" {
+			return nil, fmt.Errorf("invalid AWS_ENDPOINT_URL %q", endpoint)
+		}
+		s.endpoint.Path += "/" + s.bucket
+	} else {
+		s.endpoint = &url.URL{Scheme: "https", Host: s.bucket + ".s3." + s.region + ".amazonaws.com"}
+	}
+	// The bucket must be there, and the credentials good for it
+	if _, err := s.list(s.prefix, "/", "", 1); err != nil {
+		return nil, fmt.Errorf("bucket %s: %v", s.bucket, err)
+	}
+	return s, nil
+}
+
+// firstEnv returns the first of the environment variables that is set
+func firstEnv(names ...string) string {
+	for _, name := range names {
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// String describes the bucket for the startup log
+func (s *s3Storage) String() string {
+	return "s3://" + s.bucket + "/" + s.prefix + " at " + s.endpoint.Host
+}
+
+// key returns the object key of a storage name; folders get a trailing
+// slash
+func (s *s3Storage) key(name string, dir bool) string {
+	if name == "." {
+		return s.prefix
+	}
+	if dir {
+		return s.prefix + name + "/"
+	}
+	return s.prefix + name
+}
+
+// s3Error is an error response of the store
+type s3Error struct {
+	Status  int
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("S3 request failed: %s", http.StatusText(e.Status))
+	}
+	return fmt.Sprintf("S3 request failed: %s: %s", e.Code, e.Message)
+}
+
+// Unwrap lets missing objects and refused requests match fs.ErrNotExist
+// and fs.ErrPermission
+func (e *s3Error) Unwrap() error {
+	switch e.Status {
+	case http.StatusNotFound:
+		return fs.ErrNotExist
+	case http.StatusForbidden:
+		return fs.ErrPermission
+	}
+	return nil
+}
+
+// do sends a signed request for an object key (with query) and returns
+// the response if its status is a success. body is the request body with
+// its SHA-256 and size.
+func (s *s3Storage) do(method, key string, query url.Values, header http.Header, body io.Reader, sum string, size int64) (*http.Response, error) {
+	u := *s.endpoint
+	if key != "" || u.Path == "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = s3Escape(u.Path, false)
+	u.RawQuery = s3Query(query)
+	if body != nil && size == 0 {
+		// Empty bodies go without chunked encoding, which S3 refuses
+		body = http.NoBody
+	}
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	if sum == "" {
+		sum = emptySHA256
+	}
+	s.sign(req, sum, time.Now())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		e := &s3Error{Status: resp.StatusCode}
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		xml.Unmarshal(data, e)
+		return nil, e
+	}
+	return resp, nil
+}
+
+// sign adds the AWS Signature Version 4 of a request
+func (s *s3Storage) sign(req *http.Request, sum string, now time.Time) {
+	now = now.UTC()
+	stamp := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", stamp)
+	req.Header.Set("X-Amz-Content-Sha256", sum)
+	if s.token != "" {
+		req.Header.Set("X-Amz-Security-Token", s.token)
+	}
+
+	// The host and the x-amz-* headers are signed
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		sum,
+	}, "\n")
+	scope := day + "/" + s.region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + s.secret)
+	for _, part := range []string{day, s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.keyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Escape percent-encodes everything but unreserved characters, and
+// slashes unless slash is set, as Signature Version 4 expects
+func s3Escape(s string, slash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !slash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3Query encodes a query string sorted by name, as it is signed
+func s3Query(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var pairs []string
+	for _, name := range names {
+		for _, value := range query[name] {
+			pairs = append(pairs, s3Escape(name, true)+"="+s3Escape(value, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// s3Listing is a page of ListObjectsV2
+type s3Listing struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		LastModified time.Time `xml:"LastModified"`
+		Size         int64     `xml:"Size"`
+	} `xml:"Contents"`
+	CommonPrefixes []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// list returns a page of the keys starting with prefix; with a delimiter,
+// keys below the next one are rolled up into common prefixes
+func (s *s3Storage) list(prefix, delimiter, continuation string, max int) (*s3Listing, error) {
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	if delimiter != "" {
+		query.Set("delimiter", delimiter)
+	}
+	if continuation != "" {
+		query.Set("continuation-token", continuation)
+	}
+	if max > 0 {
+		query.Set("max-keys", strconv.Itoa(max))
+	}
+	resp, err := s.do(http.MethodGet, "", query, nil, nil, "", 0)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	listing := &s3Listing{}
+	if err := xml.NewDecoder(resp.Body).Decode(listing); err != nil {
+		return nil, fmt.Errorf("reading S3 listing: %v", err)
+	}
+	return listing, nil
+}
+
+// head returns the size and modification time of an object
+func (s *s3Storage) head(key string) (int64, time.Time, error) {
+	resp, err := s.do(http.MethodHead, key, nil, nil, nil, "", 0)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	resp.Body.Close()
+	modified, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return resp.ContentLength, modified, nil
+}
+
+// s3FileInfo describes an object or a folder of the bucket
+type s3FileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (i s3FileInfo) Name() string       { return i.name }
+func (i s3FileInfo) Size() int64        { return i.size }
+func (i s3FileInfo) ModTime() time.Time { return i.modTime }
+func (i s3FileInfo) IsDir() bool        { return i.dir }
+func (i s3FileInfo) Sys() interface{}   { return nil }
+func (i s3FileInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
+
+func (s *s3Storage) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+	if name == "." {
+		return s3FileInfo{name: ".", dir: true}, nil
+	}
+	size, modified, err := s.head(s.key(name, false))
+	if err == nil {
+		return s3FileInfo{name: path.Base(name), size: size, modTime: modified}, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	// Folders exist as long as a key is below them
+	listing, err := s.list(s.key(name, true), "", "", 1)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	if len(listing.Contents) == 0 {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return s3FileInfo{name: path.Base(name), dir: true}, nil
+}
+
+// s3File is an object opened for reading. The object is requested on the
+// first read from the current offset, so seeking to a range costs
+// nothing.
+type s3File struct {
+	s      *s3Storage
+	key    string
+	info   s3FileInfo
+	offset int64
+	body   io.ReadCloser
+}
+
+func (f *s3File) Stat() (fs.FileInfo, error) { return f.info, nil }
+
+func (f *s3File) Read(b []byte) (int, error) {
+	if f.info.dir {
+		return 0, &fs.PathError{Op: "read", Path: f.info.name, Err: errors.New("is a directory")}
+	}
+	if f.offset >= f.info.size {
+		return 0, io.EOF
+	}
+	if f.body == nil {
+		header := http.Header{"Range": {fmt.Sprintf("bytes=%d-", f.offset)}}
+		resp, err := f.s.do(http.MethodGet, f.key, nil, header, nil, "", 0)
+		if err != nil {
+			return 0, err
+		}
+		f.body = resp.Body
+	}
+	n, err := f.body.Read(b)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *s3File) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.info.size
+	}
+	if offset < 0 {
+		return 0, errors.New("seek before the start of the file")
+	}
+	if offset != f.offset && f.body != nil {
+		f.body.Close()
+		f.body = nil
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *s3File) Close() error {
+	if f.body != nil {
+		return f.body.Close()
+	}
+	return nil
+}
+
+func (s *s3Storage) Open(name string) (fs.File, error) {
+	info, err := s.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return &s3File{s: s, key: s.key(name, false), info: info.(s3FileInfo)}, nil
+}
+
+// ReadDir lists a folder: the objects directly in it and the folders
+// below it, sorted by name
+func (s *s3Storage) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	dirKey := s.key(name, true)
+	var entries []fs.DirEntry
+	continuation := ""
+	for {
+		listing, err := s.list(dirKey, "/", continuation, 0)
+		if err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+		}
+		for _, object := range listing.Contents {
+			if object.Key == dirKey {
+				continue
+			}
+			entries = append(entries, fs.FileInfoToDirEntry(s3FileInfo{
+				name:    strings.TrimPrefix(object.Key, dirKey),
+				size:    object.Size,
+				modTime: object.LastModified,
+			}))
+		}
+		for _, prefix := range listing.CommonPrefixes {
+			entries = append(entries, fs.FileInfoToDirEntry(s3FileInfo{
+				name: strings.TrimSuffix(strings.TrimPrefix(prefix.Prefix, dirKey), "/"),
+				dir:  true,
+			}))
+		}
+		if !listing.IsTruncated || listing.NextContinuationToken == "" {
+			break
+		}
+		continuation = listing.NextContinuationToken
+	}
+	if len(entries) == 0 && name != "." {
+		info, err := s.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// WriteFile stores an object. Its size must be known before it is sent,
+// so r is spooled to a temporary file first.
+func (s *s3Storage) WriteFile(name string, r io.Reader) error {
+	if !fs.ValidPath(name) || name == "." {
+		return &fs.PathError{Op: "write", Path: name, Err: fs.ErrInvalid}
+	}
+	tmp, err := os.CreateTemp("", "files-s3-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), r)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	resp, err := s.do(http.MethodPut, s.key(name, false), nil, nil, tmp, hex.EncodeToString(hash.Sum(nil)), size)
+	if err != nil {
+		return &fs.PathError{Op: "write", Path: name, Err: err}
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// MkdirAll keeps a folder by storing its marker object; the folders above
+// it exist through it
+func (s *s3Storage) MkdirAll(name string, perm fs.FileMode) error {
+	if !fs.ValidPath(name) {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrInvalid}
+	}
+	if info, err := s.Stat(name); err == nil {
+		if !info.IsDir() {
+			return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrExist}
+		}
+		return nil
+	}
+	resp, err := s.do(http.MethodPut, s.key(name, true), nil, nil, strings.NewReader(""), emptySHA256, 0)
+	if err != nil {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: err}
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Rename copies an object, or every object of a folder, to the new name
+// and deletes the original; S3 can't rename in place
+func (s *s3Storage) Rename(oldname, newname string) error {
+	if !fs.ValidPath(oldname) || !fs.ValidPath(newname) || oldname == "." || newname == "." {
+		return &fs.PathError{Op: "rename", Path: oldname, Err: fs.ErrInvalid}
+	}
+	info, err := s.Stat(oldname)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return s.move(s.key(oldname, false), s.key(newname, false))
+	}
+	from, to := s.key(oldname, true), s.key(newname, true)
+	continuation := ""
+	for {
+		listing, err := s.list(from, "", continuation, 0)
+		if err != nil {
+			return &fs.PathError{Op: "rename", Path: oldname, Err: err}
+		}
+		for _, object := range listing.Contents {
+			if err := s.move(object.Key, to+strings.TrimPrefix(object.Key, from)); err != nil {
+				return err
+			}
+		}
+		if !listing.IsTruncated || listing.NextContinuationToken == "" {
+			return nil
+		}
+		continuation = listing.NextContinuationToken
+	}
+}
+
+// move copies an object within the bucket and deletes the original
+func (s *s3Storage) move(from, to string) error {
+	source := "/" + s.bucket + "/" + s3Escape(from, false)
+	resp, err := s.do(http.MethodPut, to, nil, http.Header{"X-Amz-Copy-Source": {source}}, nil, "", 0)
+	if err != nil {
+		return &fs.PathError{Op: "rename", Path: from, Err: err}
+	}
+	resp.Body.Close()
+	return s.delete(from)
+}
+
+// delete removes an object
+func (s *s3Storage) delete(key string) error {
+	resp, err := s.do(http.MethodDelete, key, nil, nil, nil, "", 0)
+	if err != nil {
+		return &fs.PathError{Op: "remove", Path: key, Err: err}
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Remove deletes an object, or an empty folder's marker
+func (s *s3Storage) Remove(name string) error {
+	if !fs.ValidPath(name) || name == "." {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrInvalid}
+	}
+	info, err := s.Stat(name)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return s.delete(s.key(name, false))
+	}
+	dirKey := s.key(name, true)
+	listing, err := s.list(dirKey, "", "", 2)
+	if err != nil {
+		return &fs.PathError{Op: "remove", Path: name, Err: err}
+	}
+	for _, object := range listing.Contents {
+		if object.Key != dirKey {
+			return &fs.PathError{Op: "remove", Path: name, Err: errors.New("directory not empty")}
+		}
+	}
+	return s.delete(dirKey)
+}
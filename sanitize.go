@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Upload name sanitization modes, from most permissive to strictest
+const (
+	sanitizeBasic    = "basic"
+	sanitizeStrict   = "strict"
+	sanitizeTranslit = "translit"
+	sanitizeSlug     = "slug"
+)
+
+var (
+	// sanitizeMode is the policy applied to uploaded file names
+	sanitizeMode = sanitizeBasic
+	// maxNameLength caps uploaded file names, in bytes
+	maxNameLength = 255
+)
+
+// portableUnsafeChars cannot appear in file names on at least one major platform
+const portableUnsafeChars = `<>:"/\|?*`
+
+// transliterations covers letters that do not decompose into ASCII plus marks
+var transliterations = map[rune]string{
+	'ß': "ss", 'æ': "ae", 'Æ': "AE", 'œ': "oe", 'Œ': "OE", 'ø': "o", 'Ø': "O",
+	'ł': "l", 'Ł': "L", 'đ': "d", 'Đ': "D", 'ð': "d", 'Ð': "D", 'þ': "th", 'Þ': "TH",
+	'ı': "i", '€': "EUR", '£': "GBP", '–': "-", '—': "-", '‘': "'", '’': "'", '“': "\"", '”': "\"",
+}
+
+// parseSanitizeMode validates a -sanitize value
+func parseSanitizeMode(mode string) (string, error) {
+	switch mode {
+	case sanitizeBasic, sanitizeStrict, sanitizeTranslit, sanitizeSlug:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown sanitize mode %q (expected basic, strict, translit or slug)", mode)
+}
+
+// isInvisibleFormatChar reports control characters and bidirectional
+// overrides, which can disguise a name ("txt.exe" shown as "exe.txt")
+func isInvisibleFormatChar(r rune) bool {
+	return unicode.IsControl(r) || (r >= 0x202A && r <= 0x202E) || (r >= 0x2066 && r <= 0x2069) || r == 0x200E || r == 0x200F
+}
+
+// sanitizeUploadName turns the file name sent by a client into the name
+// stored on disk according to sanitizeMode:
+//   - basic: keep only the last path component (either separator style),
+//     strip control and bidi override characters, and apply the platform's
+//     restrictions
+//   - strict: additionally replace characters that are invalid on any major
+//     platform and trim leading dots, dashes and spaces
+//   - translit: additionally transliterate to ASCII
+//   - slug: additionally lowercase and reduce to [a-z0-9._-]
+//
+// The result is truncated to maxNameLength bytes, keeping the extension.
+func sanitizeUploadName(name string) string {
+	// Browsers on Windows may send full paths such as C:\fakepath\file.txt
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+	name = strings.Map(func(r rune) rune {
+		if isInvisibleFormatChar(r) {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimSpace(name)
+
+	if sanitizeMode != sanitizeBasic {
+		name = strings.Map(func(r rune) rune {
+			if strings.ContainsRune(portableUnsafeChars, r) {
+				return '_'
+			}
+			return r
+		}, name)
+		name = strings.TrimLeft(name, ".- ")
+		name = strings.TrimRight(name, ". ")
+		if isWindowsReservedName(name) {
+			ext := filepath.Ext(name)
+			name = strings.TrimSuffix(name, ext) + "_" + ext
+		}
+	}
+
+	if sanitizeMode == sanitizeTranslit || sanitizeMode == sanitizeSlug {
+		name = transliterate(name)
+	}
+
+	if sanitizeMode == sanitizeSlug {
+		name = slugify(name)
+	}
+
+	if name == "" || name == "." || name == ".." {
+		name = "file"
+	}
+	return platformSafeName(truncateName(name, maxNameLength))
+}
+
+// transliterate maps a name to ASCII: accents are dropped ("é" → "e"),
+// a few letters are spelled out ("ß" → "ss") and the rest become "_"
+func transliterate(name string) string {
+	stripMarks := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+	if stripped, _, err := transform.String(stripMarks, name); err == nil {
+		name = stripped
+	}
+
+	var b strings.Builder
+	for _, r := range name {
+		switch {
+		case r < utf8.RuneSelf:
+			b.WriteRune(r)
+		case transliterations[r] != "":
+			b.WriteString(transliterations[r])
+		default:
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
+
+// slugify lowercases a name and reduces it to [a-z0-9._-], turning spaces
+// and other characters into single dashes
+func slugify(name string) string {
+	ext := strings.ToLower(filepath.Ext(name))
+	stem := strings.ToLower(strings.TrimSuffix(name, filepath.Ext(name)))
+
+	var b strings.Builder
+	dash := false
+	for _, r := range stem {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '.' || r == '_' {
+			b.WriteRune(r)
+			dash = false
+		} else if !dash && b.Len() > 0 {
+			b.WriteByte('-')
+			dash = true
+		}
+	}
+	stem = strings.Trim(b.String(), "-._")
+	if stem == "" {
+		stem = "file"
+	}
+
+	ext = strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '.' {
+			return r
+		}
+		return -1
+	}, ext)
+	if ext == "." {
+		ext = ""
+	}
+	return stem + ext
+}
+
+// truncateName shortens name to at most limit bytes at a character
+// boundary, preserving the extension when it fits
+func truncateName(name string, limit int) string {
+	if limit <= 0 || len(name) <= limit {
+		return name
+	}
+
+	stem, ext := strings.TrimSuffix(name, filepath.Ext(name)), filepath.Ext(name)
+	if len(ext) >= limit/2 {
+		stem, ext = name, ""
+	}
+	cut := limit - len(ext)
+	for cut > 0 && !utf8.RuneStart(stem[cut]) {
+		cut--
+	}
+	return stem[:cut] + ext
+}
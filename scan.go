@@ -0,0 +1,178 @@
+package main
+
+import (
+	"io/fs"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// treeScanInterval is how long the result of a background walk over
+// workingDir is reused before the next request triggers a new walk
+var treeScanInterval = 10 * time.Minute
+
+// DirUsage is the cumulative size of a top-level entry of workingDir
+type DirUsage struct {
+	Name  string `json:"name"`
+	Size  int64  `json:"size"`
+	Files int64  `json:"files"`
+	IsDir bool   `json:"isDir"`
+}
+
+// TypeUsage is the number and cumulative size of files of one category or extension
+type TypeUsage struct {
+	Name  string `json:"name"`
+	Files int64  `json:"files"`
+	Size  int64  `json:"size"`
+}
+
+// TreeScan is the result of a background walk over workingDir
+type TreeScan struct {
+	Completed  time.Time     `json:"completed"`
+	Duration   time.Duration `json:"duration"`
+	TotalSize  int64         `json:"totalSize"`
+	TotalFiles int64         `json:"totalFiles"`
+	// HardLinks counts further links to files already counted, which
+	// don't add to the sizes, and HardLinkSize is what they would add
+	HardLinks    int64       `json:"hardLinks"`
+	HardLinkSize int64       `json:"hardLinkSize"`
+	TopLevel     []DirUsage  `json:"topLevel"`
+	Categories   []TypeUsage `json:"categories"`
+	Extensions   []TypeUsage `json:"extensions"`
+}
+
+// treeScanner runs walks over workingDir in the background and caches the
+// latest result, so expensive du-style reports never block a request
+type treeScanner struct {
+	mu       sync.Mutex
+	result   *TreeScan
+	scanning bool
+}
+
+var scanner = &treeScanner{}
+
+// get returns the latest completed scan (nil before the first one finishes)
+// and whether a scan is running, starting one when the result is stale
+func (s *treeScanner) get() (*TreeScan, bool) {
+	s.mu.Lock()
+	stale := s.result == nil || time.Since(s.result.Completed) > treeScanInterval
+	s.mu.Unlock()
+	if stale {
+		s.refresh()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.result, s.scanning
+}
+
+// refresh starts a background scan unless one is already running
+func (s *treeScanner) refresh() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.scanning {
+		return
+	}
+	s.scanning = true
+	go s.run()
+}
+
+// run walks workingDir and publishes the result
+func (s *treeScanner) run() {
+	start := time.Now()
+	result := &TreeScan{}
+	topLevel := make(map[string]*DirUsage)
+	categories := make(map[string]*TypeUsage)
+	extensions := make(map[string]*TypeUsage)
+	links := hardLinks{}
+
+	walkServed(workingDir, "", func(_, rel string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Skip unreadable directories instead of aborting the scan
+			if d != nil && d.IsDir() && rel != "." {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if rel == "." {
+			return nil
+		}
+		top, _, _ := strings.Cut(rel, "/")
+		usage, ok := topLevel[top]
+		if !ok {
+			usage = &DirUsage{Name: top, IsDir: d.IsDir()}
+			topLevel[top] = usage
+		}
+
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		if links.seen(info) {
+			result.HardLinks++
+			result.HardLinkSize += info.Size()
+			return nil
+		}
+		usage.Size += info.Size()
+		usage.Files++
+		result.TotalSize += info.Size()
+		result.TotalFiles++
+
+		ext := strings.ToLower(filepath.Ext(d.Name()))
+		if ext == "" {
+			ext = "(none)"
+		}
+		addTypeUsage(categories, fileCategory(d.Name()), info.Size())
+		addTypeUsage(extensions, ext, info.Size())
+		return nil
+	})
+
+	for _, usage := range topLevel {
+		result.TopLevel = append(result.TopLevel, *usage)
+	}
+	sort.Slice(result.TopLevel, func(i, j int) bool {
+		return result.TopLevel[i].Size > result.TopLevel[j].Size
+	})
+	result.Categories = sortedTypeUsage(categories)
+	result.Extensions = sortedTypeUsage(extensions)
+	result.Completed = time.Now()
+	result.Duration = result.Completed.Sub(start)
+	log.Printf("Scanned %s: %d files, %s in %v", workingDir, result.TotalFiles, formatSize(result.TotalSize), result.Duration.Round(time.Millisecond))
+
+	s.mu.Lock()
+	s.result = result
+	s.scanning = false
+	s.mu.Unlock()
+}
+
+// addTypeUsage counts a file of the given size toward name
+func addTypeUsage(usages map[string]*TypeUsage, name string, size int64) {
+	usage, ok := usages[name]
+	if !ok {
+		usage = &TypeUsage{Name: name}
+		usages[name] = usage
+	}
+	usage.Files++
+	usage.Size += size
+}
+
+// sortedTypeUsage returns the usages ordered by size, largest first
+func sortedTypeUsage(usages map[string]*TypeUsage) []TypeUsage {
+	sorted := make([]TypeUsage, 0, len(usages))
+	for _, usage := range usages {
+		sorted = append(sorted, *usage)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Size != sorted[j].Size {
+			return sorted[i].Size > sorted[j].Size
+		}
+		return sorted[i].Name < sorted[j].Name
+	})
+	return sorted
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// scratchCookie remembers the workspace of a browser
+	scratchCookie = "files_scratch"
+	// scratchSweepInterval is how often expired workspaces are removed
+	scratchSweepInterval = 5 * time.Minute
+)
+
+// scratchSpace keeps temporary workspaces (-scratch) for passing files
+// between devices outside the served tree. Each is a directory below root
+// named by an unguessable ID, reachable at /tmp/<id> by whoever has the
+// link or its short code. A workspace is removed once it has been unused
+// for lifetime; its directory's modification time records the last use,
+// and its code is kept in it, so nothing else needs to be kept across
+// restarts.
+type scratchSpace struct {
+	root     string
+	lifetime time.Duration
+	maxSize  int64
+
+	// mu serializes uploads, which check the size of a workspace first
+	mu sync.Mutex
+
+	codesMu sync.Mutex
+	// codes maps short codes to workspace IDs
+	codes map[string]string
+	// failures counts the wrong codes entered by each client network
+	failures map[string]*pickupFailures
+	// allFailures counts the wrong codes entered by everyone
+	allFailures pickupFailures
+}
+
+// scratch is nil unless -scratch is set
+var scratch *scratchSpace
+
+// ScratchFile is a file in a workspace
+type ScratchFile struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+}
+
+// ScratchPage is the data of scratch.html: a workspace, or without an ID
+// the page to start or pick one up
+type ScratchPage struct {
+	Page
+	ID   string
+	Code string
+	// Error tells why a code was not accepted
+	Error string
+	// URL opens the workspace on another device
+	URL     string
+	Files   []ScratchFile
+	Size    int64
+	MaxSize int64
+	Expires time.Time
+}
+
+// startScratchSpace creates root if needed and removes expired workspaces
+// from now on
+func startScratchSpace(root string, lifetime time.Duration, maxSize int64) (*scratchSpace, error) {
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, err
+	}
+	s := &scratchSpace{root: root, lifetime: lifetime, maxSize: maxSize, codes: make(map[string]string), failures: make(map[string]*pickupFailures)}
+	s.loadCodes()
+	ticker := time.NewTicker(scratchSweepInterval)
+	go func() {
+		for ; ; <-ticker.C {
+			s.sweep()
+		}
+	}()
+	return s, nil
+}
+
+// validScratchID reports whether id looks like one newShareID made
+func validScratchID(id string) bool {
+	if len(id) != 16 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// dir returns the directory of an existing, unexpired workspace
+func (s *scratchSpace) dir(id string) (string, bool) {
+	if !validScratchID(id) {
+		return "", false
+	}
+	dir := filepath.Join(s.root, id)
+	info, err := os.Stat(dir)
+	if err != nil || !info.IsDir() || time.Since(info.ModTime()) > s.lifetime {
+		return "", false
+	}
+	return dir, true
+}
+
+// touch marks a workspace as used now, which postpones its expiry
+func (s *scratchSpace) touch(dir string) {
+	now := time.Now()
+	os.Chtimes(dir, now, now)
+}
+
+// files lists a workspace, newest first, with the bytes it takes up
+func (s *scratchSpace) files(dir string) ([]ScratchFile, int64) {
+	entries, _ := os.ReadDir(dir)
+	files := make([]ScratchFile, 0, len(entries))
+	var size int64
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		files = append(files, ScratchFile{Name: entry.Name(), Size: info.Size(), ModTime: info.ModTime()})
+		size += info.Size()
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime.After(files[j].ModTime) })
+	return files, size
+}
+
+// sweep removes the workspaces unused for longer than their lifetime
+func (s *scratchSpace) sweep() {
+	entries, err := os.ReadDir(s.root)
+	if err != nil {
+		log.Printf("Scratch space error: %v", err)
+		return
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !info.IsDir() || time.Since(info.ModTime()) <= s.lifetime {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(s.root, entry.Name())); err != nil {
+			log.Printf("Failed to remove expired workspace %s: %v", entry.Name(), err)
+			continue
+		}
+		s.forget(entry.Name())
+		auditLogf("scratch-expired id=%s", entry.Name())
+	}
+	s.pruneFailures()
+}
+
+// scratchHandler sends a browser to its workspace (GET /tmp), or to the
+// one whose short code it entered (GET /tmp?code=). A browser without one
+// is shown the page to start a workspace or pick one up.
+func scratchHandler(w http.ResponseWriter, r *http.Request) {
+	data := &ScratchPage{}
+	if code := r.URL.Query().Get("code"); code != "" {
+		id, ok, blocked := scratch.pickUp(clientHost(r), code)
+		switch {
+		case ok:
+			auditLogf("scratch-picked-up client=%s id=%s", clientHost(r), id)
+			setCookie(w, r, scratchCookie, id, int(scratch.lifetime/time.Second))
+			http.Redirect(w, r, "/tmp/"+id, http.StatusSeeOther)
+			return
+		case blocked:
+			auditLogf("scratch-code-blocked client=%s", clientHost(r))
+			w.Header().Set("Retry-After", strconv.Itoa(int(pickupWindow/time.Second)))
+			http.Error(w, "Too many wrong codes, try again later", http.StatusTooManyRequests)
+			return
+		}
+		data.Error = "No workspace has this code; it may have expired"
+	} else if cookie, err := r.Cookie(scratchCookie); err == nil {
+		if _, ok := scratch.dir(cookie.Value); ok {
+			http.Redirect(w, r, "/tmp/"+cookie.Value, http.StatusSeeOther)
+			return
+		}
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	if err := renderTemplate(w, r, "scratch.html", data); err != nil {
+		log.Printf("Template error: %v", err)
+	}
+}
+
+// scratchCreateHandler starts a workspace (POST /tmp). With accounts, only
+// signed-in users may start them.
+func scratchCreateHandler(w http.ResponseWriter, r *http.Request) {
+	user := authenticatedUser(r)
+	if authEnabled() && user == "" {
+		http.Redirect(w, r, "/login?next="+url.QueryEscape("/tmp"), http.StatusSeeOther)
+		return
+	}
+	id := newShareID()
+	if err := os.Mkdir(filepath.Join(scratch.root, id), 0700); err != nil {
+		log.Printf("Failed to create workspace: %v", err)
+		http.Error(w, "Error creating workspace", http.StatusInternalServerError)
+		return
+	}
+	if _, err := scratch.newCode(id); err != nil {
+		log.Printf("Failed to create workspace: %v", err)
+		os.RemoveAll(filepath.Join(scratch.root, id))
+		http.Error(w, "Error creating workspace", http.StatusInternalServerError)
+		return
+	}
+	auditLogf("scratch-created client=%s user=%q id=%s", clientHost(r), user, id)
+	setCookie(w, r, scratchCookie, id, int(scratch.lifetime/time.Second))
+	http.Redirect(w, r, "/tmp/"+id, http.StatusSeeOther)
+}
+
+// scratchPageHandler shows a workspace (GET /tmp/<id>), or lists its files
+// as JSON for clients accepting that, and stores the files uploaded to it
+// (POST /tmp/<id>, multipart field "file")
+func scratchPageHandler(w http.ResponseWriter, r *http.Request) {
+	id := pathParam(r, "id")
+	dir, ok := scratch.dir(id)
+	if !ok {
+		http.Error(w, "Workspace not found or expired", http.StatusNotFound)
+		return
+	}
+	if r.Method == http.MethodPost {
+		if err := scratch.receive(r, dir); err != nil {
+			http.Error(w, err.message, err.status)
+			return
+		}
+		scratch.touch(dir)
+		http.Redirect(w, r, "/tmp/"+id, http.StatusSeeOther)
+		return
+	}
+
+	scratch.touch(dir)
+	// Opening the link on another device makes it that browser's
+	// workspace too
+	setCookie(w, r, scratchCookie, id, int(scratch.lifetime/time.Second))
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	files, size := scratch.files(dir)
+	w.Header().Set("Cache-Control", "no-store")
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"files": files, "size": size})
+		return
+	}
+	data := &ScratchPage{
+		ID:      id,
+		Code:    scratch.code(id),
+		URL:     scheme + "://" + r.Host + urlPrefix + "/tmp/" + id,
+		Files:   files,
+		Size:    size,
+		MaxSize: scratch.maxSize,
+		Expires: time.Now().Add(scratch.lifetime),
+	}
+	if err := renderTemplate(w, r, "scratch.html", data); err != nil {
+		log.Printf("Template error: %v", err)
+	}
+}
+
+// receive stores the files of a multipart upload in a workspace, refusing
+// those that would make it larger than maxSize
+func (s *scratchSpace) receive(r *http.Request, dir string) *uploadError {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return &uploadError{http.StatusBadRequest, "Error parsing form: " + err.Error()}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, size := s.files(dir)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return &uploadError{http.StatusBadRequest, "Error parsing form: " + err.Error()}
+		}
+		if part.FileName() == "" {
+			continue
+		}
+		name := sanitizeUploadName(part.FileName())
+		f, err := os.CreateTemp(dir, ".upload-*")
+		if err != nil {
+			return &uploadError{http.StatusInternalServerError, "Error creating file"}
+		}
+		written, err := io.Copy(f, io.LimitReader(part, s.maxSize-size+1))
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil && size+written > s.maxSize {
+			os.Remove(f.Name())
+			return &uploadError{http.StatusRequestEntityTooLarge, "The workspace is limited to " + formatSize(s.maxSize)}
+		}
+		if err == nil {
+			err = os.Rename(f.Name(), availablePath(filepath.Join(dir, name)))
+		}
+		if err != nil {
+			os.Remove(f.Name())
+			return &uploadError{http.StatusInternalServerError, "Error saving file: " + err.Error()}
+		}
+		size += written
+	}
+}
+
+// scratchFileHandler downloads a file of a workspace (GET /tmp/<id>/<name>)
+func scratchFileHandler(w http.ResponseWriter, r *http.Request) {
+	dir, ok := scratch.dir(pathParam(r, "id"))
+	name := pathParam(r, "name")
+	if !ok || name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	f, err := os.Open(filepath.Join(dir, name))
+	if err != nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	scratch.touch(dir)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, name))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, name, info.ModTime(), f)
+}
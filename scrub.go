@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+)
+
+// scrubWebhookTimeout bounds a webhook notification about a scrub
+const scrubWebhookTimeout = 30 * time.Second
+
+// ScrubStatus describes the last scrub of the checksum log, or the one in
+// progress. It is kept in dataDir/scrub.json and reported as "scrub" by
+// /api/admin/stats.
+type ScrubStatus struct {
+	Running  bool      `json:"running"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	// Checked and Bytes count the files and bytes re-read so far
+	Checked  int            `json:"checked"`
+	Bytes    int64          `json:"bytes"`
+	Problems []ScrubProblem `json:"problems"`
+}
+
+// ScrubProblem is a file that no longer matches its checksum
+type ScrubProblem struct {
+	Path string `json:"path"`
+	// Status is MISSING, SIZE, CHANGED or ERROR, as "files verify" reports it
+	Status   string    `json:"status"`
+	Recorded time.Time `json:"recorded"`
+}
+
+// checksumScrubber re-hashes the files of the checksum log every interval
+// (-scrub) to catch silent corruption, and reports what it finds in the
+// audit log, /api/admin/stats and an optional webhook
+type checksumScrubber struct {
+	interval time.Duration
+	webhook  string
+	trigger  chan struct{}
+
+	mu     sync.Mutex
+	status ScrubStatus
+}
+
+// scrubber is nil unless -scrub is set
+var scrubber *checksumScrubber
+
+// startScrubber loads the state of earlier scrubs and runs them from now on.
+// The first scrub starts right away unless one finished within interval.
+func startScrubber(interval time.Duration, webhook string) (*checksumScrubber, error) {
+	s := &checksumScrubber{interval: interval, webhook: webhook, trigger: make(chan struct{}, 1)}
+	if err := loadState("scrub", &s.status); err != nil {
+		return nil, err
+	}
+	s.status.Running = false
+	go s.loop()
+	return s, nil
+}
+
+// loop runs a scrub whenever one is due or asked for
+func (s *checksumScrubber) loop() {
+	for {
+		s.mu.Lock()
+		wait := time.Until(s.status.Finished.Add(s.interval))
+		s.mu.Unlock()
+		timer := time.NewTimer(max(wait, 0))
+		select {
+		case <-timer.C:
+		case <-s.trigger:
+			timer.Stop()
+		}
+		s.run()
+	}
+}
+
+// start asks for a scrub now; it reports false if one is running already
+func (s *checksumScrubber) start() bool {
+	s.mu.Lock()
+	running := s.status.Running
+	s.mu.Unlock()
+	if running {
+		return false
+	}
+	select {
+	case s.trigger <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// current returns a copy of the scrub status
+func (s *checksumScrubber) current() ScrubStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := s.status
+	status.Problems = append([]ScrubProblem{}, s.status.Problems...)
+	return status
+}
+
+// run re-hashes every file with a recorded checksum
+func (s *checksumScrubber) run() {
+	records := checksums.all()
+	s.mu.Lock()
+	s.status = ScrubStatus{Running: true, Started: time.Now()}
+	s.mu.Unlock()
+	log.Printf("Scrubbing %d files against their checksums", len(records))
+
+	for _, record := range records {
+		status := verifyFile(localPath(path.Clean("/"+record.Path)), record)
+		// A file uploaded again while it was read has a new checksum
+		if status != "OK" && !checksums.unchanged(record) {
+			continue
+		}
+		s.mu.Lock()
+		s.status.Checked++
+		if status == "OK" {
+			s.status.Bytes += record.Size
+		} else {
+			s.status.Problems = append(s.status.Problems, ScrubProblem{Path: record.Path, Status: status, Recorded: record.Time})
+		}
+		s.mu.Unlock()
+		if status != "OK" {
+			auditLogf("scrub-mismatch path=%q status=%s", record.Path, status)
+		}
+	}
+
+	s.mu.Lock()
+	s.status.Running = false
+	s.status.Finished = time.Now()
+	status := s.status
+	s.mu.Unlock()
+	log.Printf("Scrub finished: %d files checked, %d problems", status.Checked, len(status.Problems))
+	if err := saveState("scrub", status); err != nil {
+		log.Printf("Failed to save scrub state: %v", err)
+	}
+	if len(status.Problems) > 0 && s.webhook != "" {
+		if err := notifyScrub(s.webhook, status); err != nil {
+			log.Printf("Scrub webhook failed: %v", err)
+		}
+	}
+}
+
+// scrubNotification is posted to the -scrub-webhook URL as JSON when a
+// scrub finds problems
+type scrubNotification struct {
+	Event  string      `json:"event"`
+	Host   string      `json:"host"`
+	Text   string      `json:"text"`
+	Report ScrubStatus `json:"report"`
+}
+
+// notifyScrub posts the report of a scrub to a webhook. Text summarizes it
+// for chat services that show just that field.
+func notifyScrub(webhook string, status ScrubStatus) error {
+	host, _ := os.Hostname()
+	body, err := json.Marshal(scrubNotification{
+		Event:  "scrub-mismatch",
+		Host:   host,
+		Text:   fmt.Sprintf("files on %s: %d of %d files no longer match their checksums", host, len(status.Problems), status.Checked),
+		Report: status,
+	})
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: scrubWebhookTimeout}
+	resp, err := client.Post(webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s answered %s", webhook, resp.Status)
+	}
+	return nil
+}
+
+// adminScrubHandler starts a scrub now (POST /api/admin/scrub)
+func adminScrubHandler(w http.ResponseWriter, r *http.Request) {
+	if !scrubber.start() {
+		http.Error(w, "A scrub is running already", http.StatusConflict)
+		return
+	}
+	auditLogf("scrub-started client=%s", clientHost(r))
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// all returns the current records, sorted by path
+func (c *checksumStore) all() []ChecksumRecord {
+	c.mu.Lock()
+	records := make([]ChecksumRecord, 0, len(c.records))
+	for _, record := range c.records {
+		records = append(records, record)
+	}
+	c.mu.Unlock()
+	sort.Slice(records, func(i, j int) bool { return records[i].Path < records[j].Path })
+	return records
+}
+
+// unchanged reports whether a record is still the current one of its path
+func (c *checksumStore) unchanged(record ChecksumRecord) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	current, ok := c.records[record.Path]
+	return ok && current.SHA256 == record.SHA256 && current.Time.Equal(record.Time)
+}
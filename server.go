@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// shutdownTimeout bounds how long a stopping server waits for requests in
+// progress before closing their connections
+var shutdownTimeout = 30 * time.Second
+
+// listenNetwork is "tcp4" or "tcp6" to listen on one IP version only (-4,
+// -6); "tcp" listens on both where an address allows it
+var listenNetwork = "tcp"
+
+// listenAddress joins -host and -port, accepting bracketed IPv6 addresses
+func listenAddress(host, port string) string {
+	return net.JoinHostPort(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"), strings.TrimPrefix(port, ":"))
+}
+
+// reachableURLs returns the URLs an address is reached at: for addresses
+// of all interfaces, one for each address of this host that clients can
+// use, rather than the unhelpful 0.0.0.0
+func reachableURLs(scheme, address string) []string {
+	host, port, _ := net.SplitHostPort(address)
+	if ip := net.ParseIP(host); host != "" && (ip == nil || !ip.IsUnspecified()) {
+		return []string{scheme + "://" + address}
+	}
+	var urls []string
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			// Link-local addresses need a zone, which browsers don't take
+			if !ok || ipNet.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			v4 := ipNet.IP.To4() != nil
+			if listenNetwork == "tcp4" && !v4 || listenNetwork == "tcp6" && v4 {
+				continue
+			}
+			urls = append(urls, scheme+"://"+net.JoinHostPort(ipNet.IP.String(), port))
+		}
+	}
+	if len(urls) == 0 {
+		urls = append(urls, scheme+"://"+address)
+	}
+	return urls
+}
+
+// addressList is a flag that may be repeated, each time with one or more
+// comma-separated addresses
+type addressList []string
+
+func (l *addressList) String() string { return strings.Join(*l, ",") }
+
+func (l *addressList) Set(value string) error {
+	for _, address := range parseList(value) {
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return err
+		}
+		*l = append(*l, address)
+	}
+	return nil
+}
+
+// listen opens count listening sockets on each address. With reusePort,
+// each socket has SO_REUSEPORT set, so each gets its own accept loop and
+// other processes can listen on the same address at the same time.
+func listen(addresses []string, count int, reusePort bool) ([]net.Listener, error) {
+	// A process started by upgrade takes over its predecessor's sockets
+	inherited, err := inheritedListeners()
+	if err != nil || inherited != nil {
+		if inherited != nil {
+			log.Printf("Took over %d listening sockets from the previous process", len(inherited))
+		}
+		return inherited, err
+	}
+
+	var listeners []net.Listener
+	for _, address := range addresses {
+		opened, err := listenOn(address, count, reusePort)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, opened...)
+	}
+	return listeners, nil
+}
+
+// listenOn opens the listening sockets of one address
+func listenOn(address string, count int, reusePort bool) ([]net.Listener, error) {
+	if !reusePort {
+		l, err := net.Listen(listenNetwork, address)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{l}, nil
+	}
+
+	config := net.ListenConfig{Control: setReusePort}
+	listeners := make([]net.Listener, 0, count)
+	for i := 0; i < count; i++ {
+		l, err := config.Listen(context.Background(), listenNetwork, address)
+		if err != nil {
+			for _, opened := range listeners {
+				opened.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// serve runs server on the listeners until it is stopped with SIGINT or
+// SIGTERM, or replaced by a new process after SIGUSR2. Stopping closes the
+// listeners at once, which lets a replacement process take over new
+// connections, then waits up to shutdownTimeout for requests in progress
+// and saves the persistent state.
+func serve(server *http.Server, listeners []net.Listener) error {
+	errs := make(chan error, len(listeners))
+	// Serve sets up HTTP/2 by filling in TLSConfig, so whether to serve TLS
+	// has to be decided before the first listener starts
+	useTLS := server.TLSConfig != nil
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			// Upgrades hand over the listeners themselves, not the limit
+			if connSlots != nil {
+				l = limitListener(l, connSlots)
+			}
+			if useTLS {
+				errs <- server.ServeTLS(l, "", "")
+				return
+			}
+			errs <- server.Serve(l)
+		}(l)
+	}
+	notifyReady()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	upgrades := upgradeSignal()
+	upgraded := false
+
+wait:
+	for {
+		select {
+		case err := <-errs:
+			return err
+		case sig := <-signals:
+			log.Printf("Received %v, shutting down (waiting up to %v for requests in progress)", sig, shutdownTimeout)
+			break wait
+		case <-upgrades:
+			log.Printf("Received upgrade signal, starting a new process")
+			// Save first, so the new process starts from the latest state
+			if dataDir != "" {
+				savePersistentState()
+			}
+			if err := upgrade(listeners); err != nil {
+				log.Printf("Upgrade failed, continuing to serve: %v", err)
+				continue
+			}
+			log.Printf("Handing over, waiting up to %v for requests in progress", shutdownTimeout)
+			upgraded = true
+			break wait
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	err := server.Shutdown(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		log.Printf("Closing connections still busy after %v", shutdownTimeout)
+		err = server.Close()
+	}
+	// After an upgrade the new process owns the saved state
+	if dataDir != "" && !upgraded {
+		savePersistentState()
+	}
+	log.Printf("Server stopped")
+	return err
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sessionCookie holds the signed session of a logged-in user
+const sessionCookie = "files_session"
+
+// sessionOIDC marks sessions started by the OpenID Connect provider;
+// sessions of the login form are marked with a fingerprint of the password
+const sessionOIDC = "oidc"
+
+var (
+	// sessionKey signs session and login state cookies
+	sessionKey = make([]byte, 32)
+	// sessionLifetime is how long a login lasts (-session-lifetime)
+	sessionLifetime = 12 * time.Hour
+	// secureCookies marks cookies Secure even on plain HTTP requests
+	// (-secure-cookies), for servers behind a proxy that terminates TLS
+	secureCookies bool
+)
+
+// LoginPage is the data of the login form
+type LoginPage struct {
+	Page
+	Next  string
+	Name  string
+	Error string
+	// SSO offers logging in with the OpenID Connect provider as well
+	SSO bool
+	// Pending is the signed state of a login waiting for its TOTP code
+	Pending string
+}
+
+// sessionsEnabled reports whether users log in with sessions: through the
+// login form or an OpenID Connect provider
+func sessionsEnabled() bool {
+	return passwordLogin() || oidc != nil
+}
+
+// passwordLogin reports whether users log in with a name and password of
+// the users file or the user database
+func passwordLogin() bool {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	return users != nil || accounts != nil
+}
+
+// loadSessionKey keeps the session signing key in dataDir, so logins
+// survive restarts; without -data-dir a new key is made on every start
+func loadSessionKey() error {
+	if dataDir == "" {
+		_, err := rand.Read(sessionKey)
+		return err
+	}
+	file := filepath.Join(dataDir, "session.key")
+	if key, err := os.ReadFile(file); err == nil && len(key) == len(sessionKey) {
+		copy(sessionKey, key)
+		return nil
+	}
+	if _, err := rand.Read(sessionKey); err != nil {
+		return err
+	}
+	return os.WriteFile(file, sessionKey, 0600)
+}
+
+// signValue appends an HMAC to a cookie value
+func signValue(value string) string {
+	mac := hmac.New(sha256.New, sessionKey)
+	mac.Write([]byte(value))
+	return value + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifyValue returns the value of a signed cookie, and false if the
+// signature doesn't match
+func verifyValue(signed string) (string, bool) {
+	i := strings.LastIndexByte(signed, '.')
+	if i < 0 {
+		return "", false
+	}
+	value := signed[:i]
+	return value, hmac.Equal([]byte(signed), []byte(signValue(value)))
+}
+
+// revokedSessions holds the IDs of the sessions ended by logging out until
+// they would have expired anyway, so a copy of the cookie is no use either
+var revokedSessions = &sessionRevocations{revoked: make(map[string]int64)}
+
+// sessionRevocations maps the IDs of revoked sessions to their deadlines
+type sessionRevocations struct {
+	mu      sync.Mutex
+	revoked map[string]int64
+}
+
+// revoke ends a session for good and saves the list in dataDir at once
+func (s *sessionRevocations) revoke(id string, deadline int64) {
+	s.mu.Lock()
+	now := time.Now().Unix()
+	for other, expires := range s.revoked {
+		if now > expires {
+			delete(s.revoked, other)
+		}
+	}
+	s.revoked[id] = deadline
+	saved := make(map[string]int64, len(s.revoked))
+	for id, expires := range s.revoked {
+		saved[id] = expires
+	}
+	s.mu.Unlock()
+
+	if dataDir != "" {
+		if err := saveState("sessions", saved); err != nil {
+			log.Printf("Failed to save revoked sessions: %v", err)
+		}
+	}
+}
+
+// isRevoked reports whether a session was ended by logging out
+func (s *sessionRevocations) isRevoked(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.revoked[id]
+	return ok
+}
+
+// restore replaces the revoked sessions with those saved by a previous run
+func (s *sessionRevocations) restore(saved map[string]int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, expires := range saved {
+		s.revoked[id] = expires
+	}
+}
+
+// startSession logs a user in for sessionLifetime; kind is sessionOIDC or
+// the password fingerprint of a form login
+func startSession(w http.ResponseWriter, r *http.Request, user, kind string) {
+	session := strings.Join([]string{
+		base64.RawURLEncoding.EncodeToString([]byte(user)),
+		strconv.FormatInt(time.Now().Add(sessionLifetime).Unix(), 10),
+		kind,
+		randomToken(),
+	}, "|")
+	setCookie(w, r, sessionCookie, signValue(session), int(sessionLifetime.Seconds()))
+}
+
+// readSession returns the user and kind of a session cookie, or "" if it
+// is invalid, expired or revoked. A form login ends when the user's
+// password changes or the user is removed.
+func readSession(r *http.Request) (user, kind string) {
+	user, kind, _, _ = parseSession(r)
+	return user, kind
+}
+
+// parseSession returns the user, kind, ID and deadline of a valid session
+// cookie
+func parseSession(r *http.Request) (user, kind, id string, deadline int64) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return "", "", "", 0
+	}
+	value, ok := verifyValue(cookie.Value)
+	parts := strings.Split(value, "|")
+	if !ok || len(parts) != 4 {
+		return "", "", "", 0
+	}
+	deadline, err = strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() > deadline {
+		return "", "", "", 0
+	}
+	name, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", "", "", 0
+	}
+	kind, id = parts[2], parts[3]
+	if revokedSessions.isRevoked(id) {
+		return "", "", "", 0
+	}
+	if kind == sessionOIDC {
+		if oidc == nil {
+			return "", "", "", 0
+		}
+		return string(name), kind, id, deadline
+	}
+	stored, ok := storedPassword(string(name))
+	if !ok || !hmac.Equal([]byte(kind), []byte(passwordFingerprint(stored))) {
+		return "", "", "", 0
+	}
+	return string(name), kind, id, deadline
+}
+
+// sessionUser returns the user of a session cookie, or "" if there is no
+// valid one
+func sessionUser(r *http.Request) string {
+	user, _ := readSession(r)
+	return user
+}
+
+// passwordFingerprint identifies a stored password in a session without
+// revealing anything about it
+func passwordFingerprint(stored string) string {
+	mac := hmac.New(sha256.New, sessionKey)
+	mac.Write([]byte("password|" + stored))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// setCookie sets or, with a negative maxAge, clears a cookie of the login
+func setCookie(w http.ResponseWriter, r *http.Request, name, value string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     urlPrefix + "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   r.TLS != nil || secureCookies,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// renderLogin shows the login form
+func renderLogin(w http.ResponseWriter, r *http.Request, page LoginPage, status int) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := renderTemplate(w, r, "login.html", &page); err != nil {
+		log.Printf("Template error: %v", err)
+	}
+}
+
+// sameOrigin reports whether a form was posted from this server's own
+// pages, as far as the browser says
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+// passwordLoginHandler checks the name and password of the login form
+// (POST /login) and starts a session, or asks for the TOTP code of users
+// who enrolled in two-factor authentication
+func passwordLoginHandler(w http.ResponseWriter, r *http.Request) {
+	// Other sites may not log their visitors in to an account of theirs
+	if !sameOrigin(r) {
+		http.Error(w, "Cross-site login refused", http.StatusForbidden)
+		return
+	}
+	if r.PostFormValue("pending") != "" {
+		totpLoginHandler(w, r)
+		return
+	}
+
+	name, password := r.PostFormValue("name"), r.PostFormValue("password")
+	page := LoginPage{Next: localRedirect(r.PostFormValue("next")), Name: name, SSO: oidc != nil}
+	stored, ok := storedPassword(name)
+	if !ok || !checkPassword(stored, password) {
+		auditLogf("login-failed client=%s user=%q", clientHost(r), name)
+		page.Error = "Wrong name or password"
+		renderLogin(w, r, page, http.StatusUnauthorized)
+		return
+	}
+
+	if totp.isEnrolled(name) {
+		askTOTPCode(w, r, page, passwordFingerprint(stored), "", http.StatusOK)
+		return
+	}
+	startSession(w, r, name, passwordFingerprint(stored))
+	auditLogf("login client=%s user=%q", clientHost(r), name)
+	http.Redirect(w, r, page.Next, http.StatusSeeOther)
+}
+
+// logoutHandler ends the session (POST /logout) and, if the user logged in
+// with a provider that supports it, the login at the provider too. Only
+// the server's own pages may log users out.
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	if !sameOrigin(r) {
+		http.Error(w, "Cross-site logout refused", http.StatusForbidden)
+		return
+	}
+	user, kind, id, deadline := parseSession(r)
+	if user != "" {
+		revokedSessions.revoke(id, deadline)
+		auditLogf("logout client=%s user=%q", clientHost(r), user)
+	}
+	setCookie(w, r, sessionCookie, "", -1)
+	if kind != sessionOIDC || oidc.endSessionEndpoint == "" {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	query := url.Values{}
+	query.Set("client_id", oidc.clientID)
+	query.Set("post_logout_redirect_uri", scheme+"://"+r.Host+urlPrefix+"/")
+	http.Redirect(w, r, oidc.endSessionEndpoint+"?"+query.Encode(), http.StatusFound)
+}
@@ -0,0 +1,843 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SFTP version 3 packet types, as OpenSSH speaks them
+const (
+	sftpInit     = 1
+	sftpVersion  = 2
+	sftpOpen     = 3
+	sftpClose    = 4
+	sftpRead     = 5
+	sftpWrite    = 6
+	sftpLstat    = 7
+	sftpFstat    = 8
+	sftpSetstat  = 9
+	sftpFsetstat = 10
+	sftpOpendir  = 11
+	sftpReaddir  = 12
+	sftpRemove   = 13
+	sftpMkdir    = 14
+	sftpRmdir    = 15
+	sftpRealpath = 16
+	sftpStat     = 17
+	sftpRename   = 18
+	sftpExtended = 200
+
+	sftpStatus = 101
+	sftpHandle = 102
+	sftpData   = 103
+	sftpName   = 104
+	sftpAttrs  = 105
+)
+
+// sftpChunk is the most a read or write request moves; servers must take
+// at least this much
+const sftpChunk = 32768
+
+// sftpStorage is a directory of a remote server reached over SSH and
+// SFTP (-backend sftp://user@host/path). The connection is opened at
+// startup and opened again when it drops.
+type sftpStorage struct {
+	addr   string
+	root   string
+	config *ssh.ClientConfig
+
+	mu   sync.Mutex
+	conn *sftpConn
+}
+
+// openSFTPStorage connects to the server of an sftp://user@host:port/path
+// URL. The host key must be in ~/.ssh/known_hosts. The user logs in with
+// the keys of the SSH agent, unencrypted keys in ~/.ssh, or the password
+// in SFTP_PASSWORD. The path is absolute; one starting with /~/ is below
+// the user's home directory, which is also the default.
+func openSFTPStorage(rawURL string) (*sftpStorage, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "sftp" || u.Hostname() == "" || u.RawQuery != "" {
+		return nil, fmt.Errorf("invalid backend %q (expected sftp://user@host/path)", rawURL)
+	}
+	if _, ok := u.User.Password(); ok {
+		return nil, fmt.Errorf("put the password in SFTP_PASSWORD, not the URL")
+	}
+	name := u.User.Username()
+	if name == "" {
+		if current, err := user.Current(); err == nil {
+			name = current.Username
+		}
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+	hostKeys, err := knownhosts.New(filepath.Join(home, ".ssh", "known_hosts"))
+	if err != nil {
+		return nil, fmt.Errorf("reading known hosts: %v", err)
+	}
+	s := &sftpStorage{
+		addr: net.JoinHostPort(u.Hostname(), u.Port()),
+		root: u.Path,
+		config: &ssh.ClientConfig{
+			User:            name,
+			Auth:            sshAuthMethods(home),
+			HostKeyCallback: hostKeys,
+			Timeout:         30 * time.Second,
+		},
+	}
+	if u.Port() == "" {
+		s.addr = net.JoinHostPort(u.Hostname(), "22")
+	}
+	conn, err := s.session()
+	if err != nil {
+		return nil, err
+	}
+	// Paths below the home directory are made absolute, so a reconnect
+	// lands in the same place
+	switch {
+	case s.root == "" || s.root == "/~":
+		s.root, err = conn.realpath(".")
+	case strings.HasPrefix(s.root, "/~/"):
+		s.root, err = conn.realpath(s.root[3:])
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.root = path.Clean(s.root)
+	attrs, err := conn.stat(s.root)
+	if err != nil {
+		return nil, err
+	}
+	if !attrs.isDir() {
+		return nil, fmt.Errorf("%s is not a directory", s.root)
+	}
+	return s, nil
+}
+
+// sshAuthMethods returns the ways to log in that are at hand: the SSH
+// agent, the default private keys, and SFTP_PASSWORD
+func sshAuthMethods(home string) []ssh.AuthMethod {
+	var methods []ssh.AuthMethod
+	if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" {
+		if conn, err := net.Dial("unix", socket); err == nil {
+			methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		}
+	}
+	var signers []ssh.Signer
+	for _, file := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+		key, err := os.ReadFile(filepath.Join(home, ".ssh", file))
+		if err != nil {
+			continue
+		}
+		if signer, err := ssh.ParsePrivateKey(key); err == nil {
+			signers = append(signers, signer)
+		}
+	}
+	if len(signers) > 0 {
+		methods = append(methods, ssh.PublicKeys(signers...))
+	}
+	if password := os.Getenv("SFTP_PASSWORD"); password != "" {
+		methods = append(methods, ssh.Password(password))
+	}
+	return methods
+}
+
+// String describes the server for the startup log
+func (s *sftpStorage) String() string {
+	return "sftp://" + s.config.User + "@" + s.addr + s.root
+}
+
+// session returns the connection to the server, connecting again if the
+// last one was lost
+func (s *sftpStorage) session() (*sftpConn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != nil && s.conn.alive() {
+		return s.conn, nil
+	}
+	client, err := ssh.Dial("tcp", s.addr, s.config)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := startSFTP(client)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	s.conn = conn
+	return conn, nil
+}
+
+// remote returns the path of a storage name on the server
+func (s *sftpStorage) remote(op, name string) (*sftpConn, string, error) {
+	if !fs.ValidPath(name) {
+		return nil, "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	conn, err := s.session()
+	if err != nil {
+		return nil, "", &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	return conn, path.Join(s.root, name), nil
+}
+
+func (s *sftpStorage) Stat(name string) (fs.FileInfo, error) {
+	conn, p, err := s.remote("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	attrs, err := conn.stat(p)
+	if err != nil {
+		return nil, err
+	}
+	return sftpFileInfo{name: path.Base(name), attrs: attrs}, nil
+}
+
+func (s *sftpStorage) Open(name string) (fs.File, error) {
+	conn, p, err := s.remote("open", name)
+	if err != nil {
+		return nil, err
+	}
+	attrs, err := conn.stat(p)
+	if err != nil {
+		return nil, err
+	}
+	file := &sftpFile{conn: conn, info: sftpFileInfo{name: path.Base(name), attrs: attrs}}
+	if !attrs.isDir() {
+		if file.handle, err = conn.open(p, sftpOpenRead); err != nil {
+			return nil, err
+		}
+	}
+	return file, nil
+}
+
+// ReadDir lists a directory sorted by name. Symbolic links are listed as
+// what they point to, as on the local disk.
+func (s *sftpStorage) ReadDir(name string) ([]fs.DirEntry, error) {
+	conn, p, err := s.remote("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	infos, err := conn.readDir(p)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]fs.DirEntry, len(infos))
+	for i, info := range infos {
+		if info.attrs.mode&sftpTypeMask == sftpTypeLink {
+			if attrs, err := conn.stat(path.Join(p, info.name)); err == nil {
+				info.attrs = attrs
+			}
+		}
+		entries[i] = fs.FileInfoToDirEntry(info)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// WriteFile writes the file under a temporary name beside it and renames
+// it into place once complete
+func (s *sftpStorage) WriteFile(name string, r io.Reader) error {
+	conn, p, err := s.remote("write", name)
+	if err != nil {
+		return err
+	}
+	tmp := path.Join(path.Dir(p), "."+path.Base(p)+"."+randomToken()[:8]+".tmp")
+	handle, err := conn.open(tmp, sftpOpenWrite|sftpOpenCreate|sftpOpenExclusive)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, sftpChunk)
+	var offset int64
+	for err == nil {
+		var n int
+		n, err = io.ReadFull(r, buf)
+		if n > 0 {
+			if writeErr := conn.write(handle, offset, buf[:n]); writeErr != nil {
+				err = writeErr
+				break
+			}
+			offset += int64(n)
+		}
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	if closeErr := conn.close(handle); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = conn.replace(tmp, p)
+	}
+	if err != nil {
+		conn.remove(tmp)
+	}
+	return err
+}
+
+func (s *sftpStorage) MkdirAll(name string, perm fs.FileMode) error {
+	conn, p, err := s.remote("mkdir", name)
+	if err != nil {
+		return err
+	}
+	dir := s.root
+	for _, part := range strings.Split(strings.TrimPrefix(p, s.root), "/") {
+		if part == "" {
+			continue
+		}
+		dir = path.Join(dir, part)
+		attrs, err := conn.stat(dir)
+		if err == nil {
+			if !attrs.isDir() {
+				return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrExist}
+			}
+			continue
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		if err := conn.mkdir(dir, perm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sftpStorage) Rename(oldname, newname string) error {
+	conn, oldPath, err := s.remote("rename", oldname)
+	if err != nil {
+		return err
+	}
+	_, newPath, err := s.remote("rename", newname)
+	if err != nil {
+		return err
+	}
+	return conn.replace(oldPath, newPath)
+}
+
+func (s *sftpStorage) Remove(name string) error {
+	conn, p, err := s.remote("remove", name)
+	if err != nil {
+		return err
+	}
+	attrs, err := conn.stat(p)
+	if err != nil {
+		return err
+	}
+	if attrs.isDir() {
+		return conn.simple(sftpRmdir, "remove", p, sftpString(nil, p))
+	}
+	return conn.remove(p)
+}
+
+// sftpFile is a file opened for reading. Reads ask for the data at the
+// current offset, so seeking costs nothing.
+type sftpFile struct {
+	conn   *sftpConn
+	handle string
+	info   sftpFileInfo
+	offset int64
+}
+
+func (f *sftpFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+
+func (f *sftpFile) Read(b []byte) (int, error) {
+	if f.handle == "" {
+		return 0, &fs.PathError{Op: "read", Path: f.info.name, Err: errors.New("is a directory")}
+	}
+	data, err := f.conn.read(f.handle, f.offset, min(len(b), sftpChunk))
+	n := copy(b, data)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *sftpFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.info.Size()
+	}
+	if offset < 0 {
+		return 0, errors.New("seek before the start of the file")
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *sftpFile) Close() error {
+	if f.handle == "" {
+		return nil
+	}
+	return f.conn.close(f.handle)
+}
+
+// File attribute flags and mode bits of SFTP version 3
+const (
+	sftpAttrSize        = 0x1
+	sftpAttrUIDGID      = 0x2
+	sftpAttrPermissions = 0x4
+	sftpAttrTimes       = 0x8
+	sftpAttrExtended    = 0x80000000
+
+	sftpTypeMask = 0170000
+	sftpTypeDir  = 0040000
+	sftpTypeLink = 0120000
+)
+
+// sftpFileAttrs are the attributes the server sends for a file
+type sftpFileAttrs struct {
+	size  int64
+	mode  uint32
+	mtime time.Time
+}
+
+func (a sftpFileAttrs) isDir() bool {
+	return a.mode&sftpTypeMask == sftpTypeDir
+}
+
+// sftpFileInfo describes a file of the server
+type sftpFileInfo struct {
+	name  string
+	attrs sftpFileAttrs
+}
+
+func (i sftpFileInfo) Name() string       { return i.name }
+func (i sftpFileInfo) Size() int64        { return i.attrs.size }
+func (i sftpFileInfo) ModTime() time.Time { return i.attrs.mtime }
+func (i sftpFileInfo) IsDir() bool        { return i.attrs.isDir() }
+func (i sftpFileInfo) Sys() interface{}   { return nil }
+func (i sftpFileInfo) Mode() fs.FileMode {
+	mode := fs.FileMode(i.attrs.mode & 0777)
+	switch i.attrs.mode & sftpTypeMask {
+	case sftpTypeDir:
+		mode |= fs.ModeDir
+	case sftpTypeLink:
+		mode |= fs.ModeSymlink
+	}
+	return mode
+}
+
+// Open flags of SFTP version 3
+const (
+	sftpOpenRead      = 0x1
+	sftpOpenWrite     = 0x2
+	sftpOpenAppend    = 0x4
+	sftpOpenCreate    = 0x8
+	sftpOpenTruncate  = 0x10
+	sftpOpenExclusive = 0x20
+)
+
+// sftpConn is an SFTP session. Requests may be sent from several
+// goroutines at once; responses are matched to them by their ids.
+type sftpConn struct {
+	ssh   *ssh.Client
+	stdin io.WriteCloser
+	// posixRename is set if the server replaces files on rename with the
+	// posix-rename@openssh.com extension
+	posixRename bool
+
+	writeMu sync.Mutex
+	mu      sync.Mutex
+	nextID  uint32
+	pending map[uint32]chan []byte
+	// err is why the session ended, once it has
+	err error
+}
+
+// startSFTP starts the SFTP subsystem over an SSH connection
+func startSFTP(client *ssh.Client) (*sftpConn, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := session.RequestSubsystem("sftp"); err != nil {
+		return nil, fmt.Errorf("starting SFTP: %v", err)
+	}
+	c := &sftpConn{ssh: client, stdin: stdin, pending: make(map[uint32]chan []byte)}
+
+	// The version handshake carries no request id
+	init := binary.BigEndian.AppendUint32(nil, 5)
+	init = append(init, sftpInit)
+	init = binary.BigEndian.AppendUint32(init, 3)
+	if _, err := stdin.Write(init); err != nil {
+		return nil, err
+	}
+	packet, err := readSFTPPacket(stdout)
+	if err != nil {
+		return nil, fmt.Errorf("starting SFTP: %v", err)
+	}
+	if packet[0] != sftpVersion {
+		return nil, fmt.Errorf("starting SFTP: unexpected packet %d", packet[0])
+	}
+	version := &sftpReader{data: packet[1:]}
+	version.uint32()
+	for len(version.data) > 0 && version.err == nil {
+		name, data := version.string(), version.string()
+		if name == "posix-rename@openssh.com" && data == "1" {
+			c.posixRename = true
+		}
+	}
+	go c.receive(stdout)
+	return c, nil
+}
+
+// readSFTPPacket reads a packet: its type and what follows
+func readSFTPPacket(r io.Reader) ([]byte, error) {
+	var length [4]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(length[:])
+	if size < 1 || size > 1<<20 {
+		return nil, fmt.Errorf("invalid SFTP packet length %d", size)
+	}
+	packet := make([]byte, size)
+	if _, err := io.ReadFull(r, packet); err != nil {
+		return nil, err
+	}
+	return packet, nil
+}
+
+// receive hands the responses of the server to the requests waiting for
+// them, until the session ends
+func (c *sftpConn) receive(r io.Reader) {
+	for {
+		packet, err := readSFTPPacket(r)
+		if err == nil && len(packet) < 5 {
+			err = fmt.Errorf("short SFTP packet")
+		}
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		id := binary.BigEndian.Uint32(packet[1:5])
+		c.mu.Lock()
+		response, ok := c.pending[id]
+		delete(c.pending, id)
+		c.mu.Unlock()
+		if ok {
+			response <- append(packet[:1:1], packet[5:]...)
+		}
+	}
+}
+
+// fail ends the session, failing the requests waiting for responses
+func (c *sftpConn) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	for id, response := range c.pending {
+		close(response)
+		delete(c.pending, id)
+	}
+	c.ssh.Close()
+}
+
+// alive reports whether the session can take requests
+func (c *sftpConn) alive() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err == nil
+}
+
+// request sends a request and waits for its response, returning the
+// response's type and a reader for what follows it
+func (c *sftpConn) request(kind byte, payload []byte) (byte, *sftpReader, error) {
+	response := make(chan []byte, 1)
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return 0, nil, fmt.Errorf("SFTP connection lost: %v", c.err)
+	}
+	c.nextID++
+	id := c.nextID
+	c.pending[id] = response
+	c.mu.Unlock()
+
+	packet := binary.BigEndian.AppendUint32(make([]byte, 0, 9+len(payload)), uint32(5+len(payload)))
+	packet = append(packet, kind)
+	packet = binary.BigEndian.AppendUint32(packet, id)
+	packet = append(packet, payload...)
+	c.writeMu.Lock()
+	_, err := c.stdin.Write(packet)
+	c.writeMu.Unlock()
+	if err != nil {
+		c.fail(err)
+	}
+	data, ok := <-response
+	if !ok {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return 0, nil, fmt.Errorf("SFTP connection lost: %v", c.err)
+	}
+	return data[0], &sftpReader{data: data[1:]}, nil
+}
+
+// sftpString appends a string in SFTP encoding
+func sftpString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(len(s)))
+	return append(b, s...)
+}
+
+// sftpReader reads the fields of a packet; the first error sticks
+type sftpReader struct {
+	data []byte
+	err  error
+}
+
+func (r *sftpReader) uint32() uint32 {
+	if len(r.data) < 4 {
+		r.err = errors.New("short SFTP packet")
+		return 0
+	}
+	v := binary.BigEndian.Uint32(r.data)
+	r.data = r.data[4:]
+	return v
+}
+
+func (r *sftpReader) uint64() uint64 {
+	return uint64(r.uint32())<<32 | uint64(r.uint32())
+}
+
+func (r *sftpReader) string() string {
+	n := r.uint32()
+	if r.err != nil || uint32(len(r.data)) < n {
+		r.err = errors.New("short SFTP packet")
+		return ""
+	}
+	s := string(r.data[:n])
+	r.data = r.data[n:]
+	return s
+}
+
+// attrs reads file attributes
+func (r *sftpReader) attrs() sftpFileAttrs {
+	var attrs sftpFileAttrs
+	flags := r.uint32()
+	if flags&sftpAttrSize != 0 {
+		attrs.size = int64(r.uint64())
+	}
+	if flags&sftpAttrUIDGID != 0 {
+		r.uint32()
+		r.uint32()
+	}
+	if flags&sftpAttrPermissions != 0 {
+		attrs.mode = r.uint32()
+	}
+	if flags&sftpAttrTimes != 0 {
+		r.uint32()
+		attrs.mtime = time.Unix(int64(r.uint32()), 0)
+	}
+	if flags&sftpAttrExtended != 0 {
+		for n := r.uint32(); n > 0 && r.err == nil; n-- {
+			r.string()
+			r.string()
+		}
+	}
+	return attrs
+}
+
+// status turns a status response into an error: nil for success, io.EOF
+// at the end of a file or directory
+func (r *sftpReader) status(op, p string) error {
+	code, message := r.uint32(), r.string()
+	var err error
+	switch code {
+	case 0:
+		return nil
+	case 1:
+		return io.EOF
+	case 2:
+		err = fs.ErrNotExist
+	case 3:
+		err = fs.ErrPermission
+	default:
+		if message == "" {
+			message = fmt.Sprintf("SFTP error %d", code)
+		}
+		err = errors.New(message)
+	}
+	return &fs.PathError{Op: op, Path: p, Err: err}
+}
+
+// unexpected reports a response of the wrong type, or the status the
+// server sent instead
+func (r *sftpReader) unexpected(kind byte, op, p string) error {
+	if kind == sftpStatus {
+		if err := r.status(op, p); err != nil {
+			return err
+		}
+	}
+	return &fs.PathError{Op: op, Path: p, Err: fmt.Errorf("unexpected SFTP response %d", kind)}
+}
+
+// simple sends a request answered by a status
+func (c *sftpConn) simple(kind byte, op, p string, payload []byte) error {
+	responseKind, r, err := c.request(kind, payload)
+	if err != nil {
+		return &fs.PathError{Op: op, Path: p, Err: err}
+	}
+	if responseKind != sftpStatus {
+		return r.unexpected(responseKind, op, p)
+	}
+	return r.status(op, p)
+}
+
+func (c *sftpConn) stat(p string) (sftpFileAttrs, error) {
+	kind, r, err := c.request(sftpStat, sftpString(nil, p))
+	if err != nil {
+		return sftpFileAttrs{}, &fs.PathError{Op: "stat", Path: p, Err: err}
+	}
+	if kind != sftpAttrs {
+		return sftpFileAttrs{}, r.unexpected(kind, "stat", p)
+	}
+	return r.attrs(), r.err
+}
+
+func (c *sftpConn) realpath(p string) (string, error) {
+	kind, r, err := c.request(sftpRealpath, sftpString(nil, p))
+	if err != nil {
+		return "", &fs.PathError{Op: "realpath", Path: p, Err: err}
+	}
+	if kind != sftpName || r.uint32() != 1 {
+		return "", r.unexpected(kind, "realpath", p)
+	}
+	return r.string(), r.err
+}
+
+// open opens a file, created with mode 0644 if the flags say so
+func (c *sftpConn) open(p string, flags uint32) (string, error) {
+	payload := binary.BigEndian.AppendUint32(sftpString(nil, p), flags)
+	payload = binary.BigEndian.AppendUint32(payload, sftpAttrPermissions)
+	payload = binary.BigEndian.AppendUint32(payload, 0644)
+	kind, r, err := c.request(sftpOpen, payload)
+	if err != nil {
+		return "", &fs.PathError{Op: "open", Path: p, Err: err}
+	}
+	if kind != sftpHandle {
+		return "", r.unexpected(kind, "open", p)
+	}
+	return r.string(), r.err
+}
+
+func (c *sftpConn) close(handle string) error {
+	return c.simple(sftpClose, "close", "", sftpString(nil, handle))
+}
+
+// read returns up to n bytes of an open file from offset, and io.EOF at
+// its end
+func (c *sftpConn) read(handle string, offset int64, n int) ([]byte, error) {
+	payload := binary.BigEndian.AppendUint64(sftpString(nil, handle), uint64(offset))
+	payload = binary.BigEndian.AppendUint32(payload, uint32(n))
+	kind, r, err := c.request(sftpRead, payload)
+	if err != nil {
+		return nil, err
+	}
+	if kind != sftpData {
+		return nil, r.unexpected(kind, "read", "")
+	}
+	return []byte(r.string()), r.err
+}
+
+func (c *sftpConn) write(handle string, offset int64, data []byte) error {
+	payload := binary.BigEndian.AppendUint64(sftpString(nil, handle), uint64(offset))
+	payload = sftpString(payload, string(data))
+	return c.simple(sftpWrite, "write", "", payload)
+}
+
+// readDir returns the entries of a directory but . and ..
+func (c *sftpConn) readDir(p string) ([]sftpFileInfo, error) {
+	kind, r, err := c.request(sftpOpendir, sftpString(nil, p))
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: p, Err: err}
+	}
+	if kind != sftpHandle {
+		return nil, r.unexpected(kind, "readdir", p)
+	}
+	handle := r.string()
+	defer c.close(handle)
+	var infos []sftpFileInfo
+	for {
+		kind, r, err := c.request(sftpReaddir, sftpString(nil, handle))
+		if err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: p, Err: err}
+		}
+		if kind == sftpStatus {
+			if err := r.status("readdir", p); err != io.EOF {
+				return nil, err
+			}
+			return infos, nil
+		}
+		if kind != sftpName {
+			return nil, r.unexpected(kind, "readdir", p)
+		}
+		for n := r.uint32(); n > 0 && r.err == nil; n-- {
+			name := r.string()
+			r.string() // the long name, as ls -l shows it
+			attrs := r.attrs()
+			if name != "." && name != ".." {
+				infos = append(infos, sftpFileInfo{name: name, attrs: attrs})
+			}
+		}
+		if r.err != nil {
+			return nil, r.err
+		}
+	}
+}
+
+func (c *sftpConn) mkdir(p string, perm fs.FileMode) error {
+	payload := binary.BigEndian.AppendUint32(sftpString(nil, p), sftpAttrPermissions)
+	payload = binary.BigEndian.AppendUint32(payload, uint32(perm.Perm()))
+	return c.simple(sftpMkdir, "mkdir", p, payload)
+}
+
+func (c *sftpConn) remove(p string) error {
+	return c.simple(sftpRemove, "remove", p, sftpString(nil, p))
+}
+
+// replace renames a file, replacing any file of the new name. Without
+// the posix-rename extension, which does it in one step, the old file is
+// removed first.
+func (c *sftpConn) replace(oldPath, newPath string) error {
+	if c.posixRename {
+		payload := sftpString(nil, "posix-rename@openssh.com")
+		payload = sftpString(sftpString(payload, oldPath), newPath)
+		return c.simple(sftpExtended, "rename", oldPath, payload)
+	}
+	if attrs, err := c.stat(newPath); err == nil && !attrs.isDir() {
+		if err := c.remove(newPath); err != nil {
+			return err
+		}
+	}
+	return c.simple(sftpRename, "rename", oldPath, sftpString(sftpString(nil, oldPath), newPath))
+}
@@ -0,0 +1,624 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/webdav"
+)
+
+// SFTP status codes
+const (
+	sftpOK               = 0
+	sftpEOF              = 1
+	sftpNoSuchFile       = 2
+	sftpPermissionDenied = 3
+	sftpFailure          = 4
+	sftpOpUnsupported    = 8
+)
+
+// sftpMaxHandles is how many files and directories a session may have open
+const sftpMaxHandles = 64
+
+// sshServerConfig sets up the SSH side of -sftp, where users log in with
+// their passwords or API tokens
+func sshServerConfig(hostKey ssh.Signer) *ssh.ServerConfig {
+	config := &ssh.ServerConfig{
+		ServerVersion: "SSH-2.0-Files",
+		// Without users, everyone gets in anonymously; with them,
+		// "anonymous" gets what anonymous visitors of the web interface get
+		NoClientAuth: !authEnabled(),
+		PasswordCallback: func(meta ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			client, _, _ := net.SplitHostPort(meta.RemoteAddr().String())
+			name := meta.User()
+			if name == "anonymous" {
+				return &ssh.Permissions{}, nil
+			}
+			user := loginUser(name, string(password))
+			if user == "" {
+				auditLogf("login-failed client=%s user=%q", client, name)
+				time.Sleep(time.Second)
+				return nil, errors.New("login incorrect")
+			}
+			auditLogf("login client=%s user=%q", client, user)
+			return &ssh.Permissions{Extensions: map[string]string{"user": user}}, nil
+		},
+	}
+	config.AddHostKey(hostKey)
+	return config
+}
+
+// loadHostKey reads the SSH host key in keyFile, or creates an Ed25519 key
+// and saves it there if there is none. Without keyFile the key is new.
+func loadHostKey(keyFile string) (ssh.Signer, error) {
+	if keyFile != "" {
+		data, err := os.ReadFile(keyFile)
+		if err == nil {
+			return ssh.ParsePrivateKey(data)
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if keyFile != "" {
+		block, err := ssh.MarshalPrivateKey(key, "files")
+		if err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(keyFile, pem.EncodeToMemory(block), 0600); err != nil {
+			return nil, err
+		}
+		log.Printf("Created SFTP host key %s", keyFile)
+	}
+	return ssh.NewSignerFromKey(key)
+}
+
+// serveSFTP runs the SSH listener of -sftp. While a replaced
+// process still holds the address after an upgrade, it retries.
+func serveSFTP(address string, config *ssh.ServerConfig) {
+	var l net.Listener
+	for logged := false; ; time.Sleep(time.Second) {
+		var err error
+		if l, err = net.Listen("tcp", address); err == nil {
+			break
+		}
+		if !errors.Is(err, syscall.EADDRINUSE) {
+			log.Fatal("SFTP listener failed:", err)
+		}
+		if !logged {
+			log.Printf("%s is in use, retrying the SFTP listener", address)
+			logged = true
+		}
+	}
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			log.Fatal("SFTP listener failed:", err)
+		}
+		go serveSSHConn(conn, config)
+	}
+}
+
+// serveSSHConn runs an SSH connection, which may only start the SFTP
+// subsystem: there are no shells or commands
+func serveSSHConn(conn net.Conn, config *ssh.ServerConfig) {
+	client, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	if !addressAllowed(client) {
+		auditLogf("ip-denied client=%s path=%q", client, "sftp")
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Now().Add(time.Minute))
+	sshConn, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	defer sshConn.Close()
+	go ssh.DiscardRequests(requests)
+
+	user := ""
+	if sshConn.Permissions != nil {
+		user = sshConn.Permissions.Extensions["user"]
+	}
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			defer channel.Close()
+			for req := range requests {
+				// The subsystem name is an SSH string
+				if req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp" {
+					req.Reply(true, nil)
+					server := &sftpServer{channel: channel, user: user, client: client, handles: map[string]*sftpServerHandle{}}
+					server.serve()
+					// scp fails without an exit status
+					channel.SendRequest("exit-status", false, binary.BigEndian.AppendUint32(nil, 0))
+					return
+				}
+				req.Reply(false, nil)
+			}
+		}()
+	}
+}
+
+// sftpServer is an SFTP session of a user. Requests are answered one at
+// a time, in order, so the writes of an upload arrive in sequence.
+type sftpServer struct {
+	channel ssh.Channel
+	user    string
+	client  string
+	handles map[string]*sftpServerHandle
+	next    int
+}
+
+// sftpServerHandle is an open file or directory
+type sftpServerHandle struct {
+	requestedPath string
+	fsys          *userFS
+	file          webdav.File
+	// offset is where the file is read or written next
+	offset int64
+	// entries are those of a directory yet to be sent
+	entries []fs.FileInfo
+	writing bool
+	release func()
+}
+
+// serve answers requests until the session ends
+func (s *sftpServer) serve() {
+	// Users kept in their home directory start there
+	if home := s.home(); home != "" {
+		if store, ok := served.(writableStorage); ok {
+			if err := store.MkdirAll(storageName(home), 0755); err != nil {
+				log.Printf("Error creating home directory of %s: %v", s.user, err)
+				return
+			}
+		}
+	}
+	defer func() {
+		// Files still being written when the client goes away are dropped
+		for handle, h := range s.handles {
+			if h.writing {
+				h.fsys.body.err = io.ErrUnexpectedEOF
+			}
+			s.closeHandle(handle)
+		}
+	}()
+	for {
+		packet, err := readSFTPPacket(s.channel)
+		if err != nil {
+			return
+		}
+		r := &sftpReader{data: packet[1:]}
+		if packet[0] == sftpInit {
+			// OpenSSH renames with posix-rename when offered it, which
+			// replaces the destination like rename(2)
+			payload := binary.BigEndian.AppendUint32(nil, 3)
+			payload = sftpString(payload, "posix-rename@openssh.com")
+			payload = sftpString(payload, "1")
+			s.send(sftpVersion, payload)
+			continue
+		}
+		id := r.uint32()
+		if r.err != nil {
+			return
+		}
+		s.handle(packet[0], id, r)
+	}
+}
+
+// send sends a packet; its payload starts with the request id if it has one
+func (s *sftpServer) send(kind byte, payload []byte) {
+	packet := binary.BigEndian.AppendUint32(make([]byte, 0, 5+len(payload)), uint32(1+len(payload)))
+	packet = append(packet, kind)
+	s.channel.Write(append(packet, payload...))
+}
+
+// status answers a request with a status
+func (s *sftpServer) status(id uint32, code uint32, message string) {
+	payload := binary.BigEndian.AppendUint32(nil, id)
+	payload = binary.BigEndian.AppendUint32(payload, code)
+	payload = sftpString(payload, message)
+	payload = sftpString(payload, "en")
+	s.send(sftpStatus, payload)
+}
+
+// fail answers a request with the status of an error, or OK for nil
+func (s *sftpServer) fail(id uint32, err error) {
+	var uploadErr *uploadError
+	switch {
+	case err == nil:
+		s.status(id, sftpOK, "OK")
+	case errors.Is(err, fs.ErrNotExist):
+		s.status(id, sftpNoSuchFile, "No such file or directory")
+	case errors.Is(err, fs.ErrPermission):
+		s.status(id, sftpPermissionDenied, "Access denied")
+	case errors.As(err, &uploadErr):
+		s.status(id, sftpFailure, uploadErr.message)
+	default:
+		s.status(id, sftpFailure, err.Error())
+	}
+}
+
+// sftpAttrsOf encodes the attributes of a file
+func sftpAttrsOf(info fs.FileInfo) []byte {
+	mode := uint32(0100644)
+	if info.IsDir() {
+		mode = sftpTypeDir | 0755
+	}
+	mtime := uint32(info.ModTime().Unix())
+	payload := binary.BigEndian.AppendUint32(nil, sftpAttrSize|sftpAttrPermissions|sftpAttrTimes)
+	payload = binary.BigEndian.AppendUint64(payload, uint64(info.Size()))
+	payload = binary.BigEndian.AppendUint32(payload, mode)
+	payload = binary.BigEndian.AppendUint32(payload, mtime)
+	return binary.BigEndian.AppendUint32(payload, mtime)
+}
+
+// home is where relative paths start: the user's home directory for users
+// kept in it, else the root
+func (s *sftpServer) home() string {
+	if s.user != "" && confined(s.user) {
+		return s.user
+	}
+	return ""
+}
+
+// resolve returns the path relative to the served root that a path of
+// the client names
+func (s *sftpServer) resolve(p string) string {
+	if path.IsAbs(p) {
+		return userPath(p)
+	}
+	return userPath(path.Join("/"+s.home(), p))
+}
+
+// canBrowse reports whether the user may list and download, which
+// anonymous visitors of a drop box may not
+func (s *sftpServer) canBrowse() bool {
+	return !uploadOnly || s.user != ""
+}
+
+// handle answers one request
+func (s *sftpServer) handle(kind byte, id uint32, r *sftpReader) {
+	fsys := &userFS{user: s.user, client: s.client}
+	ctx := context.Background()
+	switch kind {
+	case sftpRealpath:
+		requestedPath := s.resolve(r.string())
+		payload := binary.BigEndian.AppendUint32(nil, id)
+		payload = binary.BigEndian.AppendUint32(payload, 1)
+		payload = sftpString(payload, "/"+requestedPath)
+		payload = sftpString(payload, "")
+		payload = binary.BigEndian.AppendUint32(payload, 0)
+		s.send(sftpName, payload)
+
+	case sftpStat, sftpLstat:
+		info, err := fsys.Stat(ctx, s.resolve(r.string()))
+		if err != nil {
+			s.fail(id, err)
+			return
+		}
+		s.send(sftpAttrs, append(binary.BigEndian.AppendUint32(nil, id), sftpAttrsOf(info)...))
+
+	case sftpFstat:
+		h, ok := s.handles[r.string()]
+		if !ok {
+			s.status(id, sftpFailure, "Invalid handle")
+			return
+		}
+		info, err := h.file.Stat()
+		if err != nil {
+			s.fail(id, err)
+			return
+		}
+		s.send(sftpAttrs, append(binary.BigEndian.AppendUint32(nil, id), sftpAttrsOf(info)...))
+
+	case sftpSetstat, sftpFsetstat:
+		// Permissions and times are the server's to keep
+		s.status(id, sftpOK, "OK")
+
+	case sftpOpen:
+		requestedPath := s.resolve(r.string())
+		pflags := r.uint32()
+		r.attrs()
+		s.open(id, requestedPath, pflags)
+
+	case sftpOpendir:
+		requestedPath := s.resolve(r.string())
+		log.Printf("[SFTP OPENDIR] /%s %s", requestedPath, s.client)
+		if !s.canBrowse() {
+			s.status(id, sftpNoSuchFile, "No such file or directory")
+			return
+		}
+		f, err := fsys.OpenFile(ctx, requestedPath, os.O_RDONLY, 0)
+		if err != nil {
+			s.fail(id, err)
+			return
+		}
+		entries, err := f.Readdir(0)
+		f.Close()
+		if err != nil {
+			s.status(id, sftpFailure, "Not a directory")
+			return
+		}
+		s.addHandle(id, &sftpServerHandle{requestedPath: requestedPath, fsys: fsys, file: f, entries: entries})
+
+	case sftpReaddir:
+		h, ok := s.handles[r.string()]
+		if !ok || h.writing {
+			s.status(id, sftpFailure, "Invalid handle")
+			return
+		}
+		if len(h.entries) == 0 {
+			s.status(id, sftpEOF, "End of directory")
+			return
+		}
+		n := min(len(h.entries), 100)
+		payload := binary.BigEndian.AppendUint32(nil, id)
+		payload = binary.BigEndian.AppendUint32(payload, uint32(n))
+		for _, entry := range h.entries[:n] {
+			payload = sftpString(payload, entry.Name())
+			payload = sftpString(payload, lsLine(entry))
+			payload = append(payload, sftpAttrsOf(entry)...)
+		}
+		h.entries = h.entries[n:]
+		s.send(sftpName, payload)
+
+	case sftpRead:
+		h, ok := s.handles[r.string()]
+		offset, length := int64(r.uint64()), r.uint32()
+		if !ok || h.writing || h.entries != nil {
+			s.status(id, sftpFailure, "Invalid handle")
+			return
+		}
+		if offset != h.offset {
+			if _, err := h.file.Seek(offset, io.SeekStart); err != nil {
+				s.fail(id, err)
+				return
+			}
+			h.offset = offset
+		}
+		data := make([]byte, min(length, sftpChunk))
+		n, err := io.ReadFull(h.file, data)
+		h.offset += int64(n)
+		if n == 0 {
+			if err == io.EOF {
+				s.status(id, sftpEOF, "End of file")
+			} else {
+				s.fail(id, err)
+			}
+			return
+		}
+		payload := binary.BigEndian.AppendUint32(nil, id)
+		s.send(sftpData, sftpString(payload, string(data[:n])))
+
+	case sftpWrite:
+		h, ok := s.handles[r.string()]
+		offset, data := int64(r.uint64()), r.string()
+		if !ok || !h.writing {
+			s.status(id, sftpFailure, "Invalid handle")
+			return
+		}
+		// Files are stored as they arrive, so they are written in order
+		if offset != h.offset {
+			s.status(id, sftpOpUnsupported, "Files can only be written from start to end")
+			return
+		}
+		n, err := h.file.Write([]byte(data))
+		h.offset += int64(n)
+		h.fsys.transfer.add(int64(n))
+		s.fail(id, err)
+
+	case sftpClose:
+		s.fail(id, s.closeHandle(r.string()))
+
+	case sftpRemove:
+		requestedPath := s.resolve(r.string())
+		log.Printf("[SFTP REMOVE] /%s %s", requestedPath, s.client)
+		if info, err := fsys.Stat(ctx, requestedPath); err == nil && info.IsDir() {
+			s.status(id, sftpFailure, "Is a directory")
+			return
+		}
+		s.fail(id, fsys.RemoveAll(ctx, requestedPath))
+
+	case sftpMkdir:
+		requestedPath := s.resolve(r.string())
+		log.Printf("[SFTP MKDIR] /%s %s", requestedPath, s.client)
+		s.fail(id, fsys.Mkdir(ctx, requestedPath, 0755))
+
+	case sftpRmdir:
+		requestedPath := s.resolve(r.string())
+		log.Printf("[SFTP RMDIR] /%s %s", requestedPath, s.client)
+		f, err := fsys.OpenFile(ctx, requestedPath, os.O_RDONLY, 0)
+		if err != nil {
+			s.fail(id, err)
+			return
+		}
+		entries, err := f.Readdir(0)
+		f.Close()
+		switch {
+		case err != nil:
+			s.status(id, sftpFailure, "Not a directory")
+		case len(entries) > 0:
+			s.status(id, sftpFailure, "Directory not empty")
+		default:
+			s.fail(id, fsys.RemoveAll(ctx, requestedPath))
+		}
+
+	case sftpRename:
+		src, dst := s.resolve(r.string()), s.resolve(r.string())
+		s.rename(id, fsys, src, dst, false)
+
+	case sftpExtended:
+		if r.string() != "posix-rename@openssh.com" {
+			s.status(id, sftpOpUnsupported, "Not supported")
+			return
+		}
+		src, dst := s.resolve(r.string()), s.resolve(r.string())
+		s.rename(id, fsys, src, dst, true)
+
+	default:
+		s.status(id, sftpOpUnsupported, "Not supported")
+	}
+}
+
+// addHandle answers an open request with a new handle
+func (s *sftpServer) addHandle(id uint32, h *sftpServerHandle) {
+	s.next++
+	handle := strconv.Itoa(s.next)
+	s.handles[handle] = h
+	s.send(sftpHandle, sftpString(binary.BigEndian.AppendUint32(nil, id), handle))
+}
+
+// closeHandle closes a file or directory, storing a file being written
+func (s *sftpServer) closeHandle(handle string) error {
+	h, ok := s.handles[handle]
+	if !ok {
+		return errors.New("invalid handle")
+	}
+	delete(s.handles, handle)
+	var err error
+	if h.entries == nil {
+		err = h.file.Close()
+	}
+	if h.fsys.transfer != nil {
+		stats.endTransfer(h.fsys.transfer)
+	}
+	if h.release != nil {
+		h.release()
+	}
+	return err
+}
+
+// open opens a file for reading, or for writing a new version of it.
+// Downloads and uploads take one of -max-transfers until closed.
+func (s *sftpServer) open(id uint32, requestedPath string, pflags uint32) {
+	if len(s.handles) >= sftpMaxHandles {
+		s.status(id, sftpFailure, "Too many open files")
+		return
+	}
+	if usage.overCap(s.user) {
+		auditLogf("cap-exceeded client=%s user=%q path=%q", s.client, s.user, "/"+requestedPath)
+		s.status(id, sftpFailure, "Monthly transfer cap exceeded")
+		return
+	}
+	fsys := &userFS{user: s.user, client: s.client}
+	ctx := context.Background()
+	writing := pflags&sftpOpenWrite != 0
+	var size int64
+	if writing {
+		log.Printf("[SFTP PUT] /%s %s", requestedPath, s.client)
+		if pflags&sftpOpenAppend != 0 || (pflags&sftpOpenTruncate == 0 && pflags&sftpOpenCreate == 0) {
+			s.status(id, sftpOpUnsupported, "Files can only be written anew")
+			return
+		}
+		if path.Base("/"+requestedPath) == "/" {
+			s.status(id, sftpFailure, "Missing file name")
+			return
+		}
+		// Visitors of a drop box only add files
+		if err := fsys.checkUpload(requestedPath, -1, s.canBrowse() && pflags&sftpOpenExclusive == 0); err != nil {
+			s.fail(id, err)
+			return
+		}
+		size = -1
+	} else {
+		log.Printf("[SFTP GET] /%s %s", requestedPath, s.client)
+		info, err := fsys.Stat(ctx, requestedPath)
+		if err != nil || !s.canBrowse() {
+			s.status(id, sftpNoSuchFile, "No such file or directory")
+			return
+		}
+		if info.IsDir() {
+			s.status(id, sftpFailure, "Is a directory")
+			return
+		}
+		size = info.Size()
+	}
+
+	release := func() {}
+	if transferSlots != nil {
+		settingsMu.RLock()
+		timeout := transferQueueTimeout
+		settingsMu.RUnlock()
+		var position int
+		release, position = transferSlots.acquire(ctx, s.client, "SFTP /"+requestedPath, timeout)
+		if release == nil {
+			s.status(id, sftpFailure, fmt.Sprintf("Too many transfers in progress; you are number %d in line, try again later", position))
+			return
+		}
+	}
+	h := &sftpServerHandle{requestedPath: requestedPath, fsys: fsys, writing: writing, release: release}
+	if writing {
+		fsys.transfer = stats.startTransfer("upload", requestedPath, s.client, s.user, size)
+		fsys.body = &uploadBody{}
+		f, err := fsys.OpenFile(ctx, requestedPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			stats.endTransfer(fsys.transfer)
+			release()
+			s.fail(id, err)
+			return
+		}
+		h.file = f
+	} else {
+		fsys.transfer = stats.startTransfer("download", requestedPath, s.client, s.user, size)
+		f, err := fsys.OpenFile(ctx, requestedPath, os.O_RDONLY, 0)
+		if err != nil {
+			stats.endTransfer(fsys.transfer)
+			release()
+			s.fail(id, err)
+			return
+		}
+		h.file = f
+	}
+	s.addHandle(id, h)
+}
+
+// rename moves a file or directory. SFTP's own rename never replaces the
+// destination; posix-rename replaces a file there.
+func (s *sftpServer) rename(id uint32, fsys *userFS, src, dst string, replace bool) {
+	log.Printf("[SFTP RENAME] /%s %s", src, s.client)
+	ctx := context.Background()
+	if info, err := fsys.Stat(ctx, dst); err == nil {
+		if !replace || info.IsDir() {
+			s.status(id, sftpFailure, "Destination already exists")
+			return
+		}
+		if err := fsys.RemoveAll(ctx, dst); err != nil {
+			s.fail(id, err)
+			return
+		}
+	}
+	s.fail(id, fsys.Rename(ctx, src, dst))
+}
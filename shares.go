@@ -0,0 +1,385 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errShareUsedUp = errors.New("share link used up")
+
+// ShareLink gives anyone holding its URL (/s/<id>) access to one file, as
+// limited by the policies its owner attached to it
+type ShareLink struct {
+	ID      string    `json:"id"`
+	Path    string    `json:"path"`
+	Owner   string    `json:"owner"`
+	Created time.Time `json:"created"`
+	// Expires ends the link; nil links don't expire
+	Expires *time.Time `json:"expires,omitempty"`
+	// Rate caps each download through the link, in bytes per second
+	Rate int64 `json:"rate,omitempty"`
+	// Allow lists the networks (CIDR) the link works from; empty is anywhere
+	Allow []string `json:"allow,omitempty"`
+	// Countries lists the ISO codes of the countries the link works from
+	// (with -geoip); empty is anywhere
+	Countries []string `json:"countries,omitempty"`
+	// MaxBytes ends the link once that much was sent through it
+	MaxBytes int64  `json:"maxBytes,omitempty"`
+	Sent     int64  `json:"sent"`
+	URL      string `json:"url,omitempty"`
+
+	networks []*net.IPNet
+	limiter  *bandwidthLimiter
+}
+
+// shareStore holds the share links, saved to dataDir/shares.json
+type shareStore struct {
+	mu    sync.Mutex
+	links map[string]*ShareLink
+}
+
+var shares = &shareStore{links: make(map[string]*ShareLink)}
+
+// shareKey is the context key of the share link a download goes through
+type shareKey struct{}
+
+// sharedLink returns the share link a download goes through, or nil
+func sharedLink(r *http.Request) *ShareLink {
+	link, _ := r.Context().Value(shareKey{}).(*ShareLink)
+	return link
+}
+
+// prepare parses the policies of a new or restored link
+func (link *ShareLink) prepare() error {
+	link.networks = nil
+	for _, allowed := range link.Allow {
+		if !strings.Contains(allowed, "/") {
+			if ip := net.ParseIP(allowed); ip != nil && ip.To4() != nil {
+				allowed += "/32"
+			} else {
+				allowed += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(allowed)
+		if err != nil {
+			return err
+		}
+		link.networks = append(link.networks, network)
+	}
+	link.limiter = nil
+	if link.Rate > 0 {
+		link.limiter = &bandwidthLimiter{rules: []bandwidthRule{{
+			days: [7]bool{true, true, true, true, true, true, true},
+			end:  24 * 60,
+			rate: link.Rate,
+		}}}
+	}
+	return nil
+}
+
+// allows reports whether a client address may use the link
+func (link *ShareLink) allows(client string) bool {
+	ip := net.ParseIP(client)
+	if len(link.Countries) > 0 {
+		if geoip == nil || ip == nil {
+			return false
+		}
+		country, listed := geoip.country(ip), false
+		for _, allowed := range link.Countries {
+			listed = listed || allowed == country
+		}
+		if !listed {
+			return false
+		}
+	}
+	if len(link.networks) == 0 {
+		return true
+	}
+	for _, network := range link.networks {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// expired reports whether the link's lifetime is over
+func (link *ShareLink) expired() bool {
+	return link.Expires != nil && time.Now().After(*link.Expires)
+}
+
+// limit returns how many bytes the next read of a download through the
+// link may ask for: no more than its rate allows at once, nor than is left
+// of its byte budget
+func (link *ShareLink) limit(n int) int {
+	if link.limiter != nil {
+		n = link.limiter.limit(n)
+	}
+	if link.MaxBytes > 0 {
+		shares.mu.Lock()
+		left := max(link.MaxBytes-link.Sent, 0)
+		shares.mu.Unlock()
+		n = int(min(int64(n), left))
+	}
+	return n
+}
+
+// send counts n bytes sent through the link and waits as its rate asks for
+func (link *ShareLink) send(n int) {
+	shares.mu.Lock()
+	link.Sent += int64(n)
+	shares.mu.Unlock()
+	if link.limiter != nil {
+		link.limiter.wait(n, nil)
+	}
+}
+
+// view returns a copy of the link as shown to its owner
+func (link *ShareLink) view(r *http.Request) ShareLink {
+	shares.mu.Lock()
+	defer shares.mu.Unlock()
+	shown := *link
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	shown.URL = scheme + "://" + r.Host + urlPrefix + "/s/" + link.ID
+	return shown
+}
+
+// restore loads the links saved by a previous run
+func (s *shareStore) restore(saved []*ShareLink) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, link := range saved {
+		if err := link.prepare(); err != nil {
+			log.Printf("Dropping share link %s: %v", link.ID, err)
+			continue
+		}
+		s.links[link.ID] = link
+	}
+}
+
+// persisted returns the links worth saving; expired ones are dropped
+func (s *shareStore) persisted() []ShareLink {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	saved := make([]ShareLink, 0, len(s.links))
+	for id, link := range s.links {
+		if link.expired() {
+			delete(s.links, id)
+			continue
+		}
+		saved = append(saved, *link)
+	}
+	sort.Slice(saved, func(i, j int) bool { return saved[i].Created.Before(saved[j].Created) })
+	return saved
+}
+
+// save writes the links to dataDir right away, so a new or revoked link
+// survives a crash
+func (s *shareStore) save() {
+	if dataDir == "" {
+		return
+	}
+	if err := saveState("shares", s.persisted()); err != nil {
+		log.Printf("Failed to save share links: %v", err)
+	}
+}
+
+// get returns the link with an ID, or nil
+func (s *shareStore) get(id string) *ShareLink {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.links[id]
+}
+
+// parseLifetime parses how long a link lives: a duration such as "90m" or
+// "24h", or a number of days such as "7d"
+func parseLifetime(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, errors.New("invalid lifetime")
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, errors.New("invalid lifetime")
+	}
+	return d, nil
+}
+
+// newShareID returns a random, unguessable link ID
+func newShareID() string {
+	return base64.RawURLEncoding.EncodeToString(randomBytes(12))
+}
+
+// writeShareJSON responds with a share link or a list of them
+func writeShareJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("JSON encoding error: %v", err)
+	}
+}
+
+// sharesHandler lists the share links of the user (GET /api/shares), or
+// creates one (POST /api/shares) from the form fields path and optionally
+// expires (a lifetime such as "24h" or "7d"), rate (bytes per second, e.g.
+// "1M"), max_bytes, allow (comma-separated IP addresses or CIDR ranges) and
+// countries (comma-separated ISO codes). Only authenticated users have
+// share links.
+func sharesHandler(w http.ResponseWriter, r *http.Request) {
+	user := authenticatedUser(r)
+	if user == "" {
+		http.Error(w, "Authentication required", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		shares.mu.Lock()
+		var owned []*ShareLink
+		for _, link := range shares.links {
+			if link.Owner == user && !link.expired() {
+				owned = append(owned, link)
+			}
+		}
+		shares.mu.Unlock()
+		sort.Slice(owned, func(i, j int) bool { return owned[i].Created.Before(owned[j].Created) })
+		list := make([]ShareLink, 0, len(owned))
+		for _, link := range owned {
+			list = append(list, link.view(r))
+		}
+		writeShareJSON(w, http.StatusOK, list)
+		return
+	}
+
+	requestedPath := strings.Trim(r.FormValue("path"), "/")
+	fullPath, err := resolvePath(requestedPath)
+	if err != nil {
+		writePathError(w, err)
+		return
+	}
+	if info, err := os.Stat(fullPath); err != nil || info.IsDir() || !canRead(user, requestedPath) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	link := &ShareLink{ID: newShareID(), Path: requestedPath, Owner: user, Created: time.Now()}
+	if value := r.FormValue("expires"); value != "" {
+		lifetime, err := parseLifetime(value)
+		if err != nil {
+			http.Error(w, "Invalid expires (expected e.g. 24h or 7d)", http.StatusBadRequest)
+			return
+		}
+		expires := link.Created.Add(lifetime)
+		link.Expires = &expires
+	}
+	if value := r.FormValue("rate"); value != "" {
+		if link.Rate, err = parseSize(value); err != nil {
+			http.Error(w, "Invalid rate", http.StatusBadRequest)
+			return
+		}
+	}
+	if value := r.FormValue("max_bytes"); value != "" {
+		if link.MaxBytes, err = parseSize(value); err != nil {
+			http.Error(w, "Invalid max_bytes", http.StatusBadRequest)
+			return
+		}
+	}
+	link.Allow = parseList(r.FormValue("allow"))
+	if err := link.prepare(); err != nil {
+		http.Error(w, "Invalid allow (expected IP addresses or CIDR ranges)", http.StatusBadRequest)
+		return
+	}
+	if value := r.FormValue("countries"); value != "" {
+		if geoip == nil {
+			http.Error(w, "Country restrictions require -geoip", http.StatusBadRequest)
+			return
+		}
+		countries, err := parseCountries(value)
+		if err != nil {
+			http.Error(w, "Invalid countries (expected ISO codes such as DE,AT)", http.StatusBadRequest)
+			return
+		}
+		for code := range countries {
+			link.Countries = append(link.Countries, code)
+		}
+		sort.Strings(link.Countries)
+	}
+
+	shares.mu.Lock()
+	shares.links[link.ID] = link
+	shares.mu.Unlock()
+	shares.save()
+	auditLogf("share client=%s user=%q path=%q id=%s", clientHost(r), user, requestedPath, link.ID)
+
+	writeShareJSON(w, http.StatusCreated, link.view(r))
+}
+
+// shareDeleteHandler revokes one of the user's share links
+// (DELETE /api/shares/<id>)
+func shareDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	user := authenticatedUser(r)
+	if user == "" {
+		http.Error(w, "Authentication required", http.StatusUnauthorized)
+		return
+	}
+	id := pathParam(r, "id")
+	shares.mu.Lock()
+	link, ok := shares.links[id]
+	if ok && link.Owner == user {
+		delete(shares.links, id)
+	}
+	shares.mu.Unlock()
+	if !ok || link.Owner != user {
+		http.Error(w, "Share link not found", http.StatusNotFound)
+		return
+	}
+	shares.save()
+	auditLogf("unshare client=%s user=%q path=%q id=%s", clientHost(r), user, link.Path, id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// shareDownloadHandler downloads the file of a share link (/s/<id>) if
+// the link's policies allow it: 410 Gone once it expired or its byte
+// budget is spent, 403 from addresses and countries it doesn't allow
+func shareDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	link := shares.get(pathParam(r, "id"))
+	if link == nil {
+		http.Error(w, "Share link not found", http.StatusNotFound)
+		return
+	}
+	shares.mu.Lock()
+	usedUp := link.MaxBytes > 0 && link.Sent >= link.MaxBytes
+	shares.mu.Unlock()
+	switch {
+	case link.expired():
+		http.Error(w, "This link has expired", http.StatusGone)
+		return
+	case usedUp:
+		http.Error(w, "This link has been used up", http.StatusGone)
+		return
+	case !link.allows(clientHost(r)):
+		http.Error(w, "This link can't be used from your network or country", http.StatusForbidden)
+		return
+	}
+
+	ctx := context.WithValue(r.Context(), shareKey{}, link)
+	ctx = context.WithValue(ctx, routeParamsKey{}, map[string]string{"path": link.Path})
+	downloadHandler(w, r.WithContext(ctx))
+}
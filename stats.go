@@ -0,0 +1,613 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// recentRequestLimit is the number of requests and errors kept for the admin API
+const recentRequestLimit = 100
+
+// topDownloadLimit is the number of most downloaded files in the admin API
+const topDownloadLimit = 20
+
+var (
+	// adminEnabled turns on the /api/admin/ endpoints
+	adminEnabled bool
+	// adminLoopback makes clients on the loopback interface admins
+	// (-admin-loopback)
+	adminLoopback bool
+)
+
+// errTransferCanceled is returned by the readers of a canceled transfer
+var errTransferCanceled = errors.New("transfer canceled")
+
+// RequestRecord describes a completed request
+type RequestRecord struct {
+	Time     time.Time     `json:"time"`
+	Method   string        `json:"method"`
+	Path     string        `json:"path"`
+	Client   string        `json:"client"`
+	Status   int           `json:"status"`
+	Bytes    int64         `json:"bytes"`
+	Duration time.Duration `json:"duration"`
+}
+
+// TransferInfo describes a download or upload in progress
+type TransferInfo struct {
+	ID       int64     `json:"id"`
+	Kind     string    `json:"kind"`
+	Path     string    `json:"path"`
+	Client   string    `json:"client"`
+	User     string    `json:"user,omitempty"`
+	Bytes    int64     `json:"bytes"`
+	Size     int64     `json:"size"`
+	Started  time.Time `json:"started"`
+	Rate     float64   `json:"rate"`
+	Canceled bool      `json:"canceled,omitempty"`
+}
+
+// FileCount is the number of downloads of a file
+type FileCount struct {
+	Path  string `json:"path"`
+	Count int64  `json:"count"`
+}
+
+// StatsSnapshot is the document served by /api/admin/stats. Counters are
+// cumulative since Since, which predates Started when -data-dir keeps
+// them across restarts.
+type StatsSnapshot struct {
+	Since         time.Time       `json:"since"`
+	Started       time.Time       `json:"started"`
+	Requests      int64           `json:"requests"`
+	Errors        int64           `json:"errors"`
+	BytesSent     int64           `json:"bytesSent"`
+	BytesReceived int64           `json:"bytesReceived"`
+	Downloads     int64           `json:"downloads"`
+	Uploads       int64           `json:"uploads"`
+	TopDownloads  []FileCount     `json:"topDownloads"`
+	Transfers     []TransferInfo  `json:"transfers"`
+	Recent        []RequestRecord `json:"recent"`
+	RecentErrors  []RequestRecord `json:"recentErrors"`
+	// Scrub is the last checksum scrub, with -scrub
+	Scrub *ScrubStatus `json:"scrub,omitempty"`
+}
+
+// persistedStats are the cumulative counters saved in dataDir
+type persistedStats struct {
+	Since         time.Time        `json:"since"`
+	Requests      int64            `json:"requests"`
+	Errors        int64            `json:"errors"`
+	BytesSent     int64            `json:"bytesSent"`
+	BytesReceived int64            `json:"bytesReceived"`
+	Downloads     int64            `json:"downloads"`
+	Uploads       int64            `json:"uploads"`
+	FileDownloads map[string]int64 `json:"fileDownloads"`
+}
+
+// transfer is a download or upload in progress
+type transfer struct {
+	id       int64
+	kind     string
+	client   string
+	user     string
+	size     int64
+	started  time.Time
+	bytes    atomic.Int64
+	canceled atomic.Bool
+	// expired holds why -upload-timeout or -upload-min-rate aborted an
+	// upload, if they did
+	expired atomic.Value
+	// share is the link a download goes through, whose policies apply
+	share *ShareLink
+
+	mu   sync.Mutex
+	path string
+}
+
+// serverStats collects live counters, recent requests and active transfers
+type serverStats struct {
+	since         time.Time
+	started       time.Time
+	requests      atomic.Int64
+	errors        atomic.Int64
+	bytesSent     atomic.Int64
+	bytesReceived atomic.Int64
+	downloads     atomic.Int64
+	uploads       atomic.Int64
+
+	mu           sync.Mutex
+	recent       []RequestRecord
+	recentErrors []RequestRecord
+	transfers    map[int64]*transfer
+	nextID       int64
+	// fileDownloads counts downloads per path
+	fileDownloads map[string]int64
+}
+
+var stats = &serverStats{
+	since:         time.Now(),
+	started:       time.Now(),
+	transfers:     make(map[int64]*transfer),
+	fileDownloads: make(map[string]int64),
+}
+
+// recordRequest adds a completed request to the counters and recent lists
+func (s *serverStats) recordRequest(record RequestRecord) {
+	s.requests.Add(1)
+	isError := record.Status >= 400
+	if isError {
+		s.errors.Add(1)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.recent = appendRecent(s.recent, record)
+	if isError {
+		s.recentErrors = appendRecent(s.recentErrors, record)
+	}
+}
+
+// appendRecent appends a record, dropping the oldest beyond recentRequestLimit
+func appendRecent(records []RequestRecord, record RequestRecord) []RequestRecord {
+	records = append(records, record)
+	if len(records) > recentRequestLimit {
+		records = append(records[:0], records[len(records)-recentRequestLimit:]...)
+	}
+	return records
+}
+
+// startTransfer registers a download or upload of size bytes (-1 if unknown)
+// by client, on behalf of user if authenticated
+func (s *serverStats) startTransfer(kind, path, client, user string, size int64) *transfer {
+	switch kind {
+	case "download":
+		s.downloads.Add(1)
+	case "upload":
+		s.uploads.Add(1)
+	}
+	if user != "" {
+		usage.startTransfer(user, kind)
+	}
+	if kind == "download" && tiers != nil {
+		tiers.touch(path)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if kind == "download" {
+		s.fileDownloads[path]++
+	}
+	s.nextID++
+	t := &transfer{
+		id:      s.nextID,
+		kind:    kind,
+		path:    path,
+		client:  client,
+		user:    user,
+		size:    size,
+		started: time.Now(),
+	}
+	s.transfers[t.id] = t
+	return t
+}
+
+// endTransfer removes a finished transfer
+func (s *serverStats) endTransfer(t *transfer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.transfers, t.id)
+}
+
+// cancelTransfer makes the reads of a transfer fail, which ends it; it
+// returns the transfer, or nil if no transfer has that ID
+func (s *serverStats) cancelTransfer(id int64) *transfer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.transfers[id]
+	if !ok {
+		return nil
+	}
+	t.canceled.Store(true)
+	return t
+}
+
+// activeTransfers returns the transfers in progress, oldest first
+func (s *serverStats) activeTransfers() []TransferInfo {
+	s.mu.Lock()
+	transfers := make([]TransferInfo, 0, len(s.transfers))
+	for _, t := range s.transfers {
+		transfers = append(transfers, t.info())
+	}
+	s.mu.Unlock()
+
+	sort.Slice(transfers, func(i, j int) bool { return transfers[i].ID < transfers[j].ID })
+	return transfers
+}
+
+// snapshot returns a copy of the current statistics
+func (s *serverStats) snapshot() StatsSnapshot {
+	snap := StatsSnapshot{
+		Started:       s.started,
+		Requests:      s.requests.Load(),
+		Errors:        s.errors.Load(),
+		BytesSent:     s.bytesSent.Load(),
+		BytesReceived: s.bytesReceived.Load(),
+		Downloads:     s.downloads.Load(),
+		Uploads:       s.uploads.Load(),
+	}
+
+	s.mu.Lock()
+	snap.Since = s.since
+	snap.TopDownloads = make([]FileCount, 0, len(s.fileDownloads))
+	for path, count := range s.fileDownloads {
+		snap.TopDownloads = append(snap.TopDownloads, FileCount{Path: path, Count: count})
+	}
+	snap.Recent = append([]RequestRecord{}, s.recent...)
+	snap.RecentErrors = append([]RequestRecord{}, s.recentErrors...)
+	s.mu.Unlock()
+
+	snap.Transfers = s.activeTransfers()
+	if scrubber != nil {
+		scrub := scrubber.current()
+		snap.Scrub = &scrub
+	}
+	sort.Slice(snap.TopDownloads, func(i, j int) bool {
+		if snap.TopDownloads[i].Count != snap.TopDownloads[j].Count {
+			return snap.TopDownloads[i].Count > snap.TopDownloads[j].Count
+		}
+		return snap.TopDownloads[i].Path < snap.TopDownloads[j].Path
+	})
+	if len(snap.TopDownloads) > topDownloadLimit {
+		snap.TopDownloads = snap.TopDownloads[:topDownloadLimit]
+	}
+	return snap
+}
+
+// persisted returns the cumulative counters to save across restarts
+func (s *serverStats) persisted() persistedStats {
+	saved := persistedStats{
+		Requests:      s.requests.Load(),
+		Errors:        s.errors.Load(),
+		BytesSent:     s.bytesSent.Load(),
+		BytesReceived: s.bytesReceived.Load(),
+		Downloads:     s.downloads.Load(),
+		Uploads:       s.uploads.Load(),
+		FileDownloads: make(map[string]int64),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	saved.Since = s.since
+	for path, count := range s.fileDownloads {
+		saved.FileDownloads[path] = count
+	}
+	return saved
+}
+
+// restore adds counters saved by a previous run
+func (s *serverStats) restore(saved persistedStats) {
+	s.requests.Add(saved.Requests)
+	s.errors.Add(saved.Errors)
+	s.bytesSent.Add(saved.BytesSent)
+	s.bytesReceived.Add(saved.BytesReceived)
+	s.downloads.Add(saved.Downloads)
+	s.uploads.Add(saved.Uploads)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !saved.Since.IsZero() && saved.Since.Before(s.since) {
+		s.since = saved.Since
+	}
+	for path, count := range saved.FileDownloads {
+		s.fileDownloads[path] += count
+	}
+}
+
+// setPath updates the path once it is known (uploads learn it from the form)
+func (t *transfer) setPath(path string) {
+	t.mu.Lock()
+	t.path = path
+	t.mu.Unlock()
+}
+
+// info describes the transfer for the admin API
+func (t *transfer) info() TransferInfo {
+	t.mu.Lock()
+	path := t.path
+	t.mu.Unlock()
+
+	bytes := t.bytes.Load()
+	rate := 0.0
+	if elapsed := time.Since(t.started).Seconds(); elapsed > 0 {
+		rate = float64(bytes) / elapsed
+	}
+	return TransferInfo{
+		ID:       t.id,
+		Kind:     t.kind,
+		Path:     path,
+		Client:   t.client,
+		User:     t.user,
+		Bytes:    bytes,
+		Size:     t.size,
+		Started:  t.started,
+		Rate:     rate,
+		Canceled: t.canceled.Load(),
+	}
+}
+
+// add counts n transferred bytes, also toward the user's accounting
+func (t *transfer) add(n int64) {
+	t.bytes.Add(n)
+	if t.user != "" {
+		usage.add(t.user, t.kind, n)
+	}
+}
+
+// interrupted returns the status and message to end a transfer with when
+// the administrator canceled it or an upload limit aborted it, or 0
+func (t *transfer) interrupted() (int, string) {
+	if t.canceled.Load() {
+		return http.StatusServiceUnavailable, "Upload canceled by the administrator"
+	}
+	if reason, _ := t.expired.Load().(string); reason != "" {
+		return http.StatusRequestTimeout, "Upload aborted: it " + reason
+	}
+	return 0, ""
+}
+
+// reader wraps r so that data read through it counts toward the transfer
+func (t *transfer) reader(r io.Reader) io.Reader {
+	return &transferReader{Reader: r, transfer: t}
+}
+
+// transferReader counts the bytes read toward a transfer
+type transferReader struct {
+	io.Reader
+	transfer *transfer
+	// booked is the time the bytes read so far take at -max-per-conn
+	booked time.Time
+}
+
+func (r *transferReader) Read(p []byte) (int, error) {
+	if r.transfer.canceled.Load() || r.transfer.expired.Load() != nil {
+		return 0, errTransferCanceled
+	}
+	// Downloads share the bandwidth of the -bandwidth schedule and
+	// -max-bandwidth, and each is held to -max-per-conn
+	throttled := r.transfer.kind == "download"
+	if throttled {
+		p = p[:bandwidth.limit(len(p))]
+	}
+	share := r.transfer.share
+	if share != nil && len(p) > 0 {
+		if p = p[:share.limit(len(p))]; len(p) == 0 {
+			return 0, errShareUsedUp
+		}
+	}
+	n, err := r.Reader.Read(p)
+	r.transfer.add(int64(n))
+	if throttled {
+		bandwidth.wait(n, &r.booked)
+	}
+	if share != nil {
+		share.send(n)
+	}
+	return n, err
+}
+
+// countingReader adds the number of bytes read to count
+type countingReader struct {
+	io.Reader
+	count *atomic.Int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	c.count.Add(int64(n))
+	return n, err
+}
+
+// countingReadCloser is a countingReader for request bodies
+type countingReadCloser struct {
+	countingReader
+	io.Closer
+}
+
+// readCloser combines a wrapped request body with the original's Close
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// statusRecorder captures the status code and body size of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	stats.bytesSent.Add(int64(n))
+	return n, err
+}
+
+// Flush lets streaming handlers flush through the recorder
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// trustedProxies are the addresses of reverse proxies whose
+// X-Forwarded-For or X-Real-IP header names the client (-trusted-proxies)
+var trustedProxies []*net.IPNet
+
+// parseNetworks parses a comma-separated list of addresses and CIDR
+// networks
+func parseNetworks(list string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", item)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// networksContain reports whether an address belongs to one of networks
+func networksContain(networks []*net.IPNet, host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// isTrustedProxy reports whether an address belongs to -trusted-proxies
+func isTrustedProxy(host string) bool {
+	return networksContain(trustedProxies, host)
+}
+
+// clientHost returns the address of the client of a request: the host part
+// of its remote address or, for requests through -trusted-proxies, the
+// last address in X-Forwarded-For that isn't one of them, or X-Real-IP
+// when a proxy sends only that. A hop that isn't an address is the client
+// too rather than letting the request pass for the proxy.
+func clientHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if len(trustedProxies) == 0 || !isTrustedProxy(host) {
+		return host
+	}
+	if r.Header.Get("X-Forwarded-For") == "" {
+		if real := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(real) != nil {
+			return real
+		}
+		return host
+	}
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		host = strings.TrimSpace(forwarded[i])
+		if !isTrustedProxy(host) {
+			break
+		}
+	}
+	return host
+}
+
+// adminMiddleware restricts admin endpoints to admins (see isAdmin)
+func adminMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isAdmin(r) {
+			auditLogf("admin-denied client=%s path=%q", clientHost(r), r.URL.Path)
+			http.Error(w, "Access denied", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// adminStatsHandler serves live server statistics as JSON
+func adminStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(stats.snapshot()); err != nil {
+		log.Printf("JSON encoding error: %v", err)
+	}
+}
+
+// adminTransfersHandler lists the transfers in progress as JSON
+func adminTransfersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(stats.activeTransfers()); err != nil {
+		log.Printf("JSON encoding error: %v", err)
+	}
+}
+
+// adminCancelTransferHandler cancels the transfer named in the path
+// (DELETE /api/admin/transfers/<id>)
+func adminCancelTransferHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.ParseInt(pathParam(r, "id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid transfer ID", http.StatusBadRequest)
+		return
+	}
+	t := stats.cancelTransfer(id)
+	if t == nil {
+		http.Error(w, "Transfer not found", http.StatusNotFound)
+		return
+	}
+	info := t.info()
+	auditLogf("cancel-transfer client=%s id=%d kind=%s path=%q transfer-client=%s", clientHost(r), id, info.Kind, info.Path, info.Client)
+	w.WriteHeader(http.StatusNoContent)
+}
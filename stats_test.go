@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientHostAndAdmin(t *testing.T) {
+	oldProxies, oldLoopback := trustedProxies, adminLoopback
+	t.Cleanup(func() { trustedProxies, adminLoopback = oldProxies, oldLoopback })
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+
+	tests := []struct {
+		name     string
+		remote   string
+		proxies  []*net.IPNet
+		header   string
+		value    string
+		loopback bool
+		client   string
+		admin    bool
+	}{
+		{"direct loopback", "127.0.0.1:5000", nil, "", "", true, "127.0.0.1", true},
+		{"loopback without opt-in", "127.0.0.1:5000", nil, "", "", false, "127.0.0.1", false},
+		{"remote", "203.0.113.7:5000", nil, "", "", true, "203.0.113.7", false},
+		{"local proxy, not trusted", "127.0.0.1:5000", nil, "X-Forwarded-For", "203.0.113.7", true, "127.0.0.1", false},
+		{"local proxy with X-Real-IP", "127.0.0.1:5000", nil, "X-Real-IP", "203.0.113.7", true, "127.0.0.1", false},
+		{"local proxy with Forwarded", "127.0.0.1:5000", nil, "Forwarded", "for=203.0.113.7", true, "127.0.0.1", false},
+		{"trusted proxy", "127.0.0.1:5000", []*net.IPNet{loopback}, "X-Forwarded-For", "203.0.113.7", true, "203.0.113.7", false},
+		{"trusted proxy, spoofed hop", "127.0.0.1:5000", []*net.IPNet{loopback}, "X-Forwarded-For", "127.0.0.1, 203.0.113.7", true, "203.0.113.7", false},
+		{"trusted proxy, unparseable hop", "127.0.0.1:5000", []*net.IPNet{loopback}, "X-Forwarded-For", "unknown", true, "unknown", false},
+		{"trusted proxy, loopback client", "127.0.0.1:5000", []*net.IPNet{loopback}, "X-Forwarded-For", "127.0.0.2", true, "127.0.0.2", false},
+	}
+	for _, tt := range tests {
+		trustedProxies, adminLoopback = tt.proxies, tt.loopback
+		r := httptest.NewRequest("GET", "/api/admin/stats", nil)
+		r.RemoteAddr = tt.remote
+		if tt.header != "" {
+			r.Header.Set(tt.header, tt.value)
+		}
+		if got := clientHost(r); got != tt.client {
+			t.Errorf("%s: clientHost = %q, want %q", tt.name, got, tt.client)
+		}
+		if got := isAdmin(r); got != tt.admin {
+			t.Errorf("%s: isAdmin = %v, want %v", tt.name, got, tt.admin)
+		}
+	}
+}
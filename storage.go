@@ -0,0 +1,288 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// storage is where the served files are kept. Names are slash-separated
+// paths relative to the served root, "." for the root itself, as io/fs
+// has them. Browsing, listings and downloads read through it, so another
+// backend (in memory, embedded, remote) can stand in for the local disk.
+// Files that implement io.Seeker make Range requests cheap; others are
+// read up to the range.
+type storage interface {
+	fs.StatFS
+	fs.ReadDirFS
+}
+
+// writableStorage is a storage files can be written to. Without one, the
+// server is read-only: canWrite refuses everything. WriteFile stores what
+// it reads from r as a file, replacing any file of that name, and leaves
+// things as they were if reading r fails.
+type writableStorage interface {
+	storage
+	WriteFile(name string, r io.Reader) error
+	MkdirAll(name string, perm fs.FileMode) error
+	Rename(oldname, newname string) error
+	Remove(name string) error
+}
+
+// served is the storage the server works on: the local disk, workingDir
+// with the mounts, unless another backend is plugged in (-backend)
+var served storage = localStorage{}
+
+// diskBacked reports whether the files are on the local disk, which the
+// features that don't go through the storage need
+func diskBacked() bool {
+	_, ok := served.(localStorage)
+	return ok
+}
+
+// diskMiddleware answers requests for features that only work on the
+// local disk with 501 Not Implemented under another backend
+func diskMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !diskBacked() {
+			http.Error(w, "Not available with this storage backend", http.StatusNotImplemented)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// openBackend sets up the storage of -backend, an s3:// or sftp:// URL
+func openBackend(rawURL string) (writableStorage, error) {
+	switch {
+	case strings.HasPrefix(rawURL, "s3://"):
+		return openS3Storage(rawURL)
+	case strings.HasPrefix(rawURL, "sftp://"):
+		return openSFTPStorage(rawURL)
+	}
+	return nil, fmt.Errorf("unsupported backend %q (expected s3://bucket/prefix or sftp://user@host/path)", rawURL)
+}
+
+// storageName returns the storage name of a path relative to the served
+// root, as the routes take it
+func storageName(requestedPath string) string {
+	name := strings.Trim(path.Clean("/"+filepath.ToSlash(requestedPath)), "/")
+	if name == "" {
+		return "."
+	}
+	return name
+}
+
+// localStorage is the storage of workingDir and the mounts, on the local
+// disk. Names resolve like the routes' paths, confined to their root and
+// matching canonically equivalent names.
+type localStorage struct{}
+
+// path returns where a name is on disk
+func (localStorage) path(op, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	p, err := resolvePath(name)
+	if err != nil {
+		return "", &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	return p, nil
+}
+
+func (s localStorage) Open(name string) (fs.File, error) {
+	p, err := s.path("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(p)
+}
+
+func (s localStorage) Stat(name string) (fs.FileInfo, error) {
+	p, err := s.path("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(p)
+}
+
+// ReadDir lists a directory sorted by name. Symbolic links are listed as
+// what they point to, and the root lists the mounts in place of any
+// entries of the same names.
+func (s localStorage) ReadDir(name string) ([]fs.DirEntry, error) {
+	p, err := s.path("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(p)
+	if err != nil {
+		return nil, err
+	}
+	for i, entry := range entries {
+		if entry.Type()&fs.ModeSymlink != 0 {
+			entries[i] = followSymlink(p, entry)
+		}
+	}
+	if name == "." {
+		entries = withMounts(entries)
+	}
+	return entries, nil
+}
+
+// WriteFile writes the file under a temporary name beside it and renames
+// it into place once complete
+func (s localStorage) WriteFile(name string, r io.Reader) error {
+	p, err := s.path("write", name)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(p), "."+filepath.Base(p)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, _, err = storeFile(tmp, r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), p)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func (s localStorage) MkdirAll(name string, perm fs.FileMode) error {
+	p, err := s.path("mkdir", name)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(p, perm)
+}
+
+func (s localStorage) Rename(oldname, newname string) error {
+	oldPath, err := s.path("rename", oldname)
+	if err != nil {
+		return err
+	}
+	newPath, err := s.path("rename", newname)
+	if err != nil {
+		return err
+	}
+	return os.Rename(oldPath, newPath)
+}
+
+func (s localStorage) Remove(name string) error {
+	p, err := s.path("remove", name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(p)
+}
+
+// saveUploadToStorage stores one file part of an upload request in a
+// backend other than the local disk, below subDir. Names, access rules,
+// conflicts and the upload policy are handled as saveUpload does; the
+// file is written in one go, so a failed upload leaves things as they
+// were.
+func saveUploadToStorage(r *http.Request, transfer *transfer, user, subDir string, part *multipart.Part) (UploadResult, *uploadError) {
+	segments := strings.Split(uploadFilename(part), "/")
+	dir := subDir
+	for _, segment := range segments[:len(segments)-1] {
+		if segment = strings.TrimSpace(segment); segment == "" || segment == "." || segment == ".." {
+			continue
+		}
+		dir = path.Join(dir, norm.NFC.String(sanitizeUploadName(segment)))
+	}
+	fileName := norm.NFC.String(sanitizeUploadName(segments[len(segments)-1]))
+	requestedPath := path.Join(dir, fileName)
+	transfer.setPath(requestedPath)
+	store, ok := served.(writableStorage)
+	if !ok || !canWrite(user, requestedPath) {
+		return UploadResult{}, &uploadError{http.StatusForbidden, "Access denied"}
+	}
+	policy, policyErr := checkUploadPolicy(dir, user, fileName, -1)
+	if policyErr != nil {
+		return UploadResult{}, policyErr
+	}
+	if dir != subDir {
+		if err := store.MkdirAll(storageName(dir), 0755); err != nil {
+			return UploadResult{}, &uploadError{http.StatusConflict, "Error creating folder: " + err.Error()}
+		}
+	}
+
+	// An existing file is replaced, kept, or kept next to the upload as
+	// -on-conflict or the directory's upload policy says
+	action := "created"
+	if info, err := store.Stat(storageName(requestedPath)); err == nil {
+		switch {
+		case info.IsDir():
+			return UploadResult{}, &uploadError{http.StatusConflict, "A folder with that name already exists"}
+		case policy.conflict() == conflictReject:
+			return UploadResult{}, &uploadError{http.StatusConflict, "A file with that name already exists"}
+		case policy.conflict() == conflictRename:
+			// A renamed upload takes the first free " (n)" name
+			action = "renamed"
+			ext := path.Ext(fileName)
+			stem := strings.TrimSuffix(fileName, ext)
+			for n := 1; ; n++ {
+				requestedPath = path.Join(dir, fmt.Sprintf("%s (%d)%s", stem, n, ext))
+				if _, err := store.Stat(storageName(requestedPath)); err != nil {
+					break
+				}
+			}
+			transfer.setPath(requestedPath)
+		default:
+			action = "replaced"
+		}
+	}
+
+	var src io.Reader = part
+	if policy.maxSize >= 0 {
+		src = http.MaxBytesReader(nil, io.NopCloser(part), policy.maxSize)
+	}
+	var written atomic.Int64
+	hash := sha256.New()
+	err := store.WriteFile(storageName(requestedPath), io.TeeReader(&countingReader{Reader: src, count: &written}, hash))
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		return UploadResult{}, policy.check(user, fileName, policy.maxSize+1)
+	case err != nil:
+		if status, message := transfer.interrupted(); status != 0 {
+			return UploadResult{}, &uploadError{status, message}
+		}
+		return UploadResult{}, &uploadError{http.StatusInternalServerError, "Error saving file: " + err.Error()}
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+	if checksums != nil {
+		if err := checksums.record(requestedPath, sum, written.Load()); err != nil {
+			return UploadResult{}, &uploadError{http.StatusInternalServerError, "Error recording checksum: " + err.Error()}
+		}
+	}
+	auditLogf("upload client=%s path=%q size=%d action=%s", clientHost(r), requestedPath, written.Load(), action)
+	journal.note(requestedPath)
+
+	result := UploadResult{
+		Path:   requestedPath,
+		Size:   written.Load(),
+		SHA256: sum,
+		Action: action,
+	}
+	result.URL = (&url.URL{Path: urlPrefix + "/download/" + result.Path}).String()
+	return result, nil
+}
@@ -0,0 +1,10 @@
+//go:build windows || plan9
+
+package main
+
+import "errors"
+
+// newSyslogSink is not available on this platform
+func newSyslogSink(target string, facility int, tag string) (logSink, error) {
+	return nil, errors.New("syslog output is not supported on this platform")
+}
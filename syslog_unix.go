@@ -0,0 +1,41 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"fmt"
+	"log/syslog"
+	"net/url"
+)
+
+// syslogSink writes records to a syslog daemon
+type syslogSink struct {
+	writer *syslog.Writer
+}
+
+// newSyslogSink connects to the local syslog daemon ("local") or a remote
+// one given as udp://host:port or tcp://host:port
+func newSyslogSink(target string, facility int, tag string) (logSink, error) {
+	network, raddr := "", ""
+	if target != "local" {
+		u, err := url.Parse(target)
+		if err != nil || (u.Scheme != "udp" && u.Scheme != "tcp") || u.Host == "" {
+			return nil, fmt.Errorf("invalid syslog target %q (expected 'local', udp://host:port or tcp://host:port)", target)
+		}
+		network, raddr = u.Scheme, u.Host
+	}
+
+	writer, err := syslog.Dial(network, raddr, syslog.Priority(facility<<3)|syslog.LOG_INFO, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogSink{writer: writer}, nil
+}
+
+func (s *syslogSink) Access(msg string) error {
+	return s.writer.Info(msg)
+}
+
+func (s *syslogSink) Audit(msg string) error {
+	return s.writer.Notice(msg)
+}
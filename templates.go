@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// templateFuncs are the functions every page template may call, built-in
+// and operator-supplied (-templates) alike. Functions added here are
+// available to all of them; list them in the README as well.
+var templateFuncs = template.FuncMap{
+	// Sizes, rates and dates
+	"formatSize": formatSize,
+	"formatRate": formatRate,
+	"formatDate": formatDate,
+	"timeAgo":    timeAgo,
+	"percent":    percent,
+	// Paths and the URLs of the server's routes
+	"splitPath":   splitPath,
+	"joinPath":    joinPath,
+	"browseURL":   func(p string) string { return routeURL("", p) },
+	"downloadURL": func(p string) string { return routeURL("/download", p) },
+	"archiveURL":  archiveURL,
+	"loginURL":    loginURL,
+	"prefix":      func() string { return urlPrefix },
+	// Files
+	"fileCategory": fileCategory,
+	"categoryIcon": func(category string) string { return categoryIcons[category] },
+}
+
+// loadTemplates parses the embedded page templates, then those in dir
+// (-templates), which replace embedded ones of the same name or add new
+// ones to include
+func loadTemplates(dir string) (*template.Template, error) {
+	t, err := template.New("").Funcs(templateFuncs).ParseFS(templateFS, "templates/*.html")
+	if err != nil || dir == "" {
+		return t, err
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.html"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no .html files in %s", dir)
+	}
+	return t.ParseFiles(files...)
+}
+
+// AuthContext describes who is viewing a page, as .Auth of every page
+type AuthContext struct {
+	// Enabled is set when the server has accounts (-auth or -users)
+	Enabled bool
+	// User is the logged-in user, or "" for anonymous visitors
+	User string
+	// Session is set for users logged in with the login page or OpenID
+	// Connect, who can log out
+	Session bool
+	// Admin is set when the admin pages (/admin/...) are open to the viewer
+	Admin bool
+}
+
+// Page is embedded in the data of every page template
+type Page struct {
+	Auth AuthContext `json:"-"`
+}
+
+func (p *Page) page() *Page { return p }
+
+// pageData is the data of a page template
+type pageData interface {
+	page() *Page
+}
+
+// renderTemplate executes a page template for a request, filling in the
+// request's .Auth
+func renderTemplate(w http.ResponseWriter, r *http.Request, name string, data pageData) error {
+	user := authenticatedUser(r)
+	auth := AuthContext{Enabled: authEnabled(), User: user, Admin: isAdmin(r)}
+	if sessionsEnabled() && user != "" {
+		sessionUser, _ := readSession(r)
+		auth.Session = sessionUser == user
+	}
+	data.page().Auth = auth
+	return templates.ExecuteTemplate(w, name, data)
+}
+
+// isAdmin reports whether a request may use the admin endpoints: it comes
+// from an admin of the user database or, with -admin-loopback, from the
+// loopback interface. A request carrying forwarding headers was relayed by
+// a proxy on the host, such as nginx in front of the server, and its
+// client may be anywhere.
+func isAdmin(r *http.Request) bool {
+	if adminLoopback && !relayed(r) {
+		if ip := net.ParseIP(clientHost(r)); ip != nil && ip.IsLoopback() {
+			return true
+		}
+	}
+	return accounts != nil && roleOf(authenticatedUser(r)) == roleAdmin
+}
+
+// relayed reports whether a request says it was relayed by a proxy
+func relayed(r *http.Request) bool {
+	for _, header := range []string{"Forwarded", "X-Forwarded-For", "X-Real-IP"} {
+		if r.Header.Get(header) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// routeURL returns the escaped URL of a path (relative to workingDir) below
+// a route of the server, including -prefix
+func routeURL(route, p string) string {
+	return urlPrefix + (&url.URL{Path: route + "/" + strings.TrimPrefix(p, "/")}).String()
+}
+
+// archiveURL returns the URL of a directory's archive in a format ("zip"
+// or "tar.gz")
+func archiveURL(p, format string) string {
+	u := routeURL("/zip", p)
+	if format != "" && format != "zip" {
+		u += "?format=" + url.QueryEscape(format)
+	}
+	return u
+}
+
+// loginURL returns the URL of the login page, coming back to a path; the
+// page redirects without -prefix, which prefixMiddleware adds
+func loginURL(p string) string {
+	next := (&url.URL{Path: "/" + strings.TrimPrefix(p, "/")}).String()
+	return urlPrefix + "/login?next=" + url.QueryEscape(next)
+}
+
+// timeAgo formats a time relative to now, e.g. "5 minutes ago", and as a
+// date once it is more than a week ago
+func timeAgo(t time.Time) string {
+	elapsed := time.Since(t)
+	plural := func(n int, unit string) string {
+		if n == 1 {
+			return "1 " + unit + " ago"
+		}
+		return fmt.Sprintf("%d %ss ago", n, unit)
+	}
+	switch {
+	case elapsed < time.Minute:
+		return "just now"
+	case elapsed < time.Hour:
+		return plural(int(elapsed/time.Minute), "minute")
+	case elapsed < 24*time.Hour:
+		return plural(int(elapsed/time.Hour), "hour")
+	case elapsed < 7*24*time.Hour:
+		return plural(int(elapsed/(24*time.Hour)), "day")
+	}
+	return t.Format("2006-01-02")
+}
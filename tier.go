@@ -0,0 +1,215 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tierSweepInterval is how often tiered directories are searched for files
+// to move to cold storage
+const tierSweepInterval = time.Hour
+
+// coldStorage moves files nobody has used for a while out of the tiered
+// directories (-tier) to a secondary path (-tier-path), such as a large
+// slow disk or a mounted object store. A symbolic link takes the place of
+// each moved file, so it is still listed and served; downloading it moves
+// it back.
+type coldStorage struct {
+	dirs  []string
+	after time.Duration
+	dir   string
+
+	mu sync.Mutex
+	// accessed holds when files were last downloaded, by path relative to
+	// workingDir; files not in it count as used when they were modified
+	accessed map[string]time.Time
+	// recalling holds the files being moved back
+	recalling map[string]bool
+}
+
+// tiers is nil unless -tier is set
+var tiers *coldStorage
+
+// startColdStorage loads the access times kept in dataDir and starts
+// sweeping dirs (relative to workingDir) for files unused for after
+func startColdStorage(dirs []string, after time.Duration, dir string) (*coldStorage, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	c := &coldStorage{dirs: dirs, after: after, dir: dir, accessed: make(map[string]time.Time), recalling: make(map[string]bool)}
+	if err := loadState("tier", &c.accessed); err != nil {
+		return nil, err
+	}
+	ticker := time.NewTicker(tierSweepInterval)
+	go func() {
+		for ; ; <-ticker.C {
+			c.sweep()
+		}
+	}()
+	return c, nil
+}
+
+// persisted returns the access times to save across restarts, without
+// those old enough not to matter any more
+func (c *coldStorage) persisted() map[string]time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	saved := make(map[string]time.Time, len(c.accessed))
+	for p, t := range c.accessed {
+		if time.Since(t) < c.after {
+			saved[p] = t
+		}
+	}
+	return saved
+}
+
+// tiered reports whether a path relative to workingDir is in a tiered
+// directory
+func (c *coldStorage) tiered(requestedPath string) bool {
+	requestedPath = path.Clean("/" + requestedPath)
+	for _, dir := range c.dirs {
+		if dir == "/" || requestedPath == dir || strings.HasPrefix(requestedPath, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// stub returns the cold copy a file was replaced with, if it was
+func (c *coldStorage) stub(fullPath string) (string, bool) {
+	target, err := os.Readlink(fullPath)
+	if err != nil || !strings.HasPrefix(target, c.dir+string(filepath.Separator)) {
+		return "", false
+	}
+	return target, true
+}
+
+// touch records a download of a file, and moves the file back from cold
+// storage if it is there. The download itself reads the cold copy.
+func (c *coldStorage) touch(requestedPath string) {
+	requestedPath = strings.TrimPrefix(path.Clean("/"+requestedPath), "/")
+	if !c.tiered(requestedPath) {
+		return
+	}
+	c.mu.Lock()
+	c.accessed[requestedPath] = time.Now()
+	fullPath := localPath(requestedPath)
+	cold, ok := c.stub(fullPath)
+	if !ok || c.recalling[requestedPath] {
+		c.mu.Unlock()
+		return
+	}
+	c.recalling[requestedPath] = true
+	c.mu.Unlock()
+
+	go func() {
+		if err := c.recall(fullPath, cold); err != nil {
+			log.Printf("Failed to move %s back from cold storage: %v", requestedPath, err)
+		} else {
+			auditLogf("tier-recalled path=%q", requestedPath)
+		}
+		c.mu.Lock()
+		delete(c.recalling, requestedPath)
+		c.mu.Unlock()
+	}()
+}
+
+// recall replaces the link at fullPath with a copy of the cold file and
+// removes that
+func (c *coldStorage) recall(fullPath, cold string) error {
+	tmp := filepath.Join(filepath.Dir(fullPath), ".recall-"+filepath.Base(fullPath))
+	os.Remove(tmp)
+	if err := copyTree(cold, tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	// The link may have been moved or replaced meanwhile
+	if target, ok := c.stub(fullPath); !ok || target != cold {
+		os.Remove(tmp)
+		return nil
+	}
+	if err := os.Rename(tmp, fullPath); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Remove(cold)
+}
+
+// sweep moves the files of the tiered directories that were neither
+// modified nor downloaded for c.after to cold storage
+func (c *coldStorage) sweep() {
+	cutoff := time.Now().Add(-c.after)
+	var moved int
+	for _, dir := range c.dirs {
+		root := filepath.Join(workingDir, filepath.FromSlash(dir))
+		filepath.WalkDir(root, func(fullPath string, d fs.DirEntry, err error) error {
+			if err != nil || !d.Type().IsRegular() || strings.HasPrefix(d.Name(), ".") {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil || info.ModTime().After(cutoff) {
+				return nil
+			}
+			rel, err := filepath.Rel(workingDir, fullPath)
+			if err != nil {
+				return nil
+			}
+			requestedPath := filepath.ToSlash(rel)
+			c.mu.Lock()
+			accessed := c.accessed[requestedPath]
+			c.mu.Unlock()
+			if accessed.After(cutoff) {
+				return nil
+			}
+			if err := c.freeze(fullPath, requestedPath, info); err != nil {
+				log.Printf("Failed to move %s to cold storage: %v", requestedPath, err)
+				return nil
+			}
+			auditLogf("tier-moved path=%q size=%d", requestedPath, info.Size())
+			moved++
+			return nil
+		})
+	}
+	if moved > 0 {
+		log.Printf("Moved %d files to cold storage", moved)
+	}
+}
+
+// freeze copies a file to cold storage and puts a link to the copy in its
+// place
+func (c *coldStorage) freeze(fullPath, requestedPath string, info fs.FileInfo) error {
+	cold := filepath.Join(c.dir, filepath.FromSlash(requestedPath))
+	if err := os.MkdirAll(filepath.Dir(cold), 0700); err != nil {
+		return err
+	}
+	// A link moved elsewhere may still point to an earlier copy
+	cold = availablePath(cold)
+	if err := copyTree(fullPath, cold); err != nil {
+		os.Remove(cold)
+		return err
+	}
+	// Leave files changed while they were copied alone
+	if now, err := os.Lstat(fullPath); err != nil || now.Size() != info.Size() || !now.ModTime().Equal(info.ModTime()) {
+		os.Remove(cold)
+		return errors.New("changed while it was copied")
+	}
+	link := filepath.Join(filepath.Dir(fullPath), ".tier-"+filepath.Base(fullPath))
+	os.Remove(link)
+	if err := os.Symlink(cold, link); err != nil {
+		os.Remove(cold)
+		return err
+	}
+	if err := os.Rename(link, fullPath); err != nil {
+		os.Remove(link)
+		os.Remove(cold)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// selfSignedLifetime is how long a generated certificate is valid; a new
+// one is made on every start anyway
+const selfSignedLifetime = 365 * 24 * time.Hour
+
+// selfSignedCertificate makes an ECDSA certificate for the names and
+// addresses the server is likely reached at (-tls-self-signed). It is only
+// kept in memory. The names and the SHA-256 fingerprint of the
+// certificate are returned too, so users can check what their browser
+// shows them.
+func selfSignedCertificate(hosts []string) (tls.Certificate, []string, string, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, nil, "", err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, nil, "", err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "files", Organization: []string{"files (self-signed)"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(selfSignedLifetime),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	// The names and addresses of the host, or just the ones listened on;
+	// a name no client uses does no harm
+	addIP := func(ip net.IP) {
+		for _, known := range template.IPAddresses {
+			if known.Equal(ip) {
+				return
+			}
+		}
+		template.IPAddresses = append(template.IPAddresses, ip)
+	}
+	everywhere := false
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() {
+			addIP(ip)
+		} else if host != "" && ip == nil {
+			template.DNSNames = append(template.DNSNames, host)
+		} else {
+			everywhere = true
+		}
+	}
+	if everywhere {
+		template.DNSNames = append(template.DNSNames, "localhost")
+		if name, err := os.Hostname(); err == nil && name != "" && name != "localhost" {
+			template.DNSNames = append(template.DNSNames, name)
+			if short, _, found := strings.Cut(name, "."); found {
+				template.DNSNames = append(template.DNSNames, short)
+			} else {
+				template.DNSNames = append(template.DNSNames, name+".local")
+			}
+		}
+		if addrs, err := net.InterfaceAddrs(); err == nil {
+			for _, addr := range addrs {
+				if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLinkLocalUnicast() {
+					addIP(ipNet.IP)
+				}
+			}
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, nil, "", err
+	}
+	names := append([]string{}, template.DNSNames...)
+	for _, ip := range template.IPAddresses {
+		names = append(names, ip.String())
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, names, certificateFingerprint(der), nil
+}
+
+// certificateFingerprint formats the SHA-256 of a certificate the way
+// browsers show it
+func certificateFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
+
+// redirectToHTTPS answers plain HTTP requests (-redirect-http) with a
+// permanent redirect to the same URL on the HTTPS port
+func redirectToHTTPS(httpsPort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+		if host == "" {
+			http.Error(w, "Use HTTPS", http.StatusBadRequest)
+			return
+		}
+		if httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		target := url.URL{Scheme: "https", Host: host, Path: r.URL.Path, RawPath: r.URL.RawPath, RawQuery: r.URL.RawQuery}
+		http.Redirect(w, r, target.String(), http.StatusMovedPermanently)
+	})
+}
+
+// serveRedirects runs the HTTP listener of -redirect-http. While a
+// replaced process still holds the address after an upgrade, it retries.
+func serveRedirects(address, httpsPort string) {
+	server := &http.Server{
+		Addr:              address,
+		Handler:           redirectToHTTPS(httpsPort),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	for logged := false; ; time.Sleep(time.Second) {
+		err := server.ListenAndServe()
+		if !errors.Is(err, syscall.EADDRINUSE) {
+			log.Fatal("Redirect listener failed:", err)
+		}
+		if !logged {
+			log.Printf("%s is in use, retrying the redirect listener", address)
+			logged = true
+		}
+	}
+}
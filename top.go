@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ANSI escape sequences used by the monitor
+const (
+	ansiClear      = "\x1b[H\x1b[2J"
+	ansiBold       = "\x1b[1m"
+	ansiRed        = "\x1b[31m"
+	ansiReset      = "\x1b[0m"
+	ansiHideCursor = "\x1b[?25l"
+	ansiShowCursor = "\x1b[?25h"
+)
+
+// runTop implements `files top`: a terminal monitor that polls the admin API
+// of a running server and shows live transfers, throughput, recent requests
+// and errors
+func runTop(args []string) {
+	fs := flag.NewFlagSet("top", flag.ExitOnError)
+	interval := fs.Duration("interval", time.Second, "Refresh interval")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s top [options] [server URL]\n\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "Monitors a server started with -admin and -admin-loopback (default URL: http://127.0.0.1:8080)\n\nOptions:\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	serverURL := "http://127.0.0.1:8080"
+	if fs.NArg() > 0 {
+		serverURL = fs.Arg(0)
+	}
+	statsURL := strings.TrimSuffix(serverURL, "/") + "/api/admin/stats"
+
+	// Restore the cursor on Ctrl-C
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	fmt.Print(ansiHideCursor)
+	defer fmt.Print(ansiShowCursor)
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+
+	var previous *StatsSnapshot
+	var previousTime time.Time
+	for {
+		snap, err := fetchStats(client, statsURL)
+		now := time.Now()
+		if err != nil {
+			fmt.Print(ansiClear)
+			fmt.Printf("files top — %s\n\n%sError:%s %v\n", serverURL, ansiRed, ansiReset, err)
+		} else {
+			renderTop(serverURL, snap, previous, now.Sub(previousTime))
+			previous, previousTime = snap, now
+		}
+
+		select {
+		case <-interrupt:
+			fmt.Println()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// fetchStats retrieves a statistics snapshot from the admin API
+func fetchStats(client *http.Client, statsURL string) (*StatsSnapshot, error) {
+	resp, err := client.Get(statsURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s (is the server running with -admin and -admin-loopback?)", resp.Status)
+	}
+
+	var snap StatsSnapshot
+	if err := json.NewDecoder(resp.Body).Decode(&snap); err != nil {
+		return nil, err
+	}
+	return &snap, nil
+}
+
+// renderTop draws one frame of the monitor
+func renderTop(serverURL string, snap, previous *StatsSnapshot, elapsed time.Duration) {
+	width := terminalSize("COLUMNS", 120)
+	height := terminalSize("LINES", 40)
+
+	// Throughput since the previous frame
+	sendRate, receiveRate := 0.0, 0.0
+	if previous != nil && elapsed > 0 {
+		sendRate = float64(snap.BytesSent-previous.BytesSent) / elapsed.Seconds()
+		receiveRate = float64(snap.BytesReceived-previous.BytesReceived) / elapsed.Seconds()
+	}
+
+	var b strings.Builder
+	b.WriteString(ansiClear)
+	fmt.Fprintf(&b, "%sfiles top%s — %s   up %s   (Ctrl-C to quit)\n\n", ansiBold, ansiReset,
+		serverURL, time.Since(snap.Started).Round(time.Second))
+	fmt.Fprintf(&b, "Requests %-10d Errors %-8d Downloads %-8d Uploads %d\n",
+		snap.Requests, snap.Errors, snap.Downloads, snap.Uploads)
+	fmt.Fprintf(&b, "Sent     %-10s (%s/s)   Received %-10s (%s/s)\n\n",
+		formatSize(snap.BytesSent), formatSize(int64(sendRate)),
+		formatSize(snap.BytesReceived), formatSize(int64(receiveRate)))
+
+	// Split the remaining rows between the three tables
+	rows := (height - 14) / 3
+	if rows < 3 {
+		rows = 3
+	}
+
+	fmt.Fprintf(&b, "%sACTIVE TRANSFERS (%d)%s\n", ansiBold, len(snap.Transfers), ansiReset)
+	b.WriteString(truncate(fmt.Sprintf("%-6s %-9s %-16s %-24s %-11s %s", "ID", "KIND", "CLIENT", "PROGRESS", "RATE", "PATH"), width) + "\n")
+	for i, t := range snap.Transfers {
+		if i == rows {
+			fmt.Fprintf(&b, "… %d more\n", len(snap.Transfers)-rows)
+			break
+		}
+		progress := formatSize(t.Bytes)
+		if t.Size > 0 {
+			progress = fmt.Sprintf("%3d%% %s/%s", t.Bytes*100/t.Size, formatSize(t.Bytes), formatSize(t.Size))
+		}
+		line := fmt.Sprintf("%-6d %-9s %-16s %-24s %-11s %s", t.ID, t.Kind, t.Client, progress,
+			formatSize(int64(t.Rate))+"/s", t.Path)
+		b.WriteString(truncate(line, width) + "\n")
+	}
+
+	b.WriteString("\n")
+	writeRequestTable(&b, "RECENT REQUESTS", snap.Recent, rows, width)
+	b.WriteString("\n")
+	writeRequestTable(&b, "RECENT ERRORS", snap.RecentErrors, rows, width)
+
+	fmt.Print(b.String())
+}
+
+// writeRequestTable renders the newest requests first
+func writeRequestTable(b *strings.Builder, title string, records []RequestRecord, rows, width int) {
+	fmt.Fprintf(b, "%s%s%s\n", ansiBold, title, ansiReset)
+	b.WriteString(truncate(fmt.Sprintf("%-9s %-7s %-6s %-10s %-16s %s", "TIME", "METHOD", "STATUS", "DURATION", "CLIENT", "PATH"), width) + "\n")
+	for i := 0; i < rows && i < len(records); i++ {
+		rec := records[len(records)-1-i]
+		line := fmt.Sprintf("%-9s %-7s %-6d %-10s %-16s %s", rec.Time.Local().Format("15:04:05"), rec.Method,
+			rec.Status, rec.Duration.Round(time.Millisecond), rec.Client, rec.Path)
+		line = truncate(line, width)
+		if rec.Status >= 400 {
+			line = ansiRed + line + ansiReset
+		}
+		b.WriteString(line + "\n")
+	}
+}
+
+// terminalSize reads a terminal dimension from the environment
+func terminalSize(name string, fallback int) int {
+	if n, err := strconv.Atoi(os.Getenv(name)); err == nil && n > 0 {
+		return n
+	}
+	return fallback
+}
+
+// truncate shortens a line to the terminal width
+func truncate(line string, width int) string {
+	runes := []rune(line)
+	if len(runes) <= width {
+		return line
+	}
+	return string(runes[:width-1]) + "…"
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+const (
+	// totpPeriod is how long a TOTP code is valid (RFC 6238)
+	totpPeriod = 30
+	// totpLoginTimeout is how long a user who gave the right password may
+	// take to enter the code
+	totpLoginTimeout = 5 * time.Minute
+	// totpMaxFailures is the number of wrong codes after which a user's
+	// codes are refused for totpLockout
+	totpMaxFailures = 5
+	totpLockout     = 5 * time.Minute
+)
+
+// totpSecretEncoding encodes secrets for authenticator apps
+var totpSecretEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// totpEnrollment is the second factor of a user
+type totpEnrollment struct {
+	Secret   string    `json:"secret"`
+	Enrolled time.Time `json:"enrolled"`
+	// LastStep is the time step of the last code used, which may not be
+	// used again
+	LastStep int64 `json:"lastStep"`
+}
+
+// totpStore holds the TOTP secrets of the users who enrolled, saved in
+// dataDir as totp.json
+type totpStore struct {
+	mu       sync.Mutex
+	enrolled map[string]*totpEnrollment
+	failures map[string]int
+	locked   map[string]time.Time
+}
+
+var totp = &totpStore{
+	enrolled: make(map[string]*totpEnrollment),
+	failures: make(map[string]int),
+	locked:   make(map[string]time.Time),
+}
+
+// TwoFactorPage is the data of the two-factor authentication page
+type TwoFactorPage struct {
+	Page
+	User     string
+	Enrolled time.Time
+	// Available is false without -data-dir, where secrets would be lost
+	Available bool
+	// Secret, Pending and QRCode enroll a new secret
+	Secret  string
+	Pending string
+	QRCode  template.URL
+	Message string
+	Error   string
+}
+
+// restore puts the saved enrollments in place
+func (s *totpStore) restore(saved map[string]*totpEnrollment) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for user, enrollment := range saved {
+		s.enrolled[user] = enrollment
+	}
+}
+
+// save writes the enrollments to dataDir; s.mu must be held
+func (s *totpStore) save() {
+	if dataDir == "" {
+		return
+	}
+	if err := saveState("totp", s.enrolled); err != nil {
+		log.Printf("Failed to save TOTP secrets: %v", err)
+	}
+}
+
+// isEnrolled reports whether a user logs in with a second factor
+func (s *totpStore) isEnrolled(user string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.enrolled[user] != nil
+}
+
+// enrolledSince returns when a user enrolled, or the zero time
+func (s *totpStore) enrolledSince(user string) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if enrollment := s.enrolled[user]; enrollment != nil {
+		return enrollment.Enrolled
+	}
+	return time.Time{}
+}
+
+// enroll stores a user's secret once the user proved to have it
+func (s *totpStore) enroll(user, secret string, step int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.enrolled[user] = &totpEnrollment{Secret: secret, Enrolled: time.Now().UTC(), LastStep: step}
+	s.save()
+}
+
+// remove ends a user's enrollment
+func (s *totpStore) remove(user string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.enrolled, user)
+	s.save()
+}
+
+// check verifies a code of an enrolled user. A code is used only once,
+// and after totpMaxFailures wrong ones every code is refused for a while;
+// the returned error says so.
+func (s *totpStore) check(user, code string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if until, ok := s.locked[user]; ok {
+		if time.Now().Before(until) {
+			return false, fmt.Errorf("Too many wrong codes; try again after %s", until.Format("15:04"))
+		}
+		delete(s.locked, user)
+	}
+	enrollment := s.enrolled[user]
+	if enrollment == nil {
+		return false, nil
+	}
+	step, ok := totpMatch(enrollment.Secret, code, enrollment.LastStep)
+	if !ok {
+		if s.failures[user]++; s.failures[user] >= totpMaxFailures {
+			delete(s.failures, user)
+			s.locked[user] = time.Now().Add(totpLockout)
+		}
+		return false, nil
+	}
+	delete(s.failures, user)
+	enrollment.LastStep = step
+	s.save()
+	return true, nil
+}
+
+// totpCode computes the code of a secret for a time step (RFC 4226)
+func totpCode(key []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value%1000000)
+}
+
+// totpMatch returns the time step a code is valid for, allowing one step
+// of clock drift either way; steps up to last were used already
+func totpMatch(secret, code string, last int64) (int64, bool) {
+	key, err := totpSecretEncoding.DecodeString(secret)
+	code = strings.Join(strings.Fields(code), "")
+	if err != nil || len(code) != 6 {
+		return 0, false
+	}
+	now := time.Now().Unix() / totpPeriod
+	for step := now - 1; step <= now+1; step++ {
+		if step > last && hmac.Equal([]byte(totpCode(key, step)), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// newTOTPSecret returns a random secret for enrolling
+func newTOTPSecret() string {
+	return totpSecretEncoding.EncodeToString(randomBytes(20))
+}
+
+// signTOTPValue signs the parts of a pending login or enrollment, which
+// wait in a hidden form field, with an expiry
+func signTOTPValue(kind string, parts ...string) string {
+	encoded := []string{kind, strconv.FormatInt(time.Now().Add(totpLoginTimeout).Unix(), 10)}
+	for _, part := range parts {
+		encoded = append(encoded, base64.RawURLEncoding.EncodeToString([]byte(part)))
+	}
+	return signValue(strings.Join(encoded, "|"))
+}
+
+// verifyTOTPValue returns the parts of a signed pending login or
+// enrollment, or nil if it is forged, of another kind or expired
+func verifyTOTPValue(kind, signed string, count int) []string {
+	value, ok := verifyValue(signed)
+	encoded := strings.Split(value, "|")
+	if !ok || len(encoded) != count+2 || encoded[0] != kind {
+		return nil
+	}
+	expires, err := strconv.ParseInt(encoded[1], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return nil
+	}
+	parts := make([]string, count)
+	for i, part := range encoded[2:] {
+		decoded, err := base64.RawURLEncoding.DecodeString(part)
+		if err != nil {
+			return nil
+		}
+		parts[i] = string(decoded)
+	}
+	return parts
+}
+
+// askTOTPCode shows the second step of the login form to a user whose
+// password was right
+func askTOTPCode(w http.ResponseWriter, r *http.Request, page LoginPage, fingerprint, message string, status int) {
+	page.Pending = signTOTPValue("login", page.Name, fingerprint, page.Next)
+	page.Error = message
+	renderLogin(w, r, page, status)
+}
+
+// totpLoginHandler checks the code of the login form's second step and
+// starts the session
+func totpLoginHandler(w http.ResponseWriter, r *http.Request) {
+	parts := verifyTOTPValue("login", r.PostFormValue("pending"), 3)
+	if parts == nil {
+		renderLogin(w, r, LoginPage{Error: "Login expired; try again", SSO: oidc != nil}, http.StatusBadRequest)
+		return
+	}
+	name, fingerprint := parts[0], parts[1]
+	page := LoginPage{Next: localRedirect(parts[2]), Name: name, SSO: oidc != nil}
+	stored, ok := storedPassword(name)
+	if !ok || !hmac.Equal([]byte(passwordFingerprint(stored)), []byte(fingerprint)) {
+		renderLogin(w, r, LoginPage{Next: page.Next, Error: "Login expired; try again", SSO: oidc != nil}, http.StatusBadRequest)
+		return
+	}
+
+	valid, err := totp.check(name, r.PostFormValue("code"))
+	if err != nil {
+		auditLogf("login-failed client=%s user=%q totp=locked", clientHost(r), name)
+		askTOTPCode(w, r, page, fingerprint, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	if !valid {
+		auditLogf("login-failed client=%s user=%q totp=true", clientHost(r), name)
+		askTOTPCode(w, r, page, fingerprint, "Wrong code", http.StatusUnauthorized)
+		return
+	}
+
+	startSession(w, r, name, fingerprint)
+	auditLogf("login client=%s user=%q totp=true", clientHost(r), name)
+	http.Redirect(w, r, page.Next, http.StatusSeeOther)
+}
+
+// twoFactorHandler lets users who logged in with a password enroll in
+// two-factor authentication and leave it again (/account/2fa)
+func twoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	user, kind := readSession(r)
+	if user == "" || kind == sessionOIDC {
+		http.Redirect(w, r, "/login?next=/account/2fa", http.StatusFound)
+		return
+	}
+	page := TwoFactorPage{User: user, Available: dataDir != ""}
+
+	if r.Method == http.MethodPost && page.Available {
+		if !sameOrigin(r) {
+			http.Error(w, "Cross-site request refused", http.StatusForbidden)
+			return
+		}
+		switch r.PostFormValue("action") {
+		case "enable":
+			parts := verifyTOTPValue("enroll", r.PostFormValue("pending"), 2)
+			if parts == nil || parts[0] != user {
+				page.Error = "The setup expired; scan the new code"
+				break
+			}
+			step, ok := totpMatch(parts[1], r.PostFormValue("code"), 0)
+			if !ok {
+				page.Error = "Wrong code; check the time on your device and try again"
+				page.Secret = parts[1]
+				break
+			}
+			totp.enroll(user, parts[1], step)
+			auditLogf("totp-enabled client=%s user=%q", clientHost(r), user)
+			page.Message = "Two-factor authentication is on. You'll be asked for a code when you log in."
+		case "disable":
+			valid, err := totp.check(user, r.PostFormValue("code"))
+			if err != nil {
+				page.Error = err.Error()
+				break
+			}
+			if !valid {
+				page.Error = "Wrong code"
+				break
+			}
+			totp.remove(user)
+			auditLogf("totp-disabled client=%s user=%q", clientHost(r), user)
+			page.Message = "Two-factor authentication is off."
+		}
+	}
+
+	page.Enrolled = totp.enrolledSince(user)
+	if page.Available && page.Enrolled.IsZero() {
+		if page.Secret == "" {
+			page.Secret = newTOTPSecret()
+		}
+		page.Pending = signTOTPValue("enroll", user, page.Secret)
+		uri := "otpauth://totp/" + url.PathEscape(r.Host+":"+user) + "?" + url.Values{
+			"secret": {page.Secret},
+			"issuer": {r.Host},
+			"period": {strconv.Itoa(totpPeriod)},
+		}.Encode()
+		png, err := qrcode.Encode(uri, qrcode.Medium, 256)
+		if err != nil {
+			http.Error(w, "Error creating QR code: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		page.QRCode = template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png))
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := renderTemplate(w, r, "twofactor.html", &page); err != nil {
+		log.Printf("Template error: %v", err)
+		http.Error(w, "Error rendering page", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// The SHA-1 test vectors of RFC 6238, cut to six digits
+	key := []byte("12345678901234567890")
+	tests := []struct {
+		time int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		if got := totpCode(key, tt.time/totpPeriod); got != tt.code {
+			t.Errorf("totpCode at %d = %s, want %s", tt.time, got, tt.code)
+		}
+	}
+}
+
+// currentTOTPStep returns the time step of now, away from the end of one
+// so that totpMatch sees the same step
+func currentTOTPStep() int64 {
+	if time.Now().Unix()%totpPeriod == totpPeriod-1 {
+		time.Sleep(time.Second)
+	}
+	return time.Now().Unix() / totpPeriod
+}
+
+func TestTOTPMatch(t *testing.T) {
+	key := []byte("12345678901234567890")
+	secret := totpSecretEncoding.EncodeToString(key)
+	now := currentTOTPStep()
+	code := totpCode(key, now)
+
+	tests := []struct {
+		name   string
+		secret string
+		code   string
+		last   int64
+		step   int64
+		ok     bool
+	}{
+		{"current", secret, code, 0, now, true},
+		{"previous", secret, totpCode(key, now-1), 0, now - 1, true},
+		{"next", secret, totpCode(key, now+1), 0, now + 1, true},
+		{"too old", secret, totpCode(key, now-3), 0, 0, false},
+		{"spaces", secret, code[:3] + " " + code[3:], 0, now, true},
+		{"used", secret, code, now, 0, false},
+		{"earlier used", secret, code, now - 1, now, true},
+		{"short", secret, code[:5], 0, 0, false},
+		{"bad secret", "not base32!", code, 0, 0, false},
+	}
+	for _, tt := range tests {
+		step, ok := totpMatch(tt.secret, tt.code, tt.last)
+		if ok != tt.ok || (ok && step != tt.step) {
+			t.Errorf("%s: totpMatch = %d, %v; want %d, %v", tt.name, step, ok, tt.step, tt.ok)
+		}
+	}
+}
+
+func TestTOTPStoreCheck(t *testing.T) {
+	oldDataDir := dataDir
+	dataDir = ""
+	t.Cleanup(func() { dataDir = oldDataDir })
+	key := []byte("12345678901234567890")
+	s := &totpStore{
+		enrolled: map[string]*totpEnrollment{"alice": {Secret: totpSecretEncoding.EncodeToString(key)}},
+		failures: make(map[string]int),
+		locked:   make(map[string]time.Time),
+	}
+	now := currentTOTPStep()
+	wrong := totpCode(key, now-5)
+
+	steps := []struct {
+		user, code string
+		ok         bool
+		locked     bool
+	}{
+		{"bob", totpCode(key, now), false, false},
+		{"alice", totpCode(key, now), true, false},
+		// A code is used once only, and trying it again is a failure
+		{"alice", totpCode(key, now), false, false},
+		{"alice", wrong, false, false},
+		{"alice", wrong, false, false},
+		{"alice", wrong, false, false},
+		{"alice", wrong, false, false},
+		// The right code is refused too after totpMaxFailures wrong ones
+		{"alice", totpCode(key, now+1), false, true},
+	}
+	for i, step := range steps {
+		ok, err := s.check(step.user, step.code)
+		if ok != step.ok || (err != nil) != step.locked {
+			t.Errorf("step %d: check(%q) = %v, %v; want %v, locked %v", i, step.user, ok, err, step.ok, step.locked)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// isASCII reports whether s has a single Unicode normalization form
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// findNormalizedEntry returns the name of the entry of dir that is
+// canonically equivalent to name (equal after NFC normalization), or ""
+func findNormalizedEntry(dir, name string) string {
+	if isASCII(name) {
+		return ""
+	}
+
+	want := norm.NFC.String(name)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return ""
+	}
+	for _, entry := range entries {
+		if norm.NFC.String(entry.Name()) == want {
+			return entry.Name()
+		}
+	}
+	return ""
+}
+
+// resolveNormalized finds the on-disk path for p when the request and the
+// filesystem use different normalization forms, e.g. a file created on
+// macOS in NFD requested by a Linux client in NFC. Components that do not
+// exist are kept as requested.
+func resolveNormalized(root, p string) string {
+	rel, err := filepath.Rel(root, p)
+	if err != nil || rel == "." {
+		return p
+	}
+
+	current := root
+	parts := strings.Split(rel, string(filepath.Separator))
+	for i, part := range parts {
+		candidate := filepath.Join(current, part)
+		if _, err := os.Lstat(fsPath(candidate)); err == nil {
+			current = candidate
+			continue
+		}
+		match := findNormalizedEntry(fsPath(current), part)
+		if match == "" {
+			return filepath.Join(append([]string{current}, parts[i:]...)...)
+		}
+		current = filepath.Join(current, match)
+	}
+	return current
+}
+
+// normalizeUploadName stores uploaded names in NFC, unless dir already holds
+// an equivalent name in another form, which is then reused so the upload
+// replaces that file instead of creating a look-alike duplicate
+func normalizeUploadName(dir, name string) string {
+	name = norm.NFC.String(name)
+	if existing := findNormalizedEntry(dir, name); existing != "" {
+		return existing
+	}
+	return name
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base32"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// uploadNamesFile records, in a directory whose uploads get generated names,
+// the name each file was sent with: one "stored<TAB>original" line per file
+const uploadNamesFile = ".upload-names"
+
+// uniqueNames stores every upload under a generated name (-unique-names);
+// upload policies may turn it on or off per directory
+var uniqueNames bool
+
+// uniqueUploadName generates the name an upload is stored under: the time
+// and a random part, keeping the extension of the name it was sent with,
+// e.g. 20261017-153012-k3j9x2qa.pdf
+func uniqueUploadName(original string) string {
+	random := strings.ToLower(base32.StdEncoding.EncodeToString(randomBytes(5)))
+	ext := strings.ToLower(filepath.Ext(original))
+	if len(ext) > 16 || strings.ContainsAny(ext, " ") {
+		ext = ""
+	}
+	return time.Now().UTC().Format("20060102-150405") + "-" + random + ext
+}
+
+// uploadNames caches the recorded names of directories, by directory
+type uploadNames struct {
+	mu   sync.Mutex
+	dirs map[string]uploadNamesEntry
+}
+
+type uploadNamesEntry struct {
+	modTime time.Time
+	size    int64
+	names   map[string]string
+}
+
+var originalNames = &uploadNames{dirs: make(map[string]uploadNamesEntry)}
+
+// record notes the name a file in dir (a file system path) was sent with
+func (u *uploadNames) record(dir, stored, original string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	f, err := os.OpenFile(filepath.Join(dir, uploadNamesFile), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(stored + "\t" + original + "\n"); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// lookup returns the recorded names of the files in dir, keyed by the
+// names they are stored under; nil if there are none
+func (u *uploadNames) lookup(dir string) map[string]string {
+	file := filepath.Join(dir, uploadNamesFile)
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if entry, ok := u.dirs[dir]; ok && entry.modTime.Equal(info.ModTime()) && entry.size == info.Size() {
+		return entry.names
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	names := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if stored, original, found := strings.Cut(scanner.Text(), "\t"); found {
+			names[stored] = original
+		}
+	}
+	u.dirs[dir] = uploadNamesEntry{modTime: info.ModTime(), size: info.Size(), names: names}
+	return names
+}
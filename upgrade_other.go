@@ -0,0 +1,30 @@
+//go:build windows || plan9
+
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+)
+
+// upgradeSignal returns nil: there is no upgrade signal on this platform
+func upgradeSignal() <-chan os.Signal {
+	return nil
+}
+
+// reloadSignal returns nil: reloads are asked for with POST
+// /api/admin/reload on this platform
+func reloadSignal() <-chan os.Signal {
+	return nil
+}
+
+func inheritedListeners() ([]net.Listener, error) {
+	return nil, nil
+}
+
+func notifyReady() {}
+
+func upgrade(listeners []net.Listener) error {
+	return errors.New("upgrades are not supported on this platform")
+}
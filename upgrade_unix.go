@@ -0,0 +1,153 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Environment variables through which a process started by upgrade finds
+// the listening sockets it inherits and the pipe to report readiness on
+const (
+	listenFDsEnv = "FILES_LISTEN_FDS"
+	readyFDEnv   = "FILES_READY_FD"
+)
+
+// upgradeTimeout bounds how long the old process waits for its replacement
+const upgradeTimeout = 30 * time.Second
+
+// upgradeSignal returns a channel receiving SIGUSR2, which starts an upgrade
+func upgradeSignal() <-chan os.Signal {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR2)
+	return signals
+}
+
+// reloadSignal returns a channel receiving SIGHUP, which reloads the
+// configuration
+func reloadSignal() <-chan os.Signal {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	return signals
+}
+
+// inheritedListeners returns the listening sockets passed on by the
+// process this one replaces, or nil when started normally
+func inheritedListeners() ([]net.Listener, error) {
+	value := os.Getenv(listenFDsEnv)
+	if value == "" {
+		return nil, nil
+	}
+	os.Unsetenv(listenFDsEnv)
+	count, err := strconv.Atoi(value)
+	if err != nil || count < 1 {
+		return nil, fmt.Errorf("invalid %s: %q", listenFDsEnv, value)
+	}
+
+	listeners := make([]net.Listener, 0, count)
+	for i := 0; i < count; i++ {
+		// Inherited files start at descriptor 3, after stdin, stdout and stderr
+		f := os.NewFile(uintptr(3+i), "listener")
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// notifyReady tells the process this one replaces that it is serving
+func notifyReady() {
+	value := os.Getenv(readyFDEnv)
+	if value == "" {
+		return
+	}
+	os.Unsetenv(readyFDEnv)
+	fd, err := strconv.Atoi(value)
+	if err != nil {
+		return
+	}
+	f := os.NewFile(uintptr(fd), "ready")
+	f.Write([]byte{1})
+	f.Close()
+}
+
+// upgrade starts the server binary again with the same arguments, handing
+// it the listening sockets, and waits until it is serving. The binary is
+// looked up again, so a new version installed in its place takes over.
+func upgrade(listeners []net.Listener) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, l := range listeners {
+		tcp, ok := l.(*net.TCPListener)
+		if !ok {
+			return errors.New("listener cannot be handed over")
+		}
+		f, err := tcp.File()
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+	}
+
+	ready, readyWriter, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer ready.Close()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(files, readyWriter)
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("%s=%d", listenFDsEnv, len(files)),
+		fmt.Sprintf("%s=%d", readyFDEnv, 3+len(files)))
+	err = cmd.Start()
+	readyWriter.Close()
+	if err != nil {
+		return err
+	}
+
+	// The pipe reports EOF without data if the new process exits first
+	done := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1)
+		_, err := ready.Read(buf)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			cmd.Wait()
+			return fmt.Errorf("new process exited before serving: %v", cmd.ProcessState)
+		}
+	case <-time.After(upgradeTimeout):
+		cmd.Process.Kill()
+		cmd.Wait()
+		return fmt.Errorf("new process not ready after %v", upgradeTimeout)
+	}
+
+	log.Printf("New process %d is serving", cmd.Process.Pid)
+	return cmd.Process.Release()
+}
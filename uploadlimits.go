@@ -0,0 +1,87 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// uploadRateWindow is the period -upload-min-rate averages over; an upload
+// is first judged once it has run this long
+const uploadRateWindow = 30 * time.Second
+
+var (
+	// uploadTimeout is the longest an upload request may take
+	// (-upload-timeout), 0 for no limit
+	uploadTimeout time.Duration
+	// uploadMinRate is the slowest an upload may arrive in bytes per second
+	// (-upload-min-rate), 0 for no limit
+	uploadMinRate int64
+)
+
+// watchUpload aborts an upload that takes longer than -upload-timeout or
+// arrives slower than -upload-min-rate, so dead clients don't hold on to a
+// connection and a half-written file. A read of the request body blocked
+// on such a client fails at once. The returned function stops watching; it
+// is called once the body is in and may be called again.
+func watchUpload(w http.ResponseWriter, t *transfer) (stop func()) {
+	if uploadTimeout <= 0 && uploadMinRate <= 0 {
+		return func() {}
+	}
+	// The lock keeps the response writer from being used once the handler
+	// is done with the body, and so possibly done with the request
+	var mu sync.Mutex
+	stopped, done := false, make(chan struct{})
+	stop = func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if !stopped {
+			stopped = true
+			close(done)
+		}
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		checked, received := t.started, int64(0)
+		for {
+			var now time.Time
+			select {
+			case <-done:
+				return
+			case now = <-ticker.C:
+			}
+
+			var reason string
+			switch {
+			case uploadTimeout > 0 && now.Sub(t.started) > uploadTimeout:
+				reason = "took longer than " + uploadTimeout.String()
+			case uploadMinRate > 0 && now.Sub(checked) >= uploadRateWindow:
+				bytes := t.bytes.Load()
+				if rate := float64(bytes-received) / now.Sub(checked).Seconds(); rate < float64(uploadMinRate) {
+					reason = "arrived slower than " + formatSize(uploadMinRate) + "/s"
+				}
+				checked, received = now, bytes
+			}
+			if reason == "" {
+				continue
+			}
+
+			mu.Lock()
+			if !stopped {
+				t.expired.Store(reason)
+				info := t.info()
+				auditLogf("upload-aborted client=%s path=%q bytes=%d reason=%q", info.Client, info.Path, info.Bytes, reason)
+				if err := http.NewResponseController(w).SetReadDeadline(now); err != nil {
+					// The next read fails instead
+					log.Printf("Failed to interrupt upload: %v", err)
+				}
+			}
+			mu.Unlock()
+			return
+		}
+	}()
+	return stop
+}
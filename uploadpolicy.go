@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// uploadPolicyFile sets the upload rules of the directory it is in and of
+// the directories below it
+const uploadPolicyFile = ".upload-policy"
+
+// uploadPolicy holds the rules for uploads into a directory
+type uploadPolicy struct {
+	// extensions are the allowed name endings in lowercase ("", any)
+	extensions []string
+	// maxSize is the largest file accepted; -1 for any size
+	maxSize int64
+	// onConflict replaces -on-conflict when set
+	onConflict string
+	// anonymous allows uploads without logging in
+	anonymous bool
+	// uniqueNames replaces -unique-names
+	uniqueNames bool
+}
+
+// uploadPolicyFor returns the rules for uploads into a directory (relative
+// to workingDir). Each .upload-policy file from the root down to the
+// directory overrides the settings it names, so the nearest one wins.
+func uploadPolicyFor(dir string) (uploadPolicy, error) {
+	policy := uploadPolicy{maxSize: -1, anonymous: true, uniqueNames: uniqueNames}
+	dirs := []string{""}
+	for _, part := range strings.Split(path.Clean("/" + dir)[1:], "/") {
+		if part != "" {
+			dirs = append(dirs, path.Join(dirs[len(dirs)-1], part))
+		}
+	}
+	for _, current := range dirs {
+		file := filepath.Join(localPath(current), uploadPolicyFile)
+		data, err := os.ReadFile(fsPath(file))
+		// Missing directories of the path are created by the upload
+		if os.IsNotExist(err) || errors.Is(err, syscall.ENOTDIR) {
+			continue
+		}
+		if err != nil {
+			return policy, err
+		}
+		if err := policy.parse(string(data)); err != nil {
+			return policy, fmt.Errorf("%s: %v", path.Join(current, uploadPolicyFile), err)
+		}
+	}
+	return policy, nil
+}
+
+// parse applies the settings of a policy file: "key = value" lines, with
+// # starting a comment
+func (p *uploadPolicy) parse(input string) error {
+	for i, line := range strings.Split(input, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			return fmt.Errorf("line %d: expected key = value", i+1)
+		}
+		key, value = strings.ToLower(strings.TrimSpace(key)), strings.TrimSpace(value)
+		switch key {
+		case "extensions":
+			p.extensions = nil
+			for _, ext := range strings.Split(value, ",") {
+				ext = strings.ToLower(strings.TrimSpace(ext))
+				if ext == "*" {
+					p.extensions = nil
+					break
+				}
+				if ext != "" {
+					p.extensions = append(p.extensions, "."+strings.TrimPrefix(ext, "."))
+				}
+			}
+		case "max-size":
+			if value == "" || value == "0" || strings.EqualFold(value, "unlimited") {
+				p.maxSize = -1
+				continue
+			}
+			size, err := parseSize(value)
+			if err != nil {
+				return fmt.Errorf("line %d: %v", i+1, err)
+			}
+			p.maxSize = size
+		case "on-conflict":
+			policy, err := parseConflictPolicy(value)
+			if err != nil {
+				return fmt.Errorf("line %d: %v", i+1, err)
+			}
+			p.onConflict = policy
+		case "anonymous":
+			switch strings.ToLower(value) {
+			case "yes", "true", "allow":
+				p.anonymous = true
+			case "no", "false", "deny":
+				p.anonymous = false
+			default:
+				return fmt.Errorf("line %d: anonymous must be yes or no", i+1)
+			}
+		case "unique-names":
+			switch strings.ToLower(value) {
+			case "yes", "true":
+				p.uniqueNames = true
+			case "no", "false":
+				p.uniqueNames = false
+			default:
+				return fmt.Errorf("line %d: unique-names must be yes or no", i+1)
+			}
+		default:
+			return fmt.Errorf("line %d: unknown setting %q", i+1, key)
+		}
+	}
+	return nil
+}
+
+// conflict returns what an upload named like an existing file does
+func (p uploadPolicy) conflict() string {
+	if p.onConflict != "" {
+		return p.onConflict
+	}
+	return onConflict
+}
+
+// check tells whether a user may upload a file with a name and size (-1
+// while unknown) under the policy
+func (p uploadPolicy) check(user, name string, size int64) *uploadError {
+	if user == "" && !p.anonymous {
+		return &uploadError{http.StatusForbidden, "Log in to upload here"}
+	}
+	if len(p.extensions) > 0 {
+		allowed := false
+		for _, ext := range p.extensions {
+			if strings.HasSuffix(strings.ToLower(name), ext) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return &uploadError{http.StatusUnsupportedMediaType, "Only " + strings.Join(p.extensions, ", ") + " files may be uploaded here"}
+		}
+	}
+	if p.maxSize >= 0 && size > p.maxSize {
+		return &uploadError{http.StatusRequestEntityTooLarge, "File is larger than " + formatSize(p.maxSize)}
+	}
+	return nil
+}
+
+// checkUploadPolicy returns the policy for uploads into a directory and
+// whether it allows a file; a broken policy file refuses every upload
+func checkUploadPolicy(dir, user, name string, size int64) (uploadPolicy, *uploadError) {
+	policy, err := uploadPolicyFor(dir)
+	if err != nil {
+		log.Printf("Invalid upload policy: %v", err)
+		return policy, &uploadError{http.StatusInternalServerError, "Invalid upload policy"}
+	}
+	return policy, policy.check(user, name, size)
+}
+
+// checkMovePolicy checks every file a move or copy places from src below
+// dst against the upload policies there, which would otherwise let files
+// into a directory its policy keeps them out of
+func checkMovePolicy(user, src, dst string) *uploadError {
+	root := storageName(src)
+	policies := make(map[string]uploadPolicy)
+	var failed *uploadError
+	fs.WalkDir(served, root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		target := path.Join(dst, strings.TrimPrefix(strings.TrimPrefix(p, root), "/"))
+		dir := path.Dir(target)
+		if dir == "." {
+			dir = ""
+		}
+		policy, ok := policies[dir]
+		if !ok {
+			if policy, err = uploadPolicyFor(dir); err != nil {
+				log.Printf("Invalid upload policy: %v", err)
+				failed = &uploadError{http.StatusInternalServerError, "Invalid upload policy"}
+				return fs.SkipAll
+			}
+			policies[dir] = policy
+		}
+		if failed = policy.check(user, path.Base(target), info.Size()); failed != nil {
+			return fs.SkipAll
+		}
+		return nil
+	})
+	return failed
+}
@@ -0,0 +1,545 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+// errQuotaExceeded refuses a write or move that doesn't fit a quota
+var errQuotaExceeded = errors.New("storage quota exceeded")
+
+// uploadBody is what an upload reads from, the body of a request or a data
+// connection. It remembers a failed read, such as of a client that went
+// away, so the incomplete file is dropped.
+type uploadBody struct {
+	io.Reader
+	err error
+}
+
+func (b *uploadBody) Read(p []byte) (int, error) {
+	n, err := b.Reader.Read(p)
+	if err != nil && err != io.EOF && b.err == nil {
+		b.err = err
+	}
+	return n, err
+}
+
+// userFS is what a user sees of the files through the servers of other
+// protocols, like WebDAV: paths they may not read don't exist, and those
+// they may not write refuse changes. Changes are audited, journaled and
+// counted against quotas as those through the web interface are. It
+// serves one request or command.
+type userFS struct {
+	user   string
+	client string
+	// transfer is the download or upload under way, if any
+	transfer *transfer
+	// body and policy are those of an upload checked with checkUpload
+	body   *uploadBody
+	policy uploadPolicy
+}
+
+// userPath returns the path relative to the served root of a slash-separated
+// name, which may start with a slash
+func userPath(name string) string {
+	return strings.Trim(path.Clean("/"+name), "/")
+}
+
+// writable returns the storage if the user may change a path, which is
+// neither the root nor a mount
+func (d *userFS) writable(requestedPath string) (writableStorage, error) {
+	store, ok := served.(writableStorage)
+	if !ok || requestedPath == "" || isMountPoint(requestedPath) || !canWrite(d.user, requestedPath) {
+		return nil, fs.ErrPermission
+	}
+	if !canRead(d.user, requestedPath) {
+		return nil, fs.ErrNotExist
+	}
+	return store, nil
+}
+
+// checkUpload checks an upload of size bytes (-1 if unknown) before it
+// starts, as putHandler does, and keeps its upload policy. replace tells
+// whether it may replace an existing file.
+func (d *userFS) checkUpload(requestedPath string, size int64, replace bool) *uploadError {
+	dir, name := path.Split(requestedPath)
+	dir = strings.Trim(dir, "/")
+	// Files keep the names clients give them, which they look for again
+	if name != sanitizeUploadName(name) {
+		return &uploadError{http.StatusForbidden, "File name not allowed"}
+	}
+	if info, err := d.Stat(context.Background(), dir); err != nil || !info.IsDir() {
+		return &uploadError{http.StatusConflict, "Parent folder not found"}
+	}
+	if !canWrite(d.user, requestedPath) || isMountPoint(requestedPath) {
+		return &uploadError{http.StatusForbidden, "Access denied"}
+	}
+	policy, policyErr := checkUploadPolicy(dir, d.user, name, size)
+	if policyErr != nil {
+		return policyErr
+	}
+	if policy.uniqueNames {
+		return &uploadError{http.StatusForbidden, "Uploads here are stored under generated names; upload with a form instead"}
+	}
+	d.policy = policy
+
+	var replaced int64
+	if info, err := served.Stat(storageName(requestedPath)); err == nil {
+		if info.IsDir() {
+			return &uploadError{http.StatusMethodNotAllowed, "A directory with that name already exists"}
+		}
+		// Everyone adds files only in a directory whose upload policy keeps
+		// existing files
+		if !replace || (policy.onConflict != "" && policy.onConflict != conflictOverwrite) {
+			return &uploadError{http.StatusConflict, "A file with that name already exists"}
+		}
+		replaced = info.Size()
+	}
+	// The size is checked against the quota again as the file is written
+	if size >= 0 {
+		if owner, fits := checkQuotaFor(requestedPath, size-replaced); !fits {
+			auditLogf("quota-exceeded client=%s user=%q path=%q", d.client, owner, requestedPath)
+			return &uploadError{http.StatusInsufficientStorage, "Storage quota exceeded"}
+		}
+	}
+	return nil
+}
+
+// checkTree fails with fs.ErrPermission unless the user may change every
+// path below a directory, as deleting or moving it does
+func (d *userFS) checkTree(requestedPath string) error {
+	if diskBacked() {
+		root := localPath(requestedPath)
+		return filepath.WalkDir(root, func(p string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(root, p)
+			if err != nil {
+				return err
+			}
+			if !canWrite(d.user, path.Join(requestedPath, filepath.ToSlash(rel))) {
+				return fs.ErrPermission
+			}
+			return nil
+		})
+	}
+	entries, err := served.ReadDir(storageName(requestedPath))
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		p := path.Join(requestedPath, entry.Name())
+		if !canWrite(d.user, p) {
+			return fs.ErrPermission
+		}
+		if entry.IsDir() {
+			if err := d.checkTree(p); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (d *userFS) Stat(ctx context.Context, name string) (fs.FileInfo, error) {
+	requestedPath := userPath(name)
+	if !canRead(d.user, requestedPath) {
+		return nil, fs.ErrNotExist
+	}
+	info, err := served.Stat(storageName(requestedPath))
+	if err != nil {
+		return nil, err
+	}
+	return userFileInfo{info}, nil
+}
+
+func (d *userFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	requestedPath := userPath(name)
+	store, err := d.writable(requestedPath)
+	if err != nil {
+		return err
+	}
+	if _, err := served.Stat(storageName(requestedPath)); err == nil {
+		return fs.ErrExist
+	}
+	// Unlike the web interface, MKCOL creates one folder only
+	if info, err := d.Stat(ctx, path.Dir(requestedPath)); err != nil || !info.IsDir() {
+		return fs.ErrNotExist
+	}
+	if err := store.MkdirAll(storageName(requestedPath), 0755); err != nil {
+		return err
+	}
+	auditLogf("mkdir client=%s path=%q", d.client, requestedPath)
+	journal.note(requestedPath)
+	return nil
+}
+
+func (d *userFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	requestedPath := userPath(name)
+	if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		return d.create(ctx, requestedPath)
+	}
+	info, err := d.Stat(ctx, requestedPath)
+	if err != nil {
+		return nil, err
+	}
+	return &userFile{fsys: d, requestedPath: requestedPath, info: info}, nil
+}
+
+func (d *userFS) RemoveAll(ctx context.Context, name string) error {
+	requestedPath := userPath(name)
+	store, err := d.writable(requestedPath)
+	if err != nil {
+		return err
+	}
+	info, err := served.Stat(storageName(requestedPath))
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		if err := d.checkTree(requestedPath); err != nil {
+			return err
+		}
+	}
+
+	if diskBacked() {
+		fullPath, err := resolvePath(requestedPath)
+		if err != nil {
+			return err
+		}
+		var size int64
+		owner := homeOwner(requestedPath)
+		if userQuota > 0 && owner != "" {
+			size = treeSize(fullPath)
+		}
+		if err := os.RemoveAll(fsPath(fullPath)); err != nil {
+			return err
+		}
+		if size > 0 {
+			quotas.add(owner, -size)
+		}
+	} else if err := removeTree(store, requestedPath, info.IsDir()); err != nil {
+		return err
+	}
+	auditLogf("delete client=%s path=%q", d.client, requestedPath)
+	journal.note(requestedPath)
+	return nil
+}
+
+// removeTree deletes a file or directory tree of a storage
+func removeTree(store writableStorage, requestedPath string, isDir bool) error {
+	if isDir {
+		entries, err := store.ReadDir(storageName(requestedPath))
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := removeTree(store, path.Join(requestedPath, entry.Name()), entry.IsDir()); err != nil {
+				return err
+			}
+		}
+	}
+	return store.Remove(storageName(requestedPath))
+}
+
+func (d *userFS) Rename(ctx context.Context, oldName, newName string) error {
+	src, dst := userPath(oldName), userPath(newName)
+	store, err := d.writable(src)
+	if err != nil {
+		return err
+	}
+	if _, err := d.writable(dst); err != nil {
+		return err
+	}
+	info, err := served.Stat(storageName(src))
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		if err := d.checkTree(src); err != nil {
+			return err
+		}
+	}
+	// Mounts are usually on filesystems of their own, which a rename can't
+	// cross
+	if mountOf(src) != mountOf(dst) {
+		return fs.ErrPermission
+	}
+	if policyErr := checkMovePolicy(d.user, src, dst); policyErr != nil {
+		return policyErr
+	}
+
+	// Moving between home directories transfers the storage to the
+	// destination's owner
+	srcOwner, dstOwner := homeOwner(src), homeOwner(dst)
+	var size int64
+	if userQuota > 0 && srcOwner != dstOwner && diskBacked() {
+		size = treeSize(localPath(src))
+		if owner, fits := checkQuotaFor(dst, size); !fits {
+			auditLogf("quota-exceeded client=%s user=%q path=%q", d.client, owner, dst)
+			return errQuotaExceeded
+		}
+	}
+	if err := store.Rename(storageName(src), storageName(dst)); err != nil {
+		return err
+	}
+	if size > 0 {
+		quotas.add(srcOwner, -size)
+		quotas.add(dstOwner, size)
+	}
+	if checksums != nil {
+		if err := checksums.relocate(src, dst, true); err != nil {
+			log.Printf("Failed to record checksums: %v", err)
+		}
+	}
+	auditLogf("move client=%s src=%q dst=%q", d.client, src, dst)
+	journal.note(src)
+	journal.note(dst)
+	return nil
+}
+
+// create opens a file for writing. What is written goes straight to the
+// storage, which keeps the previous file until the new one is complete.
+func (d *userFS) create(ctx context.Context, requestedPath string) (webdav.File, error) {
+	store, err := d.writable(requestedPath)
+	if err != nil {
+		return nil, err
+	}
+	if info, err := d.Stat(ctx, path.Dir(requestedPath)); err != nil || !info.IsDir() {
+		return nil, fs.ErrNotExist
+	}
+	w := &userWriter{
+		fsys:          d,
+		requestedPath: requestedPath,
+		hash:          sha256.New(),
+		modTime:       time.Now(),
+		done:          make(chan error, 1),
+	}
+	if info, err := served.Stat(storageName(requestedPath)); err == nil {
+		if info.IsDir() {
+			return nil, fs.ErrExist
+		}
+		w.replaced, w.exists = info.Size(), true
+	}
+	pr, pw := io.Pipe()
+	w.pipe = pw
+	go func() {
+		err := store.WriteFile(storageName(requestedPath), pr)
+		pr.CloseWithError(err)
+		w.done <- err
+	}()
+	return w, nil
+}
+
+// userFileInfo describes a file with the content type the server sends it
+// as, which spares the WebDAV handler opening it to sniff one
+type userFileInfo struct {
+	fs.FileInfo
+}
+
+func (i userFileInfo) ContentType(ctx context.Context) (string, error) {
+	mimeType, _ := getMIMEType(i.Name())
+	return mimeType, nil
+}
+
+// userFile is a file or directory opened for reading. Files are opened in
+// the storage when first read, as listings open every entry for its
+// properties.
+type userFile struct {
+	fsys          *userFS
+	requestedPath string
+	info          fs.FileInfo
+	file          fs.File
+	reader        io.Reader
+	// entries are those Readdir has yet to return
+	entries []fs.FileInfo
+	listed  bool
+}
+
+func (f *userFile) open() error {
+	if f.file != nil {
+		return nil
+	}
+	file, err := served.Open(storageName(f.requestedPath))
+	if err != nil {
+		return err
+	}
+	f.file, f.reader = file, file
+	if f.fsys.transfer != nil {
+		f.reader = f.fsys.transfer.reader(file)
+	}
+	return nil
+}
+
+func (f *userFile) Read(p []byte) (int, error) {
+	if err := f.open(); err != nil {
+		return 0, err
+	}
+	return f.reader.Read(p)
+}
+
+func (f *userFile) Seek(offset int64, whence int) (int64, error) {
+	if err := f.open(); err != nil {
+		return 0, err
+	}
+	seeker, ok := f.file.(io.Seeker)
+	if !ok {
+		return 0, &fs.PathError{Op: "seek", Path: f.requestedPath, Err: errors.ErrUnsupported}
+	}
+	return seeker.Seek(offset, whence)
+}
+
+func (f *userFile) Readdir(count int) ([]fs.FileInfo, error) {
+	if !f.listed {
+		entries, err := served.ReadDir(storageName(f.requestedPath))
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if !canRead(f.fsys.user, path.Join(f.requestedPath, entry.Name())) {
+				continue
+			}
+			if info, err := entry.Info(); err == nil {
+				f.entries = append(f.entries, userFileInfo{info})
+			}
+		}
+		f.listed = true
+	}
+	if count <= 0 {
+		entries := f.entries
+		f.entries = nil
+		return entries, nil
+	}
+	if len(f.entries) == 0 {
+		return nil, io.EOF
+	}
+	n := min(count, len(f.entries))
+	entries := f.entries[:n]
+	f.entries = f.entries[n:]
+	return entries, nil
+}
+
+func (f *userFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *userFile) Write(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "write", Path: f.requestedPath, Err: fs.ErrPermission}
+}
+
+func (f *userFile) Close() error {
+	if f.file != nil {
+		return f.file.Close()
+	}
+	return nil
+}
+
+// userWriter is a file being written. The file is stored when it is
+// closed, and dropped if it is larger than the upload policy allows or the
+// request's body broke off.
+type userWriter struct {
+	fsys          *userFS
+	requestedPath string
+	pipe          *io.PipeWriter
+	done          chan error
+	hash          hash.Hash
+	written       int64
+	replaced      int64
+	exists        bool
+	modTime       time.Time
+}
+
+func (w *userWriter) Write(p []byte) (int, error) {
+	if policy := w.fsys.policy; w.fsys.body != nil && policy.maxSize >= 0 && w.written+int64(len(p)) > policy.maxSize {
+		policyErr := policy.check(w.fsys.user, path.Base(w.requestedPath), w.written+int64(len(p)))
+		w.pipe.CloseWithError(policyErr)
+		return 0, policyErr
+	}
+	// Copies and streamed uploads don't tell their size up front
+	if owner, fits := checkQuotaFor(w.requestedPath, w.written+int64(len(p))-w.replaced); !fits {
+		auditLogf("quota-exceeded client=%s user=%q path=%q", w.fsys.client, owner, w.requestedPath)
+		w.pipe.CloseWithError(errQuotaExceeded)
+		return 0, errQuotaExceeded
+	}
+	n, err := w.pipe.Write(p)
+	w.hash.Write(p[:n])
+	w.written += int64(n)
+	return n, err
+}
+
+func (w *userWriter) Close() error {
+	if body := w.fsys.body; body != nil && body.err != nil {
+		w.pipe.CloseWithError(body.err)
+		<-w.done
+		return body.err
+	}
+	w.pipe.Close()
+	if err := <-w.done; err != nil {
+		return err
+	}
+
+	requestedPath := w.requestedPath
+	if owner := homeOwner(requestedPath); owner != "" {
+		quotas.add(owner, w.written-w.replaced)
+	}
+	if diskBacked() {
+		if err := syncNewName(filepath.Dir(localPath(requestedPath))); err != nil {
+			return err
+		}
+	}
+	if checksums != nil {
+		if err := checksums.record(requestedPath, hex.EncodeToString(w.hash.Sum(nil)), w.written); err != nil {
+			return err
+		}
+	}
+	action := "created"
+	if w.exists {
+		action = "replaced"
+	}
+	auditLogf("upload client=%s path=%q size=%d action=%s", w.fsys.client, requestedPath, w.written, action)
+	journal.note(requestedPath)
+	return nil
+}
+
+func (w *userWriter) Stat() (fs.FileInfo, error) {
+	return userWriterInfo{w}, nil
+}
+
+func (w *userWriter) Read(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: w.requestedPath, Err: fs.ErrInvalid}
+}
+
+func (w *userWriter) Seek(offset int64, whence int) (int64, error) {
+	return 0, &fs.PathError{Op: "seek", Path: w.requestedPath, Err: fs.ErrInvalid}
+}
+
+func (w *userWriter) Readdir(count int) ([]fs.FileInfo, error) {
+	return nil, &fs.PathError{Op: "readdir", Path: w.requestedPath, Err: fs.ErrInvalid}
+}
+
+// userWriterInfo describes a file being written as written so far
+type userWriterInfo struct {
+	w *userWriter
+}
+
+func (i userWriterInfo) Name() string       { return path.Base(i.w.requestedPath) }
+func (i userWriterInfo) Size() int64        { return i.w.written }
+func (i userWriterInfo) Mode() fs.FileMode  { return 0644 }
+func (i userWriterInfo) ModTime() time.Time { return i.w.modTime }
+func (i userWriterInfo) IsDir() bool        { return false }
+func (i userWriterInfo) Sys() any           { return nil }
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUserFSPermissions(t *testing.T) {
+	root := useWorkingDir(t)
+	useACL(t, testACL)
+	for _, dir := range []string{"public", "staff/archive", "private/carol"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		user, path string
+		// stat and mkdir are the errors of Stat of path and Mkdir of a new
+		// folder in it
+		stat, mkdir error
+	}{
+		{"", "public", nil, nil},
+		{"", "staff", fs.ErrNotExist, fs.ErrPermission},
+		{"alice", "staff", nil, nil},
+		{"alice", "staff/archive", nil, fs.ErrPermission},
+		{"dave", "private/carol", fs.ErrNotExist, fs.ErrPermission},
+		{"carol", "private/carol", nil, nil},
+		{"", "public/missing", fs.ErrNotExist, fs.ErrNotExist},
+	}
+	for _, tt := range tests {
+		d := &userFS{user: tt.user}
+		if _, err := d.Stat(context.Background(), tt.path); !errors.Is(err, tt.stat) {
+			t.Errorf("Stat(%q) as %q: error = %v, want %v", tt.path, tt.user, err, tt.stat)
+		}
+		name := tt.path + "/new-" + tt.user
+		if err := d.Mkdir(context.Background(), name, 0755); !errors.Is(err, tt.mkdir) {
+			t.Errorf("Mkdir(%q) as %q: error = %v, want %v", name, tt.user, err, tt.mkdir)
+		}
+	}
+}